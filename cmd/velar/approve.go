@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"velar/internal/approval"
+)
+
+const approvalsAPIURL = "http://127.0.0.1:8081/api/approvals"
+
+// approveCommand lists the held requests, or approves one: its held values
+// are forwarded unmasked, or masked with --mask.
+func approveCommand(args []string) error {
+	fs := flag.NewFlagSet("approve", flag.ContinueOnError)
+	mask := fs.Bool("mask", false, "forward the held values masked instead of unmasked")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return listApprovals(os.Stdout)
+	}
+	decision := approval.Approve
+	if *mask {
+		decision = approval.Mask
+	}
+	return resolveApproval(fs.Arg(0), decision)
+}
+
+// denyCommand rejects a held request.
+func denyCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: velar deny <id>")
+	}
+	return resolveApproval(args[0], approval.Deny)
+}
+
+// approvalsRequest builds a request to the approvals API carrying the token
+// the running daemon wrote.
+func approvalsRequest(method, url string, body io.Reader) (*http.Request, error) {
+	path, err := approval.TokenPath()
+	if err != nil {
+		return nil, err
+	}
+	token, err := approval.ReadToken(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w (is velar running?)", err)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
+
+func listApprovals(w io.Writer) error {
+	req, err := approvalsRequest(http.MethodGet, approvalsAPIURL, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("approvals API unavailable (is velar running?): %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("approvals API status %d", resp.StatusCode)
+	}
+	var pending []approval.Request
+	if err := json.NewDecoder(resp.Body).Decode(&pending); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Fprintln(w, "No requests waiting for approval")
+		return nil
+	}
+	fmt.Fprintf(w, "%-10s %-6s %-28s %-24s %s\n", "ID", "METHOD", "HOST", "DETECTED", "EXPIRES IN")
+	for _, p := range pending {
+		fmt.Fprintf(w, "%-10s %-6s %-28s %-24s %s\n", p.ID, p.Method, p.Host, strings.Join(p.Types, ", "), time.Until(p.Expires).Round(time.Second))
+	}
+	return nil
+}
+
+func resolveApproval(id string, decision approval.Decision) error {
+	body, _ := json.Marshal(map[string]string{"decision": string(decision)})
+	req, err := approvalsRequest(http.MethodPost, approvalsAPIURL+"/"+id, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("approvals API unavailable (is velar running?): %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		fmt.Printf("Request %s: %s\n", id, decision)
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("no request %s is waiting for approval", id)
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("approvals API status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+}
+
+// serveApprovals serves the approvals API for a foreground daemon, behind
+// the queue's token. It is skipped when the port is taken.
+func serveApprovals(q *approval.Queue) {
+	mux := http.NewServeMux()
+	mux.Handle("/api/approvals", q)
+	mux.Handle("/api/approvals/", q)
+	if err := http.ListenAndServe("127.0.0.1:8081", mux); err != nil {
+		log.Printf("approvals API unavailable: %v", err)
+	}
+}
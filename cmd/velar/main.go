@@ -19,13 +19,20 @@ import (
 	"syscall"
 	"time"
 
+	"velar/internal/approval"
 	"velar/internal/audit"
+	"velar/internal/auth"
+	"velar/internal/cache"
 	"velar/internal/classifier"
 	"velar/internal/config"
 	"velar/internal/policy"
 	"velar/internal/proxy"
 	"velar/internal/proxy/mitm"
+	"velar/internal/ratelimit"
+	"velar/internal/replay"
 	"velar/internal/systemproxy"
+	"velar/internal/transparent"
+	"velar/internal/upstream"
 )
 
 func main() {
@@ -44,6 +51,8 @@ func main() {
 		err = stopDaemon()
 	case "restart":
 		err = restartDaemon()
+	case "reload":
+		err = reloadDaemon()
 	case "status":
 		err = status()
 	case "logs":
@@ -56,8 +65,14 @@ func main() {
 		err = proxyCommand(flag.Args()[1:])
 	case "model":
 		err = modelCommand(flag.Args()[1:])
+	case "record":
+		err = recordCommand(flag.Args()[1:])
+	case "approve":
+		err = approveCommand(flag.Args()[1:])
+	case "deny":
+		err = denyCommand(flag.Args()[1:])
 	case "daemon":
-		err = runDaemon()
+		err = runDaemon(nil)
 	default:
 		usage()
 		os.Exit(1)
@@ -69,7 +84,7 @@ func main() {
 }
 
 func usage() {
-	fmt.Println("Usage: velar [start|stop|restart|status|logs|stats|model list|model download <name>|model info <name>|model remove <name>|model verify|ca init|ca print|proxy on|proxy off|proxy status]")
+	fmt.Println("Usage: velar [start|stop|restart|reload|status|logs|stats|record [-o file]|approve [--mask] [id]|deny <id>|model list|model download <name>|model info <name>|model remove <name>|model verify|ca init|ca print|proxy on [--pac]|proxy off|proxy status]")
 }
 
 func loadConfig() (config.Config, error) {
@@ -83,7 +98,10 @@ func loadConfig() (config.Config, error) {
 	return config.Load(cfgPath)
 }
 
-func runDaemon() error {
+// runDaemon runs the proxy in the foreground until it is signalled to
+// stop. A non-nil recorder records intercepted and gateway exchanges.
+func runDaemon(recorder *replay.Recorder) error {
+	cfgPath := mustConfigPath()
 	cfg, err := loadConfig()
 	if err != nil {
 		return err
@@ -93,30 +111,105 @@ func runDaemon() error {
 		return err
 	}
 
-	engine := policy.NewRuleEngine(cfg.Rules)
+	engine, err := policy.Compile(cfg.Rules)
+	if err != nil {
+		return err
+	}
+	if err := policy.CheckInterception(cfg); err != nil {
+		return err
+	}
 	cls := classifier.HostClassifier{}
 	addr := fmt.Sprintf("0.0.0.0:%d", cfg.Port)
-	server := proxy.New(addr, engine, cls, auditLogger, cfg.MITM, cfg.Sanitizer, cfg.Notifications)
+	router, err := upstream.NewRouter(cfg.UpstreamProxy)
+	if err != nil {
+		return err
+	}
+	hostTLS, err := upstream.LoadHostTLS(cfg.UpstreamTLS)
+	if err != nil {
+		return err
+	}
+	limiter, err := ratelimit.New(cfg.RateLimits)
+	if err != nil {
+		return err
+	}
+	retrier, err := upstream.NewRetrier(cfg.UpstreamRetry)
+	if err != nil {
+		return err
+	}
+	responseCache, err := cache.New(cfg.Cache)
+	if err != nil {
+		return err
+	}
+	player, err := replay.LoadPlayer(cfg.Replay)
+	if err != nil {
+		return err
+	}
+	approvals, err := approval.New(cfg.Approvals)
+	if err != nil {
+		return err
+	}
+	tokenPath, err := approval.TokenPath()
+	if err != nil {
+		return err
+	}
+	token, err := approval.WriteToken(tokenPath)
+	if err != nil {
+		return err
+	}
+	approvals.WithNotifications(cfg.Notifications.Enabled).WithToken(token)
+	var credentials *auth.Store
+	if cfg.Auth.Enabled {
+		credentials, err = auth.LoadFile(cfg.Auth.CredentialsFile, cfg.Auth.Realm)
+		if err != nil {
+			return err
+		}
+	}
+	gateway, err := proxy.NewGateway(cfg.Gateway)
+	if err != nil {
+		return err
+	}
+	server := proxy.New(addr, engine, cls, auditLogger, cfg.MITM, cfg.Sanitizer, cfg.Notifications).WithUpstreamProxy(router).WithUpstreamTLS(hostTLS).WithAuth(credentials).WithRateLimits(limiter).WithRetry(retrier).WithCache(responseCache).WithReplay(player).WithRecorder(recorder).WithApprovals(approvals).WithGateway(gateway).WithPAC(cfg.Rules)
+	if cfg.SOCKS5.Enabled {
+		server.WithSOCKS5(fmt.Sprintf("0.0.0.0:%d", cfg.SOCKS5.Port))
+	}
+	if cfg.Transparent.Enabled {
+		mode, err := transparent.ParseMode(cfg.Transparent.Mode)
+		if err != nil {
+			return err
+		}
+		sources, err := transparent.ParseSources(cfg.Transparent.AllowedSources, cfg.Auth.Enabled)
+		if err != nil {
+			return err
+		}
+		server.WithTransparent(fmt.Sprintf("0.0.0.0:%d", cfg.Transparent.Port), mode, sources)
+	}
 
 	errCh := make(chan error, 1)
 	go func() {
 		errCh <- server.Start()
 	}()
+	go serveApprovals(approvals)
+
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	server.WatchConfig(watchCtx, cfgPath, cfg)
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
-	select {
-	case sig := <-sigCh:
-		log.Printf("received signal %s, shutting down", sig)
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		return server.Shutdown(ctx)
-	case err := <-errCh:
-		if errors.Is(err, http.ErrServerClosed) {
-			return nil
+	for {
+		select {
+		case sig := <-sigCh:
+			log.Printf("received signal %s, shutting down", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return server.Shutdown(ctx)
+		case err := <-errCh:
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
 		}
-		return err
 	}
 }
 
@@ -264,6 +357,24 @@ func findVelardProcess() int {
 	return pid
 }
 
+// reloadDaemon asks the running daemon to re-read its configuration.
+func reloadDaemon() error {
+	running, pid := processStatus()
+	if !running {
+		fmt.Println("Velar not running")
+		return nil
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := proc.Signal(syscall.SIGHUP); err != nil {
+		return err
+	}
+	fmt.Printf("Reload requested (pid=%d)\n", pid)
+	return nil
+}
+
 func restartDaemon() error {
 	if err := stopDaemon(); err != nil {
 		return err
@@ -386,7 +497,7 @@ func ca(args []string) error {
 
 func proxyCommand(args []string) error {
 	if len(args) == 0 {
-		return fmt.Errorf("usage: velar proxy [on|off|status]")
+		return fmt.Errorf("usage: velar proxy [on [--pac]|off|status]")
 	}
 
 	switch args[0] {
@@ -399,6 +510,14 @@ func proxyCommand(args []string) error {
 			fmt.Println("Cannot enable proxy: Velar is not running")
 			os.Exit(1)
 		}
+		if len(args) > 1 && args[1] == "--pac" {
+			pacURL := fmt.Sprintf("http://localhost:%d/proxy.pac", cfg.Port)
+			if _, err := systemproxy.EnablePAC(pacURL); err != nil {
+				return err
+			}
+			fmt.Printf("System proxy auto-config enabled (%s)\n", pacURL)
+			return nil
+		}
 		if _, err := systemproxy.Enable("localhost", cfg.Port); err != nil {
 			return err
 		}
@@ -422,10 +541,14 @@ func proxyCommand(args []string) error {
 		fmt.Printf("Proxy: %s\n", enabledLabel(effective.Enabled))
 		fmt.Printf("Host: %s\n", effective.Host)
 		fmt.Printf("Port: %d\n", effective.Port)
+		fmt.Printf("Auto-config: %s\n", enabledLabel(st.AutoProxy.Enabled))
+		if st.AutoProxy.URL != "" {
+			fmt.Printf("Auto-config URL: %s\n", st.AutoProxy.URL)
+		}
 		fmt.Printf("Service: %s\n", st.Service)
 		return nil
 	default:
-		return fmt.Errorf("usage: velar proxy [on|off|status]")
+		return fmt.Errorf("usage: velar proxy [on [--pac]|off|status]")
 	}
 }
 
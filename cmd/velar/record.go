@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"velar/internal/config"
+	"velar/internal/replay"
+)
+
+// recordCommand runs the proxy in the foreground and records the sanitized
+// exchanges of intercepted and gateway requests until it is interrupted.
+func recordCommand(args []string) error {
+	fs := flag.NewFlagSet("record", flag.ContinueOnError)
+	out := fs.String("o", "", "recording file; .har is written as HAR, anything else as JSONL (default: a timestamped .har under ~/.velar/recordings)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := *out
+	if path == "" {
+		appDir, err := config.AppDir()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(appDir, "recordings", time.Now().Format("20060102-150405")+".har")
+	}
+	if running, pid := processStatus(); running {
+		return fmt.Errorf("velar is already running (pid=%d); stop it before recording", pid)
+	}
+
+	recorder, err := replay.NewRecorder(path)
+	if err != nil {
+		return err
+	}
+	defer recorder.Close()
+	fmt.Printf("Recording intercepted and gateway requests to %s (Ctrl-C to stop)\n", recorder.Path())
+	return runDaemon(recorder)
+}
@@ -176,17 +176,16 @@ func printSummary(w io.Writer, st stats.Stats) {
 	fmt.Fprintln(w)
 	fmt.Fprintln(w, "Masked Items")
 	fmt.Fprintln(w, strings.Repeat("-", 40))
-	types := make([]string, 0, len(st.MaskedItems.ByType))
-	for k := range st.MaskedItems.ByType {
-		types = append(types, k)
-	}
-	sort.Strings(types)
-	for _, t := range types {
-		v := st.MaskedItems.ByType[t]
-		fmt.Fprintf(w, "%-12s %5d %s\n", t+":", v, progress(v, st.MaskedItems.Total))
-	}
+	printMaskedTypes(w, st.MaskedItems)
 	fmt.Fprintf(w, "Total:       %d\n\n", st.MaskedItems.Total)
 
+	if st.ProjectedItems.Total > 0 {
+		fmt.Fprintln(w, "Projected Masking (monitor mode)")
+		fmt.Fprintln(w, strings.Repeat("-", 40))
+		printMaskedTypes(w, st.ProjectedItems)
+		fmt.Fprintf(w, "Total:       %d\n\n", st.ProjectedItems.Total)
+	}
+
 	fmt.Fprintln(w, "Top Domains")
 	fmt.Fprintln(w, strings.Repeat("-", 40))
 	for _, d := range st.TopDomains {
@@ -194,6 +193,18 @@ func printSummary(w io.Writer, st stats.Stats) {
 	}
 }
 
+func printMaskedTypes(w io.Writer, items stats.MaskedItemsStats) {
+	types := make([]string, 0, len(items.ByType))
+	for k := range items.ByType {
+		types = append(types, k)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		v := items.ByType[t]
+		fmt.Fprintf(w, "%-12s %5d %s\n", t+":", v, progress(v, items.Total))
+	}
+}
+
 func printRecent(w io.Writer, st stats.Stats) {
 	fmt.Fprintln(w, "Recent Requests (last 20)")
 	fmt.Fprintln(w, strings.Repeat("-", 90))
@@ -204,7 +215,11 @@ func printRecent(w io.Writer, st stats.Stats) {
 		if ts, err := time.Parse(time.RFC3339Nano, r.Timestamp); err == nil {
 			tm = ts.Format("15:04:05")
 		}
-		fmt.Fprintf(w, "%-10s %-24s %-6s %-6d %-20s %-8.1fms\n", tm, r.Domain, r.Method, r.StatusCode, maskedLabel(r.MaskedBy), r.TotalMs)
+		masked := maskedLabel(r.MaskedBy)
+		if r.Monitor && len(r.MaskedBy) > 0 {
+			masked = "would mask " + masked
+		}
+		fmt.Fprintf(w, "%-10s %-24s %-6s %-6d %-20s %-8.1fms\n", tm, r.Domain, r.Method, r.StatusCode, masked, r.TotalMs)
 	}
 	fmt.Fprintln(w, strings.Repeat("-", 90))
 	fmt.Fprintf(w, "Showing %d of %d total requests\n", len(st.Recent), st.Requests.Total)
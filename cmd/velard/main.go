@@ -13,12 +13,19 @@ import (
 	"syscall"
 	"time"
 
+	"velar/internal/approval"
 	"velar/internal/audit"
+	"velar/internal/auth"
+	"velar/internal/cache"
 	"velar/internal/classifier"
 	"velar/internal/config"
 	"velar/internal/policy"
 	"velar/internal/proxy"
+	"velar/internal/ratelimit"
+	"velar/internal/replay"
 	"velar/internal/stats"
+	"velar/internal/transparent"
+	"velar/internal/upstream"
 )
 
 func main() {
@@ -46,12 +53,80 @@ func run() error {
 	}
 
 	startedAt := time.Now().UTC()
-	engine := policy.NewRuleEngine(cfg.Rules)
+	engine, err := policy.Compile(cfg.Rules)
+	if err != nil {
+		return err
+	}
+	if err := policy.CheckInterception(cfg); err != nil {
+		return err
+	}
 	cls := classifier.HostClassifier{}
 	addr := fmt.Sprintf("0.0.0.0:%d", cfg.Port)
-	server := proxy.New(addr, engine, cls, auditLogger, cfg.MITM, cfg.Sanitizer, cfg.Notifications)
+	router, err := upstream.NewRouter(cfg.UpstreamProxy)
+	if err != nil {
+		return err
+	}
+	hostTLS, err := upstream.LoadHostTLS(cfg.UpstreamTLS)
+	if err != nil {
+		return err
+	}
+	limiter, err := ratelimit.New(cfg.RateLimits)
+	if err != nil {
+		return err
+	}
+	retrier, err := upstream.NewRetrier(cfg.UpstreamRetry)
+	if err != nil {
+		return err
+	}
+	responseCache, err := cache.New(cfg.Cache)
+	if err != nil {
+		return err
+	}
+	player, err := replay.LoadPlayer(cfg.Replay)
+	if err != nil {
+		return err
+	}
+	approvals, err := approval.New(cfg.Approvals)
+	if err != nil {
+		return err
+	}
+	tokenPath, err := approval.TokenPath()
+	if err != nil {
+		return err
+	}
+	token, err := approval.WriteToken(tokenPath)
+	if err != nil {
+		return err
+	}
+	approvals.WithNotifications(cfg.Notifications.Enabled).WithToken(token)
+	var credentials *auth.Store
+	if cfg.Auth.Enabled {
+		credentials, err = auth.LoadFile(cfg.Auth.CredentialsFile, cfg.Auth.Realm)
+		if err != nil {
+			return err
+		}
+	}
+	gateway, err := proxy.NewGateway(cfg.Gateway)
+	if err != nil {
+		return err
+	}
+	server := proxy.New(addr, engine, cls, auditLogger, cfg.MITM, cfg.Sanitizer, cfg.Notifications).WithUpstreamProxy(router).WithUpstreamTLS(hostTLS).WithAuth(credentials).WithRateLimits(limiter).WithRetry(retrier).WithCache(responseCache).WithReplay(player).WithApprovals(approvals).WithGateway(gateway).WithPAC(cfg.Rules)
+	if cfg.SOCKS5.Enabled {
+		server.WithSOCKS5(fmt.Sprintf("0.0.0.0:%d", cfg.SOCKS5.Port))
+	}
+	if cfg.Transparent.Enabled {
+		mode, err := transparent.ParseMode(cfg.Transparent.Mode)
+		if err != nil {
+			return err
+		}
+		sources, err := transparent.ParseSources(cfg.Transparent.AllowedSources, cfg.Auth.Enabled)
+		if err != nil {
+			return err
+		}
+		server.WithTransparent(fmt.Sprintf("0.0.0.0:%d", cfg.Transparent.Port), mode, sources)
+	}
 
-	statsServer, statsListener, err := newStatsServer(cfg, startedAt)
+	statsServer, statsListener, err := newStatsServer(cfg, startedAt, approvals)
 	if err != nil {
 		return err
 	}
@@ -65,28 +140,38 @@ func run() error {
 		}
 	}()
 
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	server.WatchConfig(watchCtx, cfgPath, cfg)
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
-	select {
-	case sig := <-sigCh:
-		log.Printf("received signal %s, shutting down", sig)
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := statsServer.Shutdown(ctx); err != nil {
+	for {
+		select {
+		case sig := <-sigCh:
+			log.Printf("received signal %s, shutting down", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := statsServer.Shutdown(ctx); err != nil {
+				return err
+			}
+			return server.Shutdown(ctx)
+		case err := <-errCh:
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
 			return err
 		}
-		return server.Shutdown(ctx)
-	case err := <-errCh:
-		if errors.Is(err, http.ErrServerClosed) {
-			return nil
-		}
-		return err
 	}
 }
 
-func newStatsServer(cfg config.Config, startedAt time.Time) (*http.Server, net.Listener, error) {
+// newStatsServer serves the stats API and, behind the token written by
+// approval.WriteToken, the approvals API on 127.0.0.1:8081.
+func newStatsServer(cfg config.Config, startedAt time.Time, approvals *approval.Queue) (*http.Server, net.Listener, error) {
 	mux := http.NewServeMux()
+	mux.Handle("/api/approvals", approvals)
+	mux.Handle("/api/approvals/", approvals)
 	mux.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
 		entries, err := audit.ParseFile(cfg.LogFile)
 		if err != nil {
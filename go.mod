@@ -2,4 +2,8 @@ module velar
 
 go 1.22
 
-require github.com/yalue/onnxruntime_go v1.26.0
+require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/klauspost/compress v1.17.11
+	github.com/yalue/onnxruntime_go v1.26.0
+)
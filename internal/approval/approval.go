@@ -0,0 +1,270 @@
+// Package approval parks requests held by the "hold" entity action until a
+// developer approves, masks or denies them, or they time out.
+package approval
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"velar/internal/config"
+	"velar/internal/notifier"
+)
+
+// Decision is the answer to a held request.
+type Decision string
+
+const (
+	// Approve forwards the held values unmasked.
+	Approve Decision = "approve"
+	// Mask forwards the held values masked.
+	Mask Decision = "mask"
+	// Deny rejects the request.
+	Deny Decision = "deny"
+)
+
+// ErrNotFound is returned by Resolve for a request that is not pending,
+// because it was never held, was already answered or timed out.
+var ErrNotFound = errors.New("approval: no pending request with that id")
+
+// ParseDecision returns the decision named s.
+func ParseDecision(s string) (Decision, error) {
+	switch d := Decision(strings.ToLower(strings.TrimSpace(s))); d {
+	case Approve, Mask, Deny:
+		return d, nil
+	default:
+		return "", fmt.Errorf("approval: unknown decision %q", s)
+	}
+}
+
+// Request describes a held request without the values that caused it.
+type Request struct {
+	ID      string    `json:"id"`
+	Method  string    `json:"method"`
+	Host    string    `json:"host"`
+	Path    string    `json:"path"`
+	User    string    `json:"user,omitempty"`
+	Types   []string  `json:"types"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// Queue holds requests until they are answered. A nil *Queue denies every
+// held request, as there is no one to ask.
+type Queue struct {
+	timeout   time.Duration
+	onTimeout Decision
+	notify    bool
+	token     string
+
+	mu      sync.Mutex
+	pending map[string]*pending
+}
+
+type pending struct {
+	req      Request
+	decision chan Decision
+}
+
+// New validates cfg and returns an empty queue.
+func New(cfg config.Approvals) (*Queue, error) {
+	if cfg.TimeoutSeconds <= 0 {
+		return nil, errors.New("approvals: timeout_seconds must be positive")
+	}
+	onTimeout, err := ParseDecision(cfg.OnTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("approvals: invalid on_timeout %q", cfg.OnTimeout)
+	}
+	return &Queue{
+		timeout:   time.Duration(cfg.TimeoutSeconds) * time.Second,
+		onTimeout: onTimeout,
+		pending:   make(map[string]*pending),
+	}, nil
+}
+
+// WithNotifications sends a desktop notification for every held request.
+func (q *Queue) WithNotifications(enabled bool) *Queue {
+	q.notify = enabled
+	return q
+}
+
+// WithToken sets the bearer token every approvals API request must carry.
+// Without one the API refuses all requests.
+func (q *Queue) WithToken(token string) *Queue {
+	q.token = token
+	return q
+}
+
+// Hold parks r until it is answered with Resolve, the timeout passes or
+// ctx is done. answered is false when the decision is the timeout default,
+// or Deny because ctx ended first.
+func (q *Queue) Hold(ctx context.Context, r Request) (d Decision, answered bool) {
+	if q == nil {
+		return Deny, false
+	}
+	r.ID = newID()
+	r.Created = time.Now().UTC()
+	r.Expires = r.Created.Add(q.timeout)
+	p := &pending{req: r, decision: make(chan Decision, 1)}
+	q.mu.Lock()
+	q.pending[r.ID] = p
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.pending, r.ID)
+		q.mu.Unlock()
+	}()
+
+	if q.notify {
+		notifier.Notify("Velar", fmt.Sprintf("Approval needed: %s to %s\nRun: velar approve %s (or deny)", strings.Join(r.Types, ", "), r.Host, r.ID))
+	}
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	select {
+	case d := <-p.decision:
+		return d, true
+	case <-timer.C:
+		return q.onTimeout, false
+	case <-ctx.Done():
+		return Deny, false
+	}
+}
+
+// Resolve answers the pending request id.
+func (q *Queue) Resolve(id string, d Decision) error {
+	if q == nil {
+		return ErrNotFound
+	}
+	q.mu.Lock()
+	p, ok := q.pending[id]
+	if ok {
+		delete(q.pending, id)
+	}
+	q.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	p.decision <- d
+	return nil
+}
+
+// Pending lists the held requests, oldest first.
+func (q *Queue) Pending() []Request {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	out := make([]Request, 0, len(q.pending))
+	for _, p := range q.pending {
+		out = append(out, p.req)
+	}
+	q.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// ServeHTTP is the local approvals API: GET /api/approvals lists the held
+// requests and POST /api/approvals/{id} with {"decision":"approve"} answers
+// one. Both require "Authorization: Bearer <token>" with the queue's token.
+func (q *Queue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !q.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="velar approvals"`)
+		http.Error(w, "approvals API token required", http.StatusUnauthorized)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/approvals"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(q.Pending())
+	case id != "" && r.Method == http.MethodPost:
+		var body struct {
+			Decision string `json:"decision"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		d, err := ParseDecision(body.Decision)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := q.Resolve(id, d); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (q *Queue) authorized(r *http.Request) bool {
+	if q == nil || q.token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(q.token)) == 1
+}
+
+// TokenPath returns where the daemon stores the approvals API token for the
+// velar CLI.
+func TokenPath() (string, error) {
+	dir, err := config.AppDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "approvals.token"), nil
+}
+
+// WriteToken generates a new approvals API token, stores it at path readable
+// only by the current user and returns it.
+func WriteToken(path string) (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("approvals: generate token: %w", err)
+	}
+	token := hex.EncodeToString(b[:])
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", fmt.Errorf("approvals: write token: %w", err)
+	}
+	// Remove any previous file so its permissions are not kept.
+	_ = os.Remove(path)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("approvals: write token: %w", err)
+	}
+	return token, nil
+}
+
+// ReadToken returns the approvals API token stored at path.
+func ReadToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("approvals: read token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("approvals: empty token in %s", path)
+	}
+	return token, nil
+}
+
+func newID() string {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b[:])
+}
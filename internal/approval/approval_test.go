@@ -0,0 +1,169 @@
+package approval
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"velar/internal/config"
+)
+
+// waitPending returns the first held request once one is pending.
+func waitPending(t *testing.T, q *Queue) Request {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if pending := q.Pending(); len(pending) > 0 {
+			return pending[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("no request was held")
+	return Request{}
+}
+
+// apiRequest builds an approvals API request carrying token.
+func apiRequest(method, target, body, token string) *http.Request {
+	var r *http.Request
+	if body == "" {
+		r = httptest.NewRequest(method, target, nil)
+	} else {
+		r = httptest.NewRequest(method, target, strings.NewReader(body))
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestQueueResolvesThroughAPI(t *testing.T) {
+	q, err := New(config.Approvals{TimeoutSeconds: 30, OnTimeout: "deny"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	q.WithToken("secret")
+	type result struct {
+		d        Decision
+		answered bool
+	}
+	done := make(chan result, 1)
+	go func() {
+		d, answered := q.Hold(context.Background(), Request{Method: "POST", Host: "api.openai.com", Types: []string{"private_key"}})
+		done <- result{d, answered}
+	}()
+	held := waitPending(t, q)
+
+	rec := httptest.NewRecorder()
+	q.ServeHTTP(rec, apiRequest(http.MethodGet, "/api/approvals", "", "secret"))
+	var listed []Request
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil || len(listed) != 1 || listed[0].ID != held.ID || listed[0].Types[0] != "private_key" {
+		t.Fatalf("GET /api/approvals = %s (err %v)", rec.Body.String(), err)
+	}
+
+	rec = httptest.NewRecorder()
+	q.ServeHTTP(rec, apiRequest(http.MethodPost, "/api/approvals/"+held.ID, `{"decision":"mask"}`, "secret"))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("POST status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := <-done; got.d != Mask || !got.answered {
+		t.Fatalf("Hold() = %v, %v, want mask answered", got.d, got.answered)
+	}
+
+	rec = httptest.NewRecorder()
+	q.ServeHTTP(rec, apiRequest(http.MethodPost, "/api/approvals/"+held.ID, `{"decision":"approve"}`, "secret"))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("second POST status = %d, want 404", rec.Code)
+	}
+}
+
+func TestQueueAPIRequiresToken(t *testing.T) {
+	q, err := New(config.Approvals{TimeoutSeconds: 30, OnTimeout: "deny"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	done := make(chan Decision, 1)
+	go func() {
+		d, _ := q.Hold(context.Background(), Request{Host: "api.openai.com"})
+		done <- d
+	}()
+	held := waitPending(t, q)
+
+	// Without a configured token every request is refused.
+	rec := httptest.NewRecorder()
+	q.ServeHTTP(rec, apiRequest(http.MethodPost, "/api/approvals/"+held.ID, `{"decision":"approve"}`, "anything"))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("POST without a configured token status = %d, want 401", rec.Code)
+	}
+	q.WithToken("secret")
+	for _, token := range []string{"", "wrong"} {
+		for _, r := range []*http.Request{
+			apiRequest(http.MethodGet, "/api/approvals", "", token),
+			apiRequest(http.MethodPost, "/api/approvals/"+held.ID, `{"decision":"approve"}`, token),
+		} {
+			rec := httptest.NewRecorder()
+			q.ServeHTTP(rec, r)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("%s with token %q status = %d, want 401", r.Method, token, rec.Code)
+			}
+		}
+	}
+	if len(q.Pending()) != 1 {
+		t.Fatal("unauthorized request resolved the held request")
+	}
+	if err := q.Resolve(held.ID, Deny); err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	<-done
+}
+
+func TestWriteAndReadToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "approvals.token")
+	token, err := WriteToken(path)
+	if err != nil || len(token) != 64 {
+		t.Fatalf("WriteToken() = %q, %v", token, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat token file: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("token file mode = %v, want 0600", info.Mode().Perm())
+	}
+	if got, err := ReadToken(path); err != nil || got != token {
+		t.Fatalf("ReadToken() = %q, %v, want %q", got, err, token)
+	}
+	if again, _ := WriteToken(path); again == token {
+		t.Fatal("WriteToken() reused the previous token")
+	}
+}
+
+func TestQueueTimesOutToDefault(t *testing.T) {
+	q, err := New(config.Approvals{TimeoutSeconds: 1, OnTimeout: "mask"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	q.timeout = 20 * time.Millisecond
+	if d, answered := q.Hold(context.Background(), Request{Host: "api.openai.com"}); d != Mask || answered {
+		t.Fatalf("Hold() = %v, %v, want the mask default unanswered", d, answered)
+	}
+	if len(q.Pending()) != 0 {
+		t.Fatal("timed-out request still pending")
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	for _, cfg := range []config.Approvals{
+		{TimeoutSeconds: 0, OnTimeout: "deny"},
+		{TimeoutSeconds: 10, OnTimeout: "maybe"},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Fatalf("New(%+v) succeeded, want an error", cfg)
+		}
+	}
+}
@@ -13,6 +13,7 @@ type Entry struct {
 	Timestamp           string           `json:"timestamp"`
 	Method              string           `json:"method"`
 	Host                string           `json:"host"`
+	User                string           `json:"user,omitempty"`
 	Path                string           `json:"path,omitempty"`
 	StatusCode          int              `json:"status_code,omitempty"`
 	Decision            string           `json:"decision"`
@@ -24,11 +25,23 @@ type Entry struct {
 	ResponseBodyPreview string           `json:"response_body_preview,omitempty"`
 	Sanitized           bool             `json:"sanitized,omitempty"`
 	SanitizedItems      []SanitizedAudit `json:"sanitized_items,omitempty"`
+	// Cache is "hit" or "miss" for requests to hosts with response caching.
+	Cache string `json:"cache,omitempty"`
+	// Monitor marks requests forwarded unchanged in monitor mode;
+	// SanitizedItems are then what would have been masked.
+	Monitor bool `json:"monitor,omitempty"`
+	// Approval is the answer to a request held for approval: "approve",
+	// "mask" or "deny", with " (timeout)" when none came in time.
+	Approval string `json:"approval,omitempty"`
 }
 
 type SanitizedAudit struct {
 	Type        string `json:"type"`
 	Placeholder string `json:"placeholder"`
+	// Action is the entity action taken: "mask", or "block", "warn" or
+	// "allow" for values left in place. Entries written before entity
+	// actions have none and were masked.
+	Action string `json:"action,omitempty"`
 }
 
 type Logger interface {
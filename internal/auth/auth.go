@@ -0,0 +1,207 @@
+// Package auth authenticates clients of the proxy listener using the
+// Proxy-Authorization header. Credentials come from a local file with one
+// entry per line:
+//
+//	# scheme  user     secret
+//	basic     alice    s3cret
+//	basic     bob      sha256:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8
+//	bearer    ci-bot   vk_9f2c...
+//
+// Secrets prefixed with "sha256:" are stored as the hex digest of the
+// password or token instead of the plain value.
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const defaultRealm = "velar"
+
+// unknownUser is verified in place of a missing basic user so a failed
+// lookup costs the same as a wrong password. No password hashes to its
+// all-zero digest in practice, and found is checked as well.
+var unknownUser = credential{secret: make([]byte, sha256.Size), hashed: true}
+
+type credential struct {
+	user   string
+	secret []byte
+	hashed bool
+}
+
+func (c credential) verify(presented string) bool {
+	if c.hashed {
+		sum := sha256.Sum256([]byte(presented))
+		return subtle.ConstantTimeCompare(sum[:], c.secret) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), c.secret) == 1
+}
+
+// Store holds the credentials accepted by the proxy listener.
+type Store struct {
+	realm  string
+	basic  map[string]credential
+	bearer []credential
+}
+
+// LoadFile reads a credentials file. An empty realm defaults to "velar".
+func LoadFile(path, realm string) (*Store, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open credentials: %w", err)
+	}
+	defer f.Close()
+	s, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if realm != "" {
+		s.realm = realm
+	}
+	return s, nil
+}
+
+// Parse builds a Store from credential lines.
+func Parse(r io.Reader) (*Store, error) {
+	sc := bufio.NewScanner(r)
+	s := &Store{realm: defaultRealm, basic: map[string]credential{}}
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected \"<basic|bearer> <user> <secret>\"", lineNo)
+		}
+		cred, err := newCredential(fields[1], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		switch strings.ToLower(fields[0]) {
+		case "basic":
+			if _, dup := s.basic[cred.user]; dup {
+				return nil, fmt.Errorf("line %d: duplicate user %q", lineNo, cred.user)
+			}
+			s.basic[cred.user] = cred
+		case "bearer":
+			s.bearer = append(s.bearer, cred)
+		default:
+			return nil, fmt.Errorf("line %d: unknown scheme %q", lineNo, fields[0])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read credentials: %w", err)
+	}
+	if len(s.basic) == 0 && len(s.bearer) == 0 {
+		return nil, fmt.Errorf("no credentials defined")
+	}
+	return s, nil
+}
+
+func newCredential(user, secret string) (credential, error) {
+	if digest, ok := strings.CutPrefix(secret, "sha256:"); ok {
+		sum, err := hex.DecodeString(digest)
+		if err != nil || len(sum) != sha256.Size {
+			return credential{}, fmt.Errorf("invalid sha256 digest for user %q", user)
+		}
+		return credential{user: user, secret: sum, hashed: true}, nil
+	}
+	return credential{user: user, secret: []byte(secret)}, nil
+}
+
+// Authenticate checks a Proxy-Authorization header value and returns the
+// identity it belongs to.
+func (s *Store) Authenticate(header string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	scheme, value, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return "", false
+	}
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		raw, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", false
+		}
+		user, pass, ok := strings.Cut(string(raw), ":")
+		if !ok {
+			return "", false
+		}
+		return s.AuthenticateBasic(user, pass)
+	case "bearer":
+		// Every token is compared so lookup time does not reveal which
+		// prefix matched.
+		user := ""
+		for _, cred := range s.bearer {
+			if cred.verify(value) && user == "" {
+				user = cred.user
+			}
+		}
+		return user, user != ""
+	}
+	return "", false
+}
+
+// AuthenticateBasic checks a username and password against the basic
+// entries. It serves clients that do not speak HTTP, such as SOCKS5.
+func (s *Store) AuthenticateBasic(user, pass string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	cred, found := s.basic[user]
+	if !found {
+		cred = unknownUser
+	}
+	if !cred.verify(pass) || !found {
+		return "", false
+	}
+	return cred.user, true
+}
+
+// Challenges returns the Proxy-Authenticate values sent with a 407.
+func (s *Store) Challenges() []string {
+	realm := defaultRealm
+	if s != nil && s.realm != "" {
+		realm = s.realm
+	}
+	return []string{
+		fmt.Sprintf("Basic realm=%q", realm),
+		fmt.Sprintf("Bearer realm=%q", realm),
+	}
+}
+
+type contextKeyType struct{}
+
+var contextKey = contextKeyType{}
+
+// ContextWithUser returns a context carrying the authenticated user.
+func ContextWithUser(ctx context.Context, user string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, contextKey, user)
+}
+
+// UserFromContext returns the authenticated user, or "" when the request
+// was not authenticated.
+func UserFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	user, _ := ctx.Value(contextKey).(string)
+	return user
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func basic(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func TestAuthenticate(t *testing.T) {
+	sum := sha256.Sum256([]byte("hunter2"))
+	store, err := Parse(strings.NewReader(`
+# team credentials
+basic  alice  s3cret
+basic  bob    sha256:` + hex.EncodeToString(sum[:]) + `
+bearer ci-bot tok_abc123
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		user   string
+		ok     bool
+	}{
+		{"basic plain", basic("alice", "s3cret"), "alice", true},
+		{"basic hashed", basic("bob", "hunter2"), "bob", true},
+		{"bearer", "Bearer tok_abc123", "ci-bot", true},
+		{"scheme is case-insensitive", "bearer tok_abc123", "ci-bot", true},
+		{"wrong password", basic("alice", "nope"), "", false},
+		{"unknown user", basic("mallory", "s3cret"), "", false},
+		{"wrong token", "Bearer tok_other", "", false},
+		{"missing header", "", "", false},
+		{"malformed basic", "Basic !!!", "", false},
+		{"unsupported scheme", "Digest username=alice", "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			user, ok := store.Authenticate(tc.header)
+			if user != tc.user || ok != tc.ok {
+				t.Fatalf("Authenticate(%q) = %q, %v; want %q, %v", tc.header, user, ok, tc.user, tc.ok)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"basic alice",
+		"digest alice pw",
+		"basic alice pw\nbasic alice other",
+		"basic alice sha256:nothex",
+	} {
+		if _, err := Parse(strings.NewReader(input)); err == nil {
+			t.Errorf("Parse(%q) expected error", input)
+		}
+	}
+}
+
+func TestLoadFileRealm(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	if err := os.WriteFile(path, []byte("basic alice s3cret\n"), 0o600); err != nil {
+		t.Fatalf("write credentials: %v", err)
+	}
+	store, err := LoadFile(path, "corp")
+	if err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+	got := store.Challenges()
+	if len(got) != 2 || got[0] != `Basic realm="corp"` || got[1] != `Bearer realm="corp"` {
+		t.Fatalf("Challenges() = %v", got)
+	}
+}
+
+func TestUserContext(t *testing.T) {
+	if UserFromContext(context.Background()) != "" {
+		t.Fatalf("expected empty user")
+	}
+	if got := UserFromContext(ContextWithUser(context.Background(), "alice")); got != "alice" {
+		t.Fatalf("UserFromContext() = %q", got)
+	}
+}
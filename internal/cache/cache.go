@@ -0,0 +1,284 @@
+// Package cache stores sanitized upstream responses on disk so identical
+// sanitized requests can be answered without contacting the provider.
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"velar/internal/config"
+	"velar/internal/contentcoding"
+	"velar/internal/hostmatch"
+)
+
+// Audit values recorded for requests to cached hosts.
+const (
+	Hit  = "hit"
+	Miss = "miss"
+)
+
+// Cache is an on-disk response cache. A nil *Cache caches nothing.
+type Cache struct {
+	dir      string
+	hosts    *hostmatch.List
+	ttl      time.Duration
+	maxEntry int64
+	maxSize  int64
+	now      func() time.Time
+
+	mu   sync.Mutex
+	size int64
+}
+
+// entry is the JSON form of a stored response.
+type entry struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	StoredAt   time.Time   `json:"stored_at"`
+}
+
+// New validates cfg and prepares its directory. It returns nil, nil when
+// the cache is disabled.
+func New(cfg config.Cache) (*Cache, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if strings.TrimSpace(cfg.Dir) == "" {
+		return nil, errors.New("cache: missing dir")
+	}
+	if len(cfg.Hosts) == 0 {
+		return nil, errors.New("cache: enabled without hosts")
+	}
+	if cfg.TTLSeconds <= 0 || cfg.MaxEntryBytes <= 0 || cfg.MaxSizeMB <= 0 {
+		return nil, errors.New("cache: ttl_seconds, max_entry_bytes and max_size_mb must be positive")
+	}
+	hosts, err := hostmatch.ParseList(cfg.Hosts, false)
+	if err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
+	}
+	c := &Cache{
+		dir:      cfg.Dir,
+		hosts:    hosts,
+		ttl:      time.Duration(cfg.TTLSeconds) * time.Second,
+		maxEntry: int64(cfg.MaxEntryBytes),
+		maxSize:  int64(cfg.MaxSizeMB) << 20,
+		now:      time.Now,
+	}
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+	for _, f := range c.files() {
+		c.size += f.size
+	}
+	return c, nil
+}
+
+// Enabled reports whether responses from host are cached.
+func (c *Cache) Enabled(host string) bool {
+	if c == nil {
+		return false
+	}
+	return c.hosts.Match(host)
+}
+
+// keyHeaders are the request headers that select the upstream account,
+// credentials, API version or response format, so responses are never
+// shared across them.
+var keyHeaders = []string{"Authorization", "X-Api-Key", "OpenAI-Organization", "OpenAI-Project", "Anthropic-Version", "Anthropic-Beta", "Accept"}
+
+// Key identifies a request by method, host, user, escaped path and query,
+// the keyHeaders, and body. Callers pass the sanitized request and body so
+// keys, like stored responses, only ever see placeholders.
+func Key(req *http.Request, host, user string, body []byte) string {
+	h := sha256.New()
+	for _, part := range []string{req.Method, strings.ToLower(host), user, req.URL.EscapedPath(), req.URL.RawQuery} {
+		_, _ = io.WriteString(h, part)
+		_, _ = h.Write([]byte{0})
+	}
+	for _, name := range keyHeaders {
+		_, _ = io.WriteString(h, strings.Join(req.Header.Values(name), ","))
+		_, _ = h.Write([]byte{0})
+	}
+	_, _ = h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Lookup returns the response stored under key when it has not expired.
+func (c *Cache) Lookup(key string) (*http.Response, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil || c.now().Sub(e.StoredAt) > c.ttl {
+		c.remove(path, int64(len(data)))
+		return nil, false
+	}
+	if e.Header == nil {
+		e.Header = http.Header{}
+	}
+	e.Header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+	}, true
+}
+
+// Store saves a 200 response with body under key. Encoded bodies are stored
+// decoded, without Content-Encoding, so a hit suits any client whatever its
+// Accept-Encoding. Responses larger than the configured entry limit, in a
+// coding that cannot be decoded, or varying on headers the key leaves out
+// are skipped. Set-Cookie is dropped, and the oldest entries are evicted
+// when the cache grows past its size limit.
+func (c *Cache) Store(key string, resp *http.Response, body []byte) error {
+	if c == nil || resp.StatusCode != http.StatusOK || int64(len(body)) > c.maxEntry || !varyKeyed(resp.Header) {
+		return nil
+	}
+	codings, supported := contentcoding.Parse(resp.Header.Get("Content-Encoding"))
+	if !supported {
+		return nil
+	}
+	if len(codings) > 0 {
+		plain, err := contentcoding.Decode(body, codings, c.maxEntry)
+		if err != nil {
+			return nil
+		}
+		body = plain
+	}
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie")
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	data, err := json.Marshal(entry{StatusCode: resp.StatusCode, Header: header, Body: body, StoredAt: c.now()})
+	if err != nil {
+		return fmt.Errorf("encode cache entry: %w", err)
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create cache dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+key+"-*")
+	if err != nil {
+		return fmt.Errorf("write cache entry: %w", err)
+	}
+	_, werr := tmp.Write(data)
+	cerr := tmp.Close()
+	if werr != nil || cerr != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("write cache entry: %w", errors.Join(werr, cerr))
+	}
+	var previous int64
+	if info, err := os.Stat(path); err == nil {
+		previous = info.Size()
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("write cache entry: %w", err)
+	}
+
+	c.mu.Lock()
+	c.size += int64(len(data)) - previous
+	over := c.size > c.maxSize
+	c.mu.Unlock()
+	if over {
+		c.evict()
+	}
+	return nil
+}
+
+// varyKeyed reports whether every header named by Vary in h is part of the
+// key, or is Accept-Encoding, which stored bodies do not depend on.
+func varyKeyed(h http.Header) bool {
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || strings.EqualFold(name, "Accept-Encoding") {
+				continue
+			}
+			if !slices.ContainsFunc(keyHeaders, func(k string) bool { return strings.EqualFold(k, name) }) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+func (c *Cache) remove(path string, size int64) {
+	if err := os.Remove(path); err == nil {
+		c.mu.Lock()
+		c.size -= size
+		c.mu.Unlock()
+	}
+}
+
+type file struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// files lists the stored entries.
+func (c *Cache) files() []file {
+	var out []file
+	_ = filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			out = append(out, file{path: path, size: info.Size(), modTime: info.ModTime()})
+		}
+		return nil
+	})
+	return out
+}
+
+// evict removes entries, oldest first, until the cache fits its size limit.
+func (c *Cache) evict() {
+	files := c.files()
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	for _, f := range files {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(f.path); err == nil {
+			total -= f.size
+		}
+	}
+	c.mu.Lock()
+	c.size = total
+	c.mu.Unlock()
+}
@@ -0,0 +1,196 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"velar/internal/config"
+)
+
+func newTestCache(t *testing.T, cfg config.Cache) *Cache {
+	t.Helper()
+	cfg.Enabled = true
+	cfg.Dir = t.TempDir()
+	if cfg.Hosts == nil {
+		cfg.Hosts = []string{"api.example"}
+	}
+	if cfg.TTLSeconds == 0 {
+		cfg.TTLSeconds = 60
+	}
+	if cfg.MaxEntryBytes == 0 {
+		cfg.MaxEntryBytes = 1024
+	}
+	if cfg.MaxSizeMB == 0 {
+		cfg.MaxSizeMB = 1
+	}
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return c
+}
+
+func okResponse() *http.Response {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Set-Cookie", "session=abc")
+	return &http.Response{StatusCode: http.StatusOK, Header: header}
+}
+
+func TestStoreAndLookup(t *testing.T) {
+	c := newTestCache(t, config.Cache{})
+	key := Key(httptest.NewRequest(http.MethodPost, "https://api.example/v1/chat", nil), "api.example", "", []byte(`{"q":"[EMAIL_1]"}`))
+	if _, ok := c.Lookup(key); ok {
+		t.Fatal("Lookup() hit on an empty cache")
+	}
+	if err := c.Store(key, okResponse(), []byte(`{"a":"[EMAIL_1]"}`)); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	resp, ok := c.Lookup(key)
+	if !ok {
+		t.Fatal("Lookup() missed a stored entry")
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != `{"a":"[EMAIL_1]"}` || resp.ContentLength != int64(len(body)) {
+		t.Fatalf("Lookup() = %d %q (length %d)", resp.StatusCode, body, resp.ContentLength)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" || resp.Header.Get("Set-Cookie") != "" {
+		t.Fatalf("headers = %v, want Content-Type kept and Set-Cookie dropped", resp.Header)
+	}
+}
+
+func TestLookupExpiresEntries(t *testing.T) {
+	c := newTestCache(t, config.Cache{TTLSeconds: 10})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	if err := c.Store("abcd", okResponse(), []byte("{}")); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	now = now.Add(11 * time.Second)
+	if _, ok := c.Lookup("abcd"); ok {
+		t.Fatal("Lookup() returned an expired entry")
+	}
+	if c.size != 0 {
+		t.Fatalf("size = %d after expiry, want 0", c.size)
+	}
+}
+
+func TestStoreSkipsUncacheableResponses(t *testing.T) {
+	c := newTestCache(t, config.Cache{MaxEntryBytes: 8})
+	if err := c.Store("aaaa", okResponse(), []byte("123456789")); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	if err := c.Store("bbbb", &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}, []byte("{}")); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	for _, key := range []string{"aaaa", "bbbb"} {
+		if _, ok := c.Lookup(key); ok {
+			t.Fatalf("Lookup(%s) hit, want oversized and non-200 responses skipped", key)
+		}
+	}
+}
+
+func TestStoreDecodesBodiesAndHonoursVary(t *testing.T) {
+	c := newTestCache(t, config.Cache{})
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, _ = zw.Write([]byte(`{"a":"[EMAIL_1]"}`))
+	_ = zw.Close()
+	resp := okResponse()
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Set("Vary", "Accept-Encoding, Authorization")
+	if err := c.Store("aaaa", resp, compressed.Bytes()); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	hit, ok := c.Lookup("aaaa")
+	if !ok {
+		t.Fatal("Lookup() missed a gzip response")
+	}
+	body, _ := io.ReadAll(hit.Body)
+	if string(body) != `{"a":"[EMAIL_1]"}` || hit.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("Lookup() = %q with Content-Encoding %q, want the decoded body", body, hit.Header.Get("Content-Encoding"))
+	}
+
+	for key, vary := range map[string]string{"bbbb": "Cookie", "cccc": "*"} {
+		resp := okResponse()
+		resp.Header.Set("Vary", vary)
+		if err := c.Store(key, resp, []byte("{}")); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+		if _, ok := c.Lookup(key); ok {
+			t.Errorf("Lookup() hit a response varying on %s", vary)
+		}
+	}
+}
+
+func TestStoreEvictsOldestEntries(t *testing.T) {
+	c := newTestCache(t, config.Cache{MaxEntryBytes: 1 << 20, MaxSizeMB: 1})
+	body := []byte(strings.Repeat("x", 400<<10))
+	for _, key := range []string{"aa01", "aa02", "aa03"} {
+		if err := c.Store(key, okResponse(), body); err != nil {
+			t.Fatalf("Store(%s) error = %v", key, err)
+		}
+		// Keep modification times apart so eviction order is stable.
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := c.Lookup("aa01"); ok {
+		t.Fatal("oldest entry survived eviction")
+	}
+	if _, ok := c.Lookup("aa03"); !ok {
+		t.Fatal("newest entry was evicted")
+	}
+	if c.size > c.maxSize {
+		t.Fatalf("size = %d, want at most %d", c.size, c.maxSize)
+	}
+}
+
+func TestKeyAndHosts(t *testing.T) {
+	c := newTestCache(t, config.Cache{Hosts: []string{"api.example", "*.azure.example"}})
+	for host, want := range map[string]bool{"API.example": true, "eu.azure.example": true, "azure.example": false, "other.example": false} {
+		if got := c.Enabled(host); got != want {
+			t.Errorf("Enabled(%q) = %v, want %v", host, got, want)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "https://api.example/v1/chat", nil)
+	base := Key(req, "api.example", "alice", []byte("body"))
+	if Key(req, "api.example", "bob", []byte("body")) == base || Key(req, "api.example", "alice", []byte("other")) == base {
+		t.Fatal("Key() ignores the user or the body")
+	}
+	if Key(req, "API.example", "alice", []byte("body")) != base {
+		t.Fatal("Key() is case-sensitive in the host")
+	}
+	for _, name := range []string{"Authorization", "x-api-key", "OpenAI-Organization", "anthropic-version", "Accept"} {
+		other := req.Clone(req.Context())
+		other.Header.Set(name, "other")
+		if Key(other, "api.example", "alice", []byte("body")) == base {
+			t.Errorf("Key() ignores the %s header", name)
+		}
+	}
+	other := req.Clone(req.Context())
+	other.Header.Set("User-Agent", "other")
+	if Key(other, "api.example", "alice", []byte("body")) != base {
+		t.Fatal("Key() depends on an unrelated header")
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	if c, err := New(config.Cache{}); c != nil || err != nil {
+		t.Fatalf("New(disabled) = %v, %v, want nil, nil", c, err)
+	}
+	for _, cfg := range []config.Cache{
+		{Enabled: true, Dir: t.TempDir(), TTLSeconds: 1, MaxEntryBytes: 1, MaxSizeMB: 1},
+		{Enabled: true, Dir: t.TempDir(), Hosts: []string{"a"}, MaxEntryBytes: 1, MaxSizeMB: 1},
+		{Enabled: true, Hosts: []string{"a"}, TTLSeconds: 1, MaxEntryBytes: 1, MaxSizeMB: 1},
+		{Enabled: true, Dir: t.TempDir(), Hosts: []string{"/[/"}, TTLSeconds: 1, MaxEntryBytes: 1, MaxSizeMB: 1},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v) error = nil, want error", cfg)
+		}
+	}
+}
@@ -16,42 +16,263 @@ import (
 const (
 	defaultPort    = 8080
 	defaultLogFile = "~/.velar/audit.log"
+	// defaultSOCKS5Port is used when the SOCKS5 listener is enabled without
+	// an explicit port.
+	defaultSOCKS5Port = 1080
+	// defaultTransparentPort is where redirected connections are expected
+	// when transparent mode has no explicit port.
+	defaultTransparentPort = 8443
+	// defaultCredentialsFile is read when proxy authentication is enabled
+	// without an explicit credentials_file.
+	defaultCredentialsFile = "~/.velar/credentials"
+	// defaultCacheDir holds cached responses when the cache is enabled
+	// without an explicit dir.
+	defaultCacheDir = "~/.velar/cache"
 )
 
 type Match struct {
-	Host         string `json:"host"`
+	// Host and Hosts are host patterns: names, "*.example.com" wildcards,
+	// anchored "/regex/"es, IP CIDR ranges and "!" negations. See
+	// hostmatch.List.
+	Host  string   `json:"host"`
+	Hosts []string `json:"hosts"`
+	// HostContains matches any host containing it. Prefer a wildcard, since
+	// "openai" also matches "notopenai.example".
 	HostContains string `json:"host_contains"`
+	// User restricts the rule to clients authenticated as this identity.
+	User string `json:"user"`
+	// Methods restricts the rule to these HTTP methods.
+	Methods []string `json:"methods"`
+	// Path matches the request path: a glob when it contains *, ? or [,
+	// otherwise a prefix.
+	Path string `json:"path"`
+	// Headers must all be present on the request.
+	Headers []HeaderMatch `json:"headers"`
+	// ContentType matches the request's media type, without parameters. It
+	// may be a glob such as "multipart/*".
+	ContentType string `json:"content_type"`
+	// MinBodyBytes and MaxBodyBytes bound the request body size. A body of
+	// unknown length counts as larger than either bound.
+	MinBodyBytes int64 `json:"min_body_bytes"`
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+}
+
+// HeaderMatch requires header Name, with a value equal to Value when it is
+// set.
+type HeaderMatch struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// RequestLevel reports whether m has criteria that can only be evaluated
+// against an HTTP request rather than a connection.
+func (m Match) RequestLevel() bool {
+	return len(m.Methods) > 0 || m.Path != "" || len(m.Headers) > 0 || m.ContentType != "" || m.MinBodyBytes > 0 || m.MaxBodyBytes > 0
 }
 
 type Rule struct {
 	ID     string `json:"id"`
 	Match  Match  `json:"match"`
 	Action string `json:"action"`
+	// Monitor inspects matching requests without masking them, as with
+	// Sanitizer.Monitor.
+	Monitor bool `json:"monitor"`
+	// When is a condition expression the request must also satisfy; see
+	// policy.Condition.
+	When string `json:"when"`
 }
 
 type Config struct {
-	Port          int           `json:"port"`
-	LogFile       string        `json:"log_file"`
-	MITM          MITM          `json:"mitm"`
-	Sanitizer     Sanitizer     `json:"sanitizer"`
-	Notifications Notifications `json:"notifications"`
-	Rules         []Rule        `json:"rules"`
+	Port          int             `json:"port"`
+	LogFile       string          `json:"log_file"`
+	MITM          MITM            `json:"mitm"`
+	Sanitizer     Sanitizer       `json:"sanitizer"`
+	Notifications Notifications   `json:"notifications"`
+	UpstreamProxy UpstreamProxy   `json:"upstream_proxy"`
+	UpstreamTLS   []UpstreamTLS   `json:"upstream_tls"`
+	RateLimits    []RateLimit     `json:"rate_limits"`
+	UpstreamRetry []UpstreamRetry `json:"upstream_retry"`
+	Cache         Cache           `json:"cache"`
+	Replay        Replay          `json:"replay"`
+	Approvals     Approvals       `json:"approvals"`
+	Auth          Auth            `json:"auth"`
+	SOCKS5        SOCKS5          `json:"socks5"`
+	Transparent   Transparent     `json:"transparent"`
+	Gateway       Gateway         `json:"gateway"`
+	Rules         []Rule          `json:"rules"`
+}
+
+// UpstreamProxy chains outbound connections through another proxy.
+// URL accepts http://, https://, socks5:// and socks5h:// schemes with
+// optional user:password credentials. An empty URL means direct egress.
+type UpstreamProxy struct {
+	URL       string          `json:"url"`
+	NoProxy   []string        `json:"no_proxy"`
+	Overrides []ProxyOverride `json:"overrides"`
+}
+
+// ProxyOverride routes hosts matching Host, a host pattern, through URL.
+// The special URL "direct" bypasses the upstream proxy.
+type ProxyOverride struct {
+	Host string `json:"host"`
+	URL  string `json:"url"`
+}
+
+// Auth requires clients of the proxy listener to send Proxy-Authorization
+// with Basic or Bearer credentials listed in CredentialsFile.
+type Auth struct {
+	Enabled         bool   `json:"enabled"`
+	CredentialsFile string `json:"credentials_file"`
+	Realm           string `json:"realm"`
+}
+
+// SOCKS5 exposes a second listener for clients that only speak SOCKS5. It
+// shares policy, MITM and authentication with the HTTP proxy.
+type SOCKS5 struct {
+	Enabled bool `json:"enabled"`
+	Port    int  `json:"port"`
+}
+
+// Transparent accepts TCP connections redirected by iptables/nftables on
+// Linux. Mode is "redirect" (REDIRECT/DNAT, the default) or "tproxy".
+type Transparent struct {
+	Enabled bool   `json:"enabled"`
+	Port    int    `json:"port"`
+	Mode    string `json:"mode"`
+	// AllowedSources lists the client addresses accepted, as IPs or CIDR
+	// ranges. Empty accepts any client, or while Auth is enabled only
+	// clients on this host, as redirected connections carry no credentials.
+	AllowedSources []string `json:"allowed_sources"`
+}
+
+// Gateway serves provider APIs under path prefixes of the proxy listener so
+// SDKs can point their base URL at Velar instead of trusting the MITM CA.
+type Gateway struct {
+	Enabled bool           `json:"enabled"`
+	Routes  []GatewayRoute `json:"routes"`
+}
+
+// GatewayRoute forwards requests under Prefix to the https Upstream base URL
+// with the prefix replaced by the upstream path.
+type GatewayRoute struct {
+	Prefix   string `json:"prefix"`
+	Upstream string `json:"upstream"`
+}
+
+// UpstreamTLS overrides the client TLS settings for connections to Host.
+// CAFile adds PEM roots to the system pool, CertFile and KeyFile present a
+// client certificate, MinVersion is "1.0" to "1.3", and Pins, when set,
+// require one certificate in the chain to have a matching SPKI hash
+// ("sha256/<base64>").
+type UpstreamTLS struct {
+	Host       string   `json:"host"`
+	CAFile     string   `json:"ca_file"`
+	CertFile   string   `json:"cert_file"`
+	KeyFile    string   `json:"key_file"`
+	MinVersion string   `json:"min_version"`
+	Pins       []string `json:"pins"`
+}
+
+// UpstreamRetry retries failed requests to Host and then fails over to the
+// Failover hosts in order. Attempts is the number of tries per target
+// (default 1), BackoffMS the first delay between them (default 200, doubled
+// each time), and RetryStatuses the upstream statuses treated as failures
+// (default 429, 502, 503, 504). Transport errors are only retried for
+// idempotent requests unless RetryNonIdempotent is set.
+type UpstreamRetry struct {
+	Host               string   `json:"host"`
+	Attempts           int      `json:"attempts"`
+	BackoffMS          int      `json:"backoff_ms"`
+	RetryStatuses      []int    `json:"retry_statuses"`
+	RetryNonIdempotent bool     `json:"retry_non_idempotent"`
+	Failover           []string `json:"failover"`
+}
+
+// Cache stores sanitized upstream responses on disk under Dir and replays
+// them for identical sanitized requests to Hosts, a list of host patterns.
+// Entries expire after TTLSeconds; responses over MaxEntryBytes are not
+// stored, and the oldest entries are evicted once the cache exceeds
+// MaxSizeMB.
+type Cache struct {
+	Enabled       bool     `json:"enabled"`
+	Dir           string   `json:"dir"`
+	Hosts         []string `json:"hosts"`
+	TTLSeconds    int      `json:"ttl_seconds"`
+	MaxEntryBytes int      `json:"max_entry_bytes"`
+	MaxSizeMB     int      `json:"max_size_mb"`
+}
+
+// Replay answers intercepted and gateway requests from File, a HAR or JSONL
+// recording written by "velar record", instead of the network. Requests
+// with no recording fail unless Passthrough is set; PreserveTiming replays
+// streamed responses at their recorded pace.
+type Replay struct {
+	File           string `json:"file"`
+	Passthrough    bool   `json:"passthrough"`
+	PreserveTiming bool   `json:"preserve_timing"`
+}
+
+// Approvals configures requests held by the "hold" entity action until
+// they are approved, masked or denied. Held requests not answered within
+// TimeoutSeconds get OnTimeout: "approve", "mask" or "deny".
+type Approvals struct {
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	OnTimeout      string `json:"on_timeout"`
+}
+
+// RateLimit caps requests for each value of Scope ("host", "user" or
+// "client") that Match, a host pattern, selects. An empty Match or "*" gives
+// every value its own bucket. Burst defaults to one second's worth of
+// RequestsPerMinute.
+type RateLimit struct {
+	Scope             string `json:"scope"`
+	Match             string `json:"match"`
+	RequestsPerMinute int    `json:"requests_per_minute"`
+	Burst             int    `json:"burst"`
+	MaxInFlight       int    `json:"max_in_flight"`
 }
 
 type MITM struct {
-	Enabled bool     `json:"enabled"`
-	Domains []string `json:"domains"`
+	Enabled       bool     `json:"enabled"`
+	Domains       []string `json:"domains"`
+	UpstreamHTTP2 bool     `json:"upstream_http2"`
+	// DebugHeaders adds X-Velar-Trace-Id, X-Velar-Decision and
+	// X-Velar-Masked to responses, and a detection report to responses to
+	// requests sent with X-Velar-Debug: 1.
+	DebugHeaders bool `json:"debug_headers"`
 }
 
 type Sanitizer struct {
-	Enabled             bool      `json:"enabled"`
-	Types               []string  `json:"types"`
-	ConfidenceThreshold float64   `json:"confidence_threshold"`
-	MaxReplacements     int       `json:"max_replacements"`
-	RestoreResponses    bool      `json:"restore_responses"`
-	SanitizeKeys        []string  `json:"sanitize_keys"`
-	SkipKeys            []string  `json:"skip_keys"`
-	Detectors           Detectors `json:"detectors"`
+	Enabled             bool     `json:"enabled"`
+	Types               []string `json:"types"`
+	ConfidenceThreshold float64  `json:"confidence_threshold"`
+	MaxReplacements     int      `json:"max_replacements"`
+	RestoreResponses    bool     `json:"restore_responses"`
+	SanitizeKeys        []string `json:"sanitize_keys"`
+	SkipKeys            []string `json:"skip_keys"`
+	// Headers, QueryParams and PathSegments select request data outside
+	// the body that is masked for every method.
+	Headers      []string `json:"headers"`
+	QueryParams  []string `json:"query_params"`
+	PathSegments bool     `json:"path_segments"`
+	// Uploads is "mask" or "block" for multipart parts with sensitive data.
+	Uploads string `json:"uploads"`
+	// Monitor runs every detector and audits what would be masked, but
+	// forwards requests unchanged.
+	Monitor bool `json:"monitor"`
+	// Entities overrides what happens to detections of each type; types
+	// not listed are masked.
+	Entities  []EntityAction `json:"entities"`
+	Detectors Detectors      `json:"detectors"`
+}
+
+// EntityAction is the action for one detected entity type: "mask",
+// "block", "warn" or "allow". MinScore defaults to the confidence
+// threshold.
+type EntityAction struct {
+	Type     string  `json:"type"`
+	Action   string  `json:"action"`
+	MinScore float64 `json:"min_score"`
 }
 
 type Detectors struct {
@@ -79,9 +300,21 @@ func Default() Config {
 			RestoreResponses: true,
 			SanitizeKeys:     []string{"prompt", "input", "content", "text", "message", "parts"},
 			SkipKeys:         []string{"authorization", "access_token", "session_token", "token", "bearer", "id_token", "refresh_token", "api_key", "apikey", "x-api-key", "cookie", "set-cookie", "model", "role", "type", "id", "object", "created", "system_fingerprint"},
+			Headers:          []string{"X-User-Email", "X-User-Name", "X-End-User"},
+			QueryParams:      []string{"q", "query", "search", "prompt", "input", "text", "email"},
+			Uploads:          "mask",
 			Detectors:        Detectors{ONNXNER: ONNXNER{Enabled: false, MaxBytes: 32 * 1024, TimeoutMS: 5000, MinScore: 0.70}},
 		},
 		Notifications: Notifications{Enabled: true},
+		Auth:          Auth{CredentialsFile: defaultCredentialsFile, Realm: "velar"},
+		Cache:         Cache{Dir: defaultCacheDir, TTLSeconds: 3600, MaxEntryBytes: 1 << 20, MaxSizeMB: 256},
+		Approvals:     Approvals{TimeoutSeconds: 120, OnTimeout: "deny"},
+		SOCKS5:        SOCKS5{Port: defaultSOCKS5Port},
+		Transparent:   Transparent{Port: defaultTransparentPort, Mode: "redirect"},
+		Gateway: Gateway{Routes: []GatewayRoute{
+			{Prefix: "/openai", Upstream: "https://api.openai.com"},
+			{Prefix: "/anthropic", Upstream: "https://api.anthropic.com"},
+		}},
 		Rules: []Rule{{
 			ID:     "allow_all",
 			Action: "allow",
@@ -125,6 +358,8 @@ func Load(path string) (Config, error) {
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			cfg.LogFile = expandHome(cfg.LogFile)
+			cfg.Auth.CredentialsFile = expandHome(cfg.Auth.CredentialsFile)
+			cfg.Cache.Dir = expandHome(cfg.Cache.Dir)
 			applyEnvOverrides(&cfg)
 			return cfg, nil
 		}
@@ -145,6 +380,27 @@ func Load(path string) (Config, error) {
 	if len(cfg.Rules) == 0 {
 		cfg.Rules = Default().Rules
 	}
+	if cfg.SOCKS5.Port == 0 {
+		cfg.SOCKS5.Port = defaultSOCKS5Port
+	}
+	if cfg.Transparent.Port == 0 {
+		cfg.Transparent.Port = defaultTransparentPort
+	}
+	if cfg.Auth.CredentialsFile == "" {
+		cfg.Auth.CredentialsFile = defaultCredentialsFile
+	}
+	cfg.Auth.CredentialsFile = expandHome(cfg.Auth.CredentialsFile)
+	if cfg.Cache.Dir == "" {
+		cfg.Cache.Dir = defaultCacheDir
+	}
+	cfg.Cache.Dir = expandHome(cfg.Cache.Dir)
+	cfg.Replay.File = expandHome(cfg.Replay.File)
+	for i := range cfg.UpstreamTLS {
+		t := &cfg.UpstreamTLS[i]
+		t.CAFile = expandHome(t.CAFile)
+		t.CertFile = expandHome(t.CertFile)
+		t.KeyFile = expandHome(t.KeyFile)
+	}
 
 	applyEnvOverrides(&cfg)
 
@@ -223,69 +479,436 @@ func parseYAMLLite(r *strings.Reader, cfg *Config) error {
 	s := bufio.NewScanner(r)
 	var currentRule *Rule
 	inMatch := false
+	inMatchHosts := false
+	inMatchMethods := false
+	inMatchHeaders := false
 	inMITM := false
 	inMITMDomains := false
 	inSanitizer := false
 	inSanitizerTypes := false
 	inSanitizeKeys := false
 	inSkipKeys := false
+	inSanitizeHeaders := false
+	inSanitizeQuery := false
+	inEntities := false
 	inNotifications := false
 	inDetectors := false
 	inONNXNER := false
+	inUpstreamProxy := false
+	inNoProxy := false
+	inProxyOverrides := false
+	inAuth := false
+	inSOCKS5 := false
+	inTransparent := false
+	inTransparentSources := false
+	inGateway := false
+	inGatewayRoutes := false
+	inUpstreamTLS := false
+	inUpstreamTLSPins := false
+	upstreamTLSFound := false
+	inRateLimits := false
+	inUpstreamRetry := false
+	inRetryStatuses := false
+	inRetryFailover := false
+	upstreamRetryFound := false
+	inCache := false
+	inCacheHosts := false
+	inReplay := false
+	inApprovals := false
+	rateLimitsFound := false
 	rulesFound := false
 
+	// leaveSections is called when a new top-level section starts so keys
+	// such as "enabled:" or "host:" are not attributed to the previous one.
+	leaveSections := func() {
+		inMatch = false
+		inMatchHosts = false
+		inMatchMethods = false
+		inMatchHeaders = false
+		inMITM = false
+		inMITMDomains = false
+		inSanitizer = false
+		inSanitizerTypes = false
+		inSanitizeKeys = false
+		inSkipKeys = false
+		inSanitizeHeaders = false
+		inSanitizeQuery = false
+		inEntities = false
+		inNotifications = false
+		inDetectors = false
+		inONNXNER = false
+		inUpstreamProxy = false
+		inNoProxy = false
+		inProxyOverrides = false
+		inAuth = false
+		inSOCKS5 = false
+		inTransparent = false
+		inTransparentSources = false
+		inGateway = false
+		inGatewayRoutes = false
+		inUpstreamTLS = false
+		inUpstreamTLSPins = false
+		inRateLimits = false
+		inUpstreamRetry = false
+		inRetryStatuses = false
+		inRetryFailover = false
+		inCache = false
+		inCacheHosts = false
+		inReplay = false
+		inApprovals = false
+	}
+
 	for s.Scan() {
 		line := strings.TrimSpace(s.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
+		// Unindented keys are top-level, whatever section precedes them.
+		topLevel := line == strings.TrimRight(s.Text(), " \t") && !strings.HasPrefix(line, "-")
 		line = strings.TrimLeft(line, "-")
 		line = strings.TrimSpace(line)
 
 		switch {
+		case topLevel && strings.HasPrefix(line, "port:"):
+			leaveSections()
+			v := strings.TrimSpace(strings.TrimPrefix(line, "port:"))
+			port, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid port: %s", v)
+			}
+			cfg.Port = port
+			continue
+		case topLevel && strings.HasPrefix(line, "log_file:"):
+			leaveSections()
+			cfg.LogFile = strings.TrimSpace(strings.TrimPrefix(line, "log_file:"))
+			continue
 		case line == "rules:":
 			if !rulesFound {
 				cfg.Rules = nil
 				rulesFound = true
 			}
-			inSanitizer = false
-			inSanitizerTypes = false
-			inSanitizeKeys = false
-			inSkipKeys = false
-			inMITMDomains = false
-			inMITM = false
-			inNotifications = false
+			leaveSections()
 			continue
 		case line == "mitm:":
-			inSanitizer = false
-			inSanitizerTypes = false
-			inSanitizeKeys = false
-			inSkipKeys = false
+			leaveSections()
 			inMITM = true
-			inMITMDomains = false
-			inNotifications = false
 			continue
 		case line == "sanitizer:":
-			inMITM = false
-			inMITMDomains = false
+			leaveSections()
 			inSanitizer = true
-			inSanitizerTypes = false
-			inSanitizeKeys = false
-			inSkipKeys = false
-			inNotifications = false
 			continue
 		case line == "notifications:":
-			inMITM = false
-			inMITMDomains = false
-			inSanitizer = false
-			inSanitizerTypes = false
-			inSanitizeKeys = false
-			inSkipKeys = false
+			leaveSections()
 			inNotifications = true
 			continue
+		case line == "upstream_proxy:":
+			leaveSections()
+			inUpstreamProxy = true
+			continue
+		case line == "auth:":
+			leaveSections()
+			inAuth = true
+			continue
+		case strings.HasPrefix(line, "enabled:") && inAuth:
+			cfg.Auth.Enabled = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "enabled:")), "true")
+			continue
+		case strings.HasPrefix(line, "credentials_file:") && inAuth:
+			cfg.Auth.CredentialsFile = unquote(strings.TrimSpace(strings.TrimPrefix(line, "credentials_file:")))
+			continue
+		case strings.HasPrefix(line, "realm:") && inAuth:
+			cfg.Auth.Realm = unquote(strings.TrimSpace(strings.TrimPrefix(line, "realm:")))
+			continue
+		case line == "socks5:":
+			leaveSections()
+			inSOCKS5 = true
+			continue
+		case strings.HasPrefix(line, "enabled:") && inSOCKS5:
+			cfg.SOCKS5.Enabled = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "enabled:")), "true")
+			continue
+		case strings.HasPrefix(line, "port:") && inSOCKS5:
+			v := strings.TrimSpace(strings.TrimPrefix(line, "port:"))
+			port, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid socks5 port: %s", v)
+			}
+			cfg.SOCKS5.Port = port
+			continue
+		case line == "transparent:":
+			leaveSections()
+			inTransparent = true
+			continue
+		case strings.HasPrefix(line, "enabled:") && inTransparent:
+			inTransparentSources = false
+			cfg.Transparent.Enabled = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "enabled:")), "true")
+			continue
+		case strings.HasPrefix(line, "port:") && inTransparent:
+			inTransparentSources = false
+			v := strings.TrimSpace(strings.TrimPrefix(line, "port:"))
+			port, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid transparent port: %s", v)
+			}
+			cfg.Transparent.Port = port
+			continue
+		case strings.HasPrefix(line, "mode:") && inTransparent:
+			inTransparentSources = false
+			cfg.Transparent.Mode = unquote(strings.TrimSpace(strings.TrimPrefix(line, "mode:")))
+			continue
+		case line == "allowed_sources:" && inTransparent:
+			cfg.Transparent.AllowedSources = nil
+			inTransparentSources = true
+			continue
+		case inTransparentSources && strings.HasPrefix(strings.TrimSpace(s.Text()), "-"):
+			if source := unquote(strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(s.Text()), "-"))); source != "" {
+				cfg.Transparent.AllowedSources = append(cfg.Transparent.AllowedSources, source)
+			}
+			continue
+		case line == "gateway:":
+			leaveSections()
+			inGateway = true
+			continue
+		case strings.HasPrefix(line, "enabled:") && inGateway:
+			cfg.Gateway.Enabled = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "enabled:")), "true")
+			continue
+		case line == "routes:" && inGateway:
+			cfg.Gateway.Routes = nil
+			inGatewayRoutes = true
+			continue
+		case strings.HasPrefix(line, "prefix:") && inGatewayRoutes:
+			cfg.Gateway.Routes = append(cfg.Gateway.Routes, GatewayRoute{Prefix: unquote(strings.TrimSpace(strings.TrimPrefix(line, "prefix:")))})
+			continue
+		case strings.HasPrefix(line, "upstream:") && inGatewayRoutes:
+			if n := len(cfg.Gateway.Routes); n > 0 {
+				cfg.Gateway.Routes[n-1].Upstream = unquote(strings.TrimSpace(strings.TrimPrefix(line, "upstream:")))
+			}
+			continue
+		case line == "upstream_tls:":
+			if !upstreamTLSFound {
+				cfg.UpstreamTLS = nil
+				upstreamTLSFound = true
+			}
+			leaveSections()
+			inUpstreamTLS = true
+			continue
+		case strings.HasPrefix(line, "host:") && inUpstreamTLS:
+			inUpstreamTLSPins = false
+			cfg.UpstreamTLS = append(cfg.UpstreamTLS, UpstreamTLS{Host: unquote(strings.TrimSpace(strings.TrimPrefix(line, "host:")))})
+			continue
+		case line == "pins:" && inUpstreamTLS:
+			inUpstreamTLSPins = true
+			continue
+		case inUpstreamTLSPins && strings.HasPrefix(strings.TrimSpace(s.Text()), "-"):
+			if n := len(cfg.UpstreamTLS); n > 0 {
+				if pin := unquote(strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(s.Text()), "-"))); pin != "" {
+					cfg.UpstreamTLS[n-1].Pins = append(cfg.UpstreamTLS[n-1].Pins, pin)
+				}
+			}
+			continue
+		case inUpstreamTLS && len(cfg.UpstreamTLS) > 0 && (strings.HasPrefix(line, "ca_file:") || strings.HasPrefix(line, "cert_file:") || strings.HasPrefix(line, "key_file:") || strings.HasPrefix(line, "min_version:")):
+			inUpstreamTLSPins = false
+			entry := &cfg.UpstreamTLS[len(cfg.UpstreamTLS)-1]
+			key, value, _ := strings.Cut(line, ":")
+			value = unquote(strings.TrimSpace(value))
+			switch key {
+			case "ca_file":
+				entry.CAFile = value
+			case "cert_file":
+				entry.CertFile = value
+			case "key_file":
+				entry.KeyFile = value
+			case "min_version":
+				entry.MinVersion = value
+			}
+			continue
+		case line == "upstream_retry:":
+			if !upstreamRetryFound {
+				cfg.UpstreamRetry = nil
+				upstreamRetryFound = true
+			}
+			leaveSections()
+			inUpstreamRetry = true
+			continue
+		case strings.HasPrefix(line, "host:") && inUpstreamRetry:
+			inRetryStatuses = false
+			inRetryFailover = false
+			cfg.UpstreamRetry = append(cfg.UpstreamRetry, UpstreamRetry{Host: unquote(strings.TrimSpace(strings.TrimPrefix(line, "host:")))})
+			continue
+		case line == "retry_statuses:" && inUpstreamRetry:
+			inRetryStatuses = true
+			inRetryFailover = false
+			continue
+		case line == "failover:" && inUpstreamRetry:
+			inRetryFailover = true
+			inRetryStatuses = false
+			continue
+		case (inRetryStatuses || inRetryFailover) && strings.HasPrefix(strings.TrimSpace(s.Text()), "-"):
+			n := len(cfg.UpstreamRetry)
+			item := unquote(strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(s.Text()), "-")))
+			if n == 0 || item == "" {
+				continue
+			}
+			if inRetryFailover {
+				cfg.UpstreamRetry[n-1].Failover = append(cfg.UpstreamRetry[n-1].Failover, item)
+				continue
+			}
+			code, err := strconv.Atoi(item)
+			if err != nil {
+				return fmt.Errorf("invalid upstream_retry retry_statuses: %s", item)
+			}
+			cfg.UpstreamRetry[n-1].RetryStatuses = append(cfg.UpstreamRetry[n-1].RetryStatuses, code)
+			continue
+		case inUpstreamRetry && len(cfg.UpstreamRetry) > 0 && (strings.HasPrefix(line, "attempts:") || strings.HasPrefix(line, "backoff_ms:") || strings.HasPrefix(line, "retry_non_idempotent:")):
+			inRetryStatuses = false
+			inRetryFailover = false
+			entry := &cfg.UpstreamRetry[len(cfg.UpstreamRetry)-1]
+			key, value, _ := strings.Cut(line, ":")
+			value = strings.TrimSpace(value)
+			if key == "retry_non_idempotent" {
+				entry.RetryNonIdempotent = strings.EqualFold(value, "true")
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid upstream_retry %s: %s", key, value)
+			}
+			if key == "attempts" {
+				entry.Attempts = n
+			} else {
+				entry.BackoffMS = n
+			}
+			continue
+		case line == "cache:":
+			leaveSections()
+			inCache = true
+			continue
+		case line == "hosts:" && inCache:
+			cfg.Cache.Hosts = nil
+			inCacheHosts = true
+			continue
+		case inCacheHosts && strings.HasPrefix(strings.TrimSpace(s.Text()), "-"):
+			if host := unquote(strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(s.Text()), "-"))); host != "" {
+				cfg.Cache.Hosts = append(cfg.Cache.Hosts, host)
+			}
+			continue
+		case inCache && (strings.HasPrefix(line, "enabled:") || strings.HasPrefix(line, "dir:") || strings.HasPrefix(line, "ttl_seconds:") || strings.HasPrefix(line, "max_entry_bytes:") || strings.HasPrefix(line, "max_size_mb:")):
+			inCacheHosts = false
+			key, value, _ := strings.Cut(line, ":")
+			value = unquote(strings.TrimSpace(value))
+			switch key {
+			case "enabled":
+				cfg.Cache.Enabled = strings.EqualFold(value, "true")
+				continue
+			case "dir":
+				cfg.Cache.Dir = value
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid cache %s: %s", key, value)
+			}
+			switch key {
+			case "ttl_seconds":
+				cfg.Cache.TTLSeconds = n
+			case "max_entry_bytes":
+				cfg.Cache.MaxEntryBytes = n
+			case "max_size_mb":
+				cfg.Cache.MaxSizeMB = n
+			}
+			continue
+		case line == "replay:":
+			leaveSections()
+			inReplay = true
+			continue
+		case inReplay && (strings.HasPrefix(line, "file:") || strings.HasPrefix(line, "passthrough:") || strings.HasPrefix(line, "preserve_timing:")):
+			key, value, _ := strings.Cut(line, ":")
+			value = unquote(strings.TrimSpace(value))
+			switch key {
+			case "file":
+				cfg.Replay.File = value
+			case "passthrough":
+				cfg.Replay.Passthrough = strings.EqualFold(value, "true")
+			case "preserve_timing":
+				cfg.Replay.PreserveTiming = strings.EqualFold(value, "true")
+			}
+			continue
+		case line == "approvals:":
+			leaveSections()
+			inApprovals = true
+			continue
+		case inApprovals && strings.HasPrefix(line, "timeout_seconds:"):
+			v := strings.TrimSpace(strings.TrimPrefix(line, "timeout_seconds:"))
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid approvals timeout_seconds: %s", v)
+			}
+			cfg.Approvals.TimeoutSeconds = n
+			continue
+		case inApprovals && strings.HasPrefix(line, "on_timeout:"):
+			cfg.Approvals.OnTimeout = unquote(strings.TrimSpace(strings.TrimPrefix(line, "on_timeout:")))
+			continue
+		case line == "rate_limits:":
+			if !rateLimitsFound {
+				cfg.RateLimits = nil
+				rateLimitsFound = true
+			}
+			leaveSections()
+			inRateLimits = true
+			continue
+		case strings.HasPrefix(line, "scope:") && inRateLimits:
+			cfg.RateLimits = append(cfg.RateLimits, RateLimit{Scope: unquote(strings.TrimSpace(strings.TrimPrefix(line, "scope:")))})
+			continue
+		case strings.HasPrefix(line, "match:") && inRateLimits && len(cfg.RateLimits) > 0:
+			cfg.RateLimits[len(cfg.RateLimits)-1].Match = unquote(strings.TrimSpace(strings.TrimPrefix(line, "match:")))
+			continue
+		case inRateLimits && len(cfg.RateLimits) > 0 && (strings.HasPrefix(line, "requests_per_minute:") || strings.HasPrefix(line, "burst:") || strings.HasPrefix(line, "max_in_flight:")):
+			entry := &cfg.RateLimits[len(cfg.RateLimits)-1]
+			key, value, _ := strings.Cut(line, ":")
+			value = strings.TrimSpace(value)
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid rate_limits %s: %s", key, value)
+			}
+			switch key {
+			case "requests_per_minute":
+				entry.RequestsPerMinute = n
+			case "burst":
+				entry.Burst = n
+			case "max_in_flight":
+				entry.MaxInFlight = n
+			}
+			continue
+		case line == "no_proxy:" && inUpstreamProxy:
+			cfg.UpstreamProxy.NoProxy = nil
+			inNoProxy = true
+			inProxyOverrides = false
+			continue
+		case line == "overrides:" && inUpstreamProxy:
+			cfg.UpstreamProxy.Overrides = nil
+			inProxyOverrides = true
+			inNoProxy = false
+			continue
+		case inNoProxy && strings.HasPrefix(strings.TrimSpace(s.Text()), "-"):
+			entry := unquote(strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(s.Text()), "-")))
+			if entry != "" {
+				cfg.UpstreamProxy.NoProxy = append(cfg.UpstreamProxy.NoProxy, entry)
+			}
+			continue
+		case strings.HasPrefix(line, "host:") && inProxyOverrides:
+			cfg.UpstreamProxy.Overrides = append(cfg.UpstreamProxy.Overrides, ProxyOverride{Host: unquote(strings.TrimSpace(strings.TrimPrefix(line, "host:")))})
+			continue
+		case strings.HasPrefix(line, "url:") && inProxyOverrides:
+			if n := len(cfg.UpstreamProxy.Overrides); n > 0 {
+				cfg.UpstreamProxy.Overrides[n-1].URL = unquote(strings.TrimSpace(strings.TrimPrefix(line, "url:")))
+			}
+			continue
+		case strings.HasPrefix(line, "url:") && inUpstreamProxy:
+			inNoProxy = false
+			cfg.UpstreamProxy.URL = unquote(strings.TrimSpace(strings.TrimPrefix(line, "url:")))
+			continue
 		case line == "detectors:" && inSanitizer:
 			inDetectors = true
 			inONNXNER = false
+			inEntities = false
 			continue
 		case line == "onnx_ner:" && inDetectors:
 			inONNXNER = true
@@ -298,21 +921,75 @@ func parseYAMLLite(r *strings.Reader, cfg *Config) error {
 			inSanitizerTypes = true
 			inSanitizeKeys = false
 			inSkipKeys = false
+			inSanitizeHeaders = false
+			inSanitizeQuery = false
+			inEntities = false
 			continue
 		case line == "sanitize_keys:" && inSanitizer:
 			cfg.Sanitizer.SanitizeKeys = nil
 			inSanitizeKeys = true
 			inSanitizerTypes = false
 			inSkipKeys = false
+			inSanitizeHeaders = false
+			inSanitizeQuery = false
+			inEntities = false
 			continue
 		case line == "skip_keys:" && inSanitizer:
 			cfg.Sanitizer.SkipKeys = nil
 			inSkipKeys = true
 			inSanitizerTypes = false
 			inSanitizeKeys = false
+			inEntities = false
+			continue
+		case line == "headers:" && inSanitizer:
+			cfg.Sanitizer.Headers = nil
+			inSanitizerTypes = false
+			inSanitizeKeys = false
+			inSkipKeys = false
+			inSanitizeHeaders = true
+			inSanitizeQuery = false
+			inEntities = false
+			continue
+		case line == "query_params:" && inSanitizer:
+			cfg.Sanitizer.QueryParams = nil
+			inSanitizerTypes = false
+			inSanitizeKeys = false
+			inSkipKeys = false
+			inSanitizeHeaders = false
+			inSanitizeQuery = true
+			inEntities = false
+			continue
+		case line == "entities:" && inSanitizer:
+			cfg.Sanitizer.Entities = nil
+			inSanitizerTypes = false
+			inSanitizeKeys = false
+			inSkipKeys = false
+			inSanitizeHeaders = false
+			inSanitizeQuery = false
+			inDetectors = false
+			inONNXNER = false
+			inEntities = true
+			continue
+		case strings.HasPrefix(line, "type:") && inEntities:
+			cfg.Sanitizer.Entities = append(cfg.Sanitizer.Entities, EntityAction{Type: unquote(strings.TrimSpace(strings.TrimPrefix(line, "type:")))})
+			continue
+		case strings.HasPrefix(line, "action:") && inEntities:
+			if n := len(cfg.Sanitizer.Entities); n > 0 {
+				cfg.Sanitizer.Entities[n-1].Action = unquote(strings.TrimSpace(strings.TrimPrefix(line, "action:")))
+			}
+			continue
+		case strings.HasPrefix(line, "min_score:") && inEntities:
+			v := strings.TrimSpace(strings.TrimPrefix(line, "min_score:"))
+			minScore, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("invalid entity min_score: %s", v)
+			}
+			if n := len(cfg.Sanitizer.Entities); n > 0 {
+				cfg.Sanitizer.Entities[n-1].MinScore = minScore
+			}
 			continue
 		case inMITMDomains && strings.HasPrefix(strings.TrimSpace(s.Text()), "-"):
-			domain := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(s.Text()), "-"))
+			domain := unquote(strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(s.Text()), "-")))
 			if domain != "" {
 				cfg.MITM.Domains = append(cfg.MITM.Domains, domain)
 			}
@@ -335,26 +1012,27 @@ func parseYAMLLite(r *strings.Reader, cfg *Config) error {
 				cfg.Sanitizer.SkipKeys = append(cfg.Sanitizer.SkipKeys, k)
 			}
 			continue
-		case strings.HasPrefix(line, "port:"):
-			inMITMDomains = false
-			inSanitizerTypes = false
-			inSanitizeKeys = false
-			inSkipKeys = false
-			v := strings.TrimSpace(strings.TrimPrefix(line, "port:"))
-			port, err := strconv.Atoi(v)
-			if err != nil {
-				return fmt.Errorf("invalid port: %s", v)
+		case inSanitizeHeaders && strings.HasPrefix(strings.TrimSpace(s.Text()), "-"):
+			h := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(s.Text()), "-"))
+			if h != "" {
+				cfg.Sanitizer.Headers = append(cfg.Sanitizer.Headers, h)
 			}
-			cfg.Port = port
-		case strings.HasPrefix(line, "log_file:"):
-			inMITMDomains = false
-			inSanitizerTypes = false
-			inSanitizeKeys = false
-			inSkipKeys = false
-			cfg.LogFile = strings.TrimSpace(strings.TrimPrefix(line, "log_file:"))
+			continue
+		case inSanitizeQuery && strings.HasPrefix(strings.TrimSpace(s.Text()), "-"):
+			q := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(s.Text()), "-"))
+			if q != "" {
+				cfg.Sanitizer.QueryParams = append(cfg.Sanitizer.QueryParams, q)
+			}
+			continue
 		case strings.HasPrefix(line, "enabled:") && inMITM:
 			inMITMDomains = false
 			cfg.MITM.Enabled = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "enabled:")), "true")
+		case strings.HasPrefix(line, "upstream_http2:") && inMITM:
+			inMITMDomains = false
+			cfg.MITM.UpstreamHTTP2 = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "upstream_http2:")), "true")
+		case strings.HasPrefix(line, "debug_headers:") && inMITM:
+			inMITMDomains = false
+			cfg.MITM.DebugHeaders = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "debug_headers:")), "true")
 		case strings.HasPrefix(line, "enabled:") && inONNXNER:
 			cfg.Sanitizer.Detectors.ONNXNER.Enabled = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "enabled:")), "true")
 		case strings.HasPrefix(line, "enabled:") && inSanitizer:
@@ -377,6 +1055,12 @@ func parseYAMLLite(r *strings.Reader, cfg *Config) error {
 			cfg.Sanitizer.MaxReplacements = maxRepl
 		case strings.HasPrefix(line, "restore_responses:") && inSanitizer:
 			cfg.Sanitizer.RestoreResponses = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "restore_responses:")), "true")
+		case strings.HasPrefix(line, "monitor:") && inSanitizer:
+			cfg.Sanitizer.Monitor = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "monitor:")), "true")
+		case strings.HasPrefix(line, "uploads:") && inSanitizer:
+			cfg.Sanitizer.Uploads = unquote(strings.TrimSpace(strings.TrimPrefix(line, "uploads:")))
+		case strings.HasPrefix(line, "path_segments:") && inSanitizer:
+			cfg.Sanitizer.PathSegments = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "path_segments:")), "true")
 		case strings.HasPrefix(line, "max_bytes:") && inONNXNER:
 			v := strings.TrimSpace(strings.TrimPrefix(line, "max_bytes:"))
 			maxBytes, err := strconv.Atoi(v)
@@ -407,18 +1091,90 @@ func parseYAMLLite(r *strings.Reader, cfg *Config) error {
 			currentRule = &cfg.Rules[len(cfg.Rules)-1]
 			currentRule.ID = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
 			inMatch = false
+			inMatchHosts = false
+			inMatchMethods = false
+			inMatchHeaders = false
+		case inMatchHosts && currentRule != nil && strings.HasPrefix(strings.TrimSpace(s.Text()), "-"):
+			if host := unquote(line); host != "" {
+				currentRule.Match.Hosts = append(currentRule.Match.Hosts, host)
+			}
+		case inMatchMethods && currentRule != nil && strings.HasPrefix(strings.TrimSpace(s.Text()), "-"):
+			if method := unquote(line); method != "" {
+				currentRule.Match.Methods = append(currentRule.Match.Methods, strings.ToUpper(method))
+			}
 		case strings.HasPrefix(line, "action:"):
 			if currentRule == nil {
 				cfg.Rules = append(cfg.Rules, Rule{})
 				currentRule = &cfg.Rules[len(cfg.Rules)-1]
 			}
 			currentRule.Action = strings.TrimSpace(strings.TrimPrefix(line, "action:"))
+		case strings.HasPrefix(line, "when:") && currentRule != nil:
+			currentRule.When = unquote(strings.TrimSpace(strings.TrimPrefix(line, "when:")))
+			inMatch = false
+			inMatchHosts = false
+			inMatchMethods = false
+			inMatchHeaders = false
+		case strings.HasPrefix(line, "monitor:") && currentRule != nil:
+			currentRule.Monitor = strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(line, "monitor:")), "true")
 		case line == "match:":
 			inMatch = true
+		case line == "hosts:" && inMatch && currentRule != nil:
+			currentRule.Match.Hosts = nil
+			inMatchHosts = true
+			inMatchMethods = false
+			inMatchHeaders = false
+		case line == "methods:" && inMatch && currentRule != nil:
+			currentRule.Match.Methods = nil
+			inMatchMethods = true
+			inMatchHosts = false
+			inMatchHeaders = false
+		case line == "headers:" && inMatch && currentRule != nil:
+			currentRule.Match.Headers = nil
+			inMatchHeaders = true
+			inMatchHosts = false
+			inMatchMethods = false
+		case strings.HasPrefix(line, "name:") && inMatchHeaders:
+			currentRule.Match.Headers = append(currentRule.Match.Headers, HeaderMatch{Name: unquote(strings.TrimSpace(strings.TrimPrefix(line, "name:")))})
+		case strings.HasPrefix(line, "value:") && inMatchHeaders:
+			if n := len(currentRule.Match.Headers); n > 0 {
+				currentRule.Match.Headers[n-1].Value = unquote(strings.TrimSpace(strings.TrimPrefix(line, "value:")))
+			}
+		case strings.HasPrefix(line, "path:") && inMatch && currentRule != nil:
+			currentRule.Match.Path = unquote(strings.TrimSpace(strings.TrimPrefix(line, "path:")))
+			inMatchHosts = false
+			inMatchMethods = false
+			inMatchHeaders = false
+		case strings.HasPrefix(line, "content_type:") && inMatch && currentRule != nil:
+			currentRule.Match.ContentType = unquote(strings.TrimSpace(strings.TrimPrefix(line, "content_type:")))
+			inMatchHosts = false
+			inMatchMethods = false
+			inMatchHeaders = false
+		case strings.HasPrefix(line, "min_body_bytes:") && inMatch && currentRule != nil:
+			v := strings.TrimSpace(strings.TrimPrefix(line, "min_body_bytes:"))
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid rule min_body_bytes: %s", v)
+			}
+			currentRule.Match.MinBodyBytes = n
+			inMatchHosts = false
+			inMatchMethods = false
+			inMatchHeaders = false
+		case strings.HasPrefix(line, "max_body_bytes:") && inMatch && currentRule != nil:
+			v := strings.TrimSpace(strings.TrimPrefix(line, "max_body_bytes:"))
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid rule max_body_bytes: %s", v)
+			}
+			currentRule.Match.MaxBodyBytes = n
+			inMatchHosts = false
+			inMatchMethods = false
+			inMatchHeaders = false
 		case strings.HasPrefix(line, "host_contains:") && inMatch && currentRule != nil:
 			currentRule.Match.HostContains = strings.TrimSpace(strings.TrimPrefix(line, "host_contains:"))
 		case strings.HasPrefix(line, "host:") && inMatch && currentRule != nil:
-			currentRule.Match.Host = strings.TrimSpace(strings.TrimPrefix(line, "host:"))
+			currentRule.Match.Host = unquote(strings.TrimSpace(strings.TrimPrefix(line, "host:")))
+		case strings.HasPrefix(line, "user:") && inMatch && currentRule != nil:
+			currentRule.Match.User = unquote(strings.TrimSpace(strings.TrimPrefix(line, "user:")))
 		}
 	}
 
@@ -428,6 +1184,14 @@ func parseYAMLLite(r *strings.Reader, cfg *Config) error {
 	return nil
 }
 
+// unquote strips one pair of matching single or double quotes.
+func unquote(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
 func expandHome(p string) string {
 	if !strings.HasPrefix(p, "~/") {
 		return p
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"time"
+)
+
+// Watch polls path every interval and calls onChange after its
+// modification time or size changes, including the file being created or
+// removed. It returns when ctx is done.
+func Watch(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	last := fileStamp(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if stamp := fileStamp(path); stamp != last {
+				last = stamp
+				onChange()
+			}
+		}
+	}
+}
+
+type stamp struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func fileStamp(path string) stamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return stamp{}
+	}
+	return stamp{modTime: info.ModTime(), size: info.Size(), exists: true}
+}
+
+// RestartRequired lists the sections that differ between the running and
+// the reloaded configuration but are only applied at startup: listeners,
+// upstream egress, authentication, rate limits, the response cache,
+// replay, the gateway and the audit log.
+func RestartRequired(running, next Config) []string {
+	var changed []string
+	check := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+	check("port", running.Port, next.Port)
+	check("log_file", running.LogFile, next.LogFile)
+	check("mitm.upstream_http2", running.MITM.UpstreamHTTP2, next.MITM.UpstreamHTTP2)
+	check("upstream_proxy", running.UpstreamProxy, next.UpstreamProxy)
+	check("upstream_tls", running.UpstreamTLS, next.UpstreamTLS)
+	check("upstream_retry", running.UpstreamRetry, next.UpstreamRetry)
+	check("rate_limits", running.RateLimits, next.RateLimits)
+	check("cache", running.Cache, next.Cache)
+	check("replay", running.Replay, next.Replay)
+	check("approvals", running.Approvals, next.Approvals)
+	check("auth", running.Auth, next.Auth)
+	check("socks5", running.SOCKS5, next.SOCKS5)
+	check("transparent", running.Transparent, next.Transparent)
+	check("gateway", running.Gateway, next.Gateway)
+	return changed
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatchReportsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("port: 8080\n"), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	go Watch(ctx, path, 10*time.Millisecond, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	select {
+	case <-changed:
+		t.Fatalf("change reported for an untouched file")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := os.WriteFile(path, []byte("port: 8081\nlog_file: /tmp/x\n"), 0o644); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("change not reported")
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	running := Default()
+	next := Default()
+	next.Rules = append(next.Rules, Rule{ID: "extra", Action: "block"})
+	next.MITM.Domains = []string{"example.com"}
+	next.Sanitizer.Types = []string{"email"}
+	if got := RestartRequired(running, next); len(got) != 0 {
+		t.Fatalf("RestartRequired() = %v, want none for reloadable sections", got)
+	}
+
+	next.Port = running.Port + 1
+	next.SOCKS5.Enabled = !running.SOCKS5.Enabled
+	if got, want := RestartRequired(running, next), []string{"port", "socks5"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("RestartRequired() = %v, want %v", got, want)
+	}
+}
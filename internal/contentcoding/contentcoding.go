@@ -0,0 +1,193 @@
+// Package contentcoding decodes and re-encodes HTTP bodies carrying a
+// Content-Encoding so that the sanitizer can work on plaintext.
+//
+// gzip, deflate, br and zstd are supported. Velar advertises just those
+// upstream (see FilterAccept), so providers fall back to a decodable
+// coding; Parse reports any other coding as unsupported.
+package contentcoding
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultAccept is sent upstream when the client did not ask for a coding.
+const DefaultAccept = "gzip, deflate"
+
+// ErrTooLarge is returned when a decoded body exceeds the caller's limit.
+var ErrTooLarge = errors.New("decoded body exceeds limit")
+
+// Parse splits a Content-Encoding header into the codings applied, in the
+// order they were applied. "identity" entries are dropped. supported is
+// false when any coding cannot be decoded.
+func Parse(header string) (codings []string, supported bool) {
+	supported = true
+	for _, c := range strings.Split(header, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		switch c {
+		case "", "identity":
+			continue
+		case "x-gzip":
+			c = "gzip"
+		case "gzip", "deflate", "br", "zstd":
+		default:
+			supported = false
+		}
+		codings = append(codings, c)
+	}
+	return codings, supported
+}
+
+// FilterAccept rewrites a client's Accept-Encoding so that upstream only
+// picks codings Velar can decode. An empty header yields DefaultAccept.
+func FilterAccept(header string) string {
+	if strings.TrimSpace(header) == "" {
+		return DefaultAccept
+	}
+	var kept []string
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		name, _, _ := strings.Cut(part, ";")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip", "x-gzip", "deflate", "br", "zstd", "identity":
+			kept = append(kept, part)
+		}
+	}
+	if len(kept) == 0 {
+		return "identity"
+	}
+	return strings.Join(kept, ", ")
+}
+
+// NewReader returns a reader producing the plaintext of src. Decoders are
+// created on the first Read so that callers can forward response headers
+// before any body bytes arrive. Closing the reader closes src.
+func NewReader(src io.ReadCloser, codings []string) io.ReadCloser {
+	return &lazyDecoder{src: src, codings: codings}
+}
+
+type lazyDecoder struct {
+	src     io.ReadCloser
+	codings []string
+	r       io.Reader
+	err     error
+}
+
+func (d *lazyDecoder) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = decoder(d.src, d.codings)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.r.Read(p)
+}
+
+func (d *lazyDecoder) Close() error {
+	return d.src.Close()
+}
+
+func decoder(src io.Reader, codings []string) (io.Reader, error) {
+	r := src
+	// The last coding listed was applied last, so it is removed first.
+	for i := len(codings) - 1; i >= 0; i-- {
+		switch codings[i] {
+		case "gzip":
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, fmt.Errorf("gzip: %w", err)
+			}
+			r = zr
+		case "deflate":
+			r = newDeflateReader(r)
+		case "br":
+			r = brotli.NewReader(r)
+		case "zstd":
+			zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, fmt.Errorf("zstd: %w", err)
+			}
+			r = zr.IOReadCloser()
+		default:
+			return nil, fmt.Errorf("unsupported content coding %q", codings[i])
+		}
+	}
+	return r, nil
+}
+
+// newDeflateReader accepts both the zlib-wrapped stream that RFC 9110
+// specifies for "deflate" and the raw DEFLATE data some servers send.
+func newDeflateReader(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	hdr, err := br.Peek(2)
+	if err == nil && isZlibHeader(hdr) {
+		if zr, err := zlib.NewReader(br); err == nil {
+			return zr
+		}
+	}
+	return flate.NewReader(br)
+}
+
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+// Decode returns the plaintext of body, failing with ErrTooLarge once more
+// than limit bytes would be produced.
+func Decode(body []byte, codings []string, limit int64) ([]byte, error) {
+	r, err := decoder(bytes.NewReader(body), codings)
+	if err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, ErrTooLarge
+	}
+	return out, nil
+}
+
+// Encode applies codings to plain in order.
+func Encode(plain []byte, codings []string) ([]byte, error) {
+	out := plain
+	for _, c := range codings {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch c {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		case "zstd":
+			zw, err := zstd.NewWriter(&buf, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				return nil, fmt.Errorf("zstd: %w", err)
+			}
+			w = zw
+		default:
+			return nil, fmt.Errorf("unsupported content coding %q", c)
+		}
+		if _, err := w.Write(out); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		out = buf.Bytes()
+	}
+	return out, nil
+}
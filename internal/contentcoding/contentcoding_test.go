@@ -0,0 +1,90 @@
+package contentcoding
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		header    string
+		codings   []string
+		supported bool
+	}{
+		{"", nil, true},
+		{"identity", nil, true},
+		{"gzip", []string{"gzip"}, true},
+		{"X-GZIP", []string{"gzip"}, true},
+		{"deflate, gzip", []string{"deflate", "gzip"}, true},
+		{"br", []string{"br"}, true},
+		{"gzip, zstd", []string{"gzip", "zstd"}, true},
+		{"compress", []string{"compress"}, false},
+		{"gzip, x-custom", []string{"gzip", "x-custom"}, false},
+	}
+	for _, tc := range tests {
+		codings, supported := Parse(tc.header)
+		if !reflect.DeepEqual(codings, tc.codings) || supported != tc.supported {
+			t.Errorf("Parse(%q) = %v, %v; want %v, %v", tc.header, codings, supported, tc.codings, tc.supported)
+		}
+	}
+}
+
+func TestFilterAccept(t *testing.T) {
+	tests := map[string]string{
+		"":                            DefaultAccept,
+		"gzip, deflate, br":           "gzip, deflate, br",
+		"br;q=1.0, gzip;q=0.8, zstd":  "br;q=1.0, gzip;q=0.8, zstd",
+		"compress, x-custom":          "identity",
+		"identity":                    "identity",
+		"deflate, compress, identity": "deflate, identity",
+	}
+	for in, want := range tests {
+		if got := FilterAccept(in); got != want {
+			t.Errorf("FilterAccept(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	plain := []byte(strings.Repeat(`{"prompt":"hello"}`, 50))
+	for _, codings := range [][]string{{"gzip"}, {"deflate"}, {"br"}, {"zstd"}, {"deflate", "gzip"}, {"zstd", "br"}} {
+		encoded, err := Encode(plain, codings)
+		if err != nil {
+			t.Fatalf("Encode(%v) error = %v", codings, err)
+		}
+		if bytes.Equal(encoded, plain) {
+			t.Fatalf("Encode(%v) left body unchanged", codings)
+		}
+		decoded, err := Decode(encoded, codings, int64(len(plain)))
+		if err != nil || !bytes.Equal(decoded, plain) {
+			t.Fatalf("Decode(%v) = %q, %v", codings, decoded, err)
+		}
+		streamed, err := io.ReadAll(NewReader(io.NopCloser(bytes.NewReader(encoded)), codings))
+		if err != nil || !bytes.Equal(streamed, plain) {
+			t.Fatalf("NewReader(%v) = %q, %v", codings, streamed, err)
+		}
+	}
+}
+
+func TestDecodeRawDeflate(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	_, _ = w.Write([]byte("raw deflate body"))
+	_ = w.Close()
+	got, err := Decode(buf.Bytes(), []string{"deflate"}, 1024)
+	if err != nil || string(got) != "raw deflate body" {
+		t.Fatalf("Decode(raw deflate) = %q, %v", got, err)
+	}
+}
+
+func TestDecodeLimit(t *testing.T) {
+	encoded, _ := Encode(bytes.Repeat([]byte("a"), 10000), []string{"gzip"})
+	if _, err := Decode(encoded, []string{"gzip"}, 100); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Decode() error = %v, want ErrTooLarge", err)
+	}
+}
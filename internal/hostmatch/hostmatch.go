@@ -0,0 +1,196 @@
+// Package hostmatch matches hosts against the patterns used by policy rules
+// and the MITM domain list.
+package hostmatch
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Kind is the form of a Pattern.
+type Kind int
+
+const (
+	// Exact matches one host name or IP address.
+	Exact Kind = iota
+	// Domain matches a host name and its subdomains.
+	Domain
+	// Wildcard matches the subdomains of Value ("*.example.com"), or every
+	// host when Value is empty ("*").
+	Wildcard
+	// Regexp matches host names against an anchored, case-insensitive
+	// regular expression written between slashes ("/api[0-9]*\.example\.com/").
+	Regexp
+	// CIDR matches IP-literal hosts in a range ("10.0.0.0/8").
+	CIDR
+)
+
+// Pattern is one parsed host pattern. Negate reports a leading "!", which
+// excludes the hosts the pattern matches from a List.
+type Pattern struct {
+	Kind   Kind
+	Negate bool
+	// Value is the pattern without its "!", "*." or slashes, lower-cased
+	// unless it is a regular expression.
+	Value string
+	re    *regexp.Regexp
+	cidr  *net.IPNet
+}
+
+// Parse parses pattern. A plain name is Exact, or Domain when subdomains
+// is set, as for the MITM domain list.
+func Parse(pattern string, subdomains bool) (Pattern, error) {
+	raw := strings.TrimSpace(pattern)
+	var p Pattern
+	if strings.HasPrefix(raw, "!") {
+		p.Negate = true
+		raw = strings.TrimSpace(raw[1:])
+	}
+	if raw == "" {
+		return Pattern{}, fmt.Errorf("empty host pattern %q", pattern)
+	}
+	if len(raw) >= 2 && raw[0] == '/' && raw[len(raw)-1] == '/' {
+		re, err := regexp.Compile("(?i)^(?:" + raw[1:len(raw)-1] + ")$")
+		if err != nil {
+			return Pattern{}, fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+		}
+		p.Kind, p.Value, p.re = Regexp, raw[1:len(raw)-1], re
+		return p, nil
+	}
+	raw = strings.TrimSuffix(strings.ToLower(raw), ".")
+	if _, cidr, err := net.ParseCIDR(raw); err == nil {
+		p.Kind, p.Value, p.cidr = CIDR, cidr.String(), cidr
+		return p, nil
+	}
+	if ip := net.ParseIP(strings.Trim(raw, "[]")); ip != nil {
+		p.Kind, p.Value = Exact, ip.String()
+		return p, nil
+	}
+	switch {
+	case raw == "*":
+		p.Kind = Wildcard
+	case strings.HasPrefix(raw, "*."):
+		p.Kind, p.Value = Wildcard, raw[2:]
+	case subdomains:
+		p.Kind, p.Value = Domain, strings.TrimPrefix(raw, ".")
+	default:
+		p.Kind, p.Value = Exact, raw
+	}
+	if strings.Contains(p.Value, "*") {
+		return Pattern{}, fmt.Errorf("invalid host pattern %q: * is only allowed as the first label; use a /regex/", pattern)
+	}
+	return p, nil
+}
+
+// Match reports whether host, a name or IP literal with an optional port,
+// matches p, ignoring Negate.
+func (p Pattern) Match(host string) bool {
+	host = Normalize(host)
+	switch p.Kind {
+	case Wildcard:
+		return p.Value == "" || strings.HasSuffix(host, "."+p.Value)
+	case Domain:
+		return host == p.Value || strings.HasSuffix(host, "."+p.Value)
+	case Regexp:
+		return p.re.MatchString(host)
+	case CIDR:
+		ip := net.ParseIP(host)
+		return ip != nil && p.cidr.Contains(ip)
+	default:
+		if ip := net.ParseIP(host); ip != nil {
+			return ip.String() == p.Value
+		}
+		return host == p.Value
+	}
+}
+
+// String returns the pattern as written, normalised.
+func (p Pattern) String() string {
+	s := p.Value
+	switch p.Kind {
+	case Wildcard:
+		s = "*"
+		if p.Value != "" {
+			s += "." + p.Value
+		}
+	case Regexp:
+		s = "/" + p.Value + "/"
+	}
+	if p.Negate {
+		s = "!" + s
+	}
+	return s
+}
+
+// Normalize lower-cases host and strips its port, IPv6 brackets and
+// trailing dot.
+func Normalize(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
+
+// List is an ordered set of patterns. A host matches when it matches no
+// negated pattern and at least one other, or when the list holds only
+// negated patterns.
+type List struct {
+	patterns []Pattern
+	include  bool
+}
+
+// ParseList parses patterns as with Parse.
+func ParseList(patterns []string, subdomains bool) (*List, error) {
+	l := &List{}
+	for _, raw := range patterns {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		p, err := Parse(raw, subdomains)
+		if err != nil {
+			return nil, err
+		}
+		if !p.Negate {
+			l.include = true
+		}
+		l.patterns = append(l.patterns, p)
+	}
+	return l, nil
+}
+
+// Len returns the number of patterns in l.
+func (l *List) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.patterns)
+}
+
+// Patterns returns the patterns in l.
+func (l *List) Patterns() []Pattern {
+	if l == nil {
+		return nil
+	}
+	return l.patterns
+}
+
+// Match reports whether host matches l. An empty list matches nothing.
+func (l *List) Match(host string) bool {
+	if l.Len() == 0 {
+		return false
+	}
+	matched := !l.include
+	for _, p := range l.patterns {
+		if !p.Match(host) {
+			continue
+		}
+		if p.Negate {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
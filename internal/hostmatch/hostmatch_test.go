@@ -0,0 +1,75 @@
+package hostmatch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		subdomains bool
+		host       string
+		want       bool
+	}{
+		{"api.openai.com", false, "API.OpenAI.com:443", true},
+		{"openai.com", false, "api.openai.com", false},
+		{"openai.com", true, "api.openai.com", true},
+		{"openai.com", true, "notopenai.com", false},
+		{"*.openai.com", false, "api.openai.com", true},
+		{"*.openai.com", false, "eu.api.openai.com", true},
+		{"*.openai.com", false, "openai.com", false},
+		{"*.openai.com", false, "notopenai.com", false},
+		{"*", false, "anything.example", true},
+		{`/api[0-9]*\.openai\.com/`, false, "api2.openai.com", true},
+		{`/api[0-9]*\.openai\.com/`, false, "api2.openai.com.evil.com", false},
+		{`/openai/`, false, "notopenai.com", false},
+		{`/API\.OpenAI\.com/`, false, "api.openai.com", true},
+		{"10.0.0.0/8", false, "10.1.2.3:443", true},
+		{"10.0.0.0/8", false, "11.1.2.3", false},
+		{"10.0.0.0/8", false, "ten.example", false},
+		{"fd00::/8", false, "[fd00::1]:443", true},
+		{"192.168.1.10", true, "192.168.1.10:8443", true},
+	}
+	for _, tt := range tests {
+		p, err := Parse(tt.pattern, tt.subdomains)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", tt.pattern, err)
+		}
+		if got := p.Match(tt.host); got != tt.want {
+			t.Fatalf("Parse(%q).Match(%q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for pattern, want := range map[string]string{
+		"api.*.com": "* is only allowed as the first label",
+		"/api[/":    "invalid host pattern",
+		"!":         "empty host pattern",
+	} {
+		if _, err := Parse(pattern, false); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Parse(%q) error = %v, want %q", pattern, err, want)
+		}
+	}
+}
+
+func TestListNegation(t *testing.T) {
+	l, err := ParseList([]string{"*.openai.com", "!files.openai.com"}, false)
+	if err != nil {
+		t.Fatalf("ParseList() error = %v", err)
+	}
+	for host, want := range map[string]bool{"api.openai.com": true, "files.openai.com": false, "example.com": false} {
+		if got := l.Match(host); got != want {
+			t.Fatalf("Match(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	except, _ := ParseList([]string{"!internal.example"}, false)
+	if !except.Match("api.openai.com") || except.Match("internal.example") {
+		t.Fatal("a list of only negations should match every other host")
+	}
+	if empty, _ := ParseList(nil, false); empty.Match("example.com") {
+		t.Fatal("an empty list should match nothing")
+	}
+}
@@ -222,7 +222,7 @@ func TestIntegration_RestoreResponsesFalse(t *testing.T) {
 	}
 }
 
-func TestIntegration_LargeBodySkipped(t *testing.T) {
+func TestIntegration_LargeBodySanitizedWhileStreaming(t *testing.T) {
 	var upstreamBody string
 	provider := newMockProvider(t, func(body []byte) { upstreamBody = string(body) }, nil)
 	defer provider.Close()
@@ -232,13 +232,13 @@ func TestIntegration_LargeBodySkipped(t *testing.T) {
 	h := setupTestProxy(t, cfg)
 	defer h.close(t)
 
-	// large bodies are intentionally skipped
+	// bodies over the buffering limit are sanitized as they stream
 	large := strings.Repeat("x", (1<<20)+1024)
 	payload := []byte(fmt.Sprintf(`{"messages":[{"role":"user","content":"%s alice@example.com"}]}`, large))
 	_ = sendThroughProxy(t, h.proxyAddr, provider.URL, payload, "application/json")
 
-	if !strings.Contains(upstreamBody, "alice@example.com") {
-		t.Fatalf("expected original email for large body, got: %s", upstreamBody)
+	if strings.Contains(upstreamBody, "alice@example.com") || !strings.Contains(upstreamBody, "[EMAIL_1]") {
+		t.Fatalf("expected masked email for large body, got tail: %s", upstreamBody[len(upstreamBody)-64:])
 	}
 }
 
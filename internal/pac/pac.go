@@ -0,0 +1,115 @@
+// Package pac generates proxy auto-config (PAC) scripts that send only the
+// hosts Velar inspects or has rules for through the proxy and everything
+// else DIRECT.
+package pac
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"velar/internal/config"
+	"velar/internal/hostmatch"
+)
+
+// ContentType is the MIME type browsers expect for PAC files.
+const ContentType = "application/x-ns-proxy-autoconfig"
+
+// Script returns a PAC script that routes through the proxy at proxyAddr
+// (host:port) the MITM domains and every host a rule matches on. A rule
+// without host criteria that does not allow traffic sends everything
+// through the proxy, since the script cannot know what the rule enforces;
+// rules after a catch-all allow rule, one without user, request or when
+// criteria, are unreachable and ignored. Negated host patterns are left
+// out, so the hosts they exclude may still be sent through the proxy.
+func Script(proxyAddr string, mitm config.MITM, rules []config.Rule) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(&b, "  var proxy = %s;\n", jsString("PROXY "+proxyAddr))
+	b.WriteString("  host = host.toLowerCase();\n")
+	if mitm.Enabled {
+		for _, domain := range mitm.Domains {
+			if cond := condition(domain, true); cond != "" {
+				fmt.Fprintf(&b, "  if (%s) return proxy;\n", cond)
+			}
+		}
+	}
+	for _, r := range rules {
+		m := r.Match
+		var conds []string
+		everyHost, negated := false, false
+		for _, pattern := range append([]string{m.Host}, m.Hosts...) {
+			if strings.HasPrefix(strings.TrimSpace(pattern), "!") {
+				negated = true
+				continue
+			}
+			switch cond := condition(pattern, false); cond {
+			case "":
+			case "true":
+				everyHost = true
+			default:
+				conds = append(conds, cond)
+			}
+		}
+		if m.HostContains != "" {
+			conds = append(conds, fmt.Sprintf("host.indexOf(%s) != -1", jsString(strings.ToLower(m.HostContains))))
+		}
+		if everyHost || len(conds) == 0 {
+			if !strings.EqualFold(r.Action, "allow") {
+				b.WriteString("  return proxy;\n}\n")
+				return b.String()
+			}
+			if m.User == "" && !m.RequestLevel() && r.When == "" && !negated && len(conds) == 0 {
+				break
+			}
+			continue
+		}
+		for _, cond := range conds {
+			fmt.Fprintf(&b, "  if (%s) return proxy;\n", cond)
+		}
+	}
+	b.WriteString("  return \"DIRECT\";\n}\n")
+	return b.String()
+}
+
+// condition returns the JavaScript test for the host pattern, "true" for
+// one that matches every host, or "" for an empty, invalid or negated
+// pattern.
+func condition(pattern string, subdomains bool) string {
+	if strings.TrimSpace(pattern) == "" {
+		return ""
+	}
+	p, err := hostmatch.Parse(pattern, subdomains)
+	if err != nil || p.Negate {
+		return ""
+	}
+	switch p.Kind {
+	case hostmatch.Domain:
+		return fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", jsString(p.Value), jsString("."+p.Value))
+	case hostmatch.Wildcard:
+		if p.Value == "" {
+			return "true"
+		}
+		return fmt.Sprintf("dnsDomainIs(host, %s)", jsString("."+p.Value))
+	case hostmatch.Regexp:
+		return fmt.Sprintf("new RegExp(%s).test(host)", jsString("^(?:"+p.Value+")$"))
+	case hostmatch.CIDR:
+		_, ipNet, _ := net.ParseCIDR(p.Value)
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			mask := net.IP(ipNet.Mask).To4()
+			return fmt.Sprintf("/^[0-9.]+$/.test(host) && isInNet(host, %s, %s)", jsString(ip4.String()), jsString(mask.String()))
+		}
+		// PAC has no IPv6 range test, so every IPv6 literal goes through
+		// the proxy.
+		return `host.indexOf(":") != -1`
+	default:
+		return fmt.Sprintf("host == %s", jsString(p.Value))
+	}
+}
+
+// jsString quotes s as a JavaScript string literal.
+func jsString(s string) string {
+	out, _ := json.Marshal(s)
+	return string(out)
+}
@@ -0,0 +1,75 @@
+package pac
+
+import (
+	"strings"
+	"testing"
+
+	"velar/internal/config"
+)
+
+func TestScriptRoutesConfiguredHosts(t *testing.T) {
+	mitm := config.MITM{Enabled: true, Domains: []string{"API.OpenAI.com"}}
+	rules := []config.Rule{
+		{ID: "block-gemini", Match: config.Match{HostContains: "gemini"}, Action: "block"},
+		{ID: "allow-anthropic", Match: config.Match{Host: "api.anthropic.com"}, Action: "allow"},
+		{ID: "allow-all", Action: "allow"},
+		{ID: "unreachable", Match: config.Match{Host: "never.example"}, Action: "block"},
+	}
+	script := Script("localhost:8080", mitm, rules)
+
+	for _, want := range []string{
+		`var proxy = "PROXY localhost:8080";`,
+		`if (host == "api.openai.com" || dnsDomainIs(host, ".api.openai.com")) return proxy;`,
+		`if (host.indexOf("gemini") != -1) return proxy;`,
+		`if (host == "api.anthropic.com") return proxy;`,
+		`return "DIRECT";`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Fatalf("script missing %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "never.example") {
+		t.Fatalf("script includes rule after catch-all allow:\n%s", script)
+	}
+}
+
+func TestScriptProxiesEverythingForCatchAllBlock(t *testing.T) {
+	rules := []config.Rule{
+		{ID: "allow-anthropic", Match: config.Match{Host: "api.anthropic.com"}, Action: "allow"},
+		{ID: "block-rest", Action: "block"},
+	}
+	script := Script("127.0.0.1:8080", config.MITM{}, rules)
+	if strings.Contains(script, "DIRECT") || !strings.HasSuffix(script, "  return proxy;\n}\n") {
+		t.Fatalf("expected every host to be proxied:\n%s", script)
+	}
+}
+
+func TestScriptIgnoresDomainsWhenMITMDisabled(t *testing.T) {
+	script := Script("localhost:8080", config.MITM{Domains: []string{"api.openai.com"}}, nil)
+	if strings.Contains(script, "openai") {
+		t.Fatalf("disabled MITM domains should stay DIRECT:\n%s", script)
+	}
+}
+
+func TestScriptHostPatterns(t *testing.T) {
+	mitm := config.MITM{Enabled: true, Domains: []string{"*.openai.com", "!files.openai.com", "10.0.0.0/8"}}
+	rules := []config.Rule{
+		{ID: "regex", Match: config.Match{Host: `/gemini[0-9]*\.example/`}, Action: "block"},
+		{ID: "except", Match: config.Match{Host: "!internal.example"}, Action: "allow"},
+		{ID: "after", Match: config.Match{Host: "later.example"}, Action: "block"},
+	}
+	script := Script("localhost:8080", mitm, rules)
+	for _, want := range []string{
+		`if (dnsDomainIs(host, ".openai.com")) return proxy;`,
+		`if (/^[0-9.]+$/.test(host) && isInNet(host, "10.0.0.0", "255.0.0.0")) return proxy;`,
+		`if (new RegExp("^(?:gemini[0-9]*\\.example)$").test(host)) return proxy;`,
+		`if (host == "later.example") return proxy;`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Fatalf("script missing %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "files.openai.com") || strings.Contains(script, "internal.example") {
+		t.Fatalf("script includes negated patterns:\n%s", script)
+	}
+}
@@ -0,0 +1,712 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Condition is a compiled rule expression such as
+//
+//	host.endsWith(".openai.azure.com") && detections.count("person") > 5
+//
+// It is evaluated against a Request:
+//
+//   - host, user and category are strings
+//   - request.method, request.path and request.content_type are strings,
+//     request.header(name) is the header's first value or "", and
+//     request.body_size is a number (-1 when unknown)
+//   - detections.count() is the number of sanitizer detections and
+//     detections.count(type) the number of one entity type
+//
+// Strings have the methods startsWith, endsWith, contains, matches (a
+// regular expression literal) and lower. Values combine with ==, !=, <,
+// <=, >, >=, in (a string in a [list]), !, && and ||.
+type Condition struct {
+	src  string
+	eval func(*Request) (any, error)
+	// needsRequest reports that src refers to request or detections.
+	needsRequest bool
+}
+
+// ExprError is a compile error at a line and column of the expression,
+// both counted from 1.
+type ExprError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+// Attributes a condition can need before they are known.
+var (
+	errNeedsRequest    = errors.New("condition needs the HTTP request")
+	errNeedsDetections = errors.New("condition needs the sanitizer's detections")
+)
+
+// CompileCondition parses and type-checks src, which must be a boolean
+// expression.
+func CompileCondition(src string) (*Condition, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{src: src, toks: toks}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t.pos, "unexpected %s", t)
+	}
+	if n.typ != typeBool {
+		return nil, p.errorf(0, "condition must be a boolean, got %s", n.typ)
+	}
+	return &Condition{src: src, eval: n.eval, needsRequest: p.needsRequest}, nil
+}
+
+// String returns the condition's source.
+func (c *Condition) String() string {
+	return c.src
+}
+
+// NeedsRequest reports whether c refers to request or detection
+// attributes, which are only known once a connection is intercepted.
+func (c *Condition) NeedsRequest() bool {
+	return c.needsRequest
+}
+
+// Eval reports whether req satisfies c. It returns errNeedsRequest or
+// errNeedsDetections when the outcome depends on an attribute req lacks.
+func (c *Condition) Eval(req Request) (bool, error) {
+	v, err := c.eval(&req)
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+type exprType int
+
+const (
+	typeString exprType = iota
+	typeNumber
+	typeBool
+	typeList
+)
+
+func (t exprType) String() string {
+	switch t {
+	case typeString:
+		return "string"
+	case typeNumber:
+		return "number"
+	case typeBool:
+		return "boolean"
+	default:
+		return "list"
+	}
+}
+
+// node is a type-checked subexpression.
+type node struct {
+	typ  exprType
+	pos  int
+	eval func(*Request) (any, error)
+}
+
+func constant(typ exprType, pos int, v any) node {
+	return node{typ: typ, pos: pos, eval: func(*Request) (any, error) { return v, nil }}
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return "string " + t.text
+	default:
+		return strconv.Quote(t.text)
+	}
+}
+
+// operators lists the operator tokens, two-character ones first.
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, exprErrorf(src, i, "unterminated string")
+			}
+			lit := src[i : end+1]
+			if _, err := strconv.Unquote(lit); err != nil {
+				return nil, exprErrorf(src, i, "invalid string %s", lit)
+			}
+			toks = append(toks, token{kind: tokString, text: lit, pos: i})
+			i = end + 1
+		case c >= '0' && c <= '9':
+			end := i
+			for end < len(src) && (src[end] >= '0' && src[end] <= '9' || src[end] == '.') {
+				end++
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[i:end], pos: i})
+			i = end
+		case isIdentStart(c):
+			end := i
+			for end < len(src) && (isIdentStart(src[end]) || src[end] >= '0' && src[end] <= '9') {
+				end++
+			}
+			toks = append(toks, token{kind: tokIdent, text: src[i:end], pos: i})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				r, _ := utf8.DecodeRuneInString(src[i:])
+				return nil, exprErrorf(src, i, "unexpected character %q", r)
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+// exprErrorf returns an ExprError at byte offset pos of src.
+// isIdentStart reports whether c can start an identifier. Identifiers are
+// ASCII only: [A-Za-z_][A-Za-z0-9_]*.
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func exprErrorf(src string, pos int, format string, args ...any) *ExprError {
+	line, col := 1, 1
+	for _, r := range src[:pos] {
+		if r == '\n' {
+			line++
+			col = 1
+			continue
+		}
+		col++
+	}
+	return &ExprError{Line: line, Column: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+type parser struct {
+	src  string
+	toks []token
+	i    int
+	// needsRequest is set once a request or detections attribute is parsed.
+	needsRequest bool
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// accept consumes the operator op if it is next.
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return p.errorf(t.pos, "expected %q, found %s", op, t)
+	}
+	return nil
+}
+
+func (p *parser) errorf(pos int, format string, args ...any) error {
+	return exprErrorf(p.src, pos, format, args...)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return node{}, err
+	}
+	for p.peek().text == "||" {
+		op := p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return node{}, err
+		}
+		if left, err = p.logical(op, left, right); err != nil {
+			return node{}, err
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return node{}, err
+	}
+	for p.peek().text == "&&" {
+		op := p.next()
+		right, err := p.parseComparison()
+		if err != nil {
+			return node{}, err
+		}
+		if left, err = p.logical(op, left, right); err != nil {
+			return node{}, err
+		}
+	}
+	return left, nil
+}
+
+// logical combines two booleans with && or ||, short-circuiting so that an
+// attribute the right side needs is only required when it decides.
+func (p *parser) logical(op token, left, right node) (node, error) {
+	if left.typ != typeBool || right.typ != typeBool {
+		return node{}, p.errorf(op.pos, "%s needs booleans, got %s and %s", op.text, left.typ, right.typ)
+	}
+	or := op.text == "||"
+	return node{typ: typeBool, pos: left.pos, eval: func(req *Request) (any, error) {
+		l, err := left.eval(req)
+		if err == nil && l.(bool) == or {
+			return or, nil
+		}
+		r, rerr := right.eval(req)
+		if rerr == nil && r.(bool) == or {
+			return or, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return r, rerr
+	}}, nil
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return node{}, err
+	}
+	op := p.peek()
+	isIn := op.kind == tokIdent && op.text == "in"
+	if op.kind != tokOp && !isIn {
+		return left, nil
+	}
+	switch op.text {
+	case "==", "!=", "<", "<=", ">", ">=", "in":
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseUnary()
+	if err != nil {
+		return node{}, err
+	}
+	switch op.text {
+	case "in":
+		if left.typ != typeString || right.typ != typeList {
+			return node{}, p.errorf(op.pos, "in needs a string and a list, got %s and %s", left.typ, right.typ)
+		}
+		return binary(left, right, func(l, r any) any {
+			for _, v := range r.([]string) {
+				if v == l.(string) {
+					return true
+				}
+			}
+			return false
+		}), nil
+	case "==", "!=":
+		if left.typ != right.typ || left.typ == typeList {
+			return node{}, p.errorf(op.pos, "cannot compare %s %s %s", left.typ, op.text, right.typ)
+		}
+		negate := op.text == "!="
+		return binary(left, right, func(l, r any) any { return (l == r) != negate }), nil
+	default:
+		if left.typ != typeNumber || right.typ != typeNumber {
+			return node{}, p.errorf(op.pos, "%s needs numbers, got %s and %s", op.text, left.typ, right.typ)
+		}
+		cmp := op.text
+		return binary(left, right, func(l, r any) any {
+			a, b := l.(float64), r.(float64)
+			switch cmp {
+			case "<":
+				return a < b
+			case "<=":
+				return a <= b
+			case ">":
+				return a > b
+			default:
+				return a >= b
+			}
+		}), nil
+	}
+}
+
+// binary returns a boolean node applying f to the values of left and right.
+func binary(left, right node, f func(l, r any) any) node {
+	return node{typ: typeBool, pos: left.pos, eval: func(req *Request) (any, error) {
+		l, err := left.eval(req)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right.eval(req)
+		if err != nil {
+			return nil, err
+		}
+		return f(l, r), nil
+	}}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if t := p.peek(); t.kind == tokOp && t.text == "!" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return node{}, err
+		}
+		if operand.typ != typeBool {
+			return node{}, p.errorf(t.pos, "! needs a boolean, got %s", operand.typ)
+		}
+		return node{typ: typeBool, pos: t.pos, eval: func(req *Request) (any, error) {
+			v, err := operand.eval(req)
+			if err != nil {
+				return nil, err
+			}
+			return !v.(bool), nil
+		}}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return node{}, err
+	}
+	for p.accept(".") {
+		name := p.next()
+		if name.kind != tokIdent {
+			return node{}, p.errorf(name.pos, "expected a method name, found %s", name)
+		}
+		if n.typ != typeString {
+			return node{}, p.errorf(name.pos, "%s has no method %s", n.typ, name.text)
+		}
+		if n, err = p.stringMethod(n, name); err != nil {
+			return node{}, err
+		}
+	}
+	return n, nil
+}
+
+// stringMethod compiles a call of method on the string recv.
+func (p *parser) stringMethod(recv node, method token) (node, error) {
+	args, err := p.parseArgs()
+	if err != nil {
+		return node{}, err
+	}
+	var f func(s, arg string) any
+	typ := typeBool
+	switch method.text {
+	case "startsWith":
+		f = func(s, arg string) any { return strings.HasPrefix(s, arg) }
+	case "endsWith":
+		f = func(s, arg string) any { return strings.HasSuffix(s, arg) }
+	case "contains":
+		f = func(s, arg string) any { return strings.Contains(s, arg) }
+	case "lower":
+		if len(args) != 0 {
+			return node{}, p.errorf(method.pos, "lower takes no arguments")
+		}
+		return node{typ: typeString, pos: recv.pos, eval: func(req *Request) (any, error) {
+			v, err := recv.eval(req)
+			if err != nil {
+				return nil, err
+			}
+			return strings.ToLower(v.(string)), nil
+		}}, nil
+	case "matches":
+		if len(args) != 1 || !args[0].literal {
+			return node{}, p.errorf(method.pos, "matches takes one string literal")
+		}
+		re, err := regexp.Compile(args[0].value)
+		if err != nil {
+			return node{}, p.errorf(args[0].n.pos, "invalid regular expression: %v", err)
+		}
+		f = func(s, _ string) any { return re.MatchString(s) }
+	default:
+		return node{}, p.errorf(method.pos, "unknown string method %s", method.text)
+	}
+	if len(args) != 1 || args[0].n.typ != typeString {
+		return node{}, p.errorf(method.pos, "%s takes one string argument", method.text)
+	}
+	arg := args[0].n
+	return node{typ: typ, pos: recv.pos, eval: func(req *Request) (any, error) {
+		s, err := recv.eval(req)
+		if err != nil {
+			return nil, err
+		}
+		a, err := arg.eval(req)
+		if err != nil {
+			return nil, err
+		}
+		return f(s.(string), a.(string)), nil
+	}}, nil
+}
+
+// argument is a call argument; value is set for string literals.
+type argument struct {
+	n       node
+	literal bool
+	value   string
+}
+
+func (p *parser) parseArgs() ([]argument, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []argument
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		t := p.peek()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		a := argument{n: n}
+		if t.kind == tokString && p.i > 0 && p.toks[p.i-1] == t {
+			a.literal = true
+			a.value, _ = strconv.Unquote(t.text)
+		}
+		args = append(args, a)
+	}
+	return args, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		s, _ := strconv.Unquote(t.text)
+		return constant(typeString, t.pos, s), nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return node{}, p.errorf(t.pos, "invalid number %s", t.text)
+		}
+		return constant(typeNumber, t.pos, f), nil
+	case tokIdent:
+		return p.parseIdent(t)
+	case tokOp:
+		switch t.text {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return node{}, err
+			}
+			return n, p.expect(")")
+		case "[":
+			return p.parseList(t)
+		}
+	}
+	return node{}, p.errorf(t.pos, "unexpected %s", t)
+}
+
+func (p *parser) parseList(open token) (node, error) {
+	var items []node
+	for !p.accept("]") {
+		if len(items) > 0 {
+			if err := p.expect(","); err != nil {
+				return node{}, err
+			}
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return node{}, err
+		}
+		if n.typ != typeString {
+			return node{}, p.errorf(n.pos, "lists hold strings, got %s", n.typ)
+		}
+		items = append(items, n)
+	}
+	return node{typ: typeList, pos: open.pos, eval: func(req *Request) (any, error) {
+		out := make([]string, len(items))
+		for i, item := range items {
+			v, err := item.eval(req)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v.(string)
+		}
+		return out, nil
+	}}, nil
+}
+
+func (p *parser) parseIdent(t token) (node, error) {
+	switch t.text {
+	case "true", "false":
+		return constant(typeBool, t.pos, t.text == "true"), nil
+	case "host":
+		return attribute(typeString, t.pos, func(req *Request) (any, error) { return strings.ToLower(req.Host), nil }), nil
+	case "user":
+		return attribute(typeString, t.pos, func(req *Request) (any, error) { return req.User, nil }), nil
+	case "category":
+		return attribute(typeString, t.pos, func(req *Request) (any, error) { return req.Category, nil }), nil
+	case "request":
+		p.needsRequest = true
+		return p.parseRequestField(t)
+	case "detections":
+		p.needsRequest = true
+		return p.parseDetections(t)
+	}
+	return node{}, p.errorf(t.pos, "unknown name %s", t.text)
+}
+
+func attribute(typ exprType, pos int, eval func(*Request) (any, error)) node {
+	return node{typ: typ, pos: pos, eval: eval}
+}
+
+// member reads the name after "." following the namespace ns.
+func (p *parser) member(ns token) (token, error) {
+	if err := p.expect("."); err != nil {
+		return token{}, err
+	}
+	name := p.next()
+	if name.kind != tokIdent {
+		return token{}, p.errorf(name.pos, "expected a field of %s, found %s", ns.text, name)
+	}
+	return name, nil
+}
+
+func (p *parser) parseRequestField(ns token) (node, error) {
+	field, err := p.member(ns)
+	if err != nil {
+		return node{}, err
+	}
+	get := func(typ exprType, f func(*Request) any) node {
+		return attribute(typ, ns.pos, func(req *Request) (any, error) {
+			if req.Method == "" {
+				return nil, errNeedsRequest
+			}
+			return f(req), nil
+		})
+	}
+	switch field.text {
+	case "method":
+		return get(typeString, func(req *Request) any { return strings.ToUpper(req.Method) }), nil
+	case "path":
+		return get(typeString, func(req *Request) any { return req.Path }), nil
+	case "content_type":
+		return get(typeString, func(req *Request) any { return mediaType(req.Header.Get("Content-Type")) }), nil
+	case "body_size":
+		return get(typeNumber, func(req *Request) any { return float64(req.BodySize) }), nil
+	case "header":
+		args, err := p.parseArgs()
+		if err != nil {
+			return node{}, err
+		}
+		if len(args) != 1 || args[0].n.typ != typeString {
+			return node{}, p.errorf(field.pos, "header takes one string argument")
+		}
+		name := args[0].n
+		return attribute(typeString, ns.pos, func(req *Request) (any, error) {
+			if req.Method == "" {
+				return nil, errNeedsRequest
+			}
+			v, err := name.eval(req)
+			if err != nil {
+				return nil, err
+			}
+			return req.Header.Get(v.(string)), nil
+		}), nil
+	}
+	return node{}, p.errorf(field.pos, "unknown field request.%s", field.text)
+}
+
+func (p *parser) parseDetections(ns token) (node, error) {
+	field, err := p.member(ns)
+	if err != nil {
+		return node{}, err
+	}
+	if field.text != "count" {
+		return node{}, p.errorf(field.pos, "unknown field detections.%s", field.text)
+	}
+	args, err := p.parseArgs()
+	if err != nil {
+		return node{}, err
+	}
+	if len(args) > 1 || (len(args) == 1 && args[0].n.typ != typeString) {
+		return node{}, p.errorf(field.pos, "count takes an optional entity type string")
+	}
+	return attribute(typeNumber, ns.pos, func(req *Request) (any, error) {
+		if req.Detections == nil {
+			return nil, errNeedsDetections
+		}
+		if len(args) == 0 {
+			total := 0
+			for _, n := range req.Detections {
+				total += n
+			}
+			return float64(total), nil
+		}
+		typ, err := args[0].n.eval(req)
+		if err != nil {
+			return nil, err
+		}
+		return float64(req.Detections[strings.ToLower(typ.(string))]), nil
+	}), nil
+}
@@ -0,0 +1,93 @@
+package policy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConditionEval(t *testing.T) {
+	req := Request{
+		Host:     "eu.openai.azure.com",
+		User:     "alice",
+		Method:   http.MethodPost,
+		Path:     "/openai/deployments/gpt/chat",
+		Header:   http.Header{"Content-Type": {"application/json; charset=utf-8"}, "X-Team": {"research"}},
+		BodySize: 2048,
+		Category: "UNKNOWN",
+	}.WithDetections([]string{"person", "PERSON", "email"})
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`host.endsWith(".openai.azure.com") && request.path.startsWith("/openai/deployments/") && detections.count("person") > 1`, true},
+		{`detections.count("person") > 5`, false},
+		{`detections.count() == 3 && detections.count("phone") == 0`, true},
+		{`request.method in ["PUT", "POST"] && request.body_size >= 1024`, true},
+		{`request.content_type == "application/json" && request.header("x-team") == "research"`, true},
+		{`!(user == "alice") || category != "UNKNOWN"`, false},
+		{`host.matches("^[a-z]+\\.openai\\.azure\\.com$") && request.path.lower().contains("gpt")`, true},
+		{`request.header("Missing") == ""`, true},
+	}
+	for _, tt := range tests {
+		c, err := CompileCondition(tt.expr)
+		if err != nil {
+			t.Fatalf("CompileCondition(%s) error = %v", tt.expr, err)
+		}
+		got, err := c.Eval(req)
+		if err != nil || got != tt.want {
+			t.Fatalf("Eval(%s) = %v, %v, want %v", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestConditionEvalMissingAttributes(t *testing.T) {
+	c, err := CompileCondition(`host == "api.openai.com" && (request.path == "/v1/files" || detections.count() > 0)`)
+	if err != nil {
+		t.Fatalf("CompileCondition() error = %v", err)
+	}
+	if ok, err := c.Eval(Request{Host: "example.com"}); ok || err != nil {
+		t.Fatalf("Eval(other host) = %v, %v, want false without needing more", ok, err)
+	}
+	if _, err := c.Eval(Request{Host: "api.openai.com"}); !errors.Is(err, errNeedsRequest) {
+		t.Fatalf("Eval(connection) error = %v, want errNeedsRequest", err)
+	}
+	if ok, err := c.Eval(Request{Host: "api.openai.com", Method: "POST", Path: "/v1/files"}); !ok || err != nil {
+		t.Fatalf("Eval(upload) = %v, %v, want true before inspection", ok, err)
+	}
+	chat := Request{Host: "api.openai.com", Method: "POST", Path: "/v1/chat"}
+	if _, err := c.Eval(chat); !errors.Is(err, errNeedsDetections) {
+		t.Fatalf("Eval(chat) error = %v, want errNeedsDetections", err)
+	}
+	if ok, err := c.Eval(chat.WithDetections(nil)); ok || err != nil {
+		t.Fatalf("Eval(inspected chat) = %v, %v, want false", ok, err)
+	}
+}
+
+func TestCompileConditionErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{`host.endsWith(".com") &&`, "line 1, column 25: unexpected end of expression"},
+		{`host == 5`, "line 1, column 6: cannot compare string == number"},
+		{`host`, "line 1, column 1: condition must be a boolean, got string"},
+		{"host == \"a\" &&\n  detections.count(\"person\") > \"5\"", "line 2, column 30: > needs numbers, got number and string"},
+		{`hots == "a"`, "line 1, column 1: unknown name hots"},
+		{`request.query == ""`, "line 1, column 9: unknown field request.query"},
+		{`host.matches("[")`, "line 1, column 14: invalid regular expression"},
+		{`host.startsWith(1)`, "line 1, column 6: startsWith takes one string argument"},
+		{`host == "a`, "line 1, column 9: unterminated string"},
+		{`host = "a"`, "line 1, column 6: unexpected character '='"},
+		{`host == "é" && hosté == "a"`, "line 1, column 20: unexpected character 'é'"},
+	}
+	for _, tt := range tests {
+		_, err := CompileCondition(tt.expr)
+		var exprErr *ExprError
+		if !errors.As(err, &exprErr) || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Fatalf("CompileCondition(%q) error = %v, want %q", tt.expr, err, tt.want)
+		}
+	}
+}
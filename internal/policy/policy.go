@@ -1,10 +1,15 @@
 package policy
 
 import (
+	"errors"
 	"fmt"
+	"mime"
+	"net/http"
+	"path"
 	"strings"
 
 	"velar/internal/config"
+	"velar/internal/hostmatch"
 )
 
 type Decision string
@@ -19,34 +24,227 @@ type Result struct {
 	Decision Decision
 	Reason   string
 	RuleID   string
+	// Monitor reports that the matching rule inspects requests without
+	// masking them.
+	Monitor bool
+	// NeedsDetections reports that the decision is provisional: the
+	// matching rule's condition depends on the sanitizer's detections, so
+	// the request has to be evaluated again once it has been inspected.
+	NeedsDetections bool
+	// NeedsRequest reports that the decision was made for a connection
+	// whose matching rule depends on the requests inside it, so the
+	// connection has to be intercepted for the rule to be applied.
+	NeedsRequest bool
+}
+
+// Request carries the attributes rules can match on.
+type Request struct {
+	Host string
+	// User is the authenticated proxy client, empty when authentication
+	// is disabled.
+	User string
+	// Method is empty when only the connection is known, as for a CONNECT
+	// tunnel before interception. Path, Header and BodySize are then unset.
+	Method string
+	Path   string
+	Header http.Header
+	// BodySize is the request body length in bytes, or -1 when unknown.
+	BodySize int64
+	// Category is the host's classifier category.
+	Category string
+	// Detections counts the sanitizer's detections by entity type. It is
+	// nil before the request has been inspected.
+	Detections map[string]int
+}
+
+// WithDetections returns req with the detections of the given entity
+// types, one entry per detection.
+func (req Request) WithDetections(types []string) Request {
+	req.Detections = make(map[string]int, len(types))
+	for _, typ := range types {
+		req.Detections[strings.ToLower(typ)]++
+	}
+	return req
+}
+
+// HTTPRequest returns the attributes of r, sent to host by user.
+func HTTPRequest(host, user string, r *http.Request) Request {
+	req := Request{Host: host, User: user, Method: r.Method, Header: r.Header, BodySize: r.ContentLength}
+	if r.URL != nil {
+		req.Path = r.URL.Path
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		req.BodySize = 0
+	}
+	return req
 }
 
 type Engine interface {
 	Evaluate(host string) Result
+	EvaluateRequest(req Request) Result
 }
 
 type RuleEngine struct {
-	rules []config.Rule
+	rules []compiledRule
 }
 
+// compiledRule is a rule with its host patterns and condition compiled.
+// err is set when either does not compile; the rule then blocks what it
+// matches.
+type compiledRule struct {
+	config.Rule
+	hosts *hostmatch.List
+	when  *Condition
+	err   error
+}
+
+// NewRuleEngine returns an engine for rules. Rules whose host patterns or
+// condition do not compile block the requests they match; use Compile to
+// reject them.
 func NewRuleEngine(rules []config.Rule) *RuleEngine {
-	return &RuleEngine{rules: rules}
+	e, _ := newRuleEngine(rules)
+	return e
+}
+
+// Compile returns an engine for rules, or an error naming the first rule
+// whose host patterns or condition do not compile.
+func Compile(rules []config.Rule) (*RuleEngine, error) {
+	e, err := newRuleEngine(rules)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// CheckInterception returns an error naming the first rule of cfg that
+// matches on request attributes but can apply to hosts MITM does not
+// intercept. Such connections are blocked at run time rather than
+// tunnelled past the rule. Host patterns that are regular expressions or
+// CIDR ranges, and host_contains, are not checked, and neither is any rule
+// while the gateway is enabled, as its requests are always inspected.
+func CheckInterception(cfg config.Config) error {
+	if cfg.Gateway.Enabled {
+		return nil
+	}
+	var domains *hostmatch.List
+	if cfg.MITM.Enabled {
+		var err error
+		if domains, err = hostmatch.ParseList(cfg.MITM.Domains, true); err != nil {
+			return fmt.Errorf("mitm domains: %w", err)
+		}
+	}
+	for _, r := range cfg.Rules {
+		c := compileRule(r)
+		if c.err != nil || !c.needsRequest() {
+			continue
+		}
+		if !cfg.MITM.Enabled {
+			return fmt.Errorf("rule %s matches requests but mitm is disabled", ruleID(r.ID))
+		}
+		if domains.Len() == 0 {
+			continue
+		}
+		if c.hosts.Len() == 0 && r.Match.HostContains == "" {
+			return fmt.Errorf("rule %s matches requests on every host but mitm only intercepts its domains; add a host", ruleID(r.ID))
+		}
+		for _, p := range c.hosts.Patterns() {
+			host := p.Value
+			switch {
+			case p.Negate || p.Kind == hostmatch.Regexp || p.Kind == hostmatch.CIDR:
+				continue
+			case p.Kind == hostmatch.Wildcard && host == "":
+				host = "*"
+			case p.Kind == hostmatch.Wildcard:
+				host = "*." + host
+			}
+			if !domains.Match(host) {
+				return fmt.Errorf("rule %s matches requests on %s, which is not in mitm domains", ruleID(r.ID), p)
+			}
+		}
+	}
+	return nil
+}
+
+func newRuleEngine(rules []config.Rule) (*RuleEngine, error) {
+	e := &RuleEngine{rules: make([]compiledRule, len(rules))}
+	var first error
+	for i, r := range rules {
+		e.rules[i] = compileRule(r)
+		if first == nil {
+			first = e.rules[i].err
+		}
+	}
+	return e, first
+}
+
+func compileRule(r config.Rule) compiledRule {
+	c := compiledRule{Rule: r}
+	patterns := r.Match.Hosts
+	if r.Match.Host != "" {
+		patterns = append([]string{r.Match.Host}, patterns...)
+	}
+	hosts, err := hostmatch.ParseList(patterns, false)
+	if err != nil {
+		c.err = fmt.Errorf("rule %s: host: %w", ruleID(r.ID), err)
+		return c
+	}
+	c.hosts = hosts
+	if strings.TrimSpace(r.When) == "" {
+		return c
+	}
+	when, err := CompileCondition(r.When)
+	if err != nil {
+		c.err = fmt.Errorf("rule %s: when: %w", ruleID(r.ID), err)
+		return c
+	}
+	c.when = when
+	return c
 }
 
 func (e *RuleEngine) Evaluate(host string) Result {
-	host = strings.ToLower(host)
+	return e.EvaluateRequest(Request{Host: host})
+}
+
+func (e *RuleEngine) EvaluateRequest(req Request) Result {
+	host := strings.ToLower(req.Host)
 	for _, r := range e.rules {
-		if !matches(host, r.Match) {
+		if !r.matchesHost(host) || !matchesUser(req.User, r.Match) {
 			continue
 		}
+		if r.Match.RequestLevel() {
+			if req.Method == "" {
+				// The outcome depends on each request, so the connection
+				// has to be intercepted for the rule to be applied.
+				return Result{Decision: MITM, Reason: "request rule", RuleID: ruleID(r.ID), NeedsRequest: true}
+			}
+			if !matchesRequest(req, r.Match) {
+				continue
+			}
+		}
+		if r.err != nil {
+			return Result{Decision: Block, Reason: fmt.Sprintf("invalid rule: %v", r.err), RuleID: ruleID(r.ID)}
+		}
+		if r.when != nil {
+			ok, err := r.when.Eval(req)
+			switch {
+			case errors.Is(err, errNeedsRequest):
+				return Result{Decision: MITM, Reason: "request rule", RuleID: ruleID(r.ID), NeedsRequest: true}
+			case errors.Is(err, errNeedsDetections):
+				return Result{Decision: MITM, Reason: "detection rule", RuleID: ruleID(r.ID), NeedsDetections: true, NeedsRequest: req.Method == ""}
+			case err != nil:
+				return Result{Decision: Block, Reason: fmt.Sprintf("condition error: %v", err), RuleID: ruleID(r.ID)}
+			case !ok:
+				continue
+			}
+		}
 		action := strings.ToLower(r.Action)
 		switch action {
 		case string(Block):
 			return Result{Decision: Block, Reason: "matched rule", RuleID: ruleID(r.ID)}
 		case string(Allow):
-			return Result{Decision: Allow, Reason: "matched rule", RuleID: ruleID(r.ID)}
+			return Result{Decision: Allow, Reason: "matched rule", RuleID: ruleID(r.ID), Monitor: r.Monitor}
 		case string(MITM):
-			return Result{Decision: MITM, Reason: "matched rule", RuleID: ruleID(r.ID)}
+			return Result{Decision: MITM, Reason: "matched rule", RuleID: ruleID(r.ID), Monitor: r.Monitor}
 		default:
 			return Result{Decision: Block, Reason: fmt.Sprintf("invalid action %q", r.Action), RuleID: ruleID(r.ID)}
 		}
@@ -55,15 +253,93 @@ func (e *RuleEngine) Evaluate(host string) Result {
 	return Result{Decision: Allow, Reason: "default allow", RuleID: "default"}
 }
 
-func matches(host string, m config.Match) bool {
-	if m.Host == "" && m.HostContains == "" {
+// needsRequest reports whether the rule can only be applied to the
+// requests inside a connection.
+func (r compiledRule) needsRequest() bool {
+	return r.Match.RequestLevel() || (r.when != nil && r.when.NeedsRequest())
+}
+
+// matchesHost reports whether the rule applies to host: it matches the
+// rule's host patterns or contains host_contains. Rules without host
+// criteria apply to every host.
+func (r compiledRule) matchesHost(host string) bool {
+	if r.hosts.Len() == 0 && r.Match.HostContains == "" {
 		return true
 	}
-	if m.Host != "" && strings.EqualFold(m.Host, host) {
+	if r.hosts.Match(host) {
 		return true
 	}
-	if m.HostContains != "" && strings.Contains(host, strings.ToLower(m.HostContains)) {
-		return true
+	return r.Match.HostContains != "" && strings.Contains(host, strings.ToLower(r.Match.HostContains))
+}
+
+// matchesUser reports whether the rule applies to user. Rules without a
+// user criterion apply to everyone, including unauthenticated clients.
+func matchesUser(user string, m config.Match) bool {
+	return m.User == "" || m.User == user
+}
+
+// matchesRequest reports whether req meets m's request criteria.
+func matchesRequest(req Request, m config.Match) bool {
+	if len(m.Methods) > 0 && !containsFold(m.Methods, req.Method) {
+		return false
+	}
+	if m.Path != "" && !matchesPath(req.Path, m.Path) {
+		return false
+	}
+	for _, h := range m.Headers {
+		values := req.Header.Values(h.Name)
+		if len(values) == 0 || (h.Value != "" && !contains(values, h.Value)) {
+			return false
+		}
+	}
+	if m.ContentType != "" {
+		if ok, _ := path.Match(strings.ToLower(m.ContentType), mediaType(req.Header.Get("Content-Type"))); !ok {
+			return false
+		}
+	}
+	if m.MinBodyBytes > 0 && req.BodySize >= 0 && req.BodySize < m.MinBodyBytes {
+		return false
+	}
+	if m.MaxBodyBytes > 0 && (req.BodySize < 0 || req.BodySize > m.MaxBodyBytes) {
+		return false
+	}
+	return true
+}
+
+// mediaType returns the lower-cased media type of a Content-Type value, or
+// "" when it does not parse.
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// matchesPath matches p against pattern, a glob when it has any of the
+// path.Match metacharacters and a prefix otherwise.
+func matchesPath(p, pattern string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, p)
+		return ok
+	}
+	return strings.HasPrefix(p, pattern)
+}
+
+func contains(values []string, v string) bool {
+	for _, candidate := range values {
+		if candidate == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, v string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, v) {
+			return true
+		}
 	}
 	return false
 }
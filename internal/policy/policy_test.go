@@ -1,6 +1,9 @@
 package policy
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"velar/internal/config"
@@ -52,3 +55,173 @@ func TestRuleEngineEvaluate(t *testing.T) {
 		})
 	}
 }
+
+func TestRuleEngineEvaluateRequestUser(t *testing.T) {
+	engine := NewRuleEngine([]config.Rule{
+		{ID: "block-interns", Match: config.Match{HostContains: "openai.com", User: "intern"}, Action: "block"},
+		{ID: "mitm-openai", Match: config.Match{HostContains: "openai.com"}, Action: "mitm"},
+	})
+	if got := engine.EvaluateRequest(Request{Host: "api.openai.com", User: "intern"}); got.Decision != Block || got.RuleID != "block-interns" {
+		t.Fatalf("intern decision = %+v", got)
+	}
+	if got := engine.EvaluateRequest(Request{Host: "api.openai.com", User: "alice"}); got.Decision != MITM {
+		t.Fatalf("alice decision = %+v", got)
+	}
+	if got := engine.Evaluate("api.openai.com"); got.Decision != MITM {
+		t.Fatalf("unauthenticated decision = %+v", got)
+	}
+}
+
+func TestRuleEngineEvaluateRequestMonitor(t *testing.T) {
+	engine := NewRuleEngine([]config.Rule{
+		{ID: "new-team", Match: config.Match{Host: "api.anthropic.com"}, Action: "mitm", Monitor: true},
+		{ID: "openai", Match: config.Match{Host: "api.openai.com"}, Action: "mitm"},
+	})
+	if got := engine.Evaluate("api.anthropic.com"); got.Decision != MITM || !got.Monitor {
+		t.Fatalf("monitored decision = %+v", got)
+	}
+	if got := engine.Evaluate("api.openai.com"); got.Monitor {
+		t.Fatalf("unmonitored decision = %+v", got)
+	}
+}
+
+func TestRuleEngineEvaluateRequestAttributes(t *testing.T) {
+	engine := NewRuleEngine([]config.Rule{
+		{ID: "block-uploads", Match: config.Match{Host: "api.openai.com", Methods: []string{"POST"}, Path: "/v1/files"}, Action: "block"},
+		{ID: "block-large", Match: config.Match{Host: "api.openai.com", ContentType: "multipart/*", MinBodyBytes: 1024}, Action: "block"},
+		{ID: "block-research", Match: config.Match{Host: "api.openai.com", Path: "/v1/*/completions", Headers: []config.HeaderMatch{{Name: "X-Team", Value: "research"}}}, Action: "block"},
+		{ID: "allow-openai", Match: config.Match{Host: "api.openai.com"}, Action: "mitm"},
+	})
+	newRequest := func(method, target, contentType string, body string) *http.Request {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		return r
+	}
+	chunked := newRequest(http.MethodPost, "https://api.openai.com/v1/batches", "multipart/form-data; boundary=x", "--x--")
+	chunked.ContentLength = -1
+	team := newRequest(http.MethodPost, "https://api.openai.com/v1/chat/completions", "application/json", "{}")
+	team.Header.Set("X-Team", "research")
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		ruleID string
+	}{
+		{"upload by path prefix", newRequest(http.MethodPost, "https://api.openai.com/v1/files/abc", "", ""), "block-uploads"},
+		{"listing uploads is another method", newRequest(http.MethodGet, "https://api.openai.com/v1/files", "", ""), "allow-openai"},
+		{"chat completions", newRequest(http.MethodPost, "https://api.openai.com/v1/chat/completions", "application/json", "{}"), "allow-openai"},
+		{"large multipart body", newRequest(http.MethodPost, "https://api.openai.com/v1/batches", "multipart/form-data; boundary=x", strings.Repeat("x", 2048)), "block-large"},
+		{"small multipart body", newRequest(http.MethodPost, "https://api.openai.com/v1/batches", "multipart/form-data; boundary=x", "--x--"), "allow-openai"},
+		{"unknown length counts as large", chunked, "block-large"},
+		{"header value and path glob", team, "block-research"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := engine.EvaluateRequest(HTTPRequest("api.openai.com", "", tt.req))
+			if got.RuleID != tt.ruleID {
+				t.Fatalf("decision = %+v, want rule %s", got, tt.ruleID)
+			}
+		})
+	}
+
+	// Without a request the first rule cannot be decided, so the connection
+	// is intercepted.
+	if got := engine.Evaluate("api.openai.com"); got.Decision != MITM || got.RuleID != "block-uploads" || !got.NeedsRequest {
+		t.Fatalf("connection decision = %+v, want mitm for block-uploads", got)
+	}
+}
+
+func TestRuleEngineEvaluateRequestCondition(t *testing.T) {
+	engine, err := Compile([]config.Rule{
+		{ID: "block-people", Match: config.Match{HostContains: "azure.com"}, When: `request.path.startsWith("/openai/") && detections.count("person") > 1`, Action: "block"},
+		{ID: "allow-rest", Action: "allow"},
+	})
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	if got := engine.Evaluate("eu.openai.azure.com"); got.Decision != MITM || got.RuleID != "block-people" || got.NeedsDetections || !got.NeedsRequest {
+		t.Fatalf("connection decision = %+v, want mitm to evaluate requests", got)
+	}
+	req := Request{Host: "eu.openai.azure.com", Method: http.MethodPost, Path: "/openai/deployments/gpt"}
+	if got := engine.EvaluateRequest(req); got.Decision != MITM || !got.NeedsDetections || got.NeedsRequest {
+		t.Fatalf("request decision = %+v, want a provisional decision", got)
+	}
+	if got := engine.EvaluateRequest(req.WithDetections([]string{"person", "person"})); got.Decision != Block || got.RuleID != "block-people" {
+		t.Fatalf("inspected decision = %+v, want block", got)
+	}
+	if got := engine.EvaluateRequest(req.WithDetections([]string{"person"})); got.Decision != Allow || got.RuleID != "allow-rest" {
+		t.Fatalf("inspected decision = %+v, want allow-rest", got)
+	}
+}
+
+func TestCheckInterception(t *testing.T) {
+	uploads := config.Rule{ID: "block-uploads", Match: config.Match{Host: "api.openai.com", Path: "/v1/files"}, Action: "block"}
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want string
+	}{
+		{"mitm disabled", config.Config{Rules: []config.Rule{uploads}}, "rule block-uploads matches requests but mitm is disabled"},
+		{"host intercepted", config.Config{MITM: config.MITM{Enabled: true, Domains: []string{"openai.com"}}, Rules: []config.Rule{uploads}}, ""},
+		{"every host intercepted", config.Config{MITM: config.MITM{Enabled: true}, Rules: []config.Rule{uploads}}, ""},
+		{"host not intercepted", config.Config{MITM: config.MITM{Enabled: true, Domains: []string{"anthropic.com"}}, Rules: []config.Rule{uploads}}, "rule block-uploads matches requests on api.openai.com, which is not in mitm domains"},
+		{"wildcard wider than domains", config.Config{MITM: config.MITM{Enabled: true, Domains: []string{"api.openai.com"}}, Rules: []config.Rule{{ID: "w", Match: config.Match{Host: "*.openai.com", Methods: []string{"POST"}}, Action: "block"}}}, "rule w matches requests on *.openai.com, which is not in mitm domains"},
+		{"rule without hosts", config.Config{MITM: config.MITM{Enabled: true, Domains: []string{"openai.com"}}, Rules: []config.Rule{{ID: "any", When: `request.method == "DELETE"`, Action: "block"}}}, "rule any matches requests on every host"},
+		{"connection-level condition", config.Config{Rules: []config.Rule{{ID: "c", When: `host.endsWith(".com")`, Action: "block"}}}, ""},
+		{"gateway inspects requests", config.Config{Gateway: config.Gateway{Enabled: true}, Rules: []config.Rule{uploads}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckInterception(tt.cfg)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("CheckInterception() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("CheckInterception() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileRejectsInvalidCondition(t *testing.T) {
+	rules := []config.Rule{{ID: "typo", When: `host.endswith(".com")`, Action: "allow"}}
+	if _, err := Compile(rules); err == nil || !strings.Contains(err.Error(), "rule typo: when: line 1, column 6: unknown string method endswith") {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	if got := NewRuleEngine(rules).Evaluate("example.com"); got.Decision != Block || !strings.Contains(got.Reason, "invalid rule") {
+		t.Fatalf("decision = %+v, want the invalid rule to block", got)
+	}
+}
+
+func TestRuleEngineHostPatterns(t *testing.T) {
+	engine, err := Compile([]config.Rule{
+		{ID: "block-files", Match: config.Match{Hosts: []string{"*.openai.com", "!api.openai.com"}}, Action: "block"},
+		{ID: "mitm-openai", Match: config.Match{Host: "*.openai.com"}, Action: "mitm"},
+		{ID: "block-lan", Match: config.Match{Host: "10.0.0.0/8"}, Action: "block"},
+		{ID: "block-regex", Match: config.Match{Host: `/gemini[0-9]*\.example/`}, Action: "block"},
+	})
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	for host, want := range map[string]string{
+		"files.openai.com":  "block-files",
+		"api.openai.com":    "mitm-openai",
+		"notopenai.com":     "default",
+		"10.20.30.40":       "block-lan",
+		"gemini2.example":   "block-regex",
+		"gemini2.example.x": "default",
+	} {
+		if got := engine.Evaluate(host); got.RuleID != want {
+			t.Fatalf("Evaluate(%q) = %+v, want rule %s", host, got, want)
+		}
+	}
+
+	if _, err := Compile([]config.Rule{{ID: "bad", Match: config.Match{Host: "api.*.com"}, Action: "block"}}); err == nil || !strings.Contains(err.Error(), "rule bad: host:") {
+		t.Fatalf("Compile() error = %v, want an invalid host pattern", err)
+	}
+}
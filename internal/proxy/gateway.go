@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"velar/internal/config"
+	"velar/internal/proxy/mitm"
+)
+
+// Gateway maps path prefixes on the proxy listener to provider base URLs,
+// so clients can use http://localhost:8080/openai/v1 as their API base URL
+// without trusting the Velar CA.
+type Gateway struct {
+	routes []gatewayRoute
+}
+
+type gatewayRoute struct {
+	prefix string
+	base   *url.URL
+}
+
+// NewGateway validates the configured routes. It returns nil when the
+// gateway is disabled.
+func NewGateway(cfg config.Gateway) (*Gateway, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	g := &Gateway{}
+	for _, r := range cfg.Routes {
+		prefix := "/" + strings.Trim(strings.TrimSpace(r.Prefix), "/")
+		if prefix == "/" {
+			return nil, fmt.Errorf("gateway: route for %q needs a non-root prefix", r.Upstream)
+		}
+		base, err := url.Parse(strings.TrimSpace(r.Upstream))
+		if err != nil {
+			return nil, fmt.Errorf("gateway: invalid upstream for %s: %w", prefix, err)
+		}
+		if base.Scheme != "https" || base.Host == "" {
+			return nil, fmt.Errorf("gateway: upstream for %s must be an https URL, got %q", prefix, r.Upstream)
+		}
+		g.routes = append(g.routes, gatewayRoute{prefix: prefix, base: base})
+	}
+	if len(g.routes) == 0 {
+		return nil, fmt.Errorf("gateway: enabled without routes")
+	}
+	// Longest prefix first so /openai/azure wins over /openai.
+	sort.SliceStable(g.routes, func(i, j int) bool {
+		return len(g.routes[i].prefix) > len(g.routes[j].prefix)
+	})
+	return g, nil
+}
+
+// WithGateway serves the gateway routes for requests addressed to the proxy
+// itself. A nil gateway disables them. Gateway requests share the MITM
+// handler when interception is enabled so both use one session store.
+func (p *Proxy) WithGateway(g *Gateway) *Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gateway = g
+	p.gatewayHandler = p.newGatewayHandler()
+	return p
+}
+
+// newGatewayHandler returns the handler for gateway requests under the
+// current configuration. The caller holds p.mu.
+func (p *Proxy) newGatewayHandler() *mitm.Handler {
+	if p.gateway == nil || p.mitm != nil {
+		return p.mitm
+	}
+	// Forward never terminates TLS, so no CA is needed.
+	return mitm.NewHandler(nil, p.roundTripper(), p.policy, p.classifier, p.audit, p.inspector).WithLimiter(p.limiter).WithRetrier(p.retrier).WithCache(p.cache).WithRecorder(p.recorder).WithReplay(p.player).WithApprovals(p.approvals).WithDebugHeaders(p.mitmCfg.DebugHeaders)
+}
+
+// resolve returns the upstream host and escaped path for an origin-form
+// request path, or ok=false when no route matches.
+func (g *Gateway) resolve(u *url.URL) (host, escapedPath string, ok bool) {
+	if g == nil {
+		return "", "", false
+	}
+	reqPath := u.EscapedPath()
+	for _, r := range g.routes {
+		rest, found := strings.CutPrefix(reqPath, r.prefix)
+		if !found || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			continue
+		}
+		joined := path.Join("/", r.base.EscapedPath(), rest)
+		if strings.HasSuffix(rest, "/") && !strings.HasSuffix(joined, "/") {
+			joined += "/"
+		}
+		return r.base.Host, joined, true
+	}
+	return "", "", false
+}
+
+// serveGateway forwards a gateway request through the MITM inspection
+// pipeline. It reports false when r does not target a gateway route.
+func (p *Proxy) serveGateway(w http.ResponseWriter, r *http.Request, cur pipeline) bool {
+	if p.gateway == nil || r.Method == http.MethodConnect || r.URL.IsAbs() {
+		return false
+	}
+	host, escapedPath, ok := p.gateway.resolve(r.URL)
+	if !ok {
+		return false
+	}
+	unescaped, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return true
+	}
+	out := r.Clone(r.Context())
+	out.URL.Path = unescaped
+	out.URL.RawPath = ""
+	if escapedPath != out.URL.EscapedPath() {
+		out.URL.RawPath = escapedPath
+	}
+	cur.gatewayHandler.Forward(w, out, host)
+	return true
+}
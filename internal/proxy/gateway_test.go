@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"velar/internal/config"
+	"velar/internal/policy"
+	"velar/internal/sanitizer"
+)
+
+func TestGatewayResolve(t *testing.T) {
+	g, err := NewGateway(config.Gateway{Enabled: true, Routes: []config.GatewayRoute{
+		{Prefix: "/openai", Upstream: "https://api.openai.com"},
+		{Prefix: "/openai/azure/", Upstream: "https://corp.openai.azure.com/openai"},
+		{Prefix: "anthropic", Upstream: "https://api.anthropic.com/"},
+	}})
+	if err != nil {
+		t.Fatalf("NewGateway() error = %v", err)
+	}
+	tests := []struct {
+		path     string
+		wantHost string
+		wantPath string
+		ok       bool
+	}{
+		{"/openai/v1/chat/completions", "api.openai.com", "/v1/chat/completions", true},
+		{"/openai", "api.openai.com", "/", true},
+		{"/openai/azure/deployments/gpt/chat", "corp.openai.azure.com", "/openai/deployments/gpt/chat", true},
+		{"/anthropic/v1/messages", "api.anthropic.com", "/v1/messages", true},
+		{"/openaiv1/models", "", "", false},
+		{"/other/v1", "", "", false},
+		{"/openai/v1/files/a%2Fb", "api.openai.com", "/v1/files/a%2Fb", true},
+	}
+	for _, tc := range tests {
+		u, _ := url.Parse(tc.path)
+		host, p, ok := g.resolve(u)
+		if ok != tc.ok || host != tc.wantHost || p != tc.wantPath {
+			t.Errorf("resolve(%q) = %q, %q, %v; want %q, %q, %v", tc.path, host, p, ok, tc.wantHost, tc.wantPath, tc.ok)
+		}
+	}
+}
+
+func TestNewGatewayValidation(t *testing.T) {
+	if g, err := NewGateway(config.Gateway{Routes: config.Default().Gateway.Routes}); g != nil || err != nil {
+		t.Fatalf("disabled gateway = %v, %v", g, err)
+	}
+	bad := []config.GatewayRoute{
+		{Prefix: "/", Upstream: "https://api.openai.com"},
+		{Prefix: "/openai", Upstream: "http://api.openai.com"},
+		{Prefix: "/openai", Upstream: "https://"},
+	}
+	for _, r := range bad {
+		if _, err := NewGateway(config.Gateway{Enabled: true, Routes: []config.GatewayRoute{r}}); err == nil {
+			t.Errorf("NewGateway(%+v) expected error", r)
+		}
+	}
+}
+
+func TestGatewayMasksAndRestores(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received string
+		gotPath  string
+	)
+	provider := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received, gotPath = string(body), r.URL.Path
+		mu.Unlock()
+		if r.URL.Path == "/v1/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, "data: "+string(body)+"\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}))
+	defer provider.Close()
+
+	auditLog := &memoryAudit{}
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(nil), auditLog, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+	pr.inspector = sanitizer.NewSanitizingInspector(sanitizer.New(sanitizer.DetectorsByName([]string{"email"})))
+	gw, err := NewGateway(config.Gateway{Enabled: true, Routes: []config.GatewayRoute{{Prefix: "/openai", Upstream: provider.URL}}})
+	if err != nil {
+		t.Fatalf("NewGateway() error = %v", err)
+	}
+	pr.WithGateway(gw)
+
+	reqBody, _ := json.Marshal(map[string]string{"message": "reach me at jane.doe@example.com"})
+	for _, endpoint := range []string{"/v1/chat/completions", "/v1/stream"} {
+		t.Run(endpoint, func(t *testing.T) {
+			resp, err := http.Post(proxySrv.URL+"/openai"+endpoint, "application/json", strings.NewReader(string(reqBody)))
+			if err != nil {
+				t.Fatalf("POST error = %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			mu.Lock()
+			upstreamBody, upstreamPath := received, gotPath
+			mu.Unlock()
+			if upstreamPath != endpoint {
+				t.Fatalf("upstream path = %q, want %q", upstreamPath, endpoint)
+			}
+			if strings.Contains(upstreamBody, "jane.doe@example.com") || !strings.Contains(upstreamBody, "[EMAIL_1]") {
+				t.Fatalf("upstream received unmasked body: %s", upstreamBody)
+			}
+			if !strings.Contains(string(body), "jane.doe@example.com") || strings.Contains(string(body), "[EMAIL_1]") {
+				t.Fatalf("client received unrestored body: %s", body)
+			}
+		})
+	}
+
+	found := false
+	for _, e := range auditLog.all() {
+		if e.Path == "/v1/chat/completions" && e.Sanitized {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("missing sanitized audit entry for gateway request: %+v", auditLog.all())
+	}
+}
@@ -0,0 +1,111 @@
+package mitm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"velar/internal/policy"
+	"velar/internal/sanitizer"
+)
+
+// Headers added to responses when debug headers are enabled. A request
+// with debugRequestHeader set to "1" also gets debugReportHeader; the
+// request header is never forwarded upstream.
+const (
+	traceIDHeader      = "X-Velar-Trace-Id"
+	decisionHeader     = "X-Velar-Decision"
+	maskedHeader       = "X-Velar-Masked"
+	debugRequestHeader = "X-Velar-Debug"
+	debugReportHeader  = "X-Velar-Debug-Report"
+)
+
+// debugReport is the detection report attached for X-Velar-Debug. It never
+// holds original values.
+type debugReport struct {
+	TraceID    string                `json:"trace_id"`
+	Decision   string                `json:"decision"`
+	RuleID     string                `json:"rule_id,omitempty"`
+	Reason     string                `json:"reason,omitempty"`
+	Masked     map[string]int        `json:"masked"`
+	Detections []sanitizer.Detection `json:"detections"`
+}
+
+// debugState carries what the debug headers of one request are built from.
+// A nil debugState adds nothing.
+type debugState struct {
+	traceID string
+	report  bool
+}
+
+// newDebugState strips X-Velar-Debug from r and returns the state for its
+// response, or nil when debug headers are disabled.
+func (h *Handler) newDebugState(r *http.Request, traceID string) *debugState {
+	report := r.Header.Get(debugRequestHeader) == "1"
+	r.Header.Del(debugRequestHeader)
+	if !h.debugHeaders {
+		return nil
+	}
+	return &debugState{traceID: traceID, report: report}
+}
+
+// set adds the debug headers for decision and the masking recorded on r,
+// the request as sanitized so far, to header.
+func (d *debugState) set(header http.Header, r *http.Request, decision policy.Result) {
+	if d == nil {
+		return
+	}
+	md, _ := sanitizer.AuditMetadataFromRequest(r)
+	masked := make(map[string]int)
+	for _, item := range md.Items {
+		masked[item.Type]++
+	}
+	header.Set(traceIDHeader, d.traceID)
+	value := string(decision.Decision)
+	if decision.RuleID != "" {
+		value += "; rule=" + decision.RuleID
+	}
+	header.Set(decisionHeader, value)
+	if md.Monitor {
+		header.Set(maskedHeader, "monitor: "+maskedCounts(masked))
+	} else {
+		header.Set(maskedHeader, maskedCounts(masked))
+	}
+	if !d.report {
+		return
+	}
+	detections := md.Detections
+	if detections == nil {
+		detections = []sanitizer.Detection{}
+	}
+	report, err := json.Marshal(debugReport{
+		TraceID:    d.traceID,
+		Decision:   string(decision.Decision),
+		RuleID:     decision.RuleID,
+		Reason:     decision.Reason,
+		Masked:     masked,
+		Detections: detections,
+	})
+	if err == nil {
+		header.Set(debugReportHeader, string(report))
+	}
+}
+
+// maskedCounts formats per-type counts as "email=1, phone=2", or "none".
+func maskedCounts(masked map[string]int) string {
+	if len(masked) == 0 {
+		return "none"
+	}
+	types := make([]string, 0, len(masked))
+	for typ := range masked {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	parts := make([]string, 0, len(types))
+	for _, typ := range types {
+		parts = append(parts, fmt.Sprintf("%s=%d", typ, masked[typ]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,44 @@
+package mitm
+
+import (
+	"log"
+	"net/http"
+
+	"velar/internal/approval"
+	"velar/internal/auth"
+	"velar/internal/sanitizer"
+)
+
+// WithApprovals parks requests held by the sanitizer in q until they are
+// answered. A nil q denies them.
+func (h *Handler) WithApprovals(q *approval.Queue) *Handler {
+	h.approvals = q
+	return h
+}
+
+// HoldRequest waits in q for the answer to req, which insp held for held's
+// entity types, and inspects req again with it. outcome is the answer as
+// recorded in the audit log.
+func HoldRequest(q *approval.Queue, insp Inspector, req *http.Request, host string, held *sanitizer.HeldError) (_ *http.Request, outcome string, err error) {
+	d, answered := q.Hold(req.Context(), approval.Request{
+		Method: req.Method,
+		Host:   host,
+		Path:   req.URL.Path,
+		User:   auth.UserFromContext(req.Context()),
+		Types:  held.Types,
+	})
+	outcome = string(d)
+	if !answered {
+		outcome += " (timeout)"
+	}
+	log.Printf("MITM: held request to %s: %s", host, outcome)
+	action := sanitizer.ActionBlock
+	switch d {
+	case approval.Approve:
+		action = sanitizer.ActionAllow
+	case approval.Mask:
+		action = sanitizer.ActionMask
+	}
+	req, err = insp.InspectRequest(req.WithContext(sanitizer.ContextWithHoldDecision(req.Context(), action)))
+	return req, outcome, err
+}
@@ -2,7 +2,9 @@ package mitm
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,12 +15,19 @@ import (
 	"sync"
 	"time"
 
+	"velar/internal/approval"
 	"velar/internal/audit"
+	"velar/internal/auth"
+	"velar/internal/cache"
 	"velar/internal/classifier"
+	"velar/internal/contentcoding"
 	"velar/internal/policy"
+	"velar/internal/ratelimit"
+	"velar/internal/replay"
 	"velar/internal/sanitizer"
 	"velar/internal/session"
 	"velar/internal/trace"
+	"velar/internal/upstream"
 )
 
 const (
@@ -37,15 +46,23 @@ func (el *errorLogger) Write(p []byte) (n int, err error) {
 
 type Handler struct {
 	ca         *CAStore
-	transport  *http.Transport
+	transport  http.RoundTripper
 	inspector  Inspector
 	policy     policy.Engine
 	classifier classifier.Classifier
 	audit      audit.Logger
 	sessions   *session.Store
+	limiter    *ratelimit.Limiter
+	retrier    *upstream.Retrier
+	cache      *cache.Cache
+	recorder   *replay.Recorder
+	player     *replay.Player
+	approvals  *approval.Queue
+	// debugHeaders adds the X-Velar-* tracing headers to responses.
+	debugHeaders bool
 }
 
-func NewHandler(ca *CAStore, transport *http.Transport, p policy.Engine, cls classifier.Classifier, logger audit.Logger, insp Inspector) *Handler {
+func NewHandler(ca *CAStore, transport http.RoundTripper, p policy.Engine, cls classifier.Classifier, logger audit.Logger, insp Inspector) *Handler {
 	if insp == nil {
 		insp = PassthroughInspector{}
 	}
@@ -56,33 +73,101 @@ func NewHandler(ca *CAStore, transport *http.Transport, p policy.Engine, cls cla
 	return h
 }
 
-func (h *Handler) HandleMITM(clientConn net.Conn, host string) {
+// WithLimiter throttles every request the handler serves with l. A nil l
+// disables throttling.
+func (h *Handler) WithLimiter(l *ratelimit.Limiter) *Handler {
+	h.limiter = l
+	return h
+}
+
+// WithRetrier retries and fails over upstream requests with r. A nil r
+// sends every request once.
+func (h *Handler) WithRetrier(r *upstream.Retrier) *Handler {
+	h.retrier = r
+	return h
+}
+
+// WithCache answers repeated requests to cached hosts from c. A nil c
+// disables caching.
+func (h *Handler) WithCache(c *cache.Cache) *Handler {
+	h.cache = c
+	return h
+}
+
+// WithRecorder records every sanitized exchange with r. A nil r records
+// nothing.
+func (h *Handler) WithRecorder(r *replay.Recorder) *Handler {
+	h.recorder = r
+	return h
+}
+
+// WithReplay answers requests from the recordings in p instead of the
+// network. A nil p disables replay.
+func (h *Handler) WithReplay(p *replay.Player) *Handler {
+	h.player = p
+	return h
+}
+
+// WithDebugHeaders adds X-Velar-Trace-Id, X-Velar-Decision and
+// X-Velar-Masked to every response, and a detection report to responses to
+// requests sent with X-Velar-Debug: 1.
+func (h *Handler) WithDebugHeaders(enabled bool) *Handler {
+	h.debugHeaders = enabled
+	return h
+}
+
+// HandleMITM terminates TLS on clientConn and serves the decrypted requests.
+// Values in ctx, such as the authenticated proxy user, are visible to every
+// request served on the connection.
+func (h *Handler) HandleMITM(ctx context.Context, clientConn net.Conn, host string) {
 	log.Printf("MITM: starting for %s", host)
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	cert, err := h.ca.GetLeafCert(normalizeHost(host))
 	if err != nil {
 		log.Printf("MITM: cert error for %s: %v", host, err)
 		_ = clientConn.Close()
 		return
 	}
-	tlsClient := tls.Server(clientConn, &tls.Config{Certificates: []tls.Certificate{*cert}})
+	tlsClient := tls.Server(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
 	if err := tlsClient.Handshake(); err != nil {
 		log.Printf("MITM: handshake failed for %s: %v", host, err)
 		_ = tlsClient.Close()
 		return
 	}
+	log.Printf("MITM: negotiated protocol %q for %s", tlsClient.ConnectionState().NegotiatedProtocol, host)
 
+	// The listener must hand out the *tls.Conn itself: http.Server only
+	// switches to HTTP/2 when the accepted connection is a *tls.Conn that
+	// negotiated "h2" via ALPN.
+	listener := &singleConnListener{conn: tlsClient, done: make(chan struct{})}
 	srv := &http.Server{
 		Handler:           h.serverHandler(host),
 		ReadHeaderTimeout: 10 * time.Second,
 		IdleTimeout:       120 * time.Second,
 		ErrorLog:          log.New(io.Writer(&errorLogger{host: host}), "", 0),
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				_ = listener.Close()
+			}
+		},
 	}
-	listener := &singleConnListener{done: make(chan struct{})}
-	listener.conn = &notifyCloseConn{Conn: tlsClient, onClose: listener.Close}
 	_ = srv.Serve(listener)
 	log.Printf("MITM: completed for %s", host)
 }
 
+// Forward runs r through the same inspection, masking and restore pipeline
+// as a request received inside an intercepted tunnel and sends it to host
+// over TLS. r.URL.Path is forwarded unchanged.
+func (h *Handler) Forward(w http.ResponseWriter, r *http.Request, host string) {
+	h.serverHandler(host).ServeHTTP(w, r)
+}
+
 func (h *Handler) serverHandler(connectHost string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -104,16 +189,39 @@ func (h *Handler) serverHandler(connectHost string) http.Handler {
 
 		// Add sessionID to request context
 		r = r.WithContext(session.ContextWithID(r.Context(), sessionID))
+		debug := h.newDebugState(r, requestTrace.ID)
 
-		_ = h.classifier.Classify(host)
-		decision := h.policy.Evaluate(host)
+		policyReq := policy.HTTPRequest(host, auth.UserFromContext(r.Context()), r)
+		policyReq.Category = string(h.classifier.Classify(host))
+		decision := h.policy.EvaluateRequest(policyReq)
+		if decision.Monitor {
+			r = r.WithContext(sanitizer.ContextWithMonitor(r.Context()))
+		}
 		if decision.Decision == policy.Block {
+			debug.set(w.Header(), r, decision)
 			http.Error(w, "blocked by Velar policy", http.StatusForbidden)
 			h.logAudit(r, host, decision, "", "")
 			return
 		}
+		release, denied := h.limiter.Acquire(ratelimit.Request{Host: host, User: auth.UserFromContext(r.Context()), Client: ratelimit.ClientIP(r.RemoteAddr)})
+		if denied != nil {
+			debug.set(w.Header(), r, policy.Result{Decision: ratelimit.Decision, Reason: denied.Reason})
+			denied.Respond(w)
+			entry := h.auditEntry(r, host, decision, "", "")
+			entry.StatusCode = http.StatusTooManyRequests
+			entry.Decision = ratelimit.Decision
+			entry.Reason = denied.Reason
+			h.writeAudit(entry)
+			return
+		}
+		defer release()
+
+		if isWebSocketUpgrade(r) {
+			h.handleWebSocket(w, r, connectHost, decision)
+			return
+		}
 
-		req, reqPreview, skipInspect, err := cloneLimitedRequest(r, maxBodySize)
+		req, reqPreview, err := cloneLimitedRequest(r, maxBodySize)
 		if err != nil {
 			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
 			return
@@ -124,14 +232,7 @@ func (h *Handler) serverHandler(connectHost string) http.Handler {
 		req.Host = connectHost
 
 		// Remove hop-by-hop headers that shouldn't be forwarded
-		req.Header.Del("Connection")
-		req.Header.Del("Keep-Alive")
-		req.Header.Del("Proxy-Authenticate")
-		req.Header.Del("Proxy-Authorization")
-		req.Header.Del("TE")
-		req.Header.Del("Trailers")
-		req.Header.Del("Transfer-Encoding")
-		req.Header.Del("Upgrade")
+		removeHopByHopHeaders(req.Header)
 
 		// Ensure User-Agent is set to avoid Cloudflare challenges
 		if req.Header.Get("User-Agent") == "" {
@@ -145,9 +246,9 @@ func (h *Handler) serverHandler(connectHost string) http.Handler {
 		if req.Header.Get("Accept-Language") == "" {
 			req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 		}
-		if req.Header.Get("Accept-Encoding") == "" {
-			req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-		}
+		// Only offer codings the sanitizer can decode so that responses can
+		// be restored.
+		req.Header.Set("Accept-Encoding", contentcoding.FilterAccept(req.Header.Get("Accept-Encoding")))
 		if req.Header.Get("Referer") == "" {
 			req.Header.Set("Referer", "https://"+connectHost+"/")
 		}
@@ -162,29 +263,105 @@ func (h *Handler) serverHandler(connectHost string) http.Handler {
 		}
 
 		requestTrace.SanitizeStart = time.Now()
-		if !skipInspect {
-			req, err = h.inspector.InspectRequest(req)
-			requestTrace.SanitizeEnd = time.Now()
-			if err != nil {
-				log.Printf("MITM: InspectRequest error: %v", err)
-				http.Error(w, "request inspection failed", http.StatusBadRequest)
+		req, err = h.inspector.InspectRequest(req)
+		var held *sanitizer.HeldError
+		var approvalOutcome string
+		if errors.As(err, &held) {
+			req, approvalOutcome, err = HoldRequest(h.approvals, h.inspector, req, host, held)
+		}
+		requestTrace.SanitizeEnd = time.Now()
+		if errors.Is(err, sanitizer.ErrBlocked) {
+			log.Printf("MITM: %v", err)
+			blocked := policy.Result{Decision: policy.Block, Reason: err.Error(), RuleID: "sanitizer"}
+			debug.set(w.Header(), req, blocked)
+			sanitizer.RespondBlocked(w, err)
+			entry := h.auditEntry(req, host, blocked, "", "")
+			entry.Approval = approvalOutcome
+			h.writeAudit(entry)
+			return
+		}
+		if errors.Is(err, sanitizer.ErrUnsupportedEncoding) {
+			log.Printf("MITM: %v", err)
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			log.Printf("MITM: InspectRequest error: %v", err)
+			http.Error(w, "request inspection failed", http.StatusBadRequest)
+			return
+		}
+		if decision.NeedsDetections && sanitizer.BodyStreamed(req) {
+			// Detections in a streamed body are only known once it has
+			// been sent, too late for the condition to stop it.
+			rejected := policy.Result{Decision: policy.Block, Reason: "request body too large to evaluate policy conditions", RuleID: decision.RuleID}
+			debug.set(w.Header(), req, rejected)
+			http.Error(w, rejected.Reason, http.StatusRequestEntityTooLarge)
+			entry := h.auditEntry(req, host, rejected, "", "")
+			entry.Approval = approvalOutcome
+			h.writeAudit(entry)
+			return
+		}
+		if decision.NeedsDetections {
+			decision = h.policy.EvaluateRequest(policyReq.WithDetections(DetectionTypes(req)))
+			if decision.Decision == policy.Block {
+				debug.set(w.Header(), req, decision)
+				http.Error(w, "blocked by Velar policy", http.StatusForbidden)
+				entry := h.auditEntry(req, host, decision, "", "")
+				entry.Approval = approvalOutcome
+				h.writeAudit(entry)
 				return
 			}
-			if updatedPreview, ok := requestJSONPreview(req); ok {
-				reqPreview = updatedPreview
-			}
-		} else {
-			requestTrace.SanitizeEnd = time.Now()
-			log.Printf("sanitize skipped body size: %d", r.ContentLength)
+		}
+		if updatedPreview, ok := requestJSONPreview(req); ok {
+			reqPreview = updatedPreview
+		}
+
+		cacheKey, cacheStatus := h.cacheKey(req, host)
+		auditDone := func(reqPreview, respPreview string) {
+			entry := h.auditEntry(req, host, decision, reqPreview, respPreview)
+			entry.Cache = cacheStatus
+			entry.Approval = approvalOutcome
+			h.writeAudit(entry)
 		}
 
+		// Unmasked requests in monitor mode are not recorded.
+		var recording *replay.Recording
+		if md, _ := sanitizer.AuditMetadataFromRequest(req); !md.Monitor {
+			recording = h.recorder.Begin(req)
+		}
 		requestTrace.UpstreamStart = time.Now()
-		resp, err := h.transport.RoundTrip(req)
+		resp, source, err := h.fetch(req, host, decision, cacheKey)
+		if errors.Is(err, sanitizer.ErrBlocked) {
+			// A streamed body hit a block entity while being sent.
+			log.Printf("MITM: %v", err)
+			blocked := policy.Result{Decision: policy.Block, Reason: err.Error(), RuleID: "sanitizer"}
+			debug.set(w.Header(), req, blocked)
+			sanitizer.RespondBlocked(w, err)
+			h.logAudit(req, host, blocked, "", "")
+			return
+		}
 		if err != nil {
 			log.Printf("MITM: RoundTrip error for %s: %v", host, err)
+			debug.set(w.Header(), req, decision)
 			http.Error(w, err.Error(), http.StatusBadGateway)
+			if errors.Is(err, errNoRecording) {
+				entry := h.auditEntry(req, host, decision, reqPreview, "")
+				entry.StatusCode = http.StatusBadGateway
+				entry.Reason = err.Error()
+				h.writeAudit(entry)
+			}
 			return
 		}
+		switch source {
+		case sourceCache:
+			cacheStatus = cache.Hit
+		case sourceReplay:
+			// Recorded responses are not cached.
+			cacheStatus = ""
+		}
+		// HTTP/2 clients reject connection-specific response headers.
+		removeHopByHopHeaders(resp.Header)
+		recording.Wrap(resp)
 		if resp.StatusCode == http.StatusForbidden {
 			log.Printf("MITM: upstream 403 for %s %s%s (Cf-Mitigated: %s, Server: %s, Content-Type: %s)",
 				req.Method, host, req.URL.Path,
@@ -213,22 +390,32 @@ func (h *Handler) serverHandler(connectHost string) http.Handler {
 			requestTrace.ResponseEnd = time.Now()
 
 			copyHeader(w.Header(), resp.Header)
+			debug.set(w.Header(), req, decision)
 			w.WriteHeader(resp.StatusCode)
-			_, _ = io.Copy(w, resp.Body)
+			_ = copyStreaming(w, resp.Body)
 			_ = resp.Body.Close()
 			requestTrace.LogAt(time.Now())
-			h.logAudit(req, host, decision, reqPreview, "")
+			auditDone(reqPreview, "")
 			return
 		}
 
 		if resp.ContentLength > maxBodySize || resp.ContentLength < 0 {
-			log.Printf("response processing skipped body size: %d", resp.ContentLength)
+			// Too large to buffer; the inspector restores it as it streams.
+			log.Printf("response restored while streaming, body size: %d", resp.ContentLength)
+			defer h.sessions.Delete(sessionID)
+			resp, err = h.inspector.InspectResponse(resp)
+			if err != nil {
+				log.Printf("MITM: response inspection failed: %v", err)
+				http.Error(w, "response inspection failed", http.StatusBadGateway)
+				return
+			}
 			copyHeader(w.Header(), resp.Header)
+			debug.set(w.Header(), req, decision)
 			w.WriteHeader(resp.StatusCode)
 			_, _ = io.Copy(w, resp.Body)
 			_ = resp.Body.Close()
 			requestTrace.LogAt(time.Now())
-			h.logAudit(req, host, decision, reqPreview, "")
+			auditDone(reqPreview, "")
 			return
 		}
 
@@ -238,6 +425,9 @@ func (h *Handler) serverHandler(connectHost string) http.Handler {
 			http.Error(w, "upstream body too large", http.StatusBadGateway)
 			return
 		}
+		if cacheStatus == cache.Miss {
+			h.storeResponse(cacheKey, resp)
+		}
 		resp, err = h.inspector.InspectResponse(resp)
 		if err != nil {
 			requestTrace.ResponseEnd = time.Now()
@@ -251,12 +441,92 @@ func (h *Handler) serverHandler(connectHost string) http.Handler {
 		defer h.sessions.Delete(sessionID)
 
 		copyHeader(w.Header(), resp.Header)
+		debug.set(w.Header(), req, decision)
 		w.WriteHeader(resp.StatusCode)
 		_, _ = io.Copy(w, resp.Body)
 		_ = resp.Body.Close()
 		requestTrace.LogAt(time.Now())
-		h.logAudit(req, host, decision, reqPreview, respPreview)
+		auditDone(reqPreview, respPreview)
+	})
+}
+
+// Where fetch found a response.
+const (
+	sourceNetwork = iota
+	sourceCache
+	sourceReplay
+)
+
+var errNoRecording = errors.New("replay: no recorded response for this request")
+
+// fetch returns the response to the sanitized req from the replay file, the
+// cache or the network, in that order. Failed upstream attempts are audited
+// as they happen.
+func (h *Handler) fetch(req *http.Request, host string, decision policy.Result, cacheKey string) (*http.Response, int, error) {
+	if h.player != nil {
+		if resp, ok := h.player.Response(req); ok {
+			return resp, sourceReplay, nil
+		}
+		if !h.player.Passthrough() {
+			return nil, sourceReplay, errNoRecording
+		}
+	}
+	if resp, ok := h.cache.Lookup(cacheKey); ok {
+		resp.Request = req
+		return resp, sourceCache, nil
+	}
+	resp, err := h.retrier.RoundTrip(h.transport, req, func(a upstream.Attempt) {
+		log.Printf("MITM: %s", a.Reason())
+		entry := h.auditEntry(req, normalizeHost(a.Target), decision, "", "")
+		entry.StatusCode = a.StatusCode
+		entry.Decision = a.Decision()
+		entry.Reason = a.Reason()
+		h.writeAudit(entry)
 	})
+	return resp, sourceNetwork, err
+}
+
+// cacheKey returns the cache key for the sanitized req and cache.Miss when
+// host is cached and the body is small enough to key on, or two empty
+// strings otherwise.
+func (h *Handler) cacheKey(req *http.Request, host string) (string, string) {
+	if !h.cache.Enabled(host) {
+		return "", ""
+	}
+	if md, _ := sanitizer.AuditMetadataFromRequest(req); md.Monitor {
+		// Requests forwarded unmasked in monitor mode are never cached.
+		return "", ""
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength < 0 || req.ContentLength > maxBodySize {
+			return "", ""
+		}
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return "", ""
+		}
+	}
+	return cache.Key(req, host, auth.UserFromContext(req.Context()), body), cache.Miss
+}
+
+// storeResponse saves the buffered upstream response, before restoration,
+// under key.
+func (h *Handler) storeResponse(key string, resp *http.Response) {
+	if resp.Body == nil {
+		return
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	if err := h.cache.Store(key, resp, body); err != nil {
+		log.Printf("MITM: %v", err)
+	}
 }
 
 func (h *Handler) restoreResponse(resp *http.Response, sessionID string) *http.Response {
@@ -280,8 +550,9 @@ func (h *Handler) restoreResponse(resp *http.Response, sessionID string) *http.R
 		return resp
 	}
 
-	// Skip compressed responses — cannot do text replacement on encoded content
-	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+	// Skip bodies in codings that cannot be decoded.
+	codings, supported := contentcoding.Parse(resp.Header.Get("Content-Encoding"))
+	if !supported {
 		return resp
 	}
 
@@ -309,6 +580,18 @@ func (h *Handler) restoreResponse(resp *http.Response, sessionID string) *http.R
 		return resp
 	}
 
+	if len(codings) > 0 {
+		plain, err := contentcoding.Decode(body, codings, limit)
+		if err != nil {
+			log.Printf("MITM: cannot decode %s response for restore: %v", strings.Join(codings, ", "), err)
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			return resp
+		}
+		// The restored body is sent to the client uncompressed.
+		body = plain
+		resp.Header.Del("Content-Encoding")
+	}
+
 	// Apply restoration
 	restored := string(body)
 	for placeholder, original := range sess.Mapping {
@@ -328,17 +611,37 @@ func (h *Handler) restoreResponse(resp *http.Response, sessionID string) *http.R
 }
 
 func (h *Handler) logAudit(r *http.Request, host string, decision policy.Result, reqPreview, respPreview string) {
-	if h.audit == nil {
-		return
+	h.writeAudit(h.auditEntry(r, host, decision, reqPreview, respPreview))
+}
+
+// DetectionTypes returns the entity type of each sanitizer detection in r,
+// for re-evaluating rules whose condition depends on them.
+func DetectionTypes(r *http.Request) []string {
+	md, _ := sanitizer.AuditMetadataFromRequest(r)
+	types := make([]string, len(md.Detections))
+	for i, d := range md.Detections {
+		types[i] = d.Type
 	}
-	entry := audit.Entry{Method: r.Method, Host: host, Path: r.URL.Path, Decision: string(decision.Decision), Reason: fmt.Sprintf("%s (%s)", decision.Reason, decision.RuleID), RequestBodyPreview: reqPreview, ResponseBodyPreview: respPreview}
-	if md, ok := sanitizer.AuditMetadataFromRequest(r); ok && md.Sanitized {
-		entry.Sanitized = true
-		entry.SanitizedItems = make([]audit.SanitizedAudit, 0, len(md.Items))
-		for _, item := range md.Items {
-			entry.SanitizedItems = append(entry.SanitizedItems, audit.SanitizedAudit{Type: item.Type, Placeholder: item.Placeholder})
+	return types
+}
+
+func (h *Handler) auditEntry(r *http.Request, host string, decision policy.Result, reqPreview, respPreview string) audit.Entry {
+	entry := audit.Entry{Method: r.Method, Host: host, User: auth.UserFromContext(r.Context()), Path: r.URL.Path, Decision: string(decision.Decision), Reason: fmt.Sprintf("%s (%s)", decision.Reason, decision.RuleID), RequestBodyPreview: reqPreview, ResponseBodyPreview: respPreview}
+	if md, ok := sanitizer.AuditMetadataFromRequest(r); ok {
+		entry.Sanitized = md.Sanitized
+		entry.Monitor = md.Monitor
+		entry.SanitizedItems = append(sanitizedAudit(md.Items), findingsAudit(md.Findings)...)
+		if len(entry.SanitizedItems) == 0 {
+			entry.SanitizedItems = nil
 		}
 	}
+	return entry
+}
+
+func (h *Handler) writeAudit(entry audit.Entry) {
+	if h.audit == nil {
+		return
+	}
 	_ = h.audit.Log(entry)
 }
 
@@ -351,7 +654,8 @@ func isStreamingResponse(resp *http.Response) bool {
 }
 
 func requestJSONPreview(r *http.Request) (string, bool) {
-	if r.Body == nil {
+	// Streamed bodies are not buffered for the preview.
+	if r.Body == nil || r.ContentLength < 0 || r.ContentLength > maxBodySize {
 		return "", false
 	}
 	body, err := io.ReadAll(r.Body)
@@ -362,39 +666,70 @@ func requestJSONPreview(r *http.Request) (string, bool) {
 	if !strings.Contains(strings.ToLower(r.Header.Get("Content-Type")), "application/json") {
 		return "", false
 	}
-	preview := string(body)
+	return bodyPreview(body, r.Header), true
+}
+
+// bodyPreview returns the start of body for the audit log, decoding it
+// first when it carries a supported Content-Encoding.
+func bodyPreview(body []byte, header http.Header) string {
+	preview := body
+	if codings, supported := contentcoding.Parse(header.Get("Content-Encoding")); len(codings) > 0 {
+		if !supported {
+			return ""
+		}
+		decoded, err := io.ReadAll(io.LimitReader(contentcoding.NewReader(io.NopCloser(bytes.NewReader(body)), codings), maxAuditBodySize))
+		if err != nil && len(decoded) == 0 {
+			return ""
+		}
+		preview = decoded
+	}
 	if len(preview) > maxAuditBodySize {
 		preview = preview[:maxAuditBodySize]
 	}
-	preview = strings.ReplaceAll(preview, "\n", "")
-	return preview, true
+	return strings.ReplaceAll(string(preview), "\n", "")
 }
 
-func cloneLimitedRequest(r *http.Request, limit int64) (*http.Request, string, bool, error) {
+// cloneLimitedRequest buffers bodies up to limit. Larger bodies are left
+// streaming and the inspector sanitizes them as they are forwarded.
+func cloneLimitedRequest(r *http.Request, limit int64) (*http.Request, string, error) {
 	out := r.Clone(r.Context())
 	if r.Body == nil {
-		return out, "", false, nil
+		return out, "", nil
 	}
-	if r.ContentLength > limit || r.ContentLength < 0 {
+	if r.ContentLength > limit {
 		out.Body = r.Body
 		out.ContentLength = r.ContentLength
-		return out, "", true, nil
+		return out, "", nil
 	}
-	body, preview, err := readLimitedBody(r.Body, r.Header.Get("Content-Type"), limit)
+	if r.ContentLength < 0 {
+		// HTTP/2 streams and chunked HTTP/1.1 bodies may omit Content-Length.
+		// Buffer up to the limit so small ones get a known length.
+		head, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			return nil, "", err
+		}
+		if int64(len(head)) > limit {
+			out.Body = &prefixedReadCloser{Reader: io.MultiReader(bytes.NewReader(head), r.Body), Closer: r.Body}
+			out.ContentLength = -1
+			return out, "", nil
+		}
+		r.Body = io.NopCloser(bytes.NewReader(head))
+	}
+	body, preview, err := readLimitedBody(r.Body, r.Header, limit)
 	if err != nil {
-		return nil, "", false, err
+		return nil, "", err
 	}
 	r.Body = io.NopCloser(bytes.NewReader(body))
 	out.Body = io.NopCloser(bytes.NewReader(body))
 	out.ContentLength = int64(len(body))
-	return out, preview, false, nil
+	return out, preview, nil
 }
 
 func cloneLimitedResponse(r *http.Response, limit int64) (*http.Response, string, error) {
 	if r.Body == nil {
 		return r, "", nil
 	}
-	body, preview, err := readLimitedBody(r.Body, r.Header.Get("Content-Type"), limit)
+	body, preview, err := readLimitedBody(r.Body, r.Header, limit)
 	if err != nil {
 		return nil, "", err
 	}
@@ -403,7 +738,7 @@ func cloneLimitedResponse(r *http.Response, limit int64) (*http.Response, string
 	return r, preview, nil
 }
 
-func readLimitedBody(rc io.ReadCloser, contentType string, limit int64) ([]byte, string, error) {
+func readLimitedBody(rc io.ReadCloser, header http.Header, limit int64) ([]byte, string, error) {
 	defer rc.Close()
 	body, err := io.ReadAll(io.LimitReader(rc, limit+1))
 	if err != nil {
@@ -412,15 +747,10 @@ func readLimitedBody(rc io.ReadCloser, contentType string, limit int64) ([]byte,
 	if int64(len(body)) > limit {
 		return nil, "", fmt.Errorf("body exceeds limit")
 	}
-	if !strings.Contains(strings.ToLower(contentType), "application/json") {
+	if !strings.Contains(strings.ToLower(header.Get("Content-Type")), "application/json") {
 		return body, "", nil
 	}
-	preview := string(body)
-	if len(preview) > maxAuditBodySize {
-		preview = preview[:maxAuditBodySize]
-	}
-	preview = strings.ReplaceAll(preview, "\n", "")
-	return body, preview, nil
+	return body, bodyPreview(body, header), nil
 }
 
 type singleConnListener struct {
@@ -458,23 +788,63 @@ func (l *singleConnListener) Addr() net.Addr {
 	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}
 }
 
-// notifyCloseConn wraps a net.Conn and calls onClose when Close is called.
-// When http.Server closes the connection (idle timeout, client disconnect),
-// this triggers listener.Close() which unblocks Accept() and lets Serve return.
-type notifyCloseConn struct {
-	net.Conn
-	closeOnce sync.Once
-	onClose   func() error
+// prefixedReadCloser replays bytes already consumed from a body before the
+// remainder of the original stream, closing the original on Close.
+type prefixedReadCloser struct {
+	io.Reader
+	io.Closer
 }
 
-func (c *notifyCloseConn) Close() error {
-	err := c.Conn.Close()
-	c.closeOnce.Do(func() {
-		if c.onClose != nil {
-			_ = c.onClose()
+// hopByHopHeaders are connection-scoped and must not be forwarded in either
+// direction (RFC 9110 section 7.6.1). HTTP/2 peers treat them as malformed.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopByHopHeaders(h http.Header) {
+	for _, name := range h.Values("Connection") {
+		for _, token := range strings.Split(name, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				h.Del(token)
+			}
 		}
-	})
-	return err
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// copyStreaming copies src to w and flushes after every chunk so restored
+// SSE events reach HTTP/1.1 and HTTP/2 clients without waiting for buffers
+// to fill.
+func copyStreaming(w http.ResponseWriter, src io.Reader) error {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
 
 func normalizeHost(hostport string) string {
@@ -2,24 +2,55 @@ package mitm
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"velar/internal/approval"
+	"velar/internal/audit"
+	"velar/internal/cache"
 	"velar/internal/classifier"
+	"velar/internal/config"
+	"velar/internal/contentcoding"
 	"velar/internal/policy"
+	"velar/internal/ratelimit"
+	"velar/internal/replay"
 	"velar/internal/sanitizer"
+	"velar/internal/upstream"
 )
 
 type noopAudit struct{}
 
+type recordingAudit struct {
+	mu      sync.Mutex
+	entries []audit.Entry
+}
+
+func (a *recordingAudit) Log(e audit.Entry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = append(a.entries, e)
+	return nil
+}
+
+func (a *recordingAudit) all() []audit.Entry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]audit.Entry(nil), a.entries...)
+}
+
 func (noopAudit) Log(_ interface{}) error { return nil }
 
 type rewriteInspector struct{}
@@ -287,3 +318,715 @@ func TestStreamingResponseSkipsInspectionAndRestore(t *testing.T) {
 		t.Fatalf("stream body mismatch: %q", got)
 	}
 }
+
+func TestUnknownLengthRequestBodyIsInspected(t *testing.T) {
+	var gotBody []byte
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	s := sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}})
+	h := NewHandler(
+		NewCAStore(t.TempDir()),
+		&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		policy.NewRuleEngine(nil),
+		classifier.HostClassifier{},
+		nil,
+		sanitizer.NewSanitizingInspector(s),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "https://proxy/", io.NopCloser(strings.NewReader(`{"prompt":"mail stream@example.com"}`)))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	h.serverHandler(upstream.Listener.Addr().String()).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if !strings.Contains(string(gotBody), "[EMAIL_1]") {
+		t.Fatalf("expected sanitized body for unknown-length request, got %q", gotBody)
+	}
+}
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Custom-Hop")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("X-Custom-Hop", "1")
+	h.Set("Content-Type", "application/json")
+
+	removeHopByHopHeaders(h)
+
+	for _, name := range []string{"Connection", "Keep-Alive", "X-Custom-Hop"} {
+		if h.Get(name) != "" {
+			t.Fatalf("expected %s to be removed", name)
+		}
+	}
+	if h.Get("Content-Type") != "application/json" {
+		t.Fatalf("end-to-end header was removed")
+	}
+}
+
+func TestCompressedBodiesAreSanitizedAndRestored(t *testing.T) {
+	var (
+		mu             sync.Mutex
+		gotBody        []byte
+		acceptEncoding string
+	)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		plain, err := contentcoding.Decode(raw, []string{"gzip"}, 1<<20)
+		if err != nil {
+			t.Errorf("upstream could not decode request: %v", err)
+		}
+		mu.Lock()
+		gotBody, acceptEncoding = plain, r.Header.Get("Accept-Encoding")
+		mu.Unlock()
+
+		echo, _ := contentcoding.Encode(plain, []string{"gzip"})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(echo)
+	}))
+	defer upstream.Close()
+
+	audits := &recordingAudit{}
+	h := NewHandler(
+		NewCAStore(t.TempDir()),
+		&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		policy.NewRuleEngine(nil),
+		classifier.HostClassifier{},
+		audits,
+		sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}})),
+	)
+
+	compressed, _ := contentcoding.Encode([]byte(`{"content":"zip@example.com"}`), []string{"gzip"})
+	req := httptest.NewRequest(http.MethodPost, "https://proxy/", bytes.NewReader(compressed))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "compress, gzip")
+	rec := httptest.NewRecorder()
+
+	h.serverHandler(upstream.Listener.Addr().String()).ServeHTTP(rec, req)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if acceptEncoding != "gzip" {
+		t.Fatalf("upstream Accept-Encoding = %q, want gzip", acceptEncoding)
+	}
+	if !strings.Contains(string(gotBody), "[EMAIL_1]") || strings.Contains(string(gotBody), "zip@example.com") {
+		t.Fatalf("upstream received unsanitized body %q", gotBody)
+	}
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != `{"content":"zip@example.com"}` {
+		t.Fatalf("client got %q (Content-Encoding %q)", rec.Body.String(), rec.Header().Get("Content-Encoding"))
+	}
+	entries := audits.all()
+	if len(entries) != 1 || !strings.Contains(entries[0].RequestBodyPreview, "[EMAIL_1]") {
+		t.Fatalf("audit preview should be decoded, got %+v", entries)
+	}
+}
+
+func TestServerHandlerRejectsUnsupportedContentEncoding(t *testing.T) {
+	var called bool
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer upstream.Close()
+
+	h := NewHandler(
+		NewCAStore(t.TempDir()),
+		&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		policy.NewRuleEngine(nil),
+		classifier.HostClassifier{},
+		&recordingAudit{},
+		sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}})),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "https://proxy/", strings.NewReader("opaque"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "compress")
+	rec := httptest.NewRecorder()
+
+	h.serverHandler(upstream.Listener.Addr().String()).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, want 415", rec.Code)
+	}
+	if called {
+		t.Fatal("request in an unsupported encoding reached upstream")
+	}
+}
+
+func TestServerHandlerThrottlesInterceptedRequests(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer upstream.Close()
+
+	limiter, err := ratelimit.New([]config.RateLimit{{Scope: "host", MaxInFlight: 1}})
+	if err != nil {
+		t.Fatalf("ratelimit.New() error = %v", err)
+	}
+	logger := &recordingAudit{}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, policy.NewRuleEngine(nil), classifier.HostClassifier{}, logger, nil).WithLimiter(limiter)
+	handler := h.serverHandler(upstream.Listener.Addr().String())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "https://proxy/first", nil))
+	}()
+	<-started
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "https://proxy/second", nil))
+	close(release)
+	<-done
+
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("status=%d Retry-After=%q, want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	var throttled []audit.Entry
+	for _, e := range logger.all() {
+		if e.Decision == ratelimit.Decision {
+			throttled = append(throttled, e)
+		}
+	}
+	if len(throttled) != 1 || throttled[0].Path != "/second" || throttled[0].StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("throttle audit entries = %+v", throttled)
+	}
+}
+
+func TestServerHandlerRetriesAndAuditsAttempts(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	retrier, err := upstream.NewRetrier([]config.UpstreamRetry{{Host: "127.0.0.1", Attempts: 2, BackoffMS: 1}})
+	if err != nil {
+		t.Fatalf("upstream.NewRetrier() error = %v", err)
+	}
+	logger := &recordingAudit{}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, policy.NewRuleEngine(nil), classifier.HostClassifier{}, logger, nil).WithRetrier(retrier)
+	handler := h.serverHandler(backend.Listener.Addr().String())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "https://proxy/v1/chat", strings.NewReader(`{"model":"x"}`)))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("status=%d body=%q, want 200 ok after retry", rec.Code, rec.Body.String())
+	}
+	entries := logger.all()
+	if len(entries) != 2 {
+		t.Fatalf("audit entries = %+v, want the retry and the final request", entries)
+	}
+	if entries[0].Decision != "retry" || entries[0].StatusCode != http.StatusServiceUnavailable || !strings.Contains(entries[0].Reason, "returned 503") {
+		t.Fatalf("retry audit entry = %+v", entries[0])
+	}
+	if entries[1].Decision != string(policy.Allow) {
+		t.Fatalf("final audit entry = %+v", entries[1])
+	}
+}
+
+func TestServerHandlerCachesSanitizedResponses(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	responseCache, err := cache.New(config.Cache{Enabled: true, Dir: dir, Hosts: []string{"127.0.0.1"}, TTLSeconds: 60, MaxEntryBytes: 1 << 20, MaxSizeMB: 1})
+	if err != nil {
+		t.Fatalf("cache.New() error = %v", err)
+	}
+	logger := &recordingAudit{}
+	inspector := sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}}))
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, policy.NewRuleEngine(nil), classifier.HostClassifier{}, logger, inspector).WithCache(responseCache)
+	handler := h.serverHandler(backend.Listener.Addr().String())
+
+	for _, email := range []string{"first@example.com", "second@example.com"} {
+		req := httptest.NewRequest(http.MethodPost, "https://proxy/v1/chat", strings.NewReader(`{"content":"`+email+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), email) {
+			t.Fatalf("response for %s = %d %q, want it restored with the caller's email", email, rec.Code, rec.Body.String())
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("upstream calls = %d, want 1", calls.Load())
+	}
+
+	var stored []string
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			data, _ := os.ReadFile(path)
+			var entry struct{ Body []byte }
+			_ = json.Unmarshal(data, &entry)
+			stored = append(stored, string(entry.Body))
+		}
+		return nil
+	})
+	if len(stored) != 1 || !strings.Contains(stored[0], "[EMAIL_1]") || strings.Contains(stored[0], "example.com") {
+		t.Fatalf("cached bodies = %q, want one entry with placeholders only", stored)
+	}
+
+	entries := logger.all()
+	if len(entries) != 2 || entries[0].Cache != cache.Miss || entries[1].Cache != cache.Hit {
+		t.Fatalf("audit entries = %+v, want a miss then a hit", entries)
+	}
+}
+
+func TestServerHandlerServesCachedResponsesAcrossAcceptEncodings(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			_, _ = io.WriteString(w, `{"reply":"hello"}`)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		_, _ = io.WriteString(zw, `{"reply":"hello"}`)
+		_ = zw.Close()
+	}))
+	defer backend.Close()
+
+	responseCache, err := cache.New(config.Cache{Enabled: true, Dir: t.TempDir(), Hosts: []string{"127.0.0.1"}, TTLSeconds: 60, MaxEntryBytes: 1 << 20, MaxSizeMB: 1})
+	if err != nil {
+		t.Fatalf("cache.New() error = %v", err)
+	}
+	logger := &recordingAudit{}
+	inspector := sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}}))
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, policy.NewRuleEngine(nil), classifier.HostClassifier{}, logger, inspector).WithCache(responseCache)
+	handler := h.serverHandler(backend.Listener.Addr().String())
+
+	// The requests differ only in Accept-Encoding; the second, which
+	// accepts no coding, is answered from the entry the first stored.
+	for _, acceptEncoding := range []string{"gzip", ""} {
+		req := httptest.NewRequest(http.MethodPost, "https://proxy/v1/chat", strings.NewReader(`{"content":"hi"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if acceptEncoding == "" && (rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != `{"reply":"hello"}`) {
+			t.Fatalf("cached response = %q with Content-Encoding %q, want it readable without a coding", rec.Body.String(), rec.Header().Get("Content-Encoding"))
+		}
+	}
+	entries := logger.all()
+	if len(entries) != 2 || entries[0].Cache != cache.Miss || entries[1].Cache != cache.Hit {
+		t.Fatalf("audit entries = %+v, want a miss then a hit", entries)
+	}
+}
+
+func TestServerHandlerRecordsAndReplaysSanitizedExchanges(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}))
+	addr := backend.Listener.Addr().String()
+	newHandler := func() *Handler {
+		inspector := sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}}))
+		transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		return NewHandler(NewCAStore(t.TempDir()), transport, policy.NewRuleEngine(nil), classifier.HostClassifier{}, nil, inspector)
+	}
+	send := func(h *Handler, email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "https://proxy/v1/chat", strings.NewReader(`{"content":"`+email+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.serverHandler(addr).ServeHTTP(rec, req)
+		return rec
+	}
+
+	path := filepath.Join(t.TempDir(), "fixture.har")
+	recorder, err := replay.NewRecorder(path)
+	if err != nil {
+		t.Fatalf("replay.NewRecorder() error = %v", err)
+	}
+	if rec := send(newHandler().WithRecorder(recorder), "first@example.com"); rec.Code != http.StatusOK {
+		t.Fatalf("recorded request status = %d", rec.Code)
+	}
+	_ = recorder.Close()
+	raw, _ := os.ReadFile(path)
+	if !strings.Contains(string(raw), "[EMAIL_1]") || strings.Contains(string(raw), "first@example.com") {
+		t.Fatalf("recording = %s, want placeholders only", raw)
+	}
+
+	backend.Close()
+	exchanges, err := replay.ReadFile(path)
+	if err != nil {
+		t.Fatalf("replay.ReadFile() error = %v", err)
+	}
+	player, err := replay.NewPlayer(exchanges, false, false)
+	if err != nil {
+		t.Fatalf("replay.NewPlayer() error = %v", err)
+	}
+	h := newHandler().WithReplay(player)
+	if rec := send(h, "second@example.com"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "second@example.com") {
+		t.Fatalf("replayed response = %d %q, want it restored with the new email", rec.Code, rec.Body.String())
+	}
+	req := httptest.NewRequest(http.MethodGet, "https://proxy/v1/models", nil)
+	rec := httptest.NewRecorder()
+	h.serverHandler(addr).ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("unrecorded request status = %d, want 502", rec.Code)
+	}
+}
+
+func TestServerHandlerDebugHeaders(t *testing.T) {
+	var forwardedDebug atomic.Value
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedDebug.Store(r.Header.Get("X-Velar-Debug"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer backend.Close()
+
+	inspector := sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}}))
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, policy.NewRuleEngine(nil), classifier.HostClassifier{}, &recordingAudit{}, inspector).WithDebugHeaders(true)
+	handler := h.serverHandler(backend.Listener.Addr().String())
+
+	req := httptest.NewRequest(http.MethodPost, "https://proxy/v1/chat", strings.NewReader(`{"content":"mail a@example.com and b@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Velar-Debug", "1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if got, _ := forwardedDebug.Load().(string); got != "" {
+		t.Fatalf("upstream saw X-Velar-Debug = %q, want it stripped", got)
+	}
+	if rec.Header().Get("X-Velar-Trace-Id") == "" {
+		t.Fatal("missing X-Velar-Trace-Id")
+	}
+	if got := rec.Header().Get("X-Velar-Decision"); got != "allow; rule=default" {
+		t.Fatalf("X-Velar-Decision = %q, want allow; rule=default", got)
+	}
+	if got := rec.Header().Get("X-Velar-Masked"); got != "email=2" {
+		t.Fatalf("X-Velar-Masked = %q, want email=2", got)
+	}
+	raw := rec.Header().Get("X-Velar-Debug-Report")
+	if strings.Contains(raw, "example.com") {
+		t.Fatalf("debug report contains original values: %s", raw)
+	}
+	var report debugReport
+	if err := json.Unmarshal([]byte(raw), &report); err != nil {
+		t.Fatalf("decode debug report %q: %v", raw, err)
+	}
+	if report.TraceID != rec.Header().Get("X-Velar-Trace-Id") || len(report.Detections) != 2 {
+		t.Fatalf("report = %+v, want two detections under the response trace ID", report)
+	}
+	first := report.Detections[0]
+	if first.Type != "email" || first.Placeholder != "[EMAIL_1]" || first.Field != "body.content" || first.Start != 5 || first.End != 18 || first.Source == "" {
+		t.Fatalf("first detection = %+v", first)
+	}
+
+	// Without X-Velar-Debug only the summary headers are added.
+	plain := httptest.NewRequest(http.MethodGet, "https://proxy/v1/models", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, plain)
+	if rec.Header().Get("X-Velar-Masked") != "none" || rec.Header().Get("X-Velar-Debug-Report") != "" {
+		t.Fatalf("headers = %v, want masked none and no report", rec.Header())
+	}
+}
+
+func TestServerHandlerOmitsDebugHeadersByDefault(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, policy.NewRuleEngine(nil), classifier.HostClassifier{}, &recordingAudit{}, nil)
+	req := httptest.NewRequest(http.MethodGet, "https://proxy/", nil)
+	req.Header.Set("X-Velar-Debug", "1")
+	rec := httptest.NewRecorder()
+	h.serverHandler(backend.Listener.Addr().String()).ServeHTTP(rec, req)
+	for name := range rec.Header() {
+		if strings.HasPrefix(name, "X-Velar-") {
+			t.Fatalf("unexpected header %s without debug headers enabled", name)
+		}
+	}
+}
+
+func TestServerHandlerMonitorRuleForwardsUnmasked(t *testing.T) {
+	var upstreamBody atomic.Value
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstreamBody.Store(string(body))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"reply":"[EMAIL_1]"}`))
+	}))
+	defer backend.Close()
+
+	logger := &recordingAudit{}
+	inspector := sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}}))
+	engine := policy.NewRuleEngine([]config.Rule{{ID: "new-team", Match: config.Match{Host: "127.0.0.1"}, Action: "mitm", Monitor: true}})
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, engine, classifier.HostClassifier{}, logger, inspector)
+
+	body := `{"content":"john@example.com"}`
+	req := httptest.NewRequest(http.MethodPost, "https://proxy/v1/chat", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.serverHandler(backend.Listener.Addr().String()).ServeHTTP(rec, req)
+
+	if got, _ := upstreamBody.Load().(string); got != body {
+		t.Fatalf("upstream body = %q, want the original %q", got, body)
+	}
+	if !strings.Contains(rec.Body.String(), "[EMAIL_1]") {
+		t.Fatalf("response = %q, want it unrestored", rec.Body.String())
+	}
+	entries := logger.all()
+	if len(entries) != 1 || !entries[0].Monitor || entries[0].Sanitized || len(entries[0].SanitizedItems) != 1 || entries[0].SanitizedItems[0].Type != "email" {
+		t.Fatalf("audit entries = %+v, want one monitored entry with the would-be email", entries)
+	}
+}
+
+func TestServerHandlerAppliesRequestRules(t *testing.T) {
+	var upstreamPaths []string
+	var mu sync.Mutex
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		upstreamPaths = append(upstreamPaths, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+
+	logger := &recordingAudit{}
+	inspector := sanitizer.NewSanitizingInspector(sanitizer.New(nil))
+	engine := policy.NewRuleEngine([]config.Rule{
+		{ID: "block-uploads", Match: config.Match{Host: "127.0.0.1", Methods: []string{"POST"}, Path: "/v1/files"}, Action: "block"},
+		{ID: "openai", Match: config.Match{Host: "127.0.0.1"}, Action: "mitm"},
+	})
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, engine, classifier.HostClassifier{}, logger, inspector)
+
+	for path, want := range map[string]int{"/v1/files": http.StatusForbidden, "/v1/chat/completions": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodPost, "https://proxy"+path, strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.serverHandler(backend.Listener.Addr().String()).ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("POST %s status = %d, want %d", path, rec.Code, want)
+		}
+	}
+	if want := []string{"/v1/chat/completions"}; !reflect.DeepEqual(upstreamPaths, want) {
+		t.Fatalf("upstream paths = %v, want %v", upstreamPaths, want)
+	}
+	blocked := 0
+	for _, e := range logger.all() {
+		if e.Decision == string(policy.Block) && e.Path == "/v1/files" && strings.Contains(e.Reason, "block-uploads") {
+			blocked++
+		}
+	}
+	if blocked != 1 {
+		t.Fatalf("audit entries = %+v, want one block of the upload", logger.all())
+	}
+}
+
+func TestServerHandlerAppliesDetectionConditionAfterInspection(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+
+	logger := &recordingAudit{}
+	inspector := sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}}))
+	engine, err := policy.Compile([]config.Rule{
+		{ID: "many-emails", When: `request.path.startsWith("/v1/") && detections.count("email") > 1`, Action: "block"},
+		{ID: "allow-rest", Action: "mitm"},
+	})
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, engine, classifier.HostClassifier{}, logger, inspector)
+
+	for body, want := range map[string]int{
+		`{"content":"a@example.com"}`:                   http.StatusOK,
+		`{"content":"a@example.com and b@example.com"}`: http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "https://proxy/v1/chat", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.serverHandler(backend.Listener.Addr().String()).ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("%s: status = %d, want %d", body, rec.Code, want)
+		}
+	}
+	if upstreamCalls.Load() != 1 {
+		t.Fatalf("upstream calls = %d, want only the allowed request", upstreamCalls.Load())
+	}
+	reasons := map[string]bool{}
+	for _, e := range logger.all() {
+		reasons[e.Decision+" "+e.Reason] = true
+	}
+	if !reasons["block matched rule (many-emails)"] || !reasons["mitm matched rule (allow-rest)"] {
+		t.Fatalf("audit decisions = %v", reasons)
+	}
+}
+
+func TestServerHandlerRejectsStreamedBodyUnderDetectionCondition(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	logger := &recordingAudit{}
+	inspector := sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}}))
+	engine, err := policy.Compile([]config.Rule{
+		{ID: "no-emails", When: `detections.count("email") > 0`, Action: "block"},
+		{ID: "allow-rest", Action: "mitm"},
+	})
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, engine, classifier.HostClassifier{}, logger, inspector)
+
+	// A chunked body over the sanitizer's buffer limit is sanitized while
+	// it streams upstream, after the condition would have to stop it.
+	payload := `{"content":"john@example.com ` + strings.Repeat("x", 300*1024) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "https://proxy/v1/chat", struct{ io.Reader }{strings.NewReader(payload)})
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.serverHandler(backend.Listener.Addr().String()).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", rec.Code)
+	}
+	if upstreamCalls.Load() != 0 {
+		t.Fatal("streamed body reached upstream")
+	}
+	entries := logger.all()
+	if len(entries) != 1 || entries[0].Decision != string(policy.Block) || !strings.Contains(entries[0].Reason, "no-emails") {
+		t.Fatalf("audit entries = %+v, want one block naming no-emails", entries)
+	}
+}
+
+func TestServerHandlerEntityBlockRespondsWithJSONError(t *testing.T) {
+	var upstreamCalled atomic.Bool
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalled.Store(true)
+	}))
+	defer backend.Close()
+
+	logger := &recordingAudit{}
+	inspector := sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}, sanitizer.PhoneDetector{}})).WithEntityActions([]sanitizer.EntityAction{
+		{Type: "email", Action: sanitizer.ActionBlock},
+		{Type: "phone", Action: sanitizer.ActionWarn},
+	})
+	engine := policy.NewRuleEngine([]config.Rule{{ID: "mitm", Match: config.Match{Host: "127.0.0.1"}, Action: "mitm"}})
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, engine, classifier.HostClassifier{}, logger, inspector)
+
+	req := httptest.NewRequest(http.MethodPost, "https://proxy/v1/chat", strings.NewReader(`{"content":"john@example.com, +1 555 123 4567"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.serverHandler(backend.Listener.Addr().String()).ServeHTTP(rec, req)
+
+	if upstreamCalled.Load() {
+		t.Fatal("blocked request reached upstream")
+	}
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("response = %d %q, want a 403 JSON error", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if want := `"type":"velar_blocked"`; !strings.Contains(rec.Body.String(), want) || !strings.Contains(rec.Body.String(), `"entities":["email"]`) {
+		t.Fatalf("response body = %s", rec.Body.String())
+	}
+	entries := logger.all()
+	if len(entries) != 1 || entries[0].Decision != string(policy.Block) {
+		t.Fatalf("audit entries = %+v, want one block", entries)
+	}
+	actions := map[string]string{}
+	for _, item := range entries[0].SanitizedItems {
+		actions[item.Type] = item.Action
+	}
+	if actions["email"] != sanitizer.ActionBlock || actions["phone"] != sanitizer.ActionWarn {
+		t.Fatalf("audited items = %+v, want email blocked and phone warned", entries[0].SanitizedItems)
+	}
+}
+
+func TestServerHandlerHoldsRequestUntilApproved(t *testing.T) {
+	var upstreamBody atomic.Value
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstreamBody.Store(string(body))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer backend.Close()
+
+	logger := &recordingAudit{}
+	inspector := sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}})).WithEntityActions([]sanitizer.EntityAction{
+		{Type: "email", Action: sanitizer.ActionHold},
+	})
+	queue, err := approval.New(config.Approvals{TimeoutSeconds: 30, OnTimeout: "deny"})
+	if err != nil {
+		t.Fatalf("approval.New() error = %v", err)
+	}
+	engine := policy.NewRuleEngine([]config.Rule{{ID: "mitm", Match: config.Match{Host: "127.0.0.1"}, Action: "mitm"}})
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	h := NewHandler(NewCAStore(t.TempDir()), transport, engine, classifier.HostClassifier{}, logger, inspector).WithApprovals(queue)
+
+	go func() {
+		for {
+			if pending := queue.Pending(); len(pending) > 0 {
+				_ = queue.Resolve(pending[0].ID, approval.Approve)
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	body := `{"content":"john@example.com"}`
+	req := httptest.NewRequest(http.MethodPost, "https://proxy/v1/chat", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.serverHandler(backend.Listener.Addr().String()).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := upstreamBody.Load().(string); got != body {
+		t.Fatalf("upstream body = %q, want the approved original %q", got, body)
+	}
+	entries := logger.all()
+	if len(entries) != 1 || entries[0].Approval != "approve" || len(entries[0].SanitizedItems) != 1 || entries[0].SanitizedItems[0].Action != sanitizer.ActionAllow {
+		t.Fatalf("audit entries = %+v, want one approved entry", entries)
+	}
+}
@@ -0,0 +1,352 @@
+package mitm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"velar/internal/audit"
+	"velar/internal/policy"
+	"velar/internal/sanitizer"
+	"velar/internal/session"
+)
+
+const (
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpClose        byte = 0x8
+
+	// wsClosePolicyViolation is the close code sent when a message is
+	// rejected by an entity action (RFC 6455 section 7.4.1).
+	wsClosePolicyViolation = 1008
+
+	// maxWebSocketMessageSize bounds how much of a fragmented text message is
+	// buffered for inspection. Larger messages are relayed unmodified.
+	maxWebSocketMessageSize = maxBodySize
+	// maxWebSocketFrameSize bounds a single frame held in memory.
+	maxWebSocketFrameSize = 16 << 20
+)
+
+var errWebSocketFrameTooLarge = errors.New("websocket frame too large")
+
+type wsFrame struct {
+	fin     bool
+	rsv     byte
+	opcode  byte
+	payload []byte
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleWebSocket proxies a WebSocket upgrade to connectHost and relays
+// frames in both directions. Outbound text messages are masked and inbound
+// text messages restored through a message session that lives as long as
+// the socket. A message rejected by an entity action is dropped and the
+// socket closed with a policy-violation close frame.
+func (h *Handler) handleWebSocket(w http.ResponseWriter, r *http.Request, connectHost string, decision policy.Result) {
+	host := normalizeHost(connectHost)
+	req := r.Clone(r.Context())
+	req.URL.Scheme = "https"
+	req.URL.Host = connectHost
+	req.RequestURI = ""
+	req.Host = connectHost
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	// Frames have to stay uncompressed for the sanitizer to read them, so
+	// permessage-deflate and other extensions are never negotiated.
+	req.Header.Del("Sec-WebSocket-Extensions")
+
+	resp, err := h.transport.RoundTrip(req)
+	if err != nil {
+		log.Printf("MITM: websocket upgrade to %s failed: %v", host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Upstream refused the upgrade; relay its answer as a plain response.
+		removeHopByHopHeaders(resp.Header)
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		_ = resp.Body.Close()
+		h.logAudit(req, host, decision, "", "")
+		return
+	}
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		_ = resp.Body.Close()
+		http.Error(w, "upstream connection cannot switch protocols", http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("MITM: websocket hijack failed for %s: %v", host, err)
+		return
+	}
+	defer clientConn.Close()
+
+	if err := writeSwitchingProtocols(clientBuf.Writer, resp.Header); err != nil {
+		log.Printf("MITM: websocket handshake to client failed for %s: %v", host, err)
+		return
+	}
+
+	var messages *sanitizer.MessageSession
+	if si, ok := h.inspector.(*sanitizer.SanitizingInspector); ok {
+		messages = si.NewMessageSession(session.GetIDFromContext(r.Context()))
+		defer messages.Close()
+	}
+	outbound := func(text string) (string, error) { return text, nil }
+	inbound := outbound
+	if messages != nil {
+		// The request context stays valid until this handler returns, which
+		// is after both relay directions have finished.
+		ctx := r.Context()
+		outbound = func(text string) (string, error) { return messages.Sanitize(ctx, text) }
+		inbound = func(text string) (string, error) { return messages.Restore(text), nil }
+	}
+
+	log.Printf("MITM: websocket established for %s%s", host, req.URL.Path)
+	errc := make(chan error, 2)
+	go func() { errc <- relayFrames(upstream, clientBuf.Reader, true, outbound) }()
+	go func() { errc <- relayFrames(clientConn, bufio.NewReader(upstream), false, inbound) }()
+	err = <-errc
+	if errors.Is(err, sanitizer.ErrBlocked) {
+		log.Printf("MITM: websocket message to %s rejected: %v", host, err)
+		_ = writeFrame(clientConn, closeFrame(wsClosePolicyViolation, err.Error()), false)
+		decision = policy.Result{Decision: policy.Block, Reason: err.Error(), RuleID: "sanitizer"}
+	}
+	_ = clientConn.Close()
+	_ = upstream.Close()
+	<-errc
+	log.Printf("MITM: websocket closed for %s%s", host, req.URL.Path)
+
+	entry := h.auditEntry(req, host, decision, "", "")
+	entry.StatusCode = http.StatusSwitchingProtocols
+	items, findings := messages.Items(), messages.Findings()
+	if len(items) > 0 {
+		if si, _ := h.inspector.(*sanitizer.SanitizingInspector); si.Monitoring(r.Context()) {
+			entry.Monitor = true
+		} else {
+			entry.Sanitized = true
+		}
+	}
+	if len(items) > 0 || len(findings) > 0 {
+		entry.SanitizedItems = append(sanitizedAudit(items), findingsAudit(findings)...)
+	}
+	h.writeAudit(entry)
+}
+
+// closeFrame returns a close frame with code and reason, truncated to fit
+// the 125-byte control frame payload.
+func closeFrame(code uint16, reason string) wsFrame {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	return wsFrame{fin: true, opcode: wsOpClose, payload: append(payload, reason...)}
+}
+
+func writeSwitchingProtocols(w *bufio.Writer, header http.Header) error {
+	if _, err := w.WriteString("HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return err
+	}
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// relayFrames copies frames from src to dst until src fails or transform
+// rejects a message, which is then not forwarded. Complete text messages
+// are reassembled and passed through transform; control frames, binary
+// messages and oversized text messages are forwarded unchanged. Frames
+// sent towards the server must be masked (RFC 6455 section 5.3).
+func relayFrames(dst io.Writer, src *bufio.Reader, maskOutput bool, transform func(string) (string, error)) error {
+	var (
+		message  []wsFrame
+		size     int
+		oversize bool
+	)
+	for {
+		f, err := readFrame(src)
+		if err != nil {
+			return err
+		}
+		isText := f.opcode == wsOpText || (f.opcode == wsOpContinuation && (len(message) > 0 || oversize))
+		if f.opcode >= wsOpClose || !isText {
+			if err := writeFrame(dst, f, maskOutput); err != nil {
+				return err
+			}
+			continue
+		}
+		if oversize {
+			if err := writeFrame(dst, f, maskOutput); err != nil {
+				return err
+			}
+			oversize = !f.fin
+			continue
+		}
+
+		message = append(message, f)
+		size += len(f.payload)
+		if size > maxWebSocketMessageSize {
+			log.Printf("MITM: websocket message exceeds %d bytes, relaying without inspection", maxWebSocketMessageSize)
+			for _, pending := range message {
+				if err := writeFrame(dst, pending, maskOutput); err != nil {
+					return err
+				}
+			}
+			message, size, oversize = nil, 0, !f.fin
+			continue
+		}
+		if !f.fin {
+			continue
+		}
+
+		var text bytes.Buffer
+		for _, part := range message {
+			text.Write(part.payload)
+		}
+		transformed, err := transform(text.String())
+		if err != nil {
+			return err
+		}
+		out := wsFrame{fin: true, opcode: wsOpText, payload: []byte(transformed)}
+		if err := writeFrame(dst, out, maskOutput); err != nil {
+			return err
+		}
+		message, size = nil, 0
+	}
+}
+
+func readFrame(r *bufio.Reader) (wsFrame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return wsFrame{}, err
+	}
+	f := wsFrame{fin: hdr[0]&0x80 != 0, rsv: hdr[0] & 0x70, opcode: hdr[0] & 0x0f}
+	masked := hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return wsFrame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return wsFrame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketFrameSize {
+		return wsFrame{}, fmt.Errorf("%w: %d bytes", errWebSocketFrameTooLarge, length)
+	}
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return wsFrame{}, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return wsFrame{}, err
+	}
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+func writeFrame(w io.Writer, f wsFrame, mask bool) error {
+	buf := make([]byte, 0, len(f.payload)+14)
+	b0 := f.rsv | f.opcode
+	if f.fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	switch n := len(f.payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if !mask {
+		buf = append(buf, f.payload...)
+		_, err := w.Write(buf)
+		return err
+	}
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	buf = append(buf, key[:]...)
+	start := len(buf)
+	buf = append(buf, f.payload...)
+	maskBytes(key, buf[start:])
+	_, err := w.Write(buf)
+	return err
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+func sanitizedAudit(items []sanitizer.SanitizedItem) []audit.SanitizedAudit {
+	out := make([]audit.SanitizedAudit, 0, len(items))
+	for _, item := range items {
+		out = append(out, audit.SanitizedAudit{Type: item.Type, Placeholder: item.Placeholder, Action: sanitizer.ActionMask})
+	}
+	return out
+}
+
+// findingsAudit lists the detections left in place by their entity action.
+func findingsAudit(findings []sanitizer.Finding) []audit.SanitizedAudit {
+	out := make([]audit.SanitizedAudit, 0, len(findings))
+	for _, f := range findings {
+		out = append(out, audit.SanitizedAudit{Type: f.Type, Action: f.Action})
+	}
+	return out
+}
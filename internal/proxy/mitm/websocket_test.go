@@ -0,0 +1,248 @@
+package mitm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"velar/internal/audit"
+	"velar/internal/classifier"
+	"velar/internal/config"
+	"velar/internal/policy"
+	"velar/internal/sanitizer"
+)
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsEchoServer upgrades every request and echoes text frames back with a prefix.
+func wsEchoServer(t *testing.T, received *[]string, extensions *string, mu *sync.Mutex) *httptest.Server {
+	t.Helper()
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*extensions = r.Header.Get("Sec-WebSocket-Extensions")
+		mu.Unlock()
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + wsAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		_ = buf.Flush()
+		for {
+			f, err := readFrame(buf.Reader)
+			if err != nil {
+				return
+			}
+			if f.opcode == wsOpClose {
+				_ = writeFrame(conn, f, false)
+				return
+			}
+			mu.Lock()
+			*received = append(*received, string(f.payload))
+			mu.Unlock()
+			f.payload = append([]byte("echo: "), f.payload...)
+			if err := writeFrame(conn, f, false); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestWebSocketFramesAreSanitizedAndRestored(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		received   []string
+		extensions string
+	)
+	upstream := wsEchoServer(t, &received, &extensions, &mu)
+	defer upstream.Close()
+
+	inspector := sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}}))
+	h := NewHandler(
+		NewCAStore(t.TempDir()),
+		&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		policy.NewRuleEngine(nil),
+		classifier.HostClassifier{},
+		nil,
+		inspector,
+	)
+	front := httptest.NewServer(h.serverHandler(upstream.Listener.Addr().String()))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, _ = conn.Write([]byte("GET /v1/realtime HTTP/1.1\r\nHost: example\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Extensions: permessage-deflate\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	// A fragmented text message followed by a second message reusing the value.
+	frames := []wsFrame{
+		{fin: false, opcode: wsOpText, payload: []byte(`{"type":"input","text":"mail `)},
+		{fin: true, opcode: wsOpContinuation, payload: []byte(`ws@example.com"}`)},
+		{fin: true, opcode: wsOpText, payload: []byte(`again ws@example.com`)},
+	}
+	var out bytes.Buffer
+	for _, f := range frames {
+		if err := writeFrame(&out, f, true); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+	}
+	if _, err := conn.Write(out.Bytes()); err != nil {
+		t.Fatalf("write frames: %v", err)
+	}
+
+	for _, want := range []string{`echo: {"text":"mail ws@example.com","type":"input"}`, "echo: again ws@example.com"} {
+		f, err := readFrame(br)
+		if err != nil {
+			t.Fatalf("read echo: %v", err)
+		}
+		if string(f.payload) != want {
+			t.Fatalf("client frame = %q, want %q", f.payload, want)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if extensions != "" {
+		t.Fatalf("extensions should not be negotiated upstream, got %q", extensions)
+	}
+	if len(received) != 2 || !strings.Contains(received[0], "[EMAIL_1]") || received[1] != "again [EMAIL_1]" {
+		t.Fatalf("upstream frames = %q, want masked values", received)
+	}
+}
+
+func TestRelayFramesPassesBinaryAndControlFrames(t *testing.T) {
+	var in bytes.Buffer
+	_ = writeFrame(&in, wsFrame{fin: true, opcode: 0x2, payload: []byte("bin a@example.com")}, true)
+	_ = writeFrame(&in, wsFrame{fin: true, opcode: 0x9, payload: []byte("ping")}, true)
+
+	var out bytes.Buffer
+	_ = relayFrames(&out, bufio.NewReader(&in), false, func(string) (string, error) { return "rewritten", nil })
+
+	r := bufio.NewReader(&out)
+	for _, want := range []string{"bin a@example.com", "ping"} {
+		f, err := readFrame(r)
+		if err != nil {
+			t.Fatalf("readFrame: %v", err)
+		}
+		if string(f.payload) != want {
+			t.Fatalf("payload = %q, want %q", f.payload, want)
+		}
+	}
+}
+
+func TestWebSocketMessagesFollowEntityActions(t *testing.T) {
+	tests := []struct {
+		action   string
+		upstream string
+		decision policy.Decision
+	}{
+		{sanitizer.ActionMask, "mail [EMAIL_1]", policy.MITM},
+		{sanitizer.ActionWarn, "mail ws@example.com", policy.MITM},
+		{sanitizer.ActionAllow, "mail ws@example.com", policy.MITM},
+		{sanitizer.ActionBlock, "", policy.Block},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			var (
+				mu         sync.Mutex
+				received   []string
+				extensions string
+			)
+			upstream := wsEchoServer(t, &received, &extensions, &mu)
+			defer upstream.Close()
+
+			inspector := sanitizer.NewSanitizingInspector(sanitizer.New([]sanitizer.Detector{sanitizer.EmailDetector{}})).
+				WithEntityActions([]sanitizer.EntityAction{{Type: "email", Action: tt.action}})
+			logger := &recordingAudit{}
+			engine := policy.NewRuleEngine([]config.Rule{{ID: "inspect", Action: "mitm"}})
+			h := NewHandler(NewCAStore(t.TempDir()), &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, engine, classifier.HostClassifier{}, logger, inspector)
+			front := httptest.NewServer(h.serverHandler(upstream.Listener.Addr().String()))
+			defer front.Close()
+
+			conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			_, _ = conn.Write([]byte("GET /v1/realtime HTTP/1.1\r\nHost: example\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+				"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("handshake = %v, %v; want 101", resp, err)
+			}
+
+			var out bytes.Buffer
+			_ = writeFrame(&out, wsFrame{fin: true, opcode: wsOpText, payload: []byte("mail ws@example.com")}, true)
+			if _, err := conn.Write(out.Bytes()); err != nil {
+				t.Fatalf("write frame: %v", err)
+			}
+			f, err := readFrame(br)
+			if err != nil {
+				t.Fatalf("read frame: %v", err)
+			}
+			if tt.action == sanitizer.ActionBlock {
+				if f.opcode != wsOpClose || len(f.payload) < 2 || binary.BigEndian.Uint16(f.payload) != wsClosePolicyViolation {
+					t.Fatalf("client frame = %+v, want a 1008 close frame", f)
+				}
+			} else {
+				if want := "echo: mail ws@example.com"; string(f.payload) != want {
+					t.Fatalf("client frame = %q, want %q", f.payload, want)
+				}
+				_ = conn.Close()
+			}
+
+			var entries []audit.Entry
+			for deadline := time.Now().Add(5 * time.Second); len(entries) == 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+				entries = logger.all()
+			}
+			if len(entries) != 1 {
+				t.Fatalf("audit entries = %+v, want one", entries)
+			}
+			entry := entries[0]
+			if entry.Decision != string(tt.decision) {
+				t.Fatalf("audit decision = %q, want %q", entry.Decision, tt.decision)
+			}
+			if len(entry.SanitizedItems) != 1 || entry.SanitizedItems[0].Type != "email" || entry.SanitizedItems[0].Action != tt.action {
+				t.Fatalf("audit items = %+v, want one email %s", entry.SanitizedItems, tt.action)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case tt.upstream == "" && len(received) != 0:
+				t.Fatalf("upstream frames = %q, want the message dropped", received)
+			case tt.upstream != "" && (len(received) != 1 || received[0] != tt.upstream):
+				t.Fatalf("upstream frames = %q, want %q", received, tt.upstream)
+			}
+		})
+	}
+}
@@ -11,16 +11,27 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"velar/internal/approval"
 	"velar/internal/audit"
+	"velar/internal/auth"
+	"velar/internal/cache"
 	"velar/internal/classifier"
 	"velar/internal/config"
+	"velar/internal/contentcoding"
 	"velar/internal/detect"
+	"velar/internal/hostmatch"
+	"velar/internal/pac"
 	"velar/internal/policy"
 	"velar/internal/proxy/mitm"
+	"velar/internal/ratelimit"
+	"velar/internal/replay"
 	"velar/internal/sanitizer"
 	"velar/internal/trace"
+	"velar/internal/transparent"
+	"velar/internal/upstream"
 )
 
 type Server interface {
@@ -31,12 +42,53 @@ type Server interface {
 type Proxy struct {
 	httpServer *http.Server
 	transport  *http.Transport
-	policy     policy.Engine
-	classifier classifier.Classifier
-	audit      audit.Logger
-	inspector  mitm.Inspector
-	mitm       *mitm.Handler
-	mitmCfg    config.MITM
+	// upstreamTLS wraps transport with per-host upstream TLS settings.
+	upstreamTLS *upstream.Transport
+	classifier  classifier.Classifier
+	audit       audit.Logger
+	upstream    *upstream.Router
+	auth        *auth.Store
+	gateway     *Gateway
+	limiter     *ratelimit.Limiter
+	retrier     *upstream.Retrier
+	cache       *cache.Cache
+	recorder    *replay.Recorder
+	player      *replay.Player
+	approvals   *approval.Queue
+
+	// mu guards the fields below, which Reload replaces.
+	mu        sync.RWMutex
+	policy    policy.Engine
+	inspector mitm.Inspector
+	mitm      *mitm.Handler
+	mitmCfg   config.MITM
+	// mitmDomains is mitmCfg.Domains, parsed.
+	mitmDomains *hostmatch.List
+	// gatewayHandler runs gateway requests through the inspection pipeline.
+	gatewayHandler *mitm.Handler
+	// pacRules are the rules /proxy.pac is generated from; nil disables it.
+	pacRules []config.Rule
+
+	socksAddr       string
+	transparentAddr string
+	transparentMode transparent.Mode
+	// transparentSources are the clients the transparent listener admits.
+	transparentSources *transparent.Sources
+	// listeners are the SOCKS5 and transparent listeners opened by Start.
+	listeners []net.Listener
+}
+
+// pipeline is a snapshot of the reloadable configuration. A request reads
+// it once, so requests and hijacked connections finish under the
+// configuration they started with.
+type pipeline struct {
+	policy         policy.Engine
+	inspector      mitm.Inspector
+	mitm           *mitm.Handler
+	mitmCfg        config.MITM
+	mitmDomains    *hostmatch.List
+	gatewayHandler *mitm.Handler
+	pacRules       []config.Rule
 }
 
 func New(addr string, p policy.Engine, c classifier.Classifier, a audit.Logger, mitmCfg config.MITM, sanitizerCfg config.Sanitizer, notificationCfg config.Notifications) *Proxy {
@@ -47,20 +99,65 @@ func New(addr string, p policy.Engine, c classifier.Classifier, a audit.Logger,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   5 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
-		ForceAttemptHTTP2:     false,
+		ForceAttemptHTTP2:     mitmCfg.UpstreamHTTP2,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: false,
 		},
 	}
 	pr := &Proxy{
-		transport:  transport,
-		policy:     p,
-		classifier: c,
-		audit:      a,
-		inspector:  mitm.PassthroughInspector{},
-		mitmCfg:    mitmCfg,
-	}
-	inspector := pr.inspector
+		transport:   transport,
+		upstreamTLS: upstream.NewTransport(transport),
+		classifier:  c,
+		audit:       a,
+	}
+	if err := pr.Reload(p, mitmCfg, sanitizerCfg, notificationCfg); err != nil {
+		log.Printf("mitm disabled: %v", err)
+		mitmCfg.Enabled = false
+		_ = pr.Reload(p, mitmCfg, sanitizerCfg, notificationCfg)
+	}
+	pr.httpServer = &http.Server{Addr: addr, Handler: http.HandlerFunc(pr.handle)}
+	return pr
+}
+
+// Reload swaps in a new policy engine, MITM domain list and sanitizer
+// configuration. Requests already in flight, including intercepted
+// connections, keep the configuration they started with. On error the
+// current configuration stays in place.
+func (p *Proxy) Reload(engine policy.Engine, mitmCfg config.MITM, sanitizerCfg config.Sanitizer, notificationCfg config.Notifications) error {
+	inspector := newInspector(sanitizerCfg, notificationCfg)
+	var handler *mitm.Handler
+	var domains *hostmatch.List
+	if mitmCfg.Enabled {
+		var err error
+		if domains, err = hostmatch.ParseList(mitmCfg.Domains, true); err != nil {
+			return fmt.Errorf("mitm domains: %w", err)
+		}
+		baseDir, err := mitm.DefaultCAPath()
+		if err != nil {
+			return fmt.Errorf("cannot resolve CA path: %w", err)
+		}
+		handler = mitm.NewHandler(mitm.NewCAStore(baseDir), p.roundTripper(), engine, p.classifier, p.audit, inspector).WithLimiter(p.limiter).WithRetrier(p.retrier).WithCache(p.cache).WithRecorder(p.recorder).WithReplay(p.player).WithApprovals(p.approvals).WithDebugHeaders(mitmCfg.DebugHeaders)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.policy = engine
+	p.inspector = inspector
+	p.mitm = handler
+	p.mitmCfg = mitmCfg
+	p.mitmDomains = domains
+	p.gatewayHandler = p.newGatewayHandler()
+	return nil
+}
+
+// current returns the configuration a new request should run under.
+func (p *Proxy) current() pipeline {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return pipeline{policy: p.policy, inspector: p.inspector, mitm: p.mitm, mitmCfg: p.mitmCfg, mitmDomains: p.mitmDomains, gatewayHandler: p.gatewayHandler, pacRules: p.pacRules}
+}
+
+func newInspector(sanitizerCfg config.Sanitizer, notificationCfg config.Notifications) mitm.Inspector {
+	var inspector mitm.Inspector = mitm.PassthroughInspector{}
 	if sanitizerCfg.Enabled {
 		log.Printf("proxy: initializing SanitizingInspector (notificationsEnabled=%v)", notificationCfg.Enabled)
 		detectors := sanitizer.DetectorsByName(sanitizerCfg.Types)
@@ -103,23 +200,162 @@ func New(addr string, p policy.Engine, c classifier.Classifier, a audit.Logger,
 			Config: detect.HybridConfig{NerEnabled: onnxCfg.Enabled, MaxBytes: onnxCfg.MaxBytes, Timeout: time.Duration(onnxCfg.TimeoutMS) * time.Millisecond, MinScore: onnxCfg.MinScore},
 		}
 		kc := sanitizer.NewKeyConfig(sanitizerCfg.SanitizeKeys, sanitizerCfg.SkipKeys)
-		inspector = sanitizer.NewSanitizingInspector(s).WithHybridDetector(hybrid).WithKeyConfig(kc).WithNotifications(notificationCfg.Enabled).WithRestoreResponses(sanitizerCfg.RestoreResponses)
+		rf := sanitizer.NewRequestFields(sanitizerCfg.Headers, sanitizerCfg.QueryParams, sanitizerCfg.PathSegments)
+		entities := make([]sanitizer.EntityAction, 0, len(sanitizerCfg.Entities))
+		for _, e := range sanitizerCfg.Entities {
+			entities = append(entities, sanitizer.EntityAction{Type: e.Type, Action: e.Action, MinScore: e.MinScore})
+		}
+		inspector = sanitizer.NewSanitizingInspector(s).WithHybridDetector(hybrid).WithKeyConfig(kc).WithRequestFields(rf).WithUploadPolicy(sanitizerCfg.Uploads).WithEntityActions(entities).WithNotifications(notificationCfg.Enabled).WithRestoreResponses(sanitizerCfg.RestoreResponses).WithMonitor(sanitizerCfg.Monitor)
 	}
-	pr.inspector = inspector
+	return inspector
+}
 
-	if mitmCfg.Enabled {
-		baseDir, err := mitm.DefaultCAPath()
-		if err != nil {
-			log.Printf("mitm disabled: cannot resolve CA path: %v", err)
-		} else {
-			pr.mitm = mitm.NewHandler(mitm.NewCAStore(baseDir), transport, p, c, a, inspector)
-		}
+// WithUpstreamProxy routes MITM round-trips, plain HTTP forwarding and
+// CONNECT tunnels through r. A nil router keeps direct egress.
+func (p *Proxy) WithUpstreamProxy(r *upstream.Router) *Proxy {
+	p.upstream = r
+	if r != nil {
+		p.transport.Proxy = r.ProxyFunc()
 	}
-	pr.httpServer = &http.Server{Addr: addr, Handler: http.HandlerFunc(pr.handle)}
-	return pr
+	return p
+}
+
+// WithUpstreamTLS applies per-host roots, client certificates, minimum
+// versions and pins to MITM round-trips and plain HTTP forwarding. A nil h
+// keeps the default TLS settings for every host.
+func (p *Proxy) WithUpstreamTLS(h *upstream.HostTLS) *Proxy {
+	if p.upstreamTLS == nil {
+		p.upstreamTLS = upstream.NewTransport(p.transport)
+	}
+	p.upstreamTLS.SetHostTLS(h)
+	return p
+}
+
+// roundTripper returns the transport upstream requests are sent with.
+func (p *Proxy) roundTripper() http.RoundTripper {
+	if p.upstreamTLS == nil {
+		return p.transport
+	}
+	return p.upstreamTLS
+}
+
+// WithRateLimits throttles plain HTTP requests, tunnels and intercepted
+// requests with l. A nil l disables throttling.
+func (p *Proxy) WithRateLimits(l *ratelimit.Limiter) *Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limiter = l
+	if p.mitm != nil {
+		p.mitm.WithLimiter(l)
+	}
+	p.gatewayHandler = p.newGatewayHandler()
+	return p
+}
+
+// WithRetry retries and fails over intercepted and gateway requests with r.
+// A nil r sends every request once.
+func (p *Proxy) WithRetry(r *upstream.Retrier) *Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retrier = r
+	if p.mitm != nil {
+		p.mitm.WithRetrier(r)
+	}
+	p.gatewayHandler = p.newGatewayHandler()
+	return p
+}
+
+// WithCache answers repeated intercepted and gateway requests from c. A nil
+// c disables caching.
+func (p *Proxy) WithCache(c *cache.Cache) *Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache = c
+	if p.mitm != nil {
+		p.mitm.WithCache(c)
+	}
+	p.gatewayHandler = p.newGatewayHandler()
+	return p
+}
+
+// WithRecorder records intercepted and gateway exchanges with r. A nil r
+// records nothing.
+func (p *Proxy) WithRecorder(r *replay.Recorder) *Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recorder = r
+	if p.mitm != nil {
+		p.mitm.WithRecorder(r)
+	}
+	p.gatewayHandler = p.newGatewayHandler()
+	return p
+}
+
+// WithReplay answers intercepted and gateway requests from the recordings
+// in pl. A nil pl disables replay.
+func (p *Proxy) WithReplay(pl *replay.Player) *Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.player = pl
+	if p.mitm != nil {
+		p.mitm.WithReplay(pl)
+	}
+	p.gatewayHandler = p.newGatewayHandler()
+	return p
+}
+
+// WithApprovals parks requests held by the sanitizer in q until they are
+// approved, masked or denied. A nil q denies them.
+func (p *Proxy) WithApprovals(q *approval.Queue) *Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.approvals = q
+	if p.mitm != nil {
+		p.mitm.WithApprovals(q)
+	}
+	p.gatewayHandler = p.newGatewayHandler()
+	return p
+}
+
+// WithAuth requires every client to authenticate with credentials from
+// store. A nil store leaves the listener open.
+func (p *Proxy) WithAuth(store *auth.Store) *Proxy {
+	p.auth = store
+	return p
+}
+
+// WithPAC serves a proxy auto-config script at /proxy.pac that sends the
+// MITM domains and the hosts named in rules through the proxy and
+// everything else DIRECT. It may be called again after Reload.
+func (p *Proxy) WithPAC(rules []config.Rule) *Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rules == nil {
+		rules = []config.Rule{}
+	}
+	p.pacRules = rules
+	return p
 }
 
 func (p *Proxy) Start() error {
+	if p.socksAddr != "" {
+		ln, err := net.Listen("tcp", p.socksAddr)
+		if err != nil {
+			return fmt.Errorf("socks5 listen: %w", err)
+		}
+		p.listeners = append(p.listeners, ln)
+		log.Printf("velar SOCKS5 listening on %s", p.socksAddr)
+		go p.serveSOCKS(ln)
+	}
+	if p.transparentAddr != "" {
+		ln, err := transparent.Listen(context.Background(), p.transparentAddr, p.transparentMode)
+		if err != nil {
+			return fmt.Errorf("transparent listen: %w", err)
+		}
+		p.listeners = append(p.listeners, ln)
+		log.Printf("velar transparent proxy (%s) listening on %s", p.transparentMode, p.transparentAddr)
+		go p.serveTransparent(ln)
+	}
 	log.Printf("velar daemon listening on %s", p.httpServer.Addr)
 	err := p.httpServer.ListenAndServe()
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -129,6 +365,9 @@ func (p *Proxy) Start() error {
 }
 
 func (p *Proxy) Shutdown(ctx context.Context) error {
+	for _, ln := range p.listeners {
+		_ = ln.Close()
+	}
 	return p.httpServer.Shutdown(ctx)
 }
 
@@ -146,21 +385,51 @@ func (p *Proxy) handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	cur := p.current()
+	// The PAC file is fetched before proxy credentials are configured.
+	if r.URL.Path == "/proxy.pac" && !r.URL.IsAbs() && cur.pacRules != nil {
+		p.servePAC(rec, r, cur)
+		return
+	}
+
 	host := normalizeHost(r.Host)
 	if host == "" && r.URL != nil {
 		host = normalizeHost(r.URL.Host)
 	}
 
-	_ = p.classifier.Classify(host)
-	decision := p.policy.Evaluate(host)
+	user := ""
+	if p.auth != nil {
+		var ok bool
+		user, ok = p.auth.Authenticate(r.Header.Get("Proxy-Authorization"))
+		if !ok {
+			p.requireAuth(rec, r, host)
+			return
+		}
+		r = r.WithContext(auth.ContextWithUser(r.Context(), user))
+	}
+
+	// Gateway requests are audited by the inspection pipeline.
+	if p.serveGateway(rec, r, cur) {
+		return
+	}
+
+	// CONNECT is decided on the host alone; the requests inside an
+	// intercepted tunnel are evaluated by the MITM handler.
+	policyReq := policy.Request{Host: host, User: user}
+	if r.Method != http.MethodConnect {
+		policyReq = policy.HTTPRequest(host, user, r)
+	}
+	policyReq.Category = string(p.classifier.Classify(host))
+	decision := cur.policy.EvaluateRequest(policyReq)
+	if r.Method == http.MethodConnect {
+		decision = cur.connectDecision(host, decision)
+	}
 
-	entry := audit.Entry{Method: r.Method, Host: host, Path: r.URL.Path, Decision: string(decision.Decision), Reason: fmt.Sprintf("%s (%s)", decision.Reason, decision.RuleID)}
+	entry := audit.Entry{Method: r.Method, Host: host, User: user, Path: r.URL.Path, Decision: string(decision.Decision), Reason: fmt.Sprintf("%s (%s)", decision.Reason, decision.RuleID)}
 	defer func() {
 		entry.StatusCode = rec.status
 		entry.TotalLatencyMs = float64(time.Since(start).Microseconds()) / 1000
-		if err := p.audit.Log(entry); err != nil {
-			log.Printf("audit log error: %v", err)
-		}
+		p.logAudit(entry)
 	}()
 
 	if decision.Decision == policy.Block {
@@ -168,11 +437,59 @@ func (p *Proxy) handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Intercepted tunnels are throttled per request by the MITM handler.
+	if r.Method != http.MethodConnect || !cur.shouldMITM(host, decision) {
+		release, denied := p.limiter.Acquire(ratelimit.Request{Host: host, User: user, Client: ratelimit.ClientIP(r.RemoteAddr)})
+		if denied != nil {
+			entry.Decision = ratelimit.Decision
+			entry.Reason = denied.Reason
+			denied.Respond(rec)
+			return
+		}
+		defer release()
+	}
+
 	if r.Method == http.MethodConnect {
-		p.handleConnect(rec, r)
+		p.handleConnect(rec, r, cur)
 		return
 	}
-	p.handleHTTP(rec, r)
+	p.handleHTTP(rec, r, cur, &entry, policyReq, decision)
+}
+
+// servePAC writes the PAC script, pointing clients at the address they
+// fetched it from.
+func (p *Proxy) servePAC(w http.ResponseWriter, r *http.Request, cur pipeline) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	addr := r.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		_, port, _ := net.SplitHostPort(p.httpServer.Addr)
+		if addr == "" {
+			addr = "localhost"
+		}
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	w.Header().Set("Content-Type", pac.ContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = io.WriteString(w, pac.Script(addr, cur.mitmCfg, cur.pacRules))
+}
+
+// requireAuth answers an unauthenticated request with 407 and records the
+// rejected attempt.
+func (p *Proxy) requireAuth(w http.ResponseWriter, r *http.Request, host string) {
+	for _, challenge := range p.auth.Challenges() {
+		w.Header().Add("Proxy-Authenticate", challenge)
+	}
+	http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+	p.logAudit(audit.Entry{Method: r.Method, Host: host, Path: r.URL.Path, StatusCode: http.StatusProxyAuthRequired, Decision: string(policy.Block), Reason: "proxy authentication required (auth)"})
+}
+
+func (p *Proxy) logAudit(entry audit.Entry) {
+	if err := p.audit.Log(entry); err != nil {
+		log.Printf("audit log error: %v", err)
+	}
 }
 
 type statusRecorder struct {
@@ -205,34 +522,73 @@ func (r *statusRecorder) Flush() {
 		f.Flush()
 	}
 }
-func (p *Proxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
+
+// handleHTTP forwards a plain proxy request. entry is the request's audit
+// record, updated when inspection blocks the request.
+func (p *Proxy) handleHTTP(w http.ResponseWriter, r *http.Request, cur pipeline, entry *audit.Entry, policyReq policy.Request, decision policy.Result) {
 	requestTrace := trace.NewRequestTrace()
 	ctx := trace.WithContext(r.Context(), requestTrace)
 	r = r.WithContext(ctx)
 
 	outReq := r.Clone(r.Context())
 	outReq.RequestURI = ""
+	outReq.Header.Del("Proxy-Authorization")
+	outReq.Header.Del("Proxy-Connection")
+	if outReq.Header.Get("Accept-Encoding") != "" {
+		outReq.Header.Set("Accept-Encoding", contentcoding.FilterAccept(outReq.Header.Get("Accept-Encoding")))
+	}
 	if outReq.URL.Scheme == "" {
 		outReq.URL.Scheme = "http"
 	}
 	if outReq.URL.Host == "" {
 		outReq.URL.Host = r.Host
 	}
-	inspector := p.inspector
+	inspector := cur.inspector
 	if inspector == nil {
 		inspector = mitm.PassthroughInspector{}
 	}
 	requestTrace.SanitizeStart = time.Now()
 	outReq, err := inspector.InspectRequest(outReq)
+	var held *sanitizer.HeldError
+	if errors.As(err, &held) {
+		outReq, entry.Approval, err = mitm.HoldRequest(p.approvals, inspector, outReq, entry.Host, held)
+	}
 	if err != nil {
 		requestTrace.SanitizeEnd = time.Now()
+		if errors.Is(err, sanitizer.ErrBlocked) {
+			sanitizer.RespondBlocked(w, err)
+			entry.Decision = string(policy.Block)
+			entry.Reason = err.Error()
+			return
+		}
+		if errors.Is(err, sanitizer.ErrUnsupportedEncoding) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
 		http.Error(w, "request inspection failed", http.StatusBadRequest)
 		return
 	}
 	requestTrace.SanitizeEnd = time.Now()
+	if decision.NeedsDetections && sanitizer.BodyStreamed(outReq) {
+		// Detections in a streamed body are only known once it has been
+		// sent, too late for the condition to stop it.
+		entry.Decision = string(policy.Block)
+		entry.Reason = fmt.Sprintf("request body too large to evaluate policy conditions (%s)", decision.RuleID)
+		http.Error(w, "request body too large to evaluate policy conditions", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if decision.NeedsDetections {
+		decision = cur.policy.EvaluateRequest(policyReq.WithDetections(mitm.DetectionTypes(outReq)))
+		entry.Decision = string(decision.Decision)
+		entry.Reason = fmt.Sprintf("%s (%s)", decision.Reason, decision.RuleID)
+		if decision.Decision == policy.Block {
+			http.Error(w, "blocked by Velar policy", http.StatusForbidden)
+			return
+		}
+	}
 
 	requestTrace.UpstreamStart = time.Now()
-	resp, err := p.transport.RoundTrip(outReq)
+	resp, err := p.roundTripper().RoundTrip(outReq)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
@@ -273,7 +629,7 @@ func isStreaming(resp *http.Response) bool {
 	return false
 }
 
-func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request, cur pipeline) {
 	target := connectTarget(r.Host)
 	if target == "" {
 		http.Error(w, "missing CONNECT target", http.StatusBadRequest)
@@ -281,19 +637,19 @@ func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	host := normalizeHost(target)
-	decision := p.policy.Evaluate(host)
+	decision := cur.policy.EvaluateRequest(policy.Request{Host: host, User: auth.UserFromContext(r.Context()), Category: string(p.classifier.Classify(host))})
 	log.Printf("CONNECT %s decision=%s", target, decision.Decision)
 
-	if p.shouldMITM(target, decision) {
+	if cur.shouldMITM(target, decision) {
 		log.Printf("CONNECT request to %s (mode=mitm)", target)
-		p.handleMITM(w, r, target)
+		p.handleMITM(w, r, target, cur.mitm)
 		return
 	}
 	log.Printf("CONNECT request to %s (mode=tunnel)", target)
 	p.handleTunnel(w, target)
 }
 
-func (p *Proxy) handleMITM(w http.ResponseWriter, r *http.Request, target string) {
+func (p *Proxy) handleMITM(w http.ResponseWriter, r *http.Request, target string, handler *mitm.Handler) {
 	log.Printf("handleMITM: starting for %s", target)
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
@@ -309,13 +665,16 @@ func (p *Proxy) handleMITM(w http.ResponseWriter, r *http.Request, target string
 	log.Printf("handleMITM: sending 200 Connection Established to %s", target)
 	_, _ = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 	log.Printf("handleMITM: delegating to MITM handler for %s", target)
-	p.mitm.HandleMITM(clientConn, target)
+	// Intercepted requests inherit the CONNECT request's values, such as the
+	// authenticated user, but not its cancellation.
+	handler.HandleMITM(context.WithoutCancel(r.Context()), clientConn, target)
 	log.Printf("handleMITM: completed for %s", target)
 }
 
 func (p *Proxy) handleTunnel(w http.ResponseWriter, target string) {
-	dstConn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	dstConn, err := p.dialTarget(target)
 	if err != nil {
+		log.Printf("tunnel: dial %s failed: %v", target, err)
 		http.Error(w, "failed to connect upstream", http.StatusBadGateway)
 		return
 	}
@@ -338,8 +697,15 @@ func (p *Proxy) handleTunnel(w http.ResponseWriter, target string) {
 		return
 	}
 
-	go tunnel(dstConn, clientConn)
-	tunnel(clientConn, dstConn)
+	relay(clientConn, dstConn)
+}
+
+// dialTarget opens the upstream side of a tunnel, honouring the configured
+// upstream proxy.
+func (p *Proxy) dialTarget(target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return p.upstream.DialContext(ctx, "tcp", target)
 }
 
 func connectTarget(host string) string {
@@ -356,24 +722,33 @@ func connectTarget(host string) string {
 	return net.JoinHostPort(host, "443")
 }
 
-func (p *Proxy) shouldMITM(host string, decision policy.Result) bool {
-	if p.mitm == nil || !p.mitmCfg.Enabled {
+func (c pipeline) shouldMITM(host string, decision policy.Result) bool {
+	if c.mitm == nil || !c.mitmCfg.Enabled {
 		return false
 	}
 	if decision.Decision != policy.MITM {
 		return false
 	}
-	if len(p.mitmCfg.Domains) == 0 {
+	if c.mitmDomains.Len() == 0 {
 		return true
 	}
-	needle := strings.ToLower(normalizeHost(host))
-	for _, domain := range p.mitmCfg.Domains {
-		domain = strings.ToLower(strings.TrimSpace(domain))
-		if needle == domain || strings.HasSuffix(needle, "."+domain) {
-			return true
-		}
+	return c.mitmDomains.Match(normalizeHost(host))
+}
+
+// connectDecision blocks a connection whose matching rule depends on the
+// requests inside it when the connection would not be intercepted, so the
+// rule fails closed instead of being tunnelled past.
+func (c pipeline) connectDecision(host string, decision policy.Result) policy.Result {
+	if decision.NeedsRequest && !c.shouldMITM(host, decision) {
+		return policy.Result{Decision: policy.Block, Reason: "request rule requires MITM", RuleID: decision.RuleID}
 	}
-	return false
+	return decision
+}
+
+// relay copies bytes between client and dst until either side closes.
+func relay(client, dst net.Conn) {
+	go tunnel(dst, client)
+	tunnel(client, dst)
 }
 
 func tunnel(dst net.Conn, src net.Conn) {
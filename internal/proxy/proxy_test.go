@@ -6,13 +6,17 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"io"
+	"log"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,11 +24,15 @@ import (
 	"time"
 
 	"velar/internal/audit"
+	"velar/internal/auth"
 	"velar/internal/classifier"
 	"velar/internal/config"
+	"velar/internal/hostmatch"
 	"velar/internal/policy"
 	"velar/internal/proxy/mitm"
+	"velar/internal/ratelimit"
 	"velar/internal/sanitizer"
+	"velar/internal/upstream"
 )
 
 type memoryAudit struct {
@@ -52,6 +60,11 @@ func newTestProxy(t *testing.T, p policy.Engine, logger audit.Logger, mitmCfg co
 	transport := &http.Transport{Proxy: nil, TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
 	pr := &Proxy{transport: transport, policy: p, classifier: classifier.HostClassifier{}, audit: logger, mitmCfg: mitmCfg}
 	if mitmCfg.Enabled {
+		domains, err := hostmatch.ParseList(mitmCfg.Domains, true)
+		if err != nil {
+			t.Fatalf("ParseList() error = %v", err)
+		}
+		pr.mitmDomains = domains
 		inspector := mitm.Inspector(mitm.PassthroughInspector{})
 		if sanitizerCfg.Enabled {
 			s := sanitizer.New(sanitizer.DetectorsByName(sanitizerCfg.Types))
@@ -126,14 +139,32 @@ func TestProxyBlockScenario(t *testing.T) {
 
 func TestProxyShouldMITMDecision(t *testing.T) {
 	pr, _ := newTestProxy(t, policy.NewRuleEngine(nil), &memoryAudit{}, config.MITM{Enabled: true, Domains: []string{"localhost"}}, config.Sanitizer{}, t.TempDir())
-	if !pr.shouldMITM("localhost:443", policy.Result{Decision: policy.MITM}) {
+	if !pr.current().shouldMITM("localhost:443", policy.Result{Decision: policy.MITM}) {
 		t.Fatalf("expected MITM for configured domain")
 	}
-	if pr.shouldMITM("example.com:443", policy.Result{Decision: policy.MITM}) {
+	if pr.current().shouldMITM("example.com:443", policy.Result{Decision: policy.MITM}) {
 		t.Fatalf("did not expect MITM for non-configured domain")
 	}
 }
 
+func TestProxyShouldMITMDomainPatterns(t *testing.T) {
+	pr, _ := newTestProxy(t, policy.NewRuleEngine(nil), &memoryAudit{}, config.MITM{Enabled: true, Domains: []string{"*.openai.com", "!files.openai.com", "10.0.0.0/8"}}, config.Sanitizer{}, t.TempDir())
+	for target, want := range map[string]bool{
+		"api.openai.com:443":   true,
+		"files.openai.com:443": false,
+		"openai.com:443":       false,
+		"10.1.2.3:443":         true,
+		"192.168.0.1:443":      false,
+	} {
+		if got := pr.current().shouldMITM(target, policy.Result{Decision: policy.MITM}); got != want {
+			t.Fatalf("shouldMITM(%q) = %v, want %v", target, got, want)
+		}
+	}
+	if err := pr.Reload(policy.NewRuleEngine(nil), config.MITM{Enabled: true, Domains: []string{"api.*.com"}}, config.Sanitizer{}, config.Notifications{}); err == nil {
+		t.Fatal("Reload() accepted an invalid domain pattern")
+	}
+}
+
 func TestNormalizeHost(t *testing.T) {
 	tests := []struct {
 		input string
@@ -186,6 +217,52 @@ func TestProxyConnectReturnsEstablishedInsteadOfRedirect(t *testing.T) {
 	}
 }
 
+func TestProxyBlocksConnectWhenRequestRuleCannotBeIntercepted(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen upstream: %v", err)
+	}
+	defer upstream.Close()
+	dialed := make(chan struct{}, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err == nil {
+			dialed <- struct{}{}
+			_ = conn.Close()
+		}
+	}()
+
+	engine := policy.NewRuleEngine([]config.Rule{{ID: "block-uploads", Match: config.Match{Path: "/v1/files"}, Action: "block"}})
+	logger := &memoryAudit{}
+	_, proxySrv := newTestProxy(t, engine, logger, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxySrv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("CONNECT " + upstream.Addr().String() + " HTTP/1.1\r\nHost: " + upstream.Addr().String() + "\r\n\r\n")); err != nil {
+		t.Fatalf("write connect request: %v", err)
+	}
+	statusLine, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read connect response: %v", err)
+	}
+	if !strings.Contains(statusLine, "403") {
+		t.Fatalf("expected CONNECT 403, got %q", strings.TrimSpace(statusLine))
+	}
+	select {
+	case <-dialed:
+		t.Fatal("connection was tunnelled past the request rule")
+	case <-time.After(100 * time.Millisecond):
+	}
+	entries := logger.all()
+	if len(entries) != 1 || entries[0].Decision != string(policy.Block) || !strings.Contains(entries[0].Reason, "request rule requires MITM (block-uploads)") {
+		t.Fatalf("audit entries = %+v", entries)
+	}
+}
+
 func TestProxyAuditLoggingJSON(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("audit"))
@@ -464,8 +541,9 @@ func TestMultiplePII(t *testing.T) {
 	}
 }
 
-// TestLargeBodySkipped verifies that large payloads skip sanitization
-func TestLargeBodySkipped(t *testing.T) {
+// TestLargeBodySanitizedWhileStreaming verifies that payloads over the
+// buffering limit are masked on the way out and restored on the way back.
+func TestLargeBodySanitizedWhileStreaming(t *testing.T) {
 	var upstreamReceived string
 	var mu sync.Mutex
 
@@ -517,18 +595,22 @@ func TestLargeBodySkipped(t *testing.T) {
 
 	respBody, _ := io.ReadAll(resp.Body)
 
-	// ASSERT: response contains original email (not masked due to size)
+	// ASSERT: response has the email restored
 	if !strings.Contains(string(respBody), "tail@example.com") {
-		t.Errorf("response should contain original email when sanitization skipped, got body length: %d", len(respBody))
+		t.Errorf("response should contain restored email, got body length: %d", len(respBody))
 	}
 
-	// ASSERT: upstream received original email (not masked)
+	// ASSERT: upstream received the masked body
 	mu.Lock()
 	received := upstreamReceived
 	mu.Unlock()
 
-	if !strings.Contains(received, "tail@example.com") {
-		t.Errorf("upstream should receive original email for large body, got length: %d", len(received))
+	if strings.Contains(received, "tail@example.com") || !strings.Contains(received, "[EMAIL_1]") {
+		t.Errorf("upstream should receive masked email for large body, got length: %d", len(received))
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal([]byte(received), &decoded); err != nil {
+		t.Errorf("upstream body is not valid JSON: %v", err)
 	}
 }
 
@@ -613,3 +695,387 @@ func TestConcurrentRequests(t *testing.T) {
 		t.Errorf("concurrent request error: %v", err)
 	}
 }
+
+// TestMITMServesHTTP2Clients verifies that clients negotiating h2 via ALPN get
+// HTTP/2 from the MITM layer and that masking and streaming restore still apply.
+func TestMITMServesHTTP2Clients(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+	httpsServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, string(body))
+		mu.Unlock()
+		if r.URL.Path == "/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: " + strings.ReplaceAll(string(body), `"`, `'`) + "\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Connection", "keep-alive")
+		_, _ = w.Write(body)
+	}))
+	httpsServer.StartTLS()
+	defer httpsServer.Close()
+
+	caDir := t.TempDir()
+	if err := mitm.NewCAStore(caDir).EnsureRootCA(); err != nil {
+		t.Fatalf("ensure CA: %v", err)
+	}
+	mitmCfg := config.MITM{Enabled: true, Domains: []string{"127.0.0.1"}}
+	sanitizerCfg := config.Sanitizer{Enabled: true, Types: []string{"email"}}
+	rules := []config.Rule{{ID: "mitm-all", Match: config.Match{HostContains: "127.0.0.1"}, Action: "mitm"}}
+	_, proxySrv := newTestProxy(t, policy.NewRuleEngine(rules), &memoryAudit{}, mitmCfg, sanitizerCfg, caDir)
+	defer proxySrv.Close()
+
+	certPEM, _ := os.ReadFile(filepath.Join(caDir, "cert.pem"))
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(certPEM)
+
+	client := proxyClient(proxySrv.URL, rootCAs)
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	client.Timeout = 10 * time.Second
+
+	for _, path := range []string{"/json", "/stream"} {
+		req, _ := http.NewRequest(http.MethodPost, httpsServer.URL+path, strings.NewReader(`{"message":"reach me at h2@example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("client.Do(%s) error = %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("%s: proto = %s, want HTTP/2", path, resp.Proto)
+		}
+		if !strings.Contains(string(body), "h2@example.com") || strings.Contains(string(body), "[EMAIL_1]") {
+			t.Fatalf("%s: expected restored response, got %q", path, body)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, body := range received {
+		if strings.Contains(body, "h2@example.com") || !strings.Contains(body, "[EMAIL_1]") {
+			t.Fatalf("upstream should receive masked body, got %q", body)
+		}
+	}
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	var forwardedAuth atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedAuth.Store(r.Header.Get("Proxy-Authorization"))
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	store, err := auth.Parse(strings.NewReader("basic alice s3cret\nbasic intern pw\n"))
+	if err != nil {
+		t.Fatalf("auth.Parse() error = %v", err)
+	}
+	rules := []config.Rule{{ID: "block-intern", Match: config.Match{User: "intern"}, Action: "block"}}
+	auditLog := &memoryAudit{}
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(rules), auditLog, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	pr.WithAuth(store)
+	defer proxySrv.Close()
+
+	resp, err := proxyClient(proxySrv.URL, nil).Get(upstream.URL + "/anon")
+	if err != nil {
+		t.Fatalf("client.Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired || len(resp.Header.Values("Proxy-Authenticate")) != 2 {
+		t.Fatalf("unauthenticated: status=%d challenges=%v", resp.StatusCode, resp.Header.Values("Proxy-Authenticate"))
+	}
+
+	withUser := func(user, pass string) *http.Client {
+		return proxyClient(strings.Replace(proxySrv.URL, "http://", "http://"+user+":"+pass+"@", 1), nil)
+	}
+	resp, err = withUser("alice", "wrong").Get(upstream.URL + "/bad")
+	if err != nil {
+		t.Fatalf("client.Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("wrong password: status=%d", resp.StatusCode)
+	}
+
+	resp, err = withUser("alice", "s3cret").Get(upstream.URL + "/ok")
+	if err != nil {
+		t.Fatalf("client.Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("alice: status=%d", resp.StatusCode)
+	}
+	if got, _ := forwardedAuth.Load().(string); got != "" {
+		t.Fatalf("Proxy-Authorization leaked upstream: %q", got)
+	}
+
+	resp, err = withUser("intern", "pw").Get(upstream.URL + "/blocked")
+	if err != nil {
+		t.Fatalf("client.Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("intern: status=%d", resp.StatusCode)
+	}
+
+	users := map[string]int{}
+	for _, e := range auditLog.all() {
+		users[e.User+" "+strconv.Itoa(e.StatusCode)]++
+	}
+	if users[" 407"] != 2 || users["alice 200"] != 1 || users["intern 403"] != 1 {
+		t.Fatalf("unexpected audit entries: %v", users)
+	}
+}
+
+func TestMITMRequestsCarryAuthenticatedUser(t *testing.T) {
+	caDir := t.TempDir()
+	if err := mitm.NewCAStore(caDir).EnsureRootCA(); err != nil {
+		t.Fatalf("ensure CA: %v", err)
+	}
+	certPEM, err := os.ReadFile(filepath.Join(caDir, "cert.pem"))
+	if err != nil {
+		t.Fatalf("read CA cert: %v", err)
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(certPEM)
+
+	httpsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer httpsServer.Close()
+
+	store, err := auth.Parse(strings.NewReader("bearer ci-bot tok_abc\n"))
+	if err != nil {
+		t.Fatalf("auth.Parse() error = %v", err)
+	}
+	rules := []config.Rule{{ID: "mitm-all", Match: config.Match{HostContains: "127.0.0.1"}, Action: "mitm"}}
+	auditLog := &memoryAudit{}
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(rules), auditLog, config.MITM{Enabled: true}, config.Sanitizer{}, caDir)
+	pr.WithAuth(store)
+	defer proxySrv.Close()
+
+	client := proxyClient(proxySrv.URL, rootCAs)
+	client.Transport.(*http.Transport).ProxyConnectHeader = http.Header{"Proxy-Authorization": {"Bearer tok_abc"}}
+	resp, err := client.Get(httpsServer.URL + "/v1/chat")
+	if err != nil {
+		t.Fatalf("client.Get() error = %v", err)
+	}
+	resp.Body.Close()
+
+	for _, e := range auditLog.all() {
+		if e.Path == "/v1/chat" {
+			if e.User != "ci-bot" {
+				t.Fatalf("intercepted request user = %q, want ci-bot", e.User)
+			}
+			return
+		}
+	}
+	t.Fatalf("no audit entry for intercepted request: %+v", auditLog.all())
+}
+
+func TestProxyServesPAC(t *testing.T) {
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(nil), &memoryAudit{}, config.MITM{Enabled: true, Domains: []string{"api.openai.com"}}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+	store, err := auth.Parse(strings.NewReader("basic alice s3cret\n"))
+	if err != nil {
+		t.Fatalf("auth.Parse() error = %v", err)
+	}
+	// Clients fetch the PAC file without proxy credentials.
+	pr.WithAuth(store)
+	pr.WithPAC([]config.Rule{{ID: "block-gemini", Match: config.Match{HostContains: "gemini"}, Action: "block"}})
+
+	resp, err := http.Get(proxySrv.URL + "/proxy.pac")
+	if err != nil {
+		t.Fatalf("GET /proxy.pac error = %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" {
+		t.Fatalf("status=%d content-type=%q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	proxyAddr := strings.TrimPrefix(proxySrv.URL, "http://")
+	for _, want := range []string{`"PROXY ` + proxyAddr + `"`, `".api.openai.com"`, `"gemini"`} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("PAC missing %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestProxyAppliesUpstreamTLSPins(t *testing.T) {
+	upstreamSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstreamSrv.Close()
+	upstreamSrv.Config.ErrorLog = log.New(io.Discard, "", 0)
+
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(nil), &memoryAudit{}, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+
+	// An absolute-form https request goes through the plain HTTP handler.
+	get := func() int {
+		t.Helper()
+		conn, err := net.Dial("tcp", strings.TrimPrefix(proxySrv.URL, "http://"))
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		defer conn.Close()
+		req, _ := http.NewRequest(http.MethodGet, upstreamSrv.URL+"/", nil)
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatalf("write request: %v", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Pins are matched against the verified chain, so trust the test
+	// server's certificate explicitly.
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstreamSrv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("write CA: %v", err)
+	}
+	load := func(pin string) *upstream.HostTLS {
+		t.Helper()
+		h, err := upstream.LoadHostTLS([]config.UpstreamTLS{{Host: "127.0.0.1", CAFile: caFile, Pins: []string{pin}}})
+		if err != nil {
+			t.Fatalf("LoadHostTLS() error = %v", err)
+		}
+		return h
+	}
+	pr.WithUpstreamTLS(load("sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="))
+	if status := get(); status != http.StatusBadGateway {
+		t.Fatalf("status with mismatched pin = %d, want 502", status)
+	}
+	pr.WithUpstreamTLS(load(upstream.SPKIPin(upstreamSrv.Certificate())))
+	if status := get(); status != http.StatusOK {
+		t.Fatalf("status with matching pin = %d, want 200", status)
+	}
+}
+
+func TestProxyBlocksMultipartUploadWithSensitiveData(t *testing.T) {
+	var upstreamHits atomic.Int32
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+	}))
+	defer upstreamSrv.Close()
+
+	logger := &memoryAudit{}
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(nil), logger, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+	pr.inspector = sanitizer.NewSanitizingInspector(sanitizer.New(sanitizer.DetectorsByName([]string{"email"}))).WithUploadPolicy(sanitizer.UploadBlock)
+
+	var body strings.Builder
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "customers.csv")
+	_, _ = fw.Write([]byte("name,email\nJohn,john@example.com\n"))
+	_ = mw.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, upstreamSrv.URL+"/v1/files", strings.NewReader(body.String()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := proxyClient(proxySrv.URL, nil).Do(req)
+	if err != nil {
+		t.Fatalf("client.Do() error = %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", resp.StatusCode)
+	}
+	if upstreamHits.Load() != 0 {
+		t.Fatalf("blocked upload reached upstream")
+	}
+	entries := logger.all()
+	if len(entries) != 1 || entries[0].Decision != string(policy.Block) || !strings.Contains(entries[0].Reason, "customers.csv") {
+		t.Fatalf("audit entries = %+v, want one block naming customers.csv", entries)
+	}
+}
+
+func TestProxyRejectsStreamedBodyUnderDetectionCondition(t *testing.T) {
+	var upstreamHits atomic.Int32
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+	}))
+	defer upstreamSrv.Close()
+
+	engine, err := policy.Compile([]config.Rule{
+		{ID: "no-emails", When: `detections.count("email") > 0`, Action: "block"},
+	})
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	logger := &memoryAudit{}
+	pr, proxySrv := newTestProxy(t, engine, logger, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+	pr.inspector = sanitizer.NewSanitizingInspector(sanitizer.New(sanitizer.DetectorsByName([]string{"email"})))
+
+	// A chunked body is sanitized as it streams, so its detections are not
+	// known when the condition has to be evaluated.
+	body := struct{ io.Reader }{strings.NewReader(`{"content":"john@example.com"}`)}
+	req, _ := http.NewRequest(http.MethodPost, upstreamSrv.URL+"/v1/chat", body)
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := proxyClient(proxySrv.URL, nil).Do(req)
+	if err != nil {
+		t.Fatalf("client.Do() error = %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", resp.StatusCode)
+	}
+	if upstreamHits.Load() != 0 {
+		t.Fatalf("streamed body reached upstream")
+	}
+	entries := logger.all()
+	if len(entries) != 1 || entries[0].Decision != string(policy.Block) || !strings.Contains(entries[0].Reason, "no-emails") {
+		t.Fatalf("audit entries = %+v, want one block naming no-emails", entries)
+	}
+}
+
+func TestProxyThrottlesWithRetryAfter(t *testing.T) {
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstreamSrv.Close()
+
+	logger := &memoryAudit{}
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(nil), logger, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+	limiter, err := ratelimit.New([]config.RateLimit{{Scope: "client", RequestsPerMinute: 1, Burst: 1}})
+	if err != nil {
+		t.Fatalf("ratelimit.New() error = %v", err)
+	}
+	pr.WithRateLimits(limiter)
+
+	client := proxyClient(proxySrv.URL, nil)
+	var statuses []int
+	var retryAfter string
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(upstreamSrv.URL)
+		if err != nil {
+			t.Fatalf("client.Get() error = %v", err)
+		}
+		_ = resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+		retryAfter = resp.Header.Get("Retry-After")
+	}
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusTooManyRequests {
+		t.Fatalf("statuses = %v, want [200 429]", statuses)
+	}
+	if retryAfter == "" {
+		t.Fatalf("429 without Retry-After")
+	}
+	entries := logger.all()
+	if len(entries) != 2 || entries[1].Decision != ratelimit.Decision || entries[1].StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("audit entries = %+v, want the second throttled with 429", entries)
+	}
+}
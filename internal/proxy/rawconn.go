@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"velar/internal/audit"
+	"velar/internal/auth"
+	"velar/internal/policy"
+	"velar/internal/ratelimit"
+)
+
+// connectOutcome tells a raw client whether its tunnel was opened.
+type connectOutcome int
+
+const (
+	connectOpened connectOutcome = iota
+	connectBlocked
+	connectUnreachable
+)
+
+// rawConnect is a CONNECT-style request that arrived on a raw client
+// connection, from a SOCKS5 client or a transparently redirected socket,
+// instead of as an HTTP CONNECT.
+type rawConnect struct {
+	conn   net.Conn
+	target string
+	user   string
+	// method is recorded as the audit entry's method.
+	method string
+	// reply reports the outcome to the client before any tunnel data flows.
+	// It is nil for protocols without a handshake.
+	reply func(connectOutcome) error
+}
+
+// serveRawConnect runs the HTTP CONNECT decision path for rc: policy
+// evaluation, then MITM interception or a plain tunnel. It owns rc.conn.
+func (p *Proxy) serveRawConnect(rc rawConnect) {
+	start := time.Now()
+	host := normalizeHost(rc.target)
+	cur := p.current()
+	decision := cur.connectDecision(host, cur.policy.EvaluateRequest(policy.Request{Host: host, User: rc.user, Category: string(p.classifier.Classify(host))}))
+	log.Printf("%s %s decision=%s", rc.method, rc.target, decision.Decision)
+
+	entry := audit.Entry{Method: rc.method, Host: host, User: rc.user, Decision: string(decision.Decision), Reason: fmt.Sprintf("%s (%s)", decision.Reason, decision.RuleID)}
+	defer func() {
+		entry.TotalLatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		p.logAudit(entry)
+	}()
+
+	reply := func(o connectOutcome) error {
+		if rc.reply == nil {
+			return nil
+		}
+		return rc.reply(o)
+	}
+
+	if decision.Decision == policy.Block {
+		_ = reply(connectBlocked)
+		_ = rc.conn.Close()
+		return
+	}
+
+	if cur.shouldMITM(rc.target, decision) {
+		log.Printf("%s request to %s (mode=mitm)", rc.method, rc.target)
+		if err := reply(connectOpened); err != nil {
+			_ = rc.conn.Close()
+			return
+		}
+		cur.mitm.HandleMITM(auth.ContextWithUser(context.Background(), rc.user), rc.conn, rc.target)
+		return
+	}
+
+	// Tunnels are throttled like HTTP CONNECT tunnels; intercepted ones
+	// per request by the MITM handler.
+	release, denied := p.limiter.Acquire(ratelimit.Request{Host: host, User: rc.user, Client: ratelimit.ClientIP(rc.conn.RemoteAddr().String())})
+	if denied != nil {
+		entry.Decision = ratelimit.Decision
+		entry.Reason = denied.Reason
+		_ = reply(connectBlocked)
+		_ = rc.conn.Close()
+		return
+	}
+	defer release()
+
+	log.Printf("%s request to %s (mode=tunnel)", rc.method, rc.target)
+	dstConn, err := p.dialTarget(rc.target)
+	if err != nil {
+		log.Printf("%s: dial %s failed: %v", rc.method, rc.target, err)
+		_ = reply(connectUnreachable)
+		_ = rc.conn.Close()
+		return
+	}
+	if err := reply(connectOpened); err != nil {
+		_ = rc.conn.Close()
+		_ = dstConn.Close()
+		return
+	}
+	relay(rc.conn, dstConn)
+}
+
+// acceptLoop hands every connection accepted on ln to handle until ln is
+// closed.
+func acceptLoop(ln net.Listener, name string, handle func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("%s: accept failed: %v", name, err)
+			}
+			return
+		}
+		go handle(conn)
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"velar/internal/config"
+	"velar/internal/policy"
+)
+
+// ReloadConfig loads cfgPath and applies it with Reload. started is the
+// configuration the daemon was started with, used to report sections that
+// only take effect after a restart. On error the running configuration
+// stays in place.
+func (p *Proxy) ReloadConfig(cfgPath string, started config.Config) error {
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return err
+	}
+	engine, err := policy.Compile(cfg.Rules)
+	if err != nil {
+		return err
+	}
+	if err := policy.CheckInterception(cfg); err != nil {
+		return err
+	}
+	if err := p.Reload(engine, cfg.MITM, cfg.Sanitizer, cfg.Notifications); err != nil {
+		return err
+	}
+	p.WithPAC(cfg.Rules)
+	if changed := config.RestartRequired(started, cfg); len(changed) > 0 {
+		log.Printf("config reloaded from %s; restart to apply changes to %s", cfgPath, strings.Join(changed, ", "))
+		return nil
+	}
+	log.Printf("config reloaded from %s", cfgPath)
+	return nil
+}
+
+// WatchConfig calls ReloadConfig in the background on SIGHUP and whenever
+// cfgPath changes, until ctx is done. Failed reloads are logged.
+func (p *Proxy) WatchConfig(ctx context.Context, cfgPath string, started config.Config) {
+	reloadCh := make(chan struct{}, 1)
+	go config.Watch(ctx, cfgPath, 2*time.Second, func() {
+		select {
+		case reloadCh <- struct{}{}:
+		default:
+		}
+	})
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hupCh)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupCh:
+			case <-reloadCh:
+			}
+			if err := p.ReloadConfig(cfgPath, started); err != nil {
+				log.Printf("config reload failed, keeping current configuration: %v", err)
+			}
+		}
+	}()
+}
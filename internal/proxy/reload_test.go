@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"velar/internal/config"
+	"velar/internal/policy"
+	"velar/internal/proxy/mitm"
+)
+
+func TestReloadAppliesToNewRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(nil), &memoryAudit{}, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+	client := proxyClient(proxySrv.URL, nil)
+
+	get := func() int {
+		t.Helper()
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("client.Get() error = %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := get(); status != http.StatusOK {
+		t.Fatalf("status before reload = %d, want 200", status)
+	}
+
+	rules := []config.Rule{{ID: "block-local", Match: config.Match{HostContains: "127.0.0.1"}, Action: "block"}}
+	if err := pr.Reload(policy.NewRuleEngine(rules), config.MITM{}, config.Sanitizer{}, config.Notifications{}); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if status := get(); status != http.StatusForbidden {
+		t.Fatalf("status after reload = %d, want 403", status)
+	}
+}
+
+func TestReloadConfigKeepsCurrentConfigOnError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(nil), &memoryAudit{}, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+	client := proxyClient(proxySrv.URL, nil)
+	get := func() int {
+		t.Helper()
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("client.Get() error = %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	cfgPath := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(rules string) {
+		t.Helper()
+		if err := os.WriteFile(cfgPath, []byte("rules:\n"+rules), 0o600); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+	write("  - id: block-local\n    match:\n      host_contains: 127.0.0.1\n    action: block\n")
+	if err := pr.ReloadConfig(cfgPath, config.Default()); err != nil {
+		t.Fatalf("ReloadConfig() error = %v", err)
+	}
+	if status := get(); status != http.StatusForbidden {
+		t.Fatalf("status after reload = %d, want 403", status)
+	}
+
+	write("  - id: broken\n    when: hots == \"a\"\n    action: allow\n")
+	if err := pr.ReloadConfig(cfgPath, config.Default()); err == nil {
+		t.Fatal("ReloadConfig() with an invalid condition succeeded")
+	}
+	if status := get(); status != http.StatusForbidden {
+		t.Fatalf("status after failed reload = %d, want 403", status)
+	}
+}
+
+func TestReloadKeepsInterceptedConnectionsOnOldConfig(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	caDir, err := mitm.DefaultCAPath()
+	if err != nil {
+		t.Fatalf("DefaultCAPath() error = %v", err)
+	}
+	if err := mitm.NewCAStore(caDir).EnsureRootCA(); err != nil {
+		t.Fatalf("ensure CA: %v", err)
+	}
+	certPEM, _ := os.ReadFile(filepath.Join(caDir, "cert.pem"))
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(certPEM)
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(nil), &memoryAudit{}, config.MITM{}, config.Sanitizer{}, caDir)
+	defer proxySrv.Close()
+	mitmCfg := config.MITM{Enabled: true, Domains: []string{"127.0.0.1"}}
+	mitmRules := []config.Rule{{ID: "mitm-local", Match: config.Match{HostContains: "127.0.0.1"}, Action: "mitm"}}
+	if err := pr.Reload(policy.NewRuleEngine(mitmRules), mitmCfg, config.Sanitizer{}, config.Notifications{}); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	get := func(client *http.Client) (int, error) {
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+	existing := proxyClient(proxySrv.URL, rootCAs)
+	if status, err := get(existing); err != nil || status != http.StatusOK {
+		t.Fatalf("first request: status=%d err=%v", status, err)
+	}
+
+	blockRules := []config.Rule{{ID: "block-local", Match: config.Match{HostContains: "127.0.0.1"}, Action: "block"}}
+	if err := pr.Reload(policy.NewRuleEngine(blockRules), mitmCfg, config.Sanitizer{}, config.Notifications{}); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	// The intercepted connection opened before the reload keeps its policy.
+	if status, err := get(existing); err != nil || status != http.StatusOK {
+		t.Fatalf("request on existing connection: status=%d err=%v", status, err)
+	}
+	// A new CONNECT is evaluated against the reloaded rules.
+	if _, err := get(proxyClient(proxySrv.URL, rootCAs)); err == nil {
+		t.Fatalf("expected new connection to be blocked after reload")
+	}
+}
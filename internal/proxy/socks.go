@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"velar/internal/audit"
+	"velar/internal/policy"
+	"velar/internal/socks5"
+)
+
+// socksHandshakeTimeout bounds how long a client may take to send its
+// greeting, credentials and request.
+const socksHandshakeTimeout = 10 * time.Second
+
+// WithSOCKS5 additionally accepts SOCKS5 clients on addr once Start is
+// called. Their CONNECT requests go through the same policy, MITM and
+// tunnel path as HTTP CONNECT.
+func (p *Proxy) WithSOCKS5(addr string) *Proxy {
+	p.socksAddr = addr
+	return p
+}
+
+func (p *Proxy) serveSOCKS(ln net.Listener) {
+	acceptLoop(ln, "socks5", p.handleSOCKS)
+}
+
+func (p *Proxy) handleSOCKS(conn net.Conn) {
+	var authenticate socks5.Authenticator
+	if p.auth != nil {
+		authenticate = p.auth.AuthenticateBasic
+	}
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	req, err := socks5.ServerHandshake(conn, authenticate)
+	if err != nil {
+		log.Printf("socks5: handshake from %s failed: %v", conn.RemoteAddr(), err)
+		if errors.Is(err, socks5.ErrAuthRejected) {
+			p.logAudit(audit.Entry{Method: "SOCKS5", Decision: string(policy.Block), Reason: "proxy authentication required (auth)"})
+		}
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	p.serveRawConnect(rawConnect{
+		conn:   conn,
+		target: req.Target,
+		user:   req.User,
+		method: "SOCKS5",
+		reply: func(o connectOutcome) error {
+			switch o {
+			case connectBlocked:
+				return socks5.WriteReply(conn, socks5.ReplyNotAllowed)
+			case connectUnreachable:
+				return socks5.WriteReply(conn, socks5.ReplyHostUnreachable)
+			}
+			return socks5.WriteReply(conn, socks5.ReplySucceeded)
+		},
+	})
+}
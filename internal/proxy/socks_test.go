@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"velar/internal/auth"
+	"velar/internal/config"
+	"velar/internal/policy"
+	"velar/internal/proxy/mitm"
+	"velar/internal/ratelimit"
+	"velar/internal/transparent"
+)
+
+func startSOCKS(t *testing.T, pr *Proxy) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go pr.serveSOCKS(ln)
+	return ln.Addr().String()
+}
+
+func socksClient(proxyURL string, rootCAs *x509.CertPool) *http.Client {
+	client := proxyClient(proxyURL, rootCAs)
+	client.Timeout = 5 * time.Second
+	return client
+}
+
+func TestSOCKS5TunnelAndBlock(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	upstreamPort := upstream.Listener.Addr().(*net.TCPAddr).Port
+
+	rules := []config.Rule{{ID: "block-localhost", Match: config.Match{Host: "localhost"}, Action: "block"}}
+	auditLog := &memoryAudit{}
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(rules), auditLog, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+	client := socksClient("socks5://"+startSOCKS(t, pr), nil)
+
+	resp, err := client.Get(upstream.URL + "/tunnel")
+	if err != nil {
+		t.Fatalf("client.Get() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("tunnel: status=%d body=%q", resp.StatusCode, body)
+	}
+
+	blockedURL := (&url.URL{Scheme: "http", Host: net.JoinHostPort("localhost", strconv.Itoa(upstreamPort)), Path: "/blocked"}).String()
+	if _, err := client.Get(blockedURL); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected ruleset rejection, got %v", err)
+	}
+
+	client.CloseIdleConnections()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		decisions := map[string]string{}
+		for _, e := range auditLog.all() {
+			if e.Method == "SOCKS5" {
+				decisions[e.Host] = e.Decision
+			}
+		}
+		if decisions["127.0.0.1"] == "allow" && decisions["localhost"] == "block" {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("missing SOCKS5 audit entries: %+v", auditLog.all())
+}
+
+func TestSOCKS5TunnelsAreRateLimited(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	auditLog := &memoryAudit{}
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(nil), auditLog, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+	limiter, err := ratelimit.New([]config.RateLimit{{Scope: "client", Match: "127.0.0.0/8", RequestsPerMinute: 1, Burst: 1}})
+	if err != nil {
+		t.Fatalf("ratelimit.New() error = %v", err)
+	}
+	pr.WithRateLimits(limiter)
+	client := socksClient("socks5://"+startSOCKS(t, pr), nil)
+
+	resp, err := client.Get(upstream.URL + "/first")
+	if err != nil {
+		t.Fatalf("client.Get() error = %v", err)
+	}
+	_ = resp.Body.Close()
+	client.CloseIdleConnections()
+
+	// The second tunnel is over the client's quota.
+	if _, err := client.Get(upstream.URL + "/second"); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected throttled tunnel to be rejected, got %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, e := range auditLog.all() {
+			if e.Method == "SOCKS5" && e.Decision == ratelimit.Decision {
+				return
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("missing SOCKS5 throttle audit entry: %+v", auditLog.all())
+}
+
+func TestSOCKS5MITMWithAuthentication(t *testing.T) {
+	caDir := t.TempDir()
+	if err := mitm.NewCAStore(caDir).EnsureRootCA(); err != nil {
+		t.Fatalf("ensure CA: %v", err)
+	}
+	certPEM, err := os.ReadFile(filepath.Join(caDir, "cert.pem"))
+	if err != nil {
+		t.Fatalf("read CA cert: %v", err)
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(certPEM)
+
+	httpsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	}))
+	defer httpsServer.Close()
+
+	store, err := auth.Parse(strings.NewReader("basic alice s3cret\n"))
+	if err != nil {
+		t.Fatalf("auth.Parse() error = %v", err)
+	}
+	rules := []config.Rule{{ID: "mitm-all", Match: config.Match{HostContains: "127.0.0.1"}, Action: "mitm"}}
+	auditLog := &memoryAudit{}
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(rules), auditLog, config.MITM{Enabled: true}, config.Sanitizer{}, caDir)
+	pr.WithAuth(store)
+	defer proxySrv.Close()
+	addr := startSOCKS(t, pr)
+
+	if _, err := socksClient("socks5://alice:wrong@"+addr, rootCAs).Get(httpsServer.URL); err == nil {
+		t.Fatalf("expected authentication failure")
+	}
+
+	resp, err := socksClient("socks5://alice:s3cret@"+addr, rootCAs).Get(httpsServer.URL + "/v1/messages")
+	if err != nil {
+		t.Fatalf("client.Get() error = %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "secure" {
+		t.Fatalf("body = %q", body)
+	}
+	// The client only trusts the Velar CA, so a successful request proves
+	// the connection was intercepted.
+	for _, e := range auditLog.all() {
+		if e.Path == "/v1/messages" && e.User == "alice" {
+			return
+		}
+	}
+	t.Fatalf("no audit entry for intercepted SOCKS5 request: %+v", auditLog.all())
+}
+
+func TestTransparentRoutesBySNI(t *testing.T) {
+	rules := []config.Rule{{ID: "block-openai", Match: config.Match{HostContains: "openai.com"}, Action: "block"}}
+	auditLog := &memoryAudit{}
+	pr, proxySrv := newTestProxy(t, policy.NewRuleEngine(rules), auditLog, config.MITM{}, config.Sanitizer{}, t.TempDir())
+	defer proxySrv.Close()
+	// In TPROXY mode the original destination is the socket's local
+	// address, which lets the test skip the packet filter.
+	pr.transparentMode = transparent.ModeTProxy
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go pr.serveTransparent(ln)
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "api.openai.com", InsecureSkipVerify: true})
+	if err == nil {
+		conn.Close()
+		t.Fatalf("expected blocked connection to be closed")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, e := range auditLog.all() {
+			if e.Method == "TRANSPARENT" && e.Host == "api.openai.com" && e.Decision == "block" {
+				return
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("missing transparent audit entry: %+v", auditLog.all())
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"strconv"
+
+	"velar/internal/transparent"
+)
+
+// WithTransparent additionally accepts connections redirected by the packet
+// filter on addr once Start is called. Each one is handled as if the client
+// had sent CONNECT for the TLS server name, or for the original destination
+// address when there is no SNI. Clients outside sources are disconnected;
+// a nil sources accepts every client.
+func (p *Proxy) WithTransparent(addr string, mode transparent.Mode, sources *transparent.Sources) *Proxy {
+	p.transparentAddr = addr
+	p.transparentMode = mode
+	p.transparentSources = sources
+	return p
+}
+
+func (p *Proxy) serveTransparent(ln net.Listener) {
+	acceptLoop(ln, "transparent", p.handleTransparent)
+}
+
+func (p *Proxy) handleTransparent(conn net.Conn) {
+	// Redirected connections carry no proxy credentials, so the source
+	// address is all that admits them.
+	if !p.transparentSources.Allowed(conn.RemoteAddr()) {
+		log.Printf("transparent: %s: source not allowed", conn.RemoteAddr())
+		_ = conn.Close()
+		return
+	}
+	dst, err := transparent.OriginalDst(conn, p.transparentMode)
+	if err != nil {
+		log.Printf("transparent: %s: %v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	peeked, serverName, err := transparent.PeekServerName(conn)
+	if err != nil {
+		log.Printf("transparent: %s -> %s: %v", conn.RemoteAddr(), dst, err)
+		_ = conn.Close()
+		return
+	}
+	host := serverName
+	if host == "" {
+		host = dst.IP.String()
+	}
+	p.serveRawConnect(rawConnect{
+		conn:   peeked,
+		target: net.JoinHostPort(host, strconv.Itoa(dst.Port)),
+		method: "TRANSPARENT",
+	})
+}
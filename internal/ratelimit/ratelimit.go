@@ -0,0 +1,224 @@
+// Package ratelimit enforces token-bucket request rates and in-flight caps
+// per destination host, authenticated user and client IP.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"velar/internal/config"
+	"velar/internal/hostmatch"
+)
+
+// Decision is the audit decision recorded for throttled requests.
+const Decision = "throttle"
+
+// Scopes a limit can be keyed by.
+const (
+	ScopeHost   = "host"
+	ScopeUser   = "user"
+	ScopeClient = "client"
+)
+
+// maxBuckets bounds the bucket map; above it, buckets that have refilled
+// and have nothing in flight are dropped.
+const maxBuckets = 4096
+
+// Request identifies what a request is counted against. Empty fields are
+// not limited.
+type Request struct {
+	Host   string
+	User   string
+	Client string
+}
+
+// Denial explains why a request was throttled.
+type Denial struct {
+	RetryAfter time.Duration
+	Reason     string
+}
+
+// Respond writes a 429 with a Retry-After header in whole seconds.
+func (d *Denial) Respond(w http.ResponseWriter) {
+	seconds := int(math.Ceil(d.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "rate limited by Velar: "+d.Reason, http.StatusTooManyRequests)
+}
+
+type rule struct {
+	scope string
+	// match is nil when the rule covers every value.
+	match       *hostmatch.List
+	perSecond   float64
+	burst       float64
+	maxInFlight int
+}
+
+type bucket struct {
+	tokens   float64
+	updated  time.Time
+	inFlight int
+}
+
+// Limiter applies the configured limits. A nil *Limiter allows everything.
+type Limiter struct {
+	rules []rule
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// New validates limits and returns a limiter for them. It returns nil, nil
+// when no limits are configured.
+func New(limits []config.RateLimit) (*Limiter, error) {
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	l := &Limiter{now: time.Now, buckets: make(map[string]*bucket)}
+	for idx, lim := range limits {
+		scope := strings.ToLower(strings.TrimSpace(lim.Scope))
+		switch scope {
+		case ScopeHost, ScopeUser, ScopeClient:
+		default:
+			return nil, fmt.Errorf("rate limit %d: invalid scope %q (want host, user or client)", idx+1, lim.Scope)
+		}
+		if lim.RequestsPerMinute < 0 || lim.Burst < 0 || lim.MaxInFlight < 0 {
+			return nil, fmt.Errorf("rate limit %d: values must not be negative", idx+1)
+		}
+		if lim.RequestsPerMinute == 0 && lim.MaxInFlight == 0 {
+			return nil, fmt.Errorf("rate limit %d: set requests_per_minute, max_in_flight or both", idx+1)
+		}
+		var match *hostmatch.List
+		if pattern := strings.TrimSpace(lim.Match); pattern != "" {
+			list, err := hostmatch.ParseList([]string{pattern}, false)
+			if err != nil {
+				return nil, fmt.Errorf("rate limit %d: %w", idx+1, err)
+			}
+			match = list
+		}
+		r := rule{
+			scope:       scope,
+			match:       match,
+			perSecond:   float64(lim.RequestsPerMinute) / 60,
+			burst:       float64(lim.Burst),
+			maxInFlight: lim.MaxInFlight,
+		}
+		if r.perSecond > 0 && r.burst == 0 {
+			// Default to one second's worth of requests.
+			r.burst = math.Max(1, math.Ceil(r.perSecond))
+		}
+		l.rules = append(l.rules, r)
+	}
+	return l, nil
+}
+
+// Acquire counts req against every matching limit. When all of them have
+// room it takes a token from each and returns a release func that must be
+// called when the request finishes; otherwise nothing is consumed and the
+// first denial is returned.
+func (l *Limiter) Acquire(req Request) (release func(), denied *Denial) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	type hit struct {
+		rule   rule
+		bucket *bucket
+	}
+	var hits []hit
+	for idx, r := range l.rules {
+		value := r.value(req)
+		if value == "" || !r.matches(value) {
+			continue
+		}
+		key := strconv.Itoa(idx) + "|" + value
+		b, ok := l.buckets[key]
+		if !ok {
+			if len(l.buckets) >= maxBuckets {
+				l.prune(now)
+			}
+			b = &bucket{tokens: r.burst, updated: now}
+			l.buckets[key] = b
+		}
+		if r.perSecond > 0 {
+			b.tokens = math.Min(r.burst, b.tokens+now.Sub(b.updated).Seconds()*r.perSecond)
+			b.updated = now
+			if b.tokens < 1 {
+				wait := time.Duration((1 - b.tokens) / r.perSecond * float64(time.Second))
+				return nil, &Denial{RetryAfter: wait, Reason: fmt.Sprintf("%s %s exceeded %g requests per minute", r.scope, value, r.perSecond*60)}
+			}
+		}
+		if r.maxInFlight > 0 && b.inFlight >= r.maxInFlight {
+			return nil, &Denial{RetryAfter: time.Second, Reason: fmt.Sprintf("%s %s has %d requests in flight", r.scope, value, b.inFlight)}
+		}
+		hits = append(hits, hit{rule: r, bucket: b})
+	}
+	for _, h := range hits {
+		if h.rule.perSecond > 0 {
+			h.bucket.tokens--
+		}
+		h.bucket.inFlight++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, h := range hits {
+				h.bucket.inFlight--
+			}
+		})
+	}, nil
+}
+
+// prune drops buckets that would be full again and have nothing in flight.
+// The caller holds l.mu.
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		idx, _ := strconv.Atoi(key[:strings.IndexByte(key, '|')])
+		r := l.rules[idx]
+		full := r.perSecond == 0 || b.tokens+now.Sub(b.updated).Seconds()*r.perSecond >= r.burst
+		if full && b.inFlight == 0 {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (r rule) value(req Request) string {
+	switch r.scope {
+	case ScopeHost:
+		return strings.ToLower(req.Host)
+	case ScopeUser:
+		return req.User
+	default:
+		return req.Client
+	}
+}
+
+// matches reports whether the rule applies to value, a host, user or
+// client IP matched as a host pattern. An empty match covers everything.
+func (r rule) matches(value string) bool {
+	return r.match == nil || r.match.Match(value)
+}
+
+// ClientIP returns the IP part of a request's RemoteAddr.
+func ClientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
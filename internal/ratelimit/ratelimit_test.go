@@ -0,0 +1,148 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"velar/internal/config"
+)
+
+func newTestLimiter(t *testing.T, limits ...config.RateLimit) (*Limiter, *time.Time) {
+	t.Helper()
+	l, err := New(limits)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestLimiterTokenBucket(t *testing.T) {
+	l, now := newTestLimiter(t, config.RateLimit{Scope: "host", Match: "api.openai.com", RequestsPerMinute: 60, Burst: 2})
+	req := Request{Host: "api.openai.com"}
+
+	for i := 0; i < 2; i++ {
+		release, denied := l.Acquire(req)
+		if denied != nil {
+			t.Fatalf("request %d denied: %+v", i+1, denied)
+		}
+		release()
+	}
+	_, denied := l.Acquire(req)
+	if denied == nil {
+		t.Fatalf("third request within the burst was allowed")
+	}
+	if denied.RetryAfter != time.Second || !strings.Contains(denied.Reason, "api.openai.com") {
+		t.Fatalf("denial = %+v, want a 1s retry naming the host", denied)
+	}
+	if _, denied := l.Acquire(Request{Host: "api.anthropic.com"}); denied != nil {
+		t.Fatalf("unmatched host throttled: %+v", denied)
+	}
+
+	*now = now.Add(time.Second)
+	if _, denied := l.Acquire(req); denied != nil {
+		t.Fatalf("request after refill denied: %+v", denied)
+	}
+}
+
+func TestLimiterMaxInFlight(t *testing.T) {
+	l, _ := newTestLimiter(t, config.RateLimit{Scope: "user", MaxInFlight: 1})
+
+	release, denied := l.Acquire(Request{User: "alice"})
+	if denied != nil {
+		t.Fatalf("first request denied: %+v", denied)
+	}
+	if _, denied := l.Acquire(Request{User: "alice"}); denied == nil {
+		t.Fatalf("second concurrent request allowed")
+	}
+	// Each user has a separate quota, and requests without a user are not
+	// counted.
+	if _, denied := l.Acquire(Request{User: "bob"}); denied != nil {
+		t.Fatalf("other user throttled: %+v", denied)
+	}
+	if _, denied := l.Acquire(Request{}); denied != nil {
+		t.Fatalf("anonymous request throttled: %+v", denied)
+	}
+	release()
+	release()
+	if _, denied := l.Acquire(Request{User: "alice"}); denied != nil {
+		t.Fatalf("request after release denied: %+v", denied)
+	}
+}
+
+func TestLimiterDeniedRequestConsumesNothing(t *testing.T) {
+	l, _ := newTestLimiter(t,
+		config.RateLimit{Scope: "client", RequestsPerMinute: 60, Burst: 1},
+		config.RateLimit{Scope: "host", Match: "*.example.com", MaxInFlight: 1},
+	)
+	hold, denied := l.Acquire(Request{Host: "a.example.com", Client: "10.0.0.1"})
+	if denied != nil {
+		t.Fatalf("first request denied: %+v", denied)
+	}
+	defer hold()
+	// The host quota rejects this one, so the client's token is kept.
+	if _, denied := l.Acquire(Request{Host: "b.example.com", Client: "10.0.0.2"}); denied != nil {
+		t.Fatalf("request to another subdomain denied: %+v", denied)
+	}
+	if _, denied := l.Acquire(Request{Host: "a.example.com", Client: "10.0.0.3"}); denied == nil {
+		t.Fatalf("request over the host in-flight cap allowed")
+	}
+	if _, denied := l.Acquire(Request{Host: "other.test", Client: "10.0.0.3"}); denied != nil {
+		t.Fatalf("client token was consumed by a denied request: %+v", denied)
+	}
+}
+
+func TestLimiterMatchesHostPatterns(t *testing.T) {
+	l, _ := newTestLimiter(t,
+		config.RateLimit{Scope: "client", Match: "10.0.0.0/8", MaxInFlight: 1},
+		config.RateLimit{Scope: "host", Match: "!files.example.com", MaxInFlight: 1},
+	)
+	hold, denied := l.Acquire(Request{Client: "10.1.2.3"})
+	if denied != nil {
+		t.Fatalf("first request denied: %+v", denied)
+	}
+	defer hold()
+	if _, denied := l.Acquire(Request{Client: "10.1.2.3"}); denied == nil {
+		t.Fatal("client in the CIDR range allowed over its in-flight cap")
+	}
+	if _, denied := l.Acquire(Request{Client: "192.168.0.1"}); denied != nil {
+		t.Fatalf("client outside the CIDR range denied: %+v", denied)
+	}
+
+	hold, denied = l.Acquire(Request{Host: "files.example.com"})
+	if denied != nil {
+		t.Fatalf("first request denied: %+v", denied)
+	}
+	defer hold()
+	if _, denied := l.Acquire(Request{Host: "files.example.com"}); denied != nil {
+		t.Fatalf("negated host limited: %+v", denied)
+	}
+}
+
+func TestNewRejectsInvalidLimits(t *testing.T) {
+	tests := []struct {
+		limit   config.RateLimit
+		wantErr string
+	}{
+		{config.RateLimit{Scope: "path", RequestsPerMinute: 1}, "invalid scope"},
+		{config.RateLimit{Scope: "host"}, "requests_per_minute"},
+		{config.RateLimit{Scope: "host", RequestsPerMinute: -1}, "negative"},
+		{config.RateLimit{Scope: "host", Match: "/[/", RequestsPerMinute: 1}, "invalid host pattern"},
+	}
+	for _, tt := range tests {
+		if _, err := New([]config.RateLimit{tt.limit}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Fatalf("New(%+v) error = %v, want %q", tt.limit, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDenialRespond(t *testing.T) {
+	rec := httptest.NewRecorder()
+	(&Denial{RetryAfter: 1500 * time.Millisecond, Reason: "host x exceeded"}).Respond(rec)
+	if rec.Code != 429 || rec.Header().Get("Retry-After") != "2" {
+		t.Fatalf("status=%d Retry-After=%q, want 429 and 2", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,279 @@
+// Package replay records sanitized exchanges from the inspection pipeline
+// to HAR or JSONL files and serves them back in place of the network.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Exchange is one recorded request and the upstream response to it. Both
+// are recorded as they crossed the network: the request after sanitization
+// and the response before placeholders were restored.
+type Exchange struct {
+	StartedAt time.Time `json:"started_at"`
+	// TimeMs is the time from sending the request to the end of the
+	// response body.
+	TimeMs   float64  `json:"time_ms"`
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   Body        `json:"body"`
+}
+
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   Body        `json:"body"`
+	// WaitMs is the time until the response headers arrived.
+	WaitMs float64 `json:"wait_ms"`
+	// Chunks holds the body of a streamed (text/event-stream) response as
+	// it was read, so replay can reproduce its timing.
+	Chunks []Chunk `json:"chunks,omitempty"`
+}
+
+// Body holds text as is and anything else base64-encoded.
+type Body struct {
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Chunk is part of a streamed body, OffsetMs after the response headers.
+type Chunk struct {
+	OffsetMs float64 `json:"offset_ms"`
+	Data     string  `json:"data"`
+}
+
+func newBody(b []byte) Body {
+	if utf8.Valid(b) {
+		return Body{Text: string(b)}
+	}
+	return Body{Text: base64.StdEncoding.EncodeToString(b), Encoding: "base64"}
+}
+
+// Bytes returns the decoded body.
+func (b Body) Bytes() ([]byte, error) {
+	if b.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(b.Text)
+	}
+	return []byte(b.Text), nil
+}
+
+// isHAR reports whether path is written as HAR; anything else is JSONL.
+func isHAR(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".har")
+}
+
+// ReadFile loads the exchanges in a HAR (.har) or JSONL file.
+func ReadFile(path string) ([]Exchange, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if isHAR(path) {
+		var doc harDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		out := make([]Exchange, 0, len(doc.Log.Entries))
+		for _, e := range doc.Log.Entries {
+			out = append(out, e.exchange())
+		}
+		return out, nil
+	}
+	var out []Exchange
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var ex Exchange
+		if err := json.Unmarshal(sc.Bytes(), &ex); err != nil {
+			return nil, fmt.Errorf("parse %s line %d: %w", path, line, err)
+		}
+		out = append(out, ex)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return out, nil
+}
+
+// The HAR 1.2 subset written and read by this package. Chunks are kept in
+// the custom "_chunks" field of the response.
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []harHeader `json:"headers"`
+	QueryString []harHeader `json:"queryString"`
+	Cookies     []harHeader `json:"cookies"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+	PostData    *harContent `json:"postData,omitempty"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []harHeader `json:"headers"`
+	Cookies     []harHeader `json:"cookies"`
+	Content     harContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+	Chunks      []Chunk     `json:"_chunks,omitempty"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(h http.Header) []harHeader {
+	out := []harHeader{}
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			out = append(out, harHeader{Name: name, Value: v})
+		}
+	}
+	return out
+}
+
+func httpHeader(headers []harHeader) http.Header {
+	h := http.Header{}
+	for _, hdr := range headers {
+		h.Add(hdr.Name, hdr.Value)
+	}
+	return h
+}
+
+func (b Body) size() int {
+	data, _ := b.Bytes()
+	return len(data)
+}
+
+func harEntryFor(ex Exchange) harEntry {
+	entry := harEntry{
+		StartedDateTime: ex.StartedAt,
+		Time:            ex.TimeMs,
+		Request: harRequest{
+			Method:      ex.Request.Method,
+			URL:         ex.Request.URL,
+			HTTPVersion: "HTTP/1.1",
+			Headers:     harHeaders(ex.Request.Header),
+			QueryString: []harHeader{},
+			Cookies:     []harHeader{},
+			HeadersSize: -1,
+			BodySize:    ex.Request.Body.size(),
+		},
+		Response: harResponse{
+			Status:      ex.Response.Status,
+			StatusText:  http.StatusText(ex.Response.Status),
+			HTTPVersion: "HTTP/1.1",
+			Headers:     harHeaders(ex.Response.Header),
+			Cookies:     []harHeader{},
+			Content: harContent{
+				Size:     ex.Response.Body.size(),
+				MimeType: ex.Response.Header.Get("Content-Type"),
+				Text:     ex.Response.Body.Text,
+				Encoding: ex.Response.Body.Encoding,
+			},
+			HeadersSize: -1,
+			BodySize:    ex.Response.Body.size(),
+			Chunks:      ex.Response.Chunks,
+		},
+		Timings: harTimings{Wait: ex.Response.WaitMs, Receive: max(0, ex.TimeMs-ex.Response.WaitMs)},
+	}
+	if ex.Request.Body.Text != "" {
+		entry.Request.PostData = &harContent{
+			Size:     entry.Request.BodySize,
+			MimeType: ex.Request.Header.Get("Content-Type"),
+			Text:     ex.Request.Body.Text,
+			Encoding: ex.Request.Body.Encoding,
+		}
+	}
+	return entry
+}
+
+func (e harEntry) exchange() Exchange {
+	ex := Exchange{
+		StartedAt: e.StartedDateTime,
+		TimeMs:    e.Time,
+		Request: Request{
+			Method: e.Request.Method,
+			URL:    e.Request.URL,
+			Header: httpHeader(e.Request.Headers),
+		},
+		Response: Response{
+			Status: e.Response.Status,
+			Header: httpHeader(e.Response.Headers),
+			Body:   Body{Text: e.Response.Content.Text, Encoding: e.Response.Content.Encoding},
+			WaitMs: e.Timings.Wait,
+			Chunks: e.Response.Chunks,
+		},
+	}
+	if e.Request.PostData != nil {
+		ex.Request.Body = Body{Text: e.Request.PostData.Text, Encoding: e.Request.PostData.Encoding}
+	}
+	return ex
+}
@@ -0,0 +1,189 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"velar/internal/config"
+)
+
+// Player answers requests with recorded responses. Requests match on
+// method, host, path, query and body, with JSON bodies compared after
+// normalization. Identical requests recorded several times are answered in
+// recorded order, the last response repeating once the others are used.
+type Player struct {
+	passthrough    bool
+	preserveTiming bool
+	sleep          func(time.Duration)
+
+	mu        sync.Mutex
+	exchanges map[string][]Exchange
+	served    map[string]int
+}
+
+// LoadPlayer reads the recording named by cfg. It returns nil, nil when
+// replay is not configured.
+func LoadPlayer(cfg config.Replay) (*Player, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	exchanges, err := ReadFile(cfg.File)
+	if err != nil {
+		return nil, fmt.Errorf("load replay file: %w", err)
+	}
+	return NewPlayer(exchanges, cfg.Passthrough, cfg.PreserveTiming)
+}
+
+// NewPlayer serves exchanges. With passthrough, requests without a
+// recording are sent upstream; with preserveTiming, streamed responses are
+// replayed at their recorded pace.
+func NewPlayer(exchanges []Exchange, passthrough, preserveTiming bool) (*Player, error) {
+	p := &Player{
+		passthrough:    passthrough,
+		preserveTiming: preserveTiming,
+		sleep:          time.Sleep,
+		exchanges:      make(map[string][]Exchange),
+		served:         make(map[string]int),
+	}
+	for idx, ex := range exchanges {
+		u, err := url.Parse(ex.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("replay exchange %d: invalid url %q", idx+1, ex.Request.URL)
+		}
+		body, err := ex.Request.Body.Bytes()
+		if err != nil {
+			return nil, fmt.Errorf("replay exchange %d: invalid request body: %w", idx+1, err)
+		}
+		if _, err := ex.Response.Body.Bytes(); err != nil {
+			return nil, fmt.Errorf("replay exchange %d: invalid response body: %w", idx+1, err)
+		}
+		key := matchKey(ex.Request.Method, u, body)
+		p.exchanges[key] = append(p.exchanges[key], ex)
+	}
+	return p, nil
+}
+
+// Passthrough reports whether unmatched requests go to the network.
+func (p *Player) Passthrough() bool {
+	return p != nil && p.passthrough
+}
+
+// Response returns the recorded response for req, which must already be
+// sanitized. req's body is read and replaced.
+func (p *Player) Response(req *http.Request) (*http.Response, bool) {
+	if p == nil {
+		return nil, false
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return nil, false
+		}
+	}
+	key := matchKey(req.Method, req.URL, body)
+	p.mu.Lock()
+	recorded := p.exchanges[key]
+	if len(recorded) == 0 {
+		p.mu.Unlock()
+		return nil, false
+	}
+	idx := min(p.served[key], len(recorded)-1)
+	p.served[key]++
+	p.mu.Unlock()
+	return p.response(recorded[idx].Response, req), true
+}
+
+func (p *Player) response(rec Response, req *http.Request) *http.Response {
+	header := rec.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status)),
+		StatusCode: rec.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Request:    req,
+	}
+	if len(rec.Chunks) > 0 {
+		resp.ContentLength = -1
+		header.Del("Content-Length")
+		resp.Body = &chunkReader{chunks: rec.Chunks, timed: p.preserveTiming, sleep: p.sleep, start: time.Now()}
+		return resp
+	}
+	body, _ := rec.Body.Bytes()
+	resp.ContentLength = int64(len(body))
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp
+}
+
+// chunkReader returns a streamed body chunk by chunk, optionally waiting
+// until each chunk's recorded offset.
+type chunkReader struct {
+	chunks  []Chunk
+	pending []byte
+	timed   bool
+	sleep   func(time.Duration)
+	start   time.Time
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if len(c.chunks) == 0 {
+			return 0, io.EOF
+		}
+		next := c.chunks[0]
+		c.chunks = c.chunks[1:]
+		if c.timed {
+			if wait := time.Duration(next.OffsetMs*float64(time.Millisecond)) - time.Since(c.start); wait > 0 {
+				c.sleep(wait)
+			}
+		}
+		c.pending = []byte(next.Data)
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *chunkReader) Close() error {
+	return nil
+}
+
+func matchKey(method string, u *url.URL, body []byte) string {
+	return strings.Join([]string{strings.ToUpper(method), strings.ToLower(u.Host), u.EscapedPath(), u.RawQuery, string(normalizeBody(body))}, "\x00")
+}
+
+// normalizeBody compacts JSON and sorts its object keys so formatting
+// differences do not prevent a match. Other bodies are compared as is.
+func normalizeBody(body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if dec.Decode(&v) != nil || dec.More() {
+		return body
+	}
+	normalized, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return normalized
+}
@@ -0,0 +1,259 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"velar/internal/contentcoding"
+)
+
+const (
+	// maxRecordedRequest is the largest request body recorded; larger or
+	// unknown-length bodies are recorded empty.
+	maxRecordedRequest = 1 << 20
+	// maxRecordedResponse is the largest response body recorded; exchanges
+	// with larger responses are dropped.
+	maxRecordedResponse = 16 << 20
+)
+
+// redactedHeaders are credentials never written to a recording.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "Api-Key", "X-Goog-Api-Key"}
+
+// Recorder writes exchanges to a HAR file, rewritten after each exchange so
+// it is always complete, or appends them to a JSONL file.
+type Recorder struct {
+	path string
+	har  bool
+
+	mu      sync.Mutex
+	file    *os.File
+	entries []harEntry
+}
+
+// NewRecorder creates or truncates path. Paths ending in .har are written
+// as HAR, anything else as JSONL.
+func NewRecorder(path string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create recording dir: %w", err)
+	}
+	r := &Recorder{path: path, har: isHAR(path)}
+	if r.har {
+		if err := r.writeHAR(); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("create recording: %w", err)
+	}
+	r.file = f
+	return r, nil
+}
+
+// Path returns the file being written.
+func (r *Recorder) Path() string {
+	return r.path
+}
+
+// Close flushes and closes the recording.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *Recorder) add(ex Exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.har {
+		r.entries = append(r.entries, harEntryFor(ex))
+		if err := r.writeHAR(); err != nil {
+			log.Printf("replay: %v", err)
+		}
+		return
+	}
+	if r.file == nil {
+		return
+	}
+	line, err := json.Marshal(ex)
+	if err != nil {
+		log.Printf("replay: encode exchange: %v", err)
+		return
+	}
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		log.Printf("replay: write recording: %v", err)
+	}
+}
+
+// writeHAR replaces the HAR file with the current entries. The caller holds
+// r.mu or has not shared r yet.
+func (r *Recorder) writeHAR() error {
+	entries := r.entries
+	if entries == nil {
+		entries = []harEntry{}
+	}
+	doc := harDocument{Log: harLog{Version: "1.2", Creator: harCreator{Name: "velar", Version: "1"}, Entries: entries}}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode recording: %w", err)
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write recording: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("write recording: %w", err)
+	}
+	return nil
+}
+
+// Recording is an exchange in progress.
+type Recording struct {
+	recorder *Recorder
+	started  time.Time
+	request  Request
+}
+
+// Begin snapshots req, which must already be sanitized, before it is sent.
+// A nil Recorder returns a nil Recording, whose methods do nothing.
+func (r *Recorder) Begin(req *http.Request) *Recording {
+	if r == nil {
+		return nil
+	}
+	rec := &Recording{recorder: r, started: time.Now(), request: Request{Method: req.Method, URL: req.URL.String(), Header: redact(req.Header)}}
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength >= 0 && req.ContentLength <= maxRecordedRequest {
+		body, err := io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			rec.request.Body = newBody(body)
+		}
+	}
+	return rec
+}
+
+// Wrap records resp as its body is read; the exchange is written when the
+// body reaches EOF or is closed.
+func (rec *Recording) Wrap(resp *http.Response) {
+	if rec == nil || resp == nil || resp.Body == nil {
+		return
+	}
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		rec:        rec,
+		header:     resp.Header.Clone(),
+		status:     resp.StatusCode,
+		received:   time.Now(),
+		streaming:  strings.Contains(strings.ToLower(resp.Header.Get("Content-Type")), "text/event-stream"),
+	}
+}
+
+type recordingBody struct {
+	io.ReadCloser
+	rec       *Recording
+	header    http.Header
+	status    int
+	received  time.Time
+	streaming bool
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	chunks    []Chunk
+	truncated bool
+	done      bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if n > 0 && !b.truncated {
+		if b.buf.Len()+n > maxRecordedResponse {
+			b.truncated = true
+			b.buf.Reset()
+			b.chunks = nil
+		} else {
+			b.buf.Write(p[:n])
+			if b.streaming {
+				b.chunks = append(b.chunks, Chunk{OffsetMs: milliseconds(time.Since(b.received)), Data: string(p[:n])})
+			}
+		}
+	}
+	b.mu.Unlock()
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+func (b *recordingBody) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return
+	}
+	b.done = true
+	if b.truncated {
+		log.Printf("replay: not recording %s %s: response over %d bytes", b.rec.request.Method, b.rec.request.URL, maxRecordedResponse)
+		return
+	}
+	body := b.buf.Bytes()
+	header := redact(b.header)
+	chunks := b.chunks
+	if codings, supported := contentcoding.Parse(header.Get("Content-Encoding")); supported && len(codings) > 0 {
+		// Record the decoded body so fixtures stay readable; chunks of an
+		// encoded stream cannot be replayed on their own.
+		if plain, err := contentcoding.Decode(body, codings, maxRecordedResponse); err == nil {
+			body = plain
+			header.Del("Content-Encoding")
+			chunks = nil
+		}
+	}
+	header.Del("Content-Length")
+	b.rec.recorder.add(Exchange{
+		StartedAt: b.rec.started.UTC(),
+		TimeMs:    milliseconds(time.Since(b.rec.started)),
+		Request:   b.rec.request,
+		Response: Response{
+			Status: b.status,
+			Header: header,
+			Body:   newBody(body),
+			WaitMs: milliseconds(b.received.Sub(b.rec.started)),
+			Chunks: chunks,
+		},
+	})
+}
+
+func redact(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range redactedHeaders {
+		out.Del(name)
+	}
+	return out
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
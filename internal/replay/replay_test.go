@@ -0,0 +1,133 @@
+package replay
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordExchange records one exchange of req and an upstream response with
+// the given content type and body chunks.
+func recordExchange(t *testing.T, r *Recorder, req *http.Request, contentType string, chunks ...string) {
+	t.Helper()
+	rec := r.Begin(req)
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("Set-Cookie", "session=secret")
+	pr, pw := io.Pipe()
+	resp := &http.Response{StatusCode: http.StatusOK, Header: header, Body: pr}
+	rec.Wrap(resp)
+	go func() {
+		for _, c := range chunks {
+			_, _ = pw.Write([]byte(c))
+		}
+		_ = pw.Close()
+	}()
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("read recorded body: %v", err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestRecorderRoundTrip(t *testing.T) {
+	for _, name := range []string{"session.har", "session.jsonl"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			r, err := NewRecorder(path)
+			if err != nil {
+				t.Fatalf("NewRecorder() error = %v", err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "https://api.example/v1/chat?x=1", strings.NewReader(`{"content":"[EMAIL_1]"}`))
+			req.Header.Set("Authorization", "Bearer sk-secret")
+			req.Header.Set("Content-Type", "application/json")
+			recordExchange(t, r, req, "application/json", `{"answer":"[EMAIL_1]"}`)
+			recordExchange(t, r, httptest.NewRequest(http.MethodPost, "https://api.example/v1/stream", strings.NewReader(`{}`)), "text/event-stream", "data: one\n\n", "data: two\n\n")
+			if err := r.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			raw, _ := os.ReadFile(path)
+			if strings.Contains(string(raw), "sk-secret") || strings.Contains(string(raw), "session=secret") {
+				t.Fatalf("recording contains credentials: %s", raw)
+			}
+			exchanges, err := ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if len(exchanges) != 2 {
+				t.Fatalf("exchanges = %d, want 2", len(exchanges))
+			}
+			first := exchanges[0]
+			if first.Request.Method != http.MethodPost || first.Request.URL != "https://api.example/v1/chat?x=1" || first.Request.Body.Text != `{"content":"[EMAIL_1]"}` {
+				t.Fatalf("request = %+v", first.Request)
+			}
+			if first.Response.Status != http.StatusOK || first.Response.Body.Text != `{"answer":"[EMAIL_1]"}` || len(first.Response.Chunks) != 0 {
+				t.Fatalf("response = %+v", first.Response)
+			}
+			stream := exchanges[1].Response
+			if stream.Body.Text != "data: one\n\ndata: two\n\n" || len(stream.Chunks) == 0 {
+				t.Fatalf("streamed response = %+v, want body and chunks", stream)
+			}
+		})
+	}
+}
+
+func TestPlayerMatchesAndSequences(t *testing.T) {
+	exchanges := []Exchange{
+		{Request: Request{Method: "POST", URL: "https://api.example/v1/chat", Body: Body{Text: `{"b":1,"a":"x"}`}}, Response: Response{Status: 200, Body: Body{Text: "first"}}},
+		{Request: Request{Method: "POST", URL: "https://api.example/v1/chat", Body: Body{Text: `{"a":"x","b":1}`}}, Response: Response{Status: 200, Body: Body{Text: "second"}}},
+	}
+	p, err := NewPlayer(exchanges, false, false)
+	if err != nil {
+		t.Fatalf("NewPlayer() error = %v", err)
+	}
+	for _, want := range []string{"first", "second", "second"} {
+		req := httptest.NewRequest(http.MethodPost, "https://api.example/v1/chat", strings.NewReader(`{ "a": "x", "b": 1 }`))
+		resp, ok := p.Response(req)
+		if !ok {
+			t.Fatal("Response() found no recording")
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != want || resp.ContentLength != int64(len(want)) {
+			t.Fatalf("body = %q (length %d), want %q", body, resp.ContentLength, want)
+		}
+		if got, _ := io.ReadAll(req.Body); string(got) != `{ "a": "x", "b": 1 }` {
+			t.Fatalf("request body after Response() = %q", got)
+		}
+	}
+	if _, ok := p.Response(httptest.NewRequest(http.MethodPost, "https://api.example/v1/chat", strings.NewReader(`{"a":"y"}`))); ok {
+		t.Fatal("Response() matched a different body")
+	}
+	if p.Passthrough() {
+		t.Fatal("Passthrough() = true, want false")
+	}
+}
+
+func TestPlayerReplaysChunksWithTiming(t *testing.T) {
+	exchanges := []Exchange{{
+		Request:  Request{Method: "GET", URL: "https://api.example/stream"},
+		Response: Response{Status: 200, Header: http.Header{"Content-Type": {"text/event-stream"}}, Chunks: []Chunk{{OffsetMs: 0, Data: "data: a\n\n"}, {OffsetMs: 500, Data: "data: b\n\n"}}},
+	}}
+	p, err := NewPlayer(exchanges, false, true)
+	if err != nil {
+		t.Fatalf("NewPlayer() error = %v", err)
+	}
+	var waited time.Duration
+	p.sleep = func(d time.Duration) { waited += d }
+	resp, ok := p.Response(httptest.NewRequest(http.MethodGet, "https://api.example/stream", nil))
+	if !ok {
+		t.Fatal("Response() found no recording")
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "data: a\n\ndata: b\n\n" || resp.ContentLength != -1 {
+		t.Fatalf("body = %q (length %d)", body, resp.ContentLength)
+	}
+	if waited < 400*time.Millisecond || waited > 500*time.Millisecond {
+		t.Fatalf("waited %v, want about 500ms", waited)
+	}
+}
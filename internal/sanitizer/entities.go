@@ -0,0 +1,213 @@
+package sanitizer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Entity actions for detections of one type.
+const (
+	ActionMask  = "mask"
+	ActionBlock = "block"
+	ActionWarn  = "warn"
+	ActionAllow = "allow"
+)
+
+// EntityAction sets what happens to detections of Type scoring at least
+// MinScore: ActionMask replaces them with a placeholder, ActionBlock
+// rejects the request, ActionWarn forwards them with a notification,
+// ActionAllow forwards them and ActionHold waits for a decision.
+// Detections below MinScore are ignored; a zero MinScore uses the
+// sanitizer's confidence threshold.
+type EntityAction struct {
+	Type     string
+	Action   string
+	MinScore float64
+}
+
+// Finding is a detection left in place because of its entity action,
+// described without its value.
+type Finding struct {
+	Type   string
+	Action string
+}
+
+// WithEntityActions sets per-type actions. Types without one are masked
+// when they score at least the confidence threshold. WebSocket messages
+// follow the same actions, except that held types are masked.
+func (i *SanitizingInspector) WithEntityActions(actions []EntityAction) *SanitizingInspector {
+	i.entityActions = make(map[string]EntityAction, len(actions))
+	for _, a := range actions {
+		typ := strings.ToLower(strings.TrimSpace(a.Type))
+		if typ == "" {
+			continue
+		}
+		a.Type = typ
+		a.Action = strings.ToLower(strings.TrimSpace(a.Action))
+		if a.Action == "" {
+			a.Action = ActionMask
+		}
+		i.entityActions[typ] = a
+	}
+	return i
+}
+
+// newReplacementState returns the state for masking one request under the
+// inspector's entity actions.
+func (i *SanitizingInspector) newReplacementState() *replacementState {
+	repl := newReplacementState(i.sanitizer.maxReplacements)
+	repl.policy = &entityPolicy{actions: i.entityActions, minScore: i.sanitizer.confidenceThreshold}
+	return repl
+}
+
+// entityPolicy resolves the action for each detection. A nil policy masks
+// every detection. hold is the action held types resolve to; while empty
+// they are flagged ActionHold.
+type entityPolicy struct {
+	actions  map[string]EntityAction
+	minScore float64
+	hold     string
+}
+
+// action returns the action for a detection of typ with score, or "" when
+// the detection scores below the type's minimum.
+func (p *entityPolicy) action(typ string, score float64) string {
+	if p == nil {
+		return ActionMask
+	}
+	a, ok := p.actions[strings.ToLower(typ)]
+	if !ok {
+		if score < p.minScore {
+			return ""
+		}
+		return ActionMask
+	}
+	minScore := a.MinScore
+	if minScore == 0 {
+		minScore = p.minScore
+	}
+	if score < minScore {
+		return ""
+	}
+	switch a.Action {
+	case ActionHold:
+		if p.hold != "" {
+			return p.hold
+		}
+		return ActionHold
+	case ActionBlock, ActionWarn, ActionAllow:
+		return a.Action
+	default:
+		return ActionMask
+	}
+}
+
+// floor is the lowest score any type is acted on at.
+func (p *entityPolicy) floor(threshold float64) float64 {
+	if p == nil {
+		return threshold
+	}
+	floor := p.minScore
+	for _, a := range p.actions {
+		if a.MinScore != 0 && a.MinScore < floor {
+			floor = a.MinScore
+		}
+	}
+	return floor
+}
+
+// flag records a detection of value left in place by action.
+func (r *replacementState) flag(typ, value, action string) {
+	if r.flagged == nil {
+		r.flagged = make(map[string]Finding)
+	}
+	key := typ + "|" + value
+	if _, ok := r.flagged[key]; !ok {
+		r.flagged[key] = Finding{Type: typ, Action: action}
+	}
+}
+
+// findings returns the detections left in place, one per distinct value.
+func (r *replacementState) findings() []Finding {
+	out := make([]Finding, 0, len(r.flagged))
+	for _, f := range r.flagged {
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Action != out[j].Action {
+			return out[i].Action < out[j].Action
+		}
+		return out[i].Type < out[j].Type
+	})
+	return out
+}
+
+// blocked returns the error for block findings, or nil.
+func (r *replacementState) blocked() error {
+	var types []string
+	for _, f := range r.findings() {
+		if f.Action == ActionBlock {
+			types = append(types, f.Type)
+		}
+	}
+	if len(types) == 0 {
+		return nil
+	}
+	return &BlockedError{Types: uniqueStrings(types)}
+}
+
+func uniqueStrings(values []string) []string {
+	out := values[:0]
+	seen := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		out = append(out, v)
+	}
+	return out
+}
+
+// BlockedError is returned by InspectRequest when a detection's entity
+// action is ActionBlock. It matches ErrBlocked.
+type BlockedError struct {
+	Types []string
+}
+
+func (e *BlockedError) Error() string {
+	return ErrBlocked.Error() + ": " + strings.Join(e.Types, ", ") + " detected"
+}
+
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrBlocked
+}
+
+// blockedResponse is the body of RespondBlocked, shaped like the error
+// responses of the LLM APIs Velar sits in front of.
+type blockedResponse struct {
+	Error struct {
+		Type     string   `json:"type"`
+		Message  string   `json:"message"`
+		Entities []string `json:"entities,omitempty"`
+	} `json:"error"`
+}
+
+// RespondBlocked writes the 403 for a request InspectRequest rejected with
+// err as a JSON error naming the entity types that caused it.
+func RespondBlocked(w http.ResponseWriter, err error) {
+	var body blockedResponse
+	body.Error.Type = "velar_blocked"
+	body.Error.Message = err.Error()
+	var blocked *BlockedError
+	if errors.As(err, &blocked) {
+		body.Error.Entities = blocked.Types
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,140 @@
+package sanitizer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSanitizingInspectorEntityActions(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}})).WithHybridDetector(fakeNER{}).WithEntityActions([]EntityAction{
+		{Type: "person", Action: ActionWarn},
+		{Type: "ORG", Action: ActionMask, MinScore: 0.95},
+	})
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1/chat", strings.NewReader(`{"prompt":"My name is John Smith and I work at Acme Corp in Amsterdam."}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	out, err := inspector.InspectRequest(req)
+	if err != nil {
+		t.Fatalf("InspectRequest() error = %v", err)
+	}
+	got, _ := io.ReadAll(out.Body)
+	if want := `{"prompt":"My name is John Smith and I work at Acme Corp in [LOC_1]."}`; string(got) != want {
+		t.Fatalf("body = %s, want %s", got, want)
+	}
+	md, ok := AuditMetadataFromRequest(out)
+	if !ok || !md.Sanitized || len(md.Items) != 1 {
+		t.Fatalf("audit metadata = %+v, want one masked item", md)
+	}
+	if want := []Finding{{Type: "person", Action: ActionWarn}}; !reflect.DeepEqual(md.Findings, want) {
+		t.Fatalf("findings = %+v, want %+v", md.Findings, want)
+	}
+	var actions []string
+	for _, d := range md.Detections {
+		actions = append(actions, d.Type+"="+d.Action)
+		if d.Action != ActionMask && d.Placeholder != "" {
+			t.Fatalf("detection %+v has a placeholder for an unmasked value", d)
+		}
+	}
+	if want := []string{"person=warn", "loc=mask"}; !reflect.DeepEqual(actions, want) {
+		t.Fatalf("detection actions = %v, want %v", actions, want)
+	}
+}
+
+func TestSanitizingInspectorEntityBlock(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}, PhoneDetector{}})).WithEntityActions([]EntityAction{
+		{Type: "email", Action: ActionBlock},
+	})
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1/chat", strings.NewReader(`{"content":"call +1 555 123 4567 or mail john@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	out, err := inspector.InspectRequest(req)
+	var blocked *BlockedError
+	if !errors.Is(err, ErrBlocked) || !errors.As(err, &blocked) || !reflect.DeepEqual(blocked.Types, []string{"email"}) {
+		t.Fatalf("InspectRequest() error = %v, want a block naming email", err)
+	}
+	md, _ := AuditMetadataFromRequest(out)
+	if md.Sanitized || len(md.Items) != 1 || len(md.Findings) != 1 || md.Findings[0].Action != ActionBlock {
+		t.Fatalf("audit metadata = %+v, want the masked phone and the blocking email", md)
+	}
+
+	rec := httptest.NewRecorder()
+	RespondBlocked(rec, err)
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("response = %d %q, want a 403 JSON error", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var resp blockedResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Error.Type != "velar_blocked" || !reflect.DeepEqual(resp.Error.Entities, []string{"email"}) || !strings.Contains(resp.Error.Message, "email") {
+		t.Fatalf("response body = %s", rec.Body.String())
+	}
+}
+
+func TestSanitizingInspectorEntityBlockStreamed(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}})).WithEntityActions([]EntityAction{
+		{Type: "email", Action: ActionBlock},
+	})
+	body := `{"content":"` + strings.Repeat("z", int(defaultMaxBodyBytes)) + ` john@example.com"}`
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1/chat", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = -1
+
+	out, err := inspector.InspectRequest(req)
+	if err != nil {
+		t.Fatalf("InspectRequest() error = %v", err)
+	}
+	got, err := io.ReadAll(out.Body)
+	if !errors.Is(err, ErrBlocked) {
+		t.Fatalf("read error = %v, want ErrBlocked", err)
+	}
+	if strings.Contains(string(got), "john@example.com") {
+		t.Fatal("blocked value was forwarded")
+	}
+}
+
+func TestSanitizingInspectorHoldReturnsRequestUnchanged(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}, PhoneDetector{}})).WithEntityActions([]EntityAction{
+		{Type: "email", Action: ActionHold},
+	})
+	body := `{"content":"call +1 555 123 4567, or mail john@example.com"}`
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1/chat", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	req := newRequest()
+	out, err := inspector.InspectRequest(req)
+	var held *HeldError
+	if !errors.Is(err, ErrHeld) || !errors.As(err, &held) || !reflect.DeepEqual(held.Types, []string{"email"}) {
+		t.Fatalf("InspectRequest() error = %v, want a hold for email", err)
+	}
+	if got, _ := io.ReadAll(out.Body); string(got) != body {
+		t.Fatalf("held body = %s, want it unchanged", got)
+	}
+
+	for action, want := range map[string]string{
+		ActionAllow: `{"content":"call [PHONE_1], or mail john@example.com"}`,
+		ActionMask:  `{"content":"call [PHONE_1], or mail [EMAIL_1]"}`,
+	} {
+		req := newRequest()
+		out, err := inspector.InspectRequest(req.WithContext(ContextWithHoldDecision(req.Context(), action)))
+		if err != nil {
+			t.Fatalf("InspectRequest(%s) error = %v", action, err)
+		}
+		if got, _ := io.ReadAll(out.Body); string(got) != want {
+			t.Fatalf("InspectRequest(%s) body = %s, want %s", action, got, want)
+		}
+	}
+	req = newRequest()
+	if _, err := inspector.InspectRequest(req.WithContext(ContextWithHoldDecision(req.Context(), ActionBlock))); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("InspectRequest(block) error = %v, want ErrBlocked", err)
+	}
+}
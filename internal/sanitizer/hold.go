@@ -0,0 +1,71 @@
+package sanitizer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ActionHold parks a request until a developer decides whether its values
+// are forwarded, masked or rejected. The decision is passed back to
+// InspectRequest with ContextWithHoldDecision.
+const ActionHold = "hold"
+
+// ErrHeld is returned by InspectRequest, wrapped in a *HeldError, for a
+// request with held values and no hold decision. The request is returned
+// unchanged so it can be inspected again once decided.
+var ErrHeld = errors.New("held for approval")
+
+// HeldError names the entity types a request is held for. It matches
+// ErrHeld.
+type HeldError struct {
+	Types []string
+}
+
+func (e *HeldError) Error() string {
+	return ErrHeld.Error() + ": " + strings.Join(e.Types, ", ") + " detected"
+}
+
+func (e *HeldError) Is(target error) bool {
+	return target == ErrHeld
+}
+
+type holdContextKey struct{}
+
+// ContextWithHoldDecision resolves held values of requests carrying ctx
+// with action: ActionAllow forwards them, ActionMask masks them and
+// ActionBlock rejects the request.
+func ContextWithHoldDecision(ctx context.Context, action string) context.Context {
+	return context.WithValue(ctx, holdContextKey{}, action)
+}
+
+func holdDecision(ctx context.Context) (string, bool) {
+	action, ok := ctx.Value(holdContextKey{}).(string)
+	return action, ok
+}
+
+// holds reports whether any entity type is held.
+func (i *SanitizingInspector) holds() bool {
+	for _, a := range i.entityActions {
+		if a.Action == ActionHold {
+			return true
+		}
+	}
+	return false
+}
+
+// heldTypes returns the held entity types found in r, leaving r as the
+// client sent it. Bodies too large to buffer are not scanned; held values
+// in them are masked.
+func (i *SanitizingInspector) heldTypes(r *http.Request) []string {
+	repl := i.newReplacementState()
+	i.probe(r, repl)
+	var types []string
+	for _, f := range repl.findings() {
+		if f.Action == ActionHold {
+			types = append(types, f.Type)
+		}
+	}
+	return uniqueStrings(types)
+}
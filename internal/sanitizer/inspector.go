@@ -7,11 +7,13 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"velar/internal/contentcoding"
 	"velar/internal/detect"
 	"velar/internal/notifier"
 	"velar/internal/session"
@@ -22,11 +24,25 @@ const defaultMaxBodyBytes int64 = 256 * 1024
 
 var errBodyTooLarge = errors.New("body too large")
 
+// ErrUnsupportedEncoding is returned by InspectRequest for a body in a
+// Content-Encoding the sanitizer cannot decode. Such requests are rejected
+// rather than forwarded unscanned.
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
 type auditContextKey struct{}
 
+type streamAuditContextKey struct{}
+
 type AuditMetadata struct {
 	Sanitized bool
 	Items     []SanitizedItem
+	// Detections describes each masked span without its original value.
+	Detections []Detection
+	// Monitor reports that the request was forwarded unchanged and Items
+	// are what would have been masked.
+	Monitor bool
+	// Findings are the detections whose entity action left them in place.
+	Findings []Finding
 }
 
 type SanitizingInspector struct {
@@ -37,12 +53,20 @@ type SanitizingInspector struct {
 	notificationsEnabled bool
 	restoreResponses     bool
 	sessions             *session.Store
+	requestFields        RequestFields
+	uploadPolicy         string
+	maxMultipartSize     int64
+	monitor              bool
+	entityActions        map[string]EntityAction
 }
 
 func NewSanitizingInspector(s *Sanitizer) *SanitizingInspector {
 	return &SanitizingInspector{
 		sanitizer:        s,
 		keyConfig:        DefaultKeyConfig(),
+		requestFields:    DefaultRequestFields(),
+		uploadPolicy:     UploadMask,
+		maxMultipartSize: defaultMaxMultipartBytes,
 		maxBodySize:      defaultMaxBodyBytes,
 		restoreResponses: true, // Default to enabled
 		sessions:         session.NewStore(),
@@ -76,6 +100,13 @@ func (i *SanitizingInspector) WithKeyConfig(kc KeyConfig) *SanitizingInspector {
 	return i
 }
 
+// WithRequestFields sets the headers, query parameters and path masking
+// applied to every request, whatever its method or body.
+func (i *SanitizingInspector) WithRequestFields(rf RequestFields) *SanitizingInspector {
+	i.requestFields = rf
+	return i
+}
+
 func readBodySafe(r *http.Request, maxSize int64) ([]byte, error) {
 	if r.Body == nil {
 		return nil, nil
@@ -130,6 +161,17 @@ func (i *SanitizingInspector) InspectRequest(r *http.Request) (*http.Request, er
 	if !i.sanitizer.HasDetectors() {
 		return r, nil
 	}
+	if i.Monitoring(r.Context()) {
+		return i.monitorRequest(r), nil
+	}
+	hold, decided := holdDecision(r.Context())
+	if !decided && i.holds() {
+		if types := i.heldTypes(r); len(types) > 0 {
+			log.Printf("sanitizer: holding request for approval (%s)", strings.Join(types, ", "))
+			return r, &HeldError{Types: types}
+		}
+		hold = ActionMask
+	}
 
 	// Try to get sessionID from context (set by MITM handler), or generate a new one
 	sessionID := session.GetIDFromContext(r.Context())
@@ -139,76 +181,207 @@ func (i *SanitizingInspector) InspectRequest(r *http.Request) (*http.Request, er
 			r = r.WithContext(session.ContextWithID(r.Context(), sessionID))
 		}
 	}
+	repl := i.newReplacementState()
+	repl.policy.hold = hold
+	i.requestFields.apply(r, repl, i.masker(r.Context(), repl))
+	r, streamed, err := i.inspectBody(r, sessionID, repl)
+	if err != nil || streamed {
+		return r, err
+	}
+	items := repl.items()
+	findings := repl.findings()
+	if err := repl.blocked(); err != nil {
+		log.Printf("sanitizer: %v", err)
+		return withAuditMetadata(r, AuditMetadata{Items: items, Findings: findings, Detections: repl.detectionList()}), err
+	}
+	i.warn(findings)
+	if len(items) > 0 {
+		log.Printf("sanitizer sensitive item count: %d", len(items))
+		mapping := make(map[string]string, len(items))
+		for _, item := range items {
+			mapping[item.Placeholder] = item.Original
+		}
+		i.sessions.Set(sessionID, mapping)
+		if i.notificationsEnabled {
+			msg := fmt.Sprintf(
+				"Detected: %s\nMasked before sending and restored locally",
+				strings.Join(uniqueTypes(items), ", "),
+			)
+			notifier.Notify("Velar", msg)
+		}
+	}
+	if len(items) > 0 || len(findings) > 0 {
+		r = withAuditMetadata(r, AuditMetadata{Sanitized: len(items) > 0, Items: items, Findings: findings, Detections: repl.detectionList()})
+	}
+	return r, nil
+}
+
+// warn logs and notifies the findings whose entity action is ActionWarn.
+func (i *SanitizingInspector) warn(findings []Finding) {
+	var types []string
+	for _, f := range findings {
+		if f.Action == ActionWarn {
+			types = append(types, f.Type)
+		}
+	}
+	if len(types) == 0 {
+		return
+	}
+	types = uniqueStrings(types)
+	log.Printf("sanitizer: forwarding %s unmasked (action warn)", strings.Join(types, ", "))
+	if i.notificationsEnabled {
+		notifier.Notify("Velar", fmt.Sprintf("Detected: %s\nSent unmasked (warn policy)", strings.Join(types, ", ")))
+	}
+}
+
+// masker returns a mask that tries the hybrid detector first and falls back
+// to the regex sanitizer, recording placeholders in repl.
+func (i *SanitizingInspector) masker(ctx context.Context, repl *replacementState) func(string) string {
+	return func(text string) string {
+		if i.hybridDetector != nil {
+			before := repl.found
+			if masked := applyMask(ctx, text, i.hybridDetector, repl); repl.found > before {
+				return masked
+			}
+		}
+		return applyMaskWithSanitizer(text, i.sanitizer, repl)
+	}
+}
+
+// inspectBody masks a JSON or multipart POST body, adding its placeholders
+// to repl. streamed reports that the body is sanitized as it is sent, in
+// which case the session and audit metadata are updated as the stream is
+// read.
+func (i *SanitizingInspector) inspectBody(r *http.Request, sessionID string, repl *replacementState) (_ *http.Request, streamed bool, err error) {
 	if r.Method != http.MethodPost || r.Body == nil {
-		return r, nil
+		return r, false, nil
 	}
 	if strings.Contains(strings.ToLower(r.Header.Get("Content-Type")), "text/event-stream") {
 		log.Printf("sanitizer: skipping - event-stream")
-		return r, nil
+		return r, false, nil
 	}
-	if !strings.Contains(strings.ToLower(r.Header.Get("Content-Type")), "application/json") {
-		return r, nil
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	multipartBody := mediaType == "multipart/form-data" && params["boundary"] != ""
+	if !multipartBody && !strings.Contains(strings.ToLower(r.Header.Get("Content-Type")), "application/json") {
+		return r, false, nil
 	}
 	limit := i.maxBodySize
 	if limit <= 0 {
 		limit = defaultMaxBodyBytes
 	}
+	codings, supported := contentcoding.Parse(r.Header.Get("Content-Encoding"))
+	if !supported {
+		return r, false, fmt.Errorf("%w %q", ErrUnsupportedEncoding, r.Header.Get("Content-Encoding"))
+	}
+	if multipartBody {
+		r, err := i.inspectMultipart(r, params["boundary"], codings, repl)
+		return r, false, err
+	}
 	if r.ContentLength > limit || r.ContentLength < 0 {
-		return r, nil
+		return i.streamRequest(r, codings, sessionID, repl), true, nil
 	}
 
 	body, err := readBodySafe(r, limit)
 	if err != nil {
 		log.Printf("sanitizer read failed: %v", err)
-		return r, nil
+		return r, false, nil
 	}
 	if len(body) == 0 {
 		restoreBody(r, body)
-		return r, nil
+		return r, false, nil
+	}
+	encodedBody := body
+	if len(codings) > 0 {
+		plain, err := contentcoding.Decode(body, codings, limit)
+		if err != nil {
+			log.Printf("sanitizer: skipping - cannot decode %s body: %v", strings.Join(codings, ", "), err)
+			restoreBody(r, body)
+			return r, false, nil
+		}
+		body = plain
 	}
 
 	log.Printf("sanitizer request body size: %d", len(body))
 	newBody := body
-	var items []SanitizedItem
+	before, found := repl.replacements, repl.found
 	if i.hybridDetector != nil {
-		sanitizedJSON, jsonItems, err := sanitizeJSONFields(r.Context(), body, i.hybridDetector, i.sanitizer.maxReplacements, i.keyConfig)
-		if err == nil {
+		if sanitizedJSON, err := maskJSONFields(r.Context(), body, i.hybridDetector, repl, i.keyConfig); err == nil {
 			newBody = sanitizedJSON
-			items = jsonItems
 		}
 	}
-	if len(items) == 0 {
+	if repl.found == found {
 		// JSON-aware fallback: only sanitize values under configured content keys,
 		// skipping auth/service fields to avoid breaking API authentication.
-		sanitizedJSON, fallbackItems, err := sanitizeJSONFieldsWithSanitizer(body, i.sanitizer, i.keyConfig)
-		if err == nil {
+		if sanitizedJSON, err := maskJSONFieldsWithSanitizer(body, i.sanitizer, repl, i.keyConfig); err == nil {
 			newBody = sanitizedJSON
-			items = fallbackItems
 		} else {
 			// Non-JSON body: fall back to full-text sanitization
-			sanitized, textItems := i.sanitizer.Sanitize(string(body))
-			newBody = []byte(sanitized)
-			items = textItems
+			repl.field = "body"
+			newBody = []byte(applyMaskWithSanitizer(string(body), i.sanitizer, repl))
+		}
+	}
+	if len(codings) > 0 {
+		if repl.replacements == before {
+			// Nothing was masked; keep the client's bytes.
+			newBody = encodedBody
+		} else if encoded, err := contentcoding.Encode(newBody, codings); err == nil {
+			newBody = encoded
+		} else {
+			log.Printf("sanitizer: re-encoding failed, forwarding uncompressed: %v", err)
+			r.Header.Del("Content-Encoding")
 		}
 	}
 	restoreBody(r, newBody)
-	if len(items) > 0 {
-		log.Printf("sanitizer sensitive item count: %d", len(items))
-		mapping := make(map[string]string, len(items))
-		for _, item := range items {
-			mapping[item.Placeholder] = item.Original
+	return r, false, nil
+}
+
+// streamRequest sanitizes a body that is too large or of unknown length to
+// buffer by masking it as it is read. The session mapping is updated as
+// items are found, so it is complete once the body has been sent.
+func (i *SanitizingInspector) streamRequest(r *http.Request, codings []string, sessionID string, repl *replacementState) *http.Request {
+	ctx := r.Context()
+	body := r.Body
+	if len(codings) > 0 {
+		// The sanitized body is forwarded uncompressed.
+		body = contentcoding.NewReader(body, codings)
+		r.Header.Del("Content-Encoding")
+	}
+	audit := &streamAudit{}
+	onItems := func(items []SanitizedItem, done bool) {
+		findings := repl.findings()
+		if len(items) == 0 && len(findings) == 0 {
+			return
 		}
-		i.sessions.Set(sessionID, mapping)
-		if i.notificationsEnabled {
-			msg := fmt.Sprintf(
-				"Detected: %s\nMasked before sending and restored locally",
-				strings.Join(uniqueTypes(items), ", "),
-			)
-			notifier.Notify("Velar", msg)
+		if len(items) > 0 {
+			mapping := make(map[string]string, len(items))
+			for _, item := range items {
+				mapping[item.Placeholder] = item.Original
+			}
+			i.sessions.Set(sessionID, mapping)
+		}
+		audit.set(items, findings, repl.detectionList())
+		if done && repl.blocked() == nil {
+			i.warn(findings)
+		}
+		if done && len(items) > 0 {
+			log.Printf("sanitizer sensitive item count: %d (streamed)", len(items))
+			if i.notificationsEnabled {
+				msg := fmt.Sprintf(
+					"Detected: %s\nMasked before sending and restored locally",
+					strings.Join(uniqueTypes(items), ", "),
+				)
+				notifier.Notify("Velar", msg)
+			}
 		}
-		r = withAuditMetadata(r, AuditMetadata{Sanitized: true, Items: items})
 	}
-	return r, nil
+	// Items already found in the URL and headers are restorable before the
+	// body starts.
+	onItems(repl.items(), false)
+	log.Printf("sanitizer: streaming request body (length %d)", r.ContentLength)
+	r.Body = newJSONStreamSanitizer(body, i.keyConfig, repl, i.masker(ctx, repl), onItems)
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+	return r.WithContext(context.WithValue(ctx, streamAuditContextKey{}, audit))
 }
 
 func uniqueTypes(items []SanitizedItem) []string {
@@ -246,17 +419,19 @@ func (i *SanitizingInspector) InspectResponse(r *http.Response) (*http.Response,
 	if !isTextContent(contentType) && !streaming {
 		return r, nil
 	}
-	// Skip if response body is compressed — we cannot do text replacement
-	// on gzip/br/zstd encoded content. The browser will decompress it.
-	if ce := r.Header.Get("Content-Encoding"); ce != "" {
+	// Bodies in a coding we cannot decode are passed through;
+	// placeholders in them stay unrestored.
+	codings, supported := contentcoding.Parse(r.Header.Get("Content-Encoding"))
+	if !supported {
 		return r, nil
 	}
 	limit := i.maxBodySize
 	if limit <= 0 {
 		limit = defaultMaxBodyBytes
 	}
-	if !streaming && (r.ContentLength > limit || r.ContentLength < 0) {
-		return r, nil
+	// Bodies too large or of unknown length are restored as they stream.
+	if r.ContentLength > limit || r.ContentLength < 0 {
+		streaming = true
 	}
 	if r.Request == nil {
 		return r, nil
@@ -276,6 +451,13 @@ func (i *SanitizingInspector) InspectResponse(r *http.Response) (*http.Response,
 	if !ok || len(sess.Mapping) == 0 || r.Body == nil {
 		return r, nil
 	}
+	if len(codings) > 0 {
+		// The restored body is sent to the client uncompressed.
+		r.Body = contentcoding.NewReader(r.Body, codings)
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+	}
 	if streaming {
 		r.Body = NewStreamingRestorer(r.Body, sess.Mapping)
 		r.ContentLength = -1
@@ -284,12 +466,18 @@ func (i *SanitizingInspector) InspectResponse(r *http.Response) (*http.Response,
 	}
 	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
 	if err != nil {
-		return r, nil
+		_ = r.Body.Close()
+		return nil, fmt.Errorf("read response body: %w", err)
 	}
-	_ = r.Body.Close()
 	if int64(len(body)) > limit {
+		// Too large to restore in memory; restore what was read and the
+		// rest as it streams.
+		r.Body = NewStreamingRestorer(prefixedReadCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}, sess.Mapping)
+		r.ContentLength = -1
+		r.Header.Del("Content-Length")
 		return r, nil
 	}
+	_ = r.Body.Close()
 	restored := string(body)
 	for placeholder, original := range sess.Mapping {
 		restored = strings.ReplaceAll(restored, placeholder, original)
@@ -302,6 +490,11 @@ func (i *SanitizingInspector) InspectResponse(r *http.Response) (*http.Response,
 	return r, nil
 }
 
+type prefixedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 func isStreamingResponse(r *http.Response) bool {
 	if r == nil {
 		return false
@@ -322,8 +515,20 @@ func withAuditMetadata(r *http.Request, md AuditMetadata) *http.Request {
 	return r.WithContext(ctx)
 }
 
+// BodyStreamed reports whether r's body is sanitized as it is forwarded, in
+// which case its detections are not known until it has been sent.
+func BodyStreamed(r *http.Request) bool {
+	_, ok := r.Context().Value(streamAuditContextKey{}).(*streamAudit)
+	return ok
+}
+
 func AuditMetadataFromRequest(r *http.Request) (AuditMetadata, bool) {
 	v := r.Context().Value(auditContextKey{})
-	md, ok := v.(AuditMetadata)
-	return md, ok
+	if md, ok := v.(AuditMetadata); ok {
+		return md, true
+	}
+	if a, ok := r.Context().Value(streamAuditContextKey{}).(*streamAudit); ok {
+		return a.metadata(), true
+	}
+	return AuditMetadata{}, false
 }
@@ -1,11 +1,15 @@
 package sanitizer
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
 	"testing"
+
+	"velar/internal/contentcoding"
 )
 
 func TestSanitizingInspectorInspectRequestSanitizesAndRestoresBody(t *testing.T) {
@@ -45,6 +49,35 @@ func TestSanitizingInspectorInspectRequestSanitizesAndRestoresBody(t *testing.T)
 	}
 }
 
+func TestSanitizingInspectorRecordsDetections(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}}))
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1/chat?q=ann@example.com", strings.NewReader(`{"content":"hi ann@example.com, bob@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	out, err := inspector.InspectRequest(req)
+	if err != nil {
+		t.Fatalf("InspectRequest() error = %v", err)
+	}
+	md, _ := AuditMetadataFromRequest(out)
+	want := []Detection{
+		{Type: "email", Placeholder: "[EMAIL_1]", Field: "query.q", Start: 0, End: 15, Action: ActionMask},
+		{Type: "email", Placeholder: "[EMAIL_1]", Field: "body.content", Start: 3, End: 18, Action: ActionMask},
+		{Type: "email", Placeholder: "[EMAIL_2]", Field: "body.content", Start: 20, End: 35, Action: ActionMask},
+	}
+	if len(md.Detections) != len(want) {
+		t.Fatalf("detections = %+v, want %d", md.Detections, len(want))
+	}
+	for idx, d := range md.Detections {
+		if d.Source != "sanitizer" || d.Score <= 0 {
+			t.Fatalf("detection %d = %+v, want sanitizer source and a score", idx, d)
+		}
+		d.Source, d.Score = "", 0
+		if d != want[idx] {
+			t.Fatalf("detection %d = %+v, want %+v", idx, d, want[idx])
+		}
+	}
+}
+
 func TestSanitizingInspectorInspectRequestSkipsNonText(t *testing.T) {
 	s := New([]Detector{EmailDetector{}})
 	inspector := NewSanitizingInspector(s)
@@ -63,10 +96,11 @@ func TestSanitizingInspectorInspectRequestSkipsNonText(t *testing.T) {
 	}
 }
 
-func TestSanitizingInspectorInspectRequestSkipsUnknownLength(t *testing.T) {
+func TestSanitizingInspectorInspectRequestStreamsUnknownLengthByKey(t *testing.T) {
 	s := New([]Detector{EmailDetector{}})
 	inspector := NewSanitizingInspector(s)
 
+	// Streamed bodies honour KeyConfig: "email" is not a content key.
 	original := `{"email":"john@example.com"}`
 	req, _ := http.NewRequest(http.MethodPost, "https://example.com/stream", io.NopCloser(strings.NewReader(original)))
 	req.ContentLength = -1
@@ -179,3 +213,109 @@ func TestSanitizingInspectorInspectResponseSkipsNonTextContent(t *testing.T) {
 		t.Fatalf("body mutated unexpectedly: %q", got)
 	}
 }
+
+func TestSanitizingInspectorHandlesGzipBodies(t *testing.T) {
+	s := New([]Detector{EmailDetector{}})
+	inspector := NewSanitizingInspector(s)
+
+	compressed, err := contentcoding.Encode([]byte(`{"content":"john@example.com"}`), []string{"gzip"})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1/chat/completions", bytes.NewReader(compressed))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	out, err := inspector.InspectRequest(req)
+	if err != nil {
+		t.Fatalf("InspectRequest() error = %v", err)
+	}
+	if out.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("request should stay gzip encoded, got %q", out.Header.Get("Content-Encoding"))
+	}
+	raw, _ := io.ReadAll(out.Body)
+	if out.ContentLength != int64(len(raw)) {
+		t.Fatalf("ContentLength=%d want %d", out.ContentLength, len(raw))
+	}
+	plain, err := contentcoding.Decode(raw, []string{"gzip"}, 1<<20)
+	if err != nil || !strings.Contains(string(plain), "[EMAIL_1]") || strings.Contains(string(plain), "john@example.com") {
+		t.Fatalf("decoded request = %q, %v", plain, err)
+	}
+
+	respBody, _ := contentcoding.Encode([]byte(`{"echo":"[EMAIL_1]"}`), []string{"gzip"})
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       out,
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(respBody)))
+
+	restored, err := inspector.InspectResponse(resp)
+	if err != nil {
+		t.Fatalf("InspectResponse() error = %v", err)
+	}
+	body, _ := io.ReadAll(restored.Body)
+	if string(body) != `{"echo":"john@example.com"}` {
+		t.Fatalf("restored body = %q", body)
+	}
+	if restored.Header.Get("Content-Encoding") != "" || restored.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Fatalf("unexpected headers after restore: %v", restored.Header)
+	}
+}
+
+func TestSanitizingInspectorHandlesBrotliAndZstdBodies(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}}))
+	for _, coding := range []string{"br", "zstd"} {
+		compressed, err := contentcoding.Encode([]byte(`{"content":"john@example.com"}`), []string{coding})
+		if err != nil {
+			t.Fatalf("%s: encode: %v", coding, err)
+		}
+		req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1", bytes.NewReader(compressed))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", coding)
+		out, err := inspector.InspectRequest(req)
+		if err != nil {
+			t.Fatalf("%s: InspectRequest() error = %v", coding, err)
+		}
+		raw, _ := io.ReadAll(out.Body)
+		plain, err := contentcoding.Decode(raw, []string{coding}, 1<<20)
+		if err != nil || !strings.Contains(string(plain), "[EMAIL_1]") || strings.Contains(string(plain), "john@example.com") {
+			t.Fatalf("%s: decoded request = %q, %v", coding, plain, err)
+		}
+	}
+}
+
+func TestSanitizingInspectorRejectsUnsupportedEncoding(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}}))
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1", strings.NewReader("opaque-compress"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "compress")
+	if _, err := inspector.InspectRequest(req); !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Fatalf("InspectRequest() error = %v, want ErrUnsupportedEncoding", err)
+	}
+}
+
+func TestSanitizingInspectorRestoresGzipStream(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}}))
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1", strings.NewReader(`{"content":"john@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	out, _ := inspector.InspectRequest(req)
+
+	stream, _ := contentcoding.Encode([]byte("data: {\"delta\":\"[EMAIL_1]\"}\n\n"), []string{"gzip"})
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(bytes.NewReader(stream)), ContentLength: -1, Request: out}
+	resp.Header.Set("Content-Type", "text/event-stream")
+	resp.Header.Set("Content-Encoding", "gzip")
+
+	restored, err := inspector.InspectResponse(resp)
+	if err != nil {
+		t.Fatalf("InspectResponse() error = %v", err)
+	}
+	body, _ := io.ReadAll(restored.Body)
+	if !strings.Contains(string(body), "john@example.com") || restored.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("stream not restored: %q headers=%v", body, restored.Header)
+	}
+}
@@ -74,19 +74,25 @@ func sanitizeJSONFields(ctx context.Context, raw []byte, detector detect.Detecto
 	if detector == nil || len(raw) == 0 {
 		return raw, nil, nil
 	}
-	var payload any
-	if err := json.Unmarshal(raw, &payload); err != nil {
-		return raw, nil, err
-	}
-	repl := &replacementState{maxReplacements: maxReplacements, counters: map[string]int{}, byKey: map[string]string{}, byPlaceholder: map[string]SanitizedItem{}}
-	payload = walkAndMask(ctx, payload, detector, repl, "", kc)
-	out, err := json.Marshal(payload)
+	repl := newReplacementState(maxReplacements)
+	out, err := maskJSONFields(ctx, raw, detector, repl, kc)
 	if err != nil {
 		return raw, nil, err
 	}
 	return out, repl.items(), nil
 }
 
+// maskJSONFields masks sanitizable JSON values with detector, recording
+// placeholders in repl so several payloads can share one numbering.
+func maskJSONFields(ctx context.Context, raw []byte, detector detect.Detector, repl *replacementState, kc KeyConfig) ([]byte, error) {
+	var payload any
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, err
+	}
+	payload = walkAndMask(ctx, payload, detector, repl, "", kc)
+	return json.Marshal(payload)
+}
+
 // sanitizeJSONFieldsWithSanitizer performs JSON-aware sanitization using the regex-based Sanitizer
 // as a fallback when HybridDetector is not available or finds nothing.
 // It only sanitizes values under sanitizeKeys and never touches skipKeys.
@@ -94,25 +100,62 @@ func sanitizeJSONFieldsWithSanitizer(raw []byte, s *Sanitizer, kc KeyConfig) ([]
 	if s == nil || len(raw) == 0 {
 		return raw, nil, nil
 	}
-	var payload any
-	if err := json.Unmarshal(raw, &payload); err != nil {
-		return raw, nil, err
-	}
-	repl := &replacementState{maxReplacements: s.maxReplacements, counters: map[string]int{}, byKey: map[string]string{}, byPlaceholder: map[string]SanitizedItem{}}
-	payload = walkAndMaskWithSanitizer(payload, s, repl, "", kc)
-	out, err := json.Marshal(payload)
+	repl := newReplacementState(s.maxReplacements)
+	out, err := maskJSONFieldsWithSanitizer(raw, s, repl, kc)
 	if err != nil {
 		return raw, nil, err
 	}
 	return out, repl.items(), nil
 }
 
+func maskJSONFieldsWithSanitizer(raw []byte, s *Sanitizer, repl *replacementState, kc KeyConfig) ([]byte, error) {
+	var payload any
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, err
+	}
+	payload = walkAndMaskWithSanitizer(payload, s, repl, "", kc)
+	return json.Marshal(payload)
+}
+
 type replacementState struct {
 	maxReplacements int
 	replacements    int
 	counters        map[string]int
 	byKey           map[string]string
 	byPlaceholder   map[string]SanitizedItem
+	// field names the value being masked, and offset is where the masked
+	// text starts in it, for the detections recorded.
+	field      string
+	offset     int
+	detections []Detection
+	// policy decides what happens to each detection; flagged holds those
+	// left in place, keyed like byKey, and found counts every detection
+	// acted on.
+	policy  *entityPolicy
+	flagged map[string]Finding
+	found   int
+}
+
+// maxDetections caps the detections kept for one request; replacements
+// past it are made but not reported.
+const maxDetections = 256
+
+// Detection is one detected span, described without its original value.
+// Start and End are byte offsets in the value of Field. Placeholder is
+// empty unless Action is ActionMask.
+type Detection struct {
+	Type        string  `json:"type"`
+	Placeholder string  `json:"placeholder"`
+	Field       string  `json:"field,omitempty"`
+	Start       int     `json:"start"`
+	End         int     `json:"end"`
+	Source      string  `json:"source"`
+	Score       float64 `json:"score"`
+	Action      string  `json:"action"`
+}
+
+func newReplacementState(maxReplacements int) *replacementState {
+	return &replacementState{maxReplacements: maxReplacements, counters: map[string]int{}, byKey: map[string]string{}, byPlaceholder: map[string]SanitizedItem{}}
 }
 
 func (r *replacementState) items() []SanitizedItem {
@@ -124,6 +167,20 @@ func (r *replacementState) items() []SanitizedItem {
 	return out
 }
 
+func (r *replacementState) detect(d Detection) {
+	if len(r.detections) < maxDetections {
+		d.Field = r.field
+		d.Start += r.offset
+		d.End += r.offset
+		r.detections = append(r.detections, d)
+	}
+}
+
+// detectionList returns a copy of the detections recorded so far.
+func (r *replacementState) detectionList() []Detection {
+	return append([]Detection(nil), r.detections...)
+}
+
 func walkAndMask(ctx context.Context, node any, detector detect.Detector, repl *replacementState, key string, kc KeyConfig) any {
 	switch v := node.(type) {
 	case map[string]any:
@@ -140,6 +197,7 @@ func walkAndMask(ctx context.Context, node any, detector detect.Detector, repl *
 		if !kc.shouldSanitize(key) {
 			return v
 		}
+		repl.field = "body." + key
 		return applyMask(ctx, v, detector, repl)
 	default:
 		return node
@@ -162,6 +220,7 @@ func walkAndMaskWithSanitizer(node any, s *Sanitizer, repl *replacementState, ke
 		if !kc.shouldSanitize(key) {
 			return v
 		}
+		repl.field = "body." + key
 		return applyMaskWithSanitizer(v, s, repl)
 	default:
 		return node
@@ -169,7 +228,7 @@ func walkAndMaskWithSanitizer(node any, s *Sanitizer, repl *replacementState, ke
 }
 
 func applyMaskWithSanitizer(input string, s *Sanitizer, repl *replacementState) string {
-	_, matches := s.collectMatches(input)
+	_, matches := s.collectMatchesAbove(input, repl.policy.floor(s.confidenceThreshold))
 	if len(matches) == 0 {
 		return input
 	}
@@ -185,6 +244,16 @@ func applyMaskWithSanitizer(input string, s *Sanitizer, repl *replacementState)
 			continue
 		}
 		upperType := strings.ToUpper(m.Type)
+		action := repl.policy.action(upperType, m.Confidence)
+		if action == "" {
+			continue
+		}
+		repl.found++
+		if action != ActionMask {
+			repl.flag(strings.ToLower(upperType), value, action)
+			repl.detect(Detection{Type: strings.ToLower(upperType), Start: m.Start, End: m.End, Source: "sanitizer", Score: m.Confidence, Action: action})
+			continue
+		}
 		key := upperType + "|" + value
 		placeholder, ok := repl.byKey[key]
 		if !ok {
@@ -197,6 +266,7 @@ func applyMaskWithSanitizer(input string, s *Sanitizer, repl *replacementState)
 		b.WriteString(placeholder)
 		cursor = m.End
 		repl.replacements++
+		repl.detect(Detection{Type: strings.ToLower(upperType), Placeholder: placeholder, Start: m.Start, End: m.End, Source: "sanitizer", Score: m.Confidence, Action: ActionMask})
 	}
 	b.WriteString(input[cursor:])
 	return b.String()
@@ -228,6 +298,17 @@ func applyMask(ctx context.Context, input string, detector detect.Detector, repl
 			continue
 		}
 		upperType := strings.ToUpper(e.Type)
+		action := repl.policy.action(upperType, e.Score)
+		if action == "" {
+			continue
+		}
+		repl.found++
+		if action != ActionMask {
+			lastEnd = e.End
+			repl.flag(strings.ToLower(upperType), value, action)
+			repl.detect(Detection{Type: strings.ToLower(upperType), Start: e.Start, End: e.End, Source: e.Source, Score: e.Score, Action: action})
+			continue
+		}
 		key := upperType + "|" + value
 		placeholder, ok := repl.byKey[key]
 		if !ok {
@@ -241,6 +322,7 @@ func applyMask(ctx context.Context, input string, detector detect.Detector, repl
 		cursor = e.End
 		lastEnd = e.End
 		repl.replacements++
+		repl.detect(Detection{Type: strings.ToLower(upperType), Placeholder: placeholder, Start: e.Start, End: e.End, Source: e.Source, Score: e.Score, Action: ActionMask})
 	}
 	b.WriteString(input[cursor:])
 	return b.String()
@@ -0,0 +1,377 @@
+package sanitizer
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// streamWindow is how much of a single sanitizable string value is
+	// buffered before it is masked and emitted as a segment.
+	streamWindow = 64 * 1024
+	// streamMaxKey caps how much of an object key is kept for matching
+	// against KeyConfig; longer keys are never sanitized.
+	streamMaxKey   = 256
+	streamReadSize = 32 * 1024
+)
+
+type jsonFrame struct {
+	object    bool
+	expectKey bool
+	key       string
+}
+
+// jsonStreamSanitizer masks sanitizable JSON string values while the body
+// is read, so arbitrarily large or chunked bodies are inspected with
+// bounded memory. Bytes outside masked values are copied through
+// unchanged. Long values are masked in segments cut at a newline or space
+// where possible, so a match is only missed if it straddles a segment
+// boundary without whitespace. Once the body turns out not to be JSON, the
+// rest of it is masked as plain text in the same segments.
+type jsonStreamSanitizer struct {
+	src     io.ReadCloser
+	kc      KeyConfig
+	mask    func(string) string
+	repl    *replacementState
+	onItems func(items []SanitizedItem, done bool)
+
+	stack      []jsonFrame
+	inString   bool
+	escaped    bool
+	isKey      bool
+	sanitizing bool
+	key        []byte
+	segment    []byte
+	text       bool
+	// offset is how much of the current value was masked in earlier
+	// segments, so detections report spans in the whole value.
+	offset int
+
+	buf   []byte
+	out   []byte
+	count int
+	eof   bool
+}
+
+func newJSONStreamSanitizer(src io.ReadCloser, kc KeyConfig, repl *replacementState, mask func(string) string, onItems func([]SanitizedItem, bool)) *jsonStreamSanitizer {
+	return &jsonStreamSanitizer{src: src, kc: kc, repl: repl, mask: mask, onItems: onItems}
+}
+
+func (s *jsonStreamSanitizer) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+		if s.buf == nil {
+			s.buf = make([]byte, streamReadSize)
+		}
+		n, err := s.src.Read(s.buf)
+		if n > 0 {
+			s.process(s.buf[:n])
+		}
+		if err == io.EOF {
+			s.finish()
+			s.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		// A block finding aborts the upload mid-body.
+		if len(s.repl.flagged) > 0 {
+			if err := s.repl.blocked(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+func (s *jsonStreamSanitizer) Close() error {
+	s.out = nil
+	s.segment = nil
+	return s.src.Close()
+}
+
+func (s *jsonStreamSanitizer) process(chunk []byte) {
+	for i, c := range chunk {
+		if s.text {
+			s.textBytes(chunk[i:])
+			return
+		}
+		if s.inString {
+			s.stringByte(c)
+		} else {
+			s.structByte(c)
+		}
+	}
+}
+
+func (s *jsonStreamSanitizer) stringByte(c byte) {
+	if c == '"' && !s.escaped {
+		s.endString()
+		return
+	}
+	if s.escaped {
+		s.escaped = false
+	} else if c == '\\' {
+		s.escaped = true
+	}
+	switch {
+	case s.sanitizing:
+		s.segment = append(s.segment, c)
+		if len(s.segment) >= streamWindow {
+			s.flushSegment(false)
+		}
+	case s.isKey:
+		s.out = append(s.out, c)
+		if len(s.key) <= streamMaxKey {
+			s.key = append(s.key, c)
+		}
+	default:
+		s.out = append(s.out, c)
+	}
+}
+
+func (s *jsonStreamSanitizer) endString() {
+	if s.sanitizing {
+		s.flushSegment(true)
+		s.sanitizing = false
+	}
+	s.out = append(s.out, '"')
+	s.inString = false
+	if s.isKey {
+		top := &s.stack[len(s.stack)-1]
+		top.key = ""
+		if len(s.key) <= streamMaxKey {
+			_ = json.Unmarshal(quoted(s.key), &top.key)
+		}
+		top.expectKey = false
+		s.key = s.key[:0]
+		s.isKey = false
+	}
+}
+
+func (s *jsonStreamSanitizer) structByte(c byte) {
+	malformed := strings.IndexByte(jsonStructBytes, c) < 0
+	if c == '}' || c == ']' {
+		malformed = len(s.stack) == 0 || s.stack[len(s.stack)-1].object != (c == '}')
+	}
+	if malformed {
+		log.Printf("sanitizer: malformed JSON stream, masking remainder as text")
+		s.text = true
+		s.offset = 0
+		s.textBytes([]byte{c})
+		return
+	}
+	s.out = append(s.out, c)
+	switch c {
+	case '{':
+		s.stack = append(s.stack, jsonFrame{object: true, expectKey: true})
+	case '[':
+		s.stack = append(s.stack, jsonFrame{key: s.valueKey()})
+	case '}', ']':
+		s.stack = s.stack[:len(s.stack)-1]
+	case ',':
+		if len(s.stack) > 0 && s.stack[len(s.stack)-1].object {
+			s.stack[len(s.stack)-1].expectKey = true
+		}
+	case '"':
+		s.inString = true
+		if len(s.stack) > 0 && s.stack[len(s.stack)-1].object && s.stack[len(s.stack)-1].expectKey {
+			s.isKey = true
+		} else {
+			s.sanitizing = s.kc.shouldSanitize(s.valueKey())
+			s.offset = 0
+		}
+	}
+}
+
+// jsonStructBytes are the bytes that may appear outside JSON strings:
+// whitespace, punctuation, numbers and the literals true, false and null.
+const jsonStructBytes = " \t\r\n{}[],:\"-+.0123456789eEtrufalsn"
+
+// textBytes buffers the rest of a body that is not JSON and masks it as
+// plain text.
+func (s *jsonStreamSanitizer) textBytes(chunk []byte) {
+	s.segment = append(s.segment, chunk...)
+	for len(s.segment) >= streamWindow {
+		before := len(s.segment)
+		s.flushSegment(false)
+		if len(s.segment) == before {
+			s.flushSegment(true)
+		}
+	}
+}
+
+// valueKey returns the key a value at the current position is sanitized
+// under. Array elements inherit the key of the array, as in walkAndMask.
+func (s *jsonStreamSanitizer) valueKey() string {
+	if len(s.stack) == 0 {
+		return ""
+	}
+	return s.stack[len(s.stack)-1].key
+}
+
+func (s *jsonStreamSanitizer) flushSegment(final bool) {
+	cut := len(s.segment)
+	if !final {
+		cut = segmentCut(s.segment)
+		if cut == 0 {
+			return
+		}
+	}
+	if s.text {
+		s.out = append(s.out, s.maskText(s.segment[:cut])...)
+	} else {
+		s.out = append(s.out, s.maskRaw(s.segment[:cut])...)
+	}
+	s.segment = append(s.segment[:0], s.segment[cut:]...)
+	if n := len(s.repl.byPlaceholder) + len(s.repl.flagged); n != s.count {
+		s.count = n
+		if s.onItems != nil {
+			s.onItems(s.repl.items(), false)
+		}
+	}
+}
+
+// maskRaw masks one JSON-escaped segment of a string value and returns it
+// re-escaped. Segments without findings are returned untouched.
+func (s *jsonStreamSanitizer) maskRaw(raw []byte) []byte {
+	var text string
+	if err := json.Unmarshal(quoted(raw), &text); err != nil {
+		return raw
+	}
+	s.repl.field, s.repl.offset = "body."+s.valueKey(), s.offset
+	masked := s.mask(text)
+	s.repl.offset = 0
+	s.offset += len(text)
+	if masked == text {
+		return raw
+	}
+	encoded, err := json.Marshal(masked)
+	if err != nil {
+		return raw
+	}
+	return encoded[1 : len(encoded)-1]
+}
+
+// maskText masks one segment of a body that is not JSON.
+func (s *jsonStreamSanitizer) maskText(raw []byte) []byte {
+	text := string(raw)
+	s.repl.field, s.repl.offset = "body", s.offset
+	masked := s.mask(text)
+	s.repl.offset = 0
+	s.offset += len(text)
+	return []byte(masked)
+}
+
+func (s *jsonStreamSanitizer) finish() {
+	if s.sanitizing || s.text {
+		// Truncated body: emit what is left of the open value.
+		s.flushSegment(true)
+	}
+	if s.onItems != nil {
+		s.onItems(s.repl.items(), true)
+	}
+}
+
+func quoted(raw []byte) []byte {
+	b := make([]byte, 0, len(raw)+2)
+	b = append(b, '"')
+	b = append(b, raw...)
+	return append(b, '"')
+}
+
+// segmentCut picks where to split a buffered, still-escaped string value.
+// It prefers the last escaped newline, then the last space, in the second
+// half of the buffer, and otherwise cuts at the last character boundary
+// that does not split an escape sequence, a UTF-8 sequence or a surrogate
+// pair. Zero means no safe cut was found.
+func segmentCut(seg []byte) int {
+	newline, space, boundary := 0, 0, 0
+scan:
+	for i := 0; i < len(seg); {
+		c := seg[i]
+		if c == '\\' {
+			if i+1 >= len(seg) {
+				break
+			}
+			n := 2
+			switch seg[i+1] {
+			case 'n':
+				boundary = i
+				newline = i + 2
+			case 'u':
+				if i+6 > len(seg) {
+					break scan
+				}
+				if !isLowSurrogateEscape(seg[i+2 : i+6]) {
+					boundary = i
+				}
+				n = 6
+			default:
+				boundary = i
+			}
+			i += n
+			continue
+		}
+		if c == ' ' {
+			space = i + 1
+		}
+		if c < utf8.RuneSelf || utf8.RuneStart(c) {
+			boundary = i
+		}
+		i++
+	}
+	half := len(seg) / 2
+	switch {
+	case newline > half:
+		return newline
+	case space > half:
+		return space
+	default:
+		return boundary
+	}
+}
+
+func isLowSurrogateEscape(hex []byte) bool {
+	if hex[0] != 'd' && hex[0] != 'D' {
+		return false
+	}
+	switch hex[1] {
+	case 'c', 'C', 'd', 'D', 'e', 'E', 'f', 'F':
+		return true
+	}
+	return false
+}
+
+// streamAudit carries the items found by a streamed request body, which
+// are only known once the body has been sent, and those found in monitor
+// mode.
+type streamAudit struct {
+	monitor bool
+
+	mu         sync.Mutex
+	items      []SanitizedItem
+	findings   []Finding
+	detections []Detection
+}
+
+func (a *streamAudit) set(items []SanitizedItem, findings []Finding, detections []Detection) {
+	a.mu.Lock()
+	a.items = items
+	a.findings = findings
+	a.detections = detections
+	a.mu.Unlock()
+}
+
+func (a *streamAudit) metadata() AuditMetadata {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return AuditMetadata{Sanitized: !a.monitor && len(a.items) > 0, Items: a.items, Findings: a.findings, Detections: a.detections, Monitor: a.monitor}
+}
@@ -0,0 +1,141 @@
+package sanitizer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"velar/internal/session"
+)
+
+func streamSanitize(t *testing.T, src io.Reader) (string, []SanitizedItem) {
+	t.Helper()
+	s := New([]Detector{EmailDetector{}})
+	repl := newReplacementState(0)
+	var got []SanitizedItem
+	mask := func(text string) string { return applyMaskWithSanitizer(text, s, repl) }
+	out, err := io.ReadAll(newJSONStreamSanitizer(io.NopCloser(src), DefaultKeyConfig(), repl, mask, func(items []SanitizedItem, done bool) {
+		if done {
+			got = items
+		}
+	}))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(out), got
+}
+
+func TestJSONStreamSanitizerMasksLargeValues(t *testing.T) {
+	var b strings.Builder
+	for b.Len() < 3*streamWindow {
+		b.WriteString("log line with alice@example.com\\n")
+	}
+	b.WriteString(strings.Repeat("y", streamWindow+10))
+	b.WriteString(" bob@example.com")
+	body := `{"model":"alice@example.com","messages":[{"role":"user","content":"` + b.String() + `"}]}`
+
+	out, items := streamSanitize(t, iotest.HalfReader(strings.NewReader(body)))
+	var payload struct {
+		Model    string `json:"model"`
+		Messages []struct {
+			Content string `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal([]byte(out), &payload); err != nil {
+		t.Fatalf("output is not valid JSON: %v", err)
+	}
+	if payload.Model != "alice@example.com" {
+		t.Fatalf("skip key was masked: %q", payload.Model)
+	}
+	content := payload.Messages[0].Content
+	if strings.Contains(content, "@example.com") {
+		t.Fatalf("email left unmasked in streamed content")
+	}
+	if !strings.Contains(content, "log line with [EMAIL_1]\n") || !strings.HasSuffix(content, " [EMAIL_2]") {
+		t.Fatalf("unexpected masked content tail %q", content[len(content)-40:])
+	}
+	if len(items) != 2 {
+		t.Fatalf("items = %+v, want 2", items)
+	}
+}
+
+func TestJSONStreamSanitizerPreservesBytesWithoutFindings(t *testing.T) {
+	value := strings.Repeat(`café 😀 \"quoted\" \\ \u00e9 `, streamWindow/16)
+	body := "{\n  \"content\": \"" + value + "\",\n  \"n\": [1, 2.5, true, null]\n}"
+	out, items := streamSanitize(t, iotest.OneByteReader(strings.NewReader(body)))
+	if out != body {
+		t.Fatalf("body changed without findings")
+	}
+	if len(items) != 0 {
+		t.Fatalf("items = %+v, want none", items)
+	}
+}
+
+func TestJSONStreamSanitizerMasksMalformedRemainderAsText(t *testing.T) {
+	body := `{"content":"a@example.com"]} "content":"b@example.com"`
+	out, _ := streamSanitize(t, iotest.OneByteReader(strings.NewReader(body)))
+	if want := `{"content":"[EMAIL_1]"]} "content":"[EMAIL_2]"`; out != want {
+		t.Fatalf("out = %q, want %q", out, want)
+	}
+}
+
+func TestJSONStreamSanitizerMasksNonJSONBody(t *testing.T) {
+	body := "contact john@example.com " + strings.Repeat("lorem ipsum ", streamWindow/8) + "or jane@example.com"
+	out, items := streamSanitize(t, iotest.OneByteReader(strings.NewReader(body)))
+	if strings.Contains(out, "@example.com") {
+		t.Fatalf("non-JSON body forwarded with emails: %q", out[:64])
+	}
+	if len(items) != 2 {
+		t.Fatalf("items = %+v, want two emails", items)
+	}
+}
+
+func TestSegmentCutKeepsEscapesWhole(t *testing.T) {
+	seg := []byte(`abc\ud83d\ude00`)
+	if got := segmentCut(seg); got != 3 {
+		t.Fatalf("segmentCut = %d, want 3 (before the surrogate pair)", got)
+	}
+	seg = []byte(`aaaa bbbb\ncc`)
+	if got := segmentCut(seg); got != 11 {
+		t.Fatalf("segmentCut = %d, want 11 (after the newline)", got)
+	}
+	seg = []byte("aaé")
+	if got := segmentCut(seg); got != 2 {
+		t.Fatalf("segmentCut = %d, want 2 (rune start)", got)
+	}
+}
+
+func TestSanitizingInspectorStreamsChunkedBody(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}}))
+	body := `{"content":"` + strings.Repeat("z", int(defaultMaxBodyBytes)) + ` john@example.com"}`
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1", io.NopCloser(iotest.HalfReader(strings.NewReader(body))))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+
+	out, err := inspector.InspectRequest(req)
+	if err != nil {
+		t.Fatalf("InspectRequest() error = %v", err)
+	}
+	if out.ContentLength != -1 {
+		t.Fatalf("ContentLength = %d, want -1 for a streamed body", out.ContentLength)
+	}
+	got, _ := io.ReadAll(out.Body)
+	if !strings.HasSuffix(string(got), ` [EMAIL_1]"}`) {
+		t.Fatalf("streamed body not masked, tail %q", got[len(got)-20:])
+	}
+	md, ok := AuditMetadataFromRequest(out)
+	if !ok || !md.Sanitized || len(md.Items) != 1 {
+		t.Fatalf("audit metadata = %+v, ok=%v", md, ok)
+	}
+	start := int(defaultMaxBodyBytes) + 1
+	if len(md.Detections) != 1 || md.Detections[0].Field != "body.content" || md.Detections[0].Start != start || md.Detections[0].End != start+len("john@example.com") {
+		t.Fatalf("detections = %+v, want one span at %d in the whole value", md.Detections, start)
+	}
+	sess, ok := inspector.sessions.Get(session.GetIDFromContext(out.Context()))
+	if !ok || sess.Mapping["[EMAIL_1]"] != "john@example.com" {
+		t.Fatalf("session mapping = %+v", sess.Mapping)
+	}
+}
@@ -0,0 +1,152 @@
+package sanitizer
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// MessageSession masks and restores a sequence of text messages that share a
+// single placeholder namespace, such as the text frames of one WebSocket
+// connection. The accumulated mapping is kept in the inspector's session
+// store under the session ID until Close is called.
+type MessageSession struct {
+	inspector *SanitizingInspector
+	sessionID string
+
+	mu   sync.Mutex
+	repl *replacementState
+	// findings accumulates the findings of every message, one per type and
+	// action.
+	findings []Finding
+}
+
+// NewMessageSession starts a message session bound to sessionID. Messages
+// are subject to the inspector's entity actions, except that held types
+// are masked, as a message cannot wait for approval.
+func (i *SanitizingInspector) NewMessageSession(sessionID string) *MessageSession {
+	if i == nil || i.sanitizer == nil {
+		return &MessageSession{inspector: i, sessionID: sessionID, repl: newReplacementState(0)}
+	}
+	repl := i.newReplacementState()
+	repl.policy.hold = ActionMask
+	return &MessageSession{inspector: i, sessionID: sessionID, repl: repl}
+}
+
+// Sanitize masks sensitive values in one outbound message. JSON messages are
+// masked field by field using the inspector's key configuration; anything
+// else is treated as plain text. The original text is returned unchanged when
+// nothing is masked or the inspector is monitoring ctx. A detection whose
+// entity action is ActionBlock rejects the message with a *BlockedError,
+// unless ctx is monitored.
+func (m *MessageSession) Sanitize(ctx context.Context, text string) (string, error) {
+	if m == nil || m.inspector == nil || text == "" || !m.inspector.sanitizer.HasDetectors() {
+		return text, nil
+	}
+	i := m.inspector
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// max_replacements applies per message, not per connection, and
+	// findings are acted on per message.
+	m.repl.replacements = 0
+	m.repl.flagged = nil
+	out := text
+	if i.hybridDetector != nil {
+		if masked, err := maskJSONFields(ctx, []byte(text), i.hybridDetector, m.repl, i.keyConfig); err == nil {
+			out = string(masked)
+		}
+	}
+	if m.repl.replacements == 0 {
+		if masked, err := maskJSONFieldsWithSanitizer([]byte(text), i.sanitizer, m.repl, i.keyConfig); err == nil {
+			out = string(masked)
+		} else {
+			out = applyMaskWithSanitizer(text, i.sanitizer, m.repl)
+		}
+	}
+	findings := m.repl.findings()
+	m.addFindingsLocked(findings)
+	if i.Monitoring(ctx) {
+		return text, nil
+	}
+	if err := m.repl.blocked(); err != nil {
+		return "", err
+	}
+	i.warn(findings)
+	if m.repl.replacements == 0 {
+		return text, nil
+	}
+	i.sessions.Set(m.sessionID, m.mappingLocked())
+	return out, nil
+}
+
+// Restore replaces placeholders issued by this session in an inbound message.
+func (m *MessageSession) Restore(text string) string {
+	if m == nil || m.inspector == nil || !m.inspector.restoreResponses {
+		return text
+	}
+	m.mu.Lock()
+	mapping := m.mappingLocked()
+	m.mu.Unlock()
+	if len(mapping) == 0 {
+		return text
+	}
+	pairs := make([]string, 0, len(mapping)*2)
+	for placeholder, original := range mapping {
+		pairs = append(pairs, placeholder, original)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// Items returns every value masked during the session.
+func (m *MessageSession) Items() []SanitizedItem {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.repl.items()
+}
+
+// Findings returns the detections left in place or blocked during the
+// session, one per entity type and action.
+func (m *MessageSession) Findings() []Finding {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Finding(nil), m.findings...)
+}
+
+// Close drops the session mapping.
+func (m *MessageSession) Close() {
+	if m == nil || m.inspector == nil {
+		return
+	}
+	m.inspector.sessions.Delete(m.sessionID)
+}
+
+func (m *MessageSession) mappingLocked() map[string]string {
+	mapping := make(map[string]string, len(m.repl.byPlaceholder))
+	for placeholder, item := range m.repl.byPlaceholder {
+		mapping[placeholder] = item.Original
+	}
+	return mapping
+}
+
+func (m *MessageSession) addFindingsLocked(findings []Finding) {
+	for _, f := range findings {
+		seen := false
+		for _, prev := range m.findings {
+			if prev == f {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			m.findings = append(m.findings, f)
+		}
+	}
+}
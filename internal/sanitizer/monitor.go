@@ -0,0 +1,131 @@
+package sanitizer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+type monitorContextKey struct{}
+
+// ContextWithMonitor marks requests carrying ctx for monitor mode, whatever
+// the inspector's own setting.
+func ContextWithMonitor(ctx context.Context) context.Context {
+	return context.WithValue(ctx, monitorContextKey{}, true)
+}
+
+// WithMonitor inspects every request in monitor mode: detectors run and
+// the items that would be masked are audited, but requests and messages
+// are forwarded unchanged and responses are not restored.
+func (i *SanitizingInspector) WithMonitor(enabled bool) *SanitizingInspector {
+	i.monitor = enabled
+	return i
+}
+
+// Monitoring reports whether requests carrying ctx are inspected in monitor
+// mode.
+func (i *SanitizingInspector) Monitoring(ctx context.Context) bool {
+	if i != nil && i.monitor {
+		return true
+	}
+	v, _ := ctx.Value(monitorContextKey{}).(bool)
+	return v
+}
+
+// monitorRequest masks a copy of r and records the would-be items in its
+// audit metadata, leaving r as the client sent it. No session mapping is
+// stored. Bodies too large to buffer are scanned as they are forwarded;
+// those in a Content-Encoding are not scanned.
+func (i *SanitizingInspector) monitorRequest(r *http.Request) *http.Request {
+	ctx := r.Context()
+	repl := i.newReplacementState()
+	audit := &streamAudit{monitor: true}
+	buffered := i.probe(r, repl)
+	if !buffered && r.Method == http.MethodPost && r.Body != nil && r.Body != http.NoBody &&
+		strings.Contains(strings.ToLower(r.Header.Get("Content-Type")), "application/json") && r.Header.Get("Content-Encoding") == "" {
+		onItems := func(items []SanitizedItem, done bool) {
+			audit.set(items, repl.findings(), repl.detectionList())
+			if done && len(items) > 0 {
+				log.Printf("sanitizer monitor: would mask %d items (streamed)", len(items))
+			}
+		}
+		r.Body = &monitorBody{ReadCloser: r.Body, s: newJSONStreamSanitizer(nil, i.keyConfig, repl, i.masker(ctx, repl), onItems)}
+	}
+	items := repl.items()
+	if len(items) > 0 {
+		log.Printf("sanitizer monitor: would mask %d items", len(items))
+	}
+	audit.set(items, repl.findings(), repl.detectionList())
+	return r.WithContext(context.WithValue(ctx, streamAuditContextKey{}, audit))
+}
+
+// probe masks a copy of r's URL, headers and body into repl, leaving r as
+// the client sent it. buffered reports that the body was read into memory
+// and scanned; bodies too large for that are left unread.
+func (i *SanitizingInspector) probe(r *http.Request, repl *replacementState) (buffered bool) {
+	probe := r.Clone(r.Context())
+	probe.Body = nil
+	i.requestFields.apply(probe, repl, i.masker(r.Context(), repl))
+	if r.Method != http.MethodPost || r.Body == nil || r.Body == http.NoBody || !i.monitorBuffers(r) {
+		return false
+	}
+	body, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		log.Printf("sanitizer probe read failed: %v", err)
+		return true
+	}
+	probe.Body = io.NopCloser(bytes.NewReader(body))
+	probe.ContentLength = int64(len(body))
+	if _, _, err := i.inspectBody(probe, "", repl); err != nil && !errors.Is(err, ErrBlocked) {
+		log.Printf("sanitizer probe: %v", err)
+	}
+	return true
+}
+
+// monitorBuffers reports whether r's body is small enough for inspectBody
+// to mask it in memory.
+func (i *SanitizingInspector) monitorBuffers(r *http.Request) bool {
+	if r.ContentLength < 0 {
+		return false
+	}
+	limit := i.maxBodySize
+	if limit <= 0 {
+		limit = defaultMaxBodyBytes
+	}
+	if r.ContentLength <= limit {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data" && r.ContentLength <= i.maxMultipartSize
+}
+
+// monitorBody forwards a body unchanged while feeding it to s, whose
+// masked output is discarded.
+type monitorBody struct {
+	io.ReadCloser
+	s    *jsonStreamSanitizer
+	done bool
+}
+
+func (b *monitorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done {
+		return n, err
+	}
+	if n > 0 {
+		b.s.process(p[:n])
+		b.s.out = b.s.out[:0]
+	}
+	if err == io.EOF {
+		b.done = true
+		b.s.finish()
+	}
+	return n, err
+}
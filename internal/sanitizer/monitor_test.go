@@ -0,0 +1,69 @@
+package sanitizer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"velar/internal/session"
+)
+
+func TestSanitizingInspectorMonitorForwardsOriginalBody(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}})).WithMonitor(true)
+	body := `{"content":"mail john@example.com"}`
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1?q=ann@example.com", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	out, err := inspector.InspectRequest(req)
+	if err != nil {
+		t.Fatalf("InspectRequest() error = %v", err)
+	}
+	got, _ := io.ReadAll(out.Body)
+	if string(got) != body || out.URL.RawQuery != "q=ann@example.com" {
+		t.Fatalf("request changed in monitor mode: body %q, query %q", got, out.URL.RawQuery)
+	}
+	md, ok := AuditMetadataFromRequest(out)
+	if !ok || !md.Monitor || md.Sanitized || len(md.Items) != 2 || len(md.Detections) != 2 {
+		t.Fatalf("audit metadata = %+v, ok=%v, want two would-be items", md, ok)
+	}
+	if _, ok := inspector.sessions.Get(session.GetIDFromContext(out.Context())); ok {
+		t.Fatal("monitor mode stored a session mapping")
+	}
+}
+
+func TestSanitizingInspectorMonitorScansStreamedBody(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}}))
+	body := `{"content":"` + strings.Repeat("z", int(defaultMaxBodyBytes)) + ` john@example.com"}`
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1", io.NopCloser(iotest.HalfReader(strings.NewReader(body))))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ContextWithMonitor(context.Background()))
+
+	out, err := inspector.InspectRequest(req)
+	if err != nil {
+		t.Fatalf("InspectRequest() error = %v", err)
+	}
+	got, _ := io.ReadAll(out.Body)
+	if string(got) != body {
+		t.Fatal("streamed body changed in monitor mode")
+	}
+	md, _ := AuditMetadataFromRequest(out)
+	if !md.Monitor || len(md.Items) != 1 || md.Items[0].Type != "email" {
+		t.Fatalf("audit metadata = %+v, want one would-be email", md)
+	}
+}
+
+func TestMessageSessionMonitorLeavesMessages(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}}))
+	messages := inspector.NewMessageSession("ws")
+	text := `{"content":"john@example.com"}`
+	if got, err := messages.Sanitize(ContextWithMonitor(context.Background()), text); got != text || err != nil {
+		t.Fatalf("Sanitize() = %q, %v, want the message unchanged", got, err)
+	}
+	if items := messages.Items(); len(items) != 1 {
+		t.Fatalf("Items() = %+v, want the would-be item", items)
+	}
+}
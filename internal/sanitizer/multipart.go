@@ -0,0 +1,203 @@
+package sanitizer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"velar/internal/contentcoding"
+)
+
+const defaultMaxMultipartBytes int64 = 8 * 1024 * 1024
+
+// ErrBlocked is returned by InspectRequest when a request must not be
+// forwarded, such as an upload with sensitive data under the block policy.
+var ErrBlocked = errors.New("blocked by sanitizer")
+
+// Upload policies for multipart parts in which sensitive data is found.
+const (
+	UploadMask  = "mask"
+	UploadBlock = "block"
+)
+
+// textUploadExtensions are file extensions scanned as text even when the
+// part is sent as application/octet-stream.
+var textUploadExtensions = map[string]struct{}{
+	".txt": {}, ".md": {}, ".markdown": {}, ".rst": {}, ".csv": {}, ".tsv": {},
+	".json": {}, ".jsonl": {}, ".ndjson": {}, ".log": {}, ".xml": {}, ".html": {},
+	".htm": {}, ".yaml": {}, ".yml": {}, ".toml": {}, ".ini": {}, ".env": {},
+	".go": {}, ".py": {}, ".js": {}, ".mjs": {}, ".ts": {}, ".tsx": {}, ".jsx": {},
+	".java": {}, ".kt": {}, ".rb": {}, ".rs": {}, ".c": {}, ".h": {}, ".cc": {},
+	".cpp": {}, ".hpp": {}, ".cs": {}, ".php": {}, ".swift": {}, ".scala": {},
+	".sh": {}, ".sql": {}, ".css": {},
+}
+
+// WithUploadPolicy sets what happens when sensitive data is found in a
+// multipart part: UploadMask (default) masks it in place, UploadBlock
+// rejects the request.
+func (i *SanitizingInspector) WithUploadPolicy(policy string) *SanitizingInspector {
+	i.uploadPolicy = policy
+	return i
+}
+
+// isTextPart reports whether a multipart part is scanned. Form fields
+// without a filename are, as are files with a text media type or a text
+// file extension. Parts with a Content-Transfer-Encoding are left alone.
+func isTextPart(header textproto.MIMEHeader, filename string) bool {
+	if header.Get("Content-Transfer-Encoding") != "" {
+		return false
+	}
+	if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") || mediaType == "application/x-ndjson" {
+			return true
+		}
+	}
+	if filename == "" {
+		return true
+	}
+	_, ok := textUploadExtensions[strings.ToLower(path.Ext(filename))]
+	return ok
+}
+
+// inspectMultipart masks text parts of a multipart/form-data body and
+// rebuilds it. The original boundary is kept where possible; otherwise the
+// Content-Type header is updated with the new one. Under the block policy,
+// a part with sensitive data fails the request with ErrBlocked, as does a
+// body that cannot be scanned.
+func (i *SanitizingInspector) inspectMultipart(r *http.Request, boundary string, codings []string, repl *replacementState) (*http.Request, error) {
+	limit := i.maxMultipartSize
+	if limit <= 0 {
+		limit = defaultMaxMultipartBytes
+	}
+	if r.ContentLength > limit {
+		return r, i.unscannedUpload(fmt.Sprintf("multipart body of %d bytes exceeds %d", r.ContentLength, limit))
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		_ = r.Body.Close()
+		return r, fmt.Errorf("read multipart body: %w", err)
+	}
+	if int64(len(body)) > limit {
+		r.Body = prefixedReadCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+		return r, i.unscannedUpload(fmt.Sprintf("multipart body exceeds %d bytes", limit))
+	}
+	_ = r.Body.Close()
+	encodedBody := body
+	if len(codings) > 0 {
+		plain, err := contentcoding.Decode(body, codings, limit)
+		if err != nil {
+			restoreBody(r, body)
+			return r, i.unscannedUpload(fmt.Sprintf("cannot decode %s multipart body: %v", strings.Join(codings, ", "), err))
+		}
+		body = plain
+	}
+
+	type part struct {
+		header  textproto.MIMEHeader
+		content []byte
+	}
+	var parts []part
+	changed := false
+	mask := i.masker(r.Context(), repl)
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			restoreBody(r, encodedBody)
+			return r, i.unscannedUpload(fmt.Sprintf("malformed multipart body: %v", err))
+		}
+		content, err := io.ReadAll(p)
+		if err != nil {
+			restoreBody(r, encodedBody)
+			return r, i.unscannedUpload(fmt.Sprintf("malformed multipart part: %v", err))
+		}
+		name := p.FormName()
+		filename := p.FileName()
+		_, skipped := i.keyConfig.SkipKeys[strings.ToLower(name)]
+		if isTextPart(p.Header, filename) && utf8.Valid(content) && !skipped {
+			before := repl.replacements
+			repl.field = "part." + name
+			masked := mask(string(content))
+			if repl.replacements > before {
+				if i.uploadPolicy == UploadBlock {
+					restoreBody(r, encodedBody)
+					return r, fmt.Errorf("%w: sensitive data in multipart part %q", ErrBlocked, partLabel(name, filename))
+				}
+				content = []byte(masked)
+				changed = true
+			}
+		}
+		parts = append(parts, part{header: p.Header, content: content})
+	}
+	if !changed {
+		restoreBody(r, encodedBody)
+		return r, nil
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	collides := false
+	for _, p := range parts {
+		collides = collides || bytes.Contains(p.content, []byte("--"+boundary))
+	}
+	if !collides {
+		// A boundary SetBoundary rejects is replaced by a random one.
+		_ = mw.SetBoundary(boundary)
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(p.header)
+		if err != nil {
+			return r, fmt.Errorf("rebuild multipart body: %w", err)
+		}
+		if _, err := w.Write(p.content); err != nil {
+			return r, fmt.Errorf("rebuild multipart body: %w", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return r, fmt.Errorf("rebuild multipart body: %w", err)
+	}
+	if mw.Boundary() != boundary {
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+	}
+	newBody := buf.Bytes()
+	if len(codings) > 0 {
+		if encoded, err := contentcoding.Encode(newBody, codings); err == nil {
+			newBody = encoded
+		} else {
+			log.Printf("sanitizer: re-encoding failed, forwarding uncompressed: %v", err)
+			r.Header.Del("Content-Encoding")
+		}
+	}
+	restoreBody(r, newBody)
+	return r, nil
+}
+
+// unscannedUpload decides a multipart body that cannot be scanned. Only the
+// mask policy forwards it unchanged; any other policy fails the request
+// with ErrBlocked.
+func (i *SanitizingInspector) unscannedUpload(reason string) error {
+	if i.uploadPolicy == UploadMask {
+		log.Printf("sanitizer: skipping - %s", reason)
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrBlocked, reason)
+}
+
+func partLabel(name, filename string) string {
+	if filename != "" {
+		return filename
+	}
+	return name
+}
@@ -0,0 +1,150 @@
+package sanitizer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func multipartRequest(t *testing.T, build func(w *multipart.Writer)) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	build(w)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close multipart writer: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, "https://api.openai.com/v1/files", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+func writePart(t *testing.T, w *multipart.Writer, header textproto.MIMEHeader, content string) {
+	t.Helper()
+	pw, err := w.CreatePart(header)
+	if err != nil {
+		t.Fatalf("create part: %v", err)
+	}
+	_, _ = pw.Write([]byte(content))
+}
+
+func fileHeader(field, filename, contentType string) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="`+field+`"; filename="`+filename+`"`)
+	h.Set("Content-Type", contentType)
+	return h
+}
+
+func readParts(t *testing.T, r *http.Request) map[string]string {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parse content type: %v", err)
+	}
+	body, _ := io.ReadAll(r.Body)
+	if r.ContentLength != int64(len(body)) || r.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Fatalf("ContentLength=%d header=%q, body is %d bytes", r.ContentLength, r.Header.Get("Content-Length"), len(body))
+	}
+	parts := map[string]string{}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatalf("next part: %v", err)
+		}
+		content, _ := io.ReadAll(p)
+		parts[p.FormName()] = string(content)
+	}
+}
+
+func TestSanitizingInspectorMasksMultipartTextParts(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}}))
+	binary := "\x89PNG\x00john@example.com"
+	req := multipartRequest(t, func(w *multipart.Writer) {
+		_ = w.WriteField("purpose", "assistants")
+		_ = w.WriteField("note", "from john@example.com")
+		writePart(t, w, fileHeader("file", "contacts.csv", "application/octet-stream"), "name,email\nJohn,john@example.com\nAnn,ann@example.com\n")
+		writePart(t, w, fileHeader("image", "logo.png", "image/png"), binary)
+	})
+	boundary := req.Header.Get("Content-Type")
+
+	out, err := inspector.InspectRequest(req)
+	if err != nil {
+		t.Fatalf("InspectRequest() error = %v", err)
+	}
+	if got := out.Header.Get("Content-Type"); got != boundary {
+		t.Fatalf("Content-Type = %q, want the original %q", got, boundary)
+	}
+	parts := readParts(t, out)
+	want := map[string]string{
+		"purpose": "assistants",
+		"note":    "from [EMAIL_1]",
+		"file":    "name,email\nJohn,[EMAIL_1]\nAnn,[EMAIL_2]\n",
+		"image":   binary,
+	}
+	for name, content := range want {
+		if parts[name] != content {
+			t.Fatalf("part %q = %q, want %q", name, parts[name], content)
+		}
+	}
+	if md, ok := AuditMetadataFromRequest(out); !ok || len(md.Items) != 2 {
+		t.Fatalf("expected audit metadata with two items, got ok=%v md=%+v", ok, md)
+	}
+}
+
+func TestSanitizingInspectorBlocksMultipartUpload(t *testing.T) {
+	inspector := NewSanitizingInspector(New([]Detector{EmailDetector{}})).WithUploadPolicy(UploadBlock)
+
+	clean := multipartRequest(t, func(w *multipart.Writer) {
+		writePart(t, w, fileHeader("file", "notes.md", "text/markdown"), "# Nothing sensitive here\n")
+	})
+	if _, err := inspector.InspectRequest(clean); err != nil {
+		t.Fatalf("InspectRequest() on clean upload error = %v", err)
+	}
+
+	req := multipartRequest(t, func(w *multipart.Writer) {
+		writePart(t, w, fileHeader("file", "notes.md", "text/markdown"), "contact: john@example.com\n")
+	})
+	_, err := inspector.InspectRequest(req)
+	if !errors.Is(err, ErrBlocked) || !strings.Contains(err.Error(), "notes.md") {
+		t.Fatalf("InspectRequest() error = %v, want ErrBlocked naming notes.md", err)
+	}
+}
+
+func TestSanitizingInspectorOversizedMultipartUpload(t *testing.T) {
+	build := func() *http.Request {
+		req := multipartRequest(t, func(w *multipart.Writer) {
+			writePart(t, w, fileHeader("file", "dump.csv", "text/csv"), "john@example.com\n"+strings.Repeat("x", 1024))
+		})
+		// Unknown length, as for a chunked upload.
+		req.ContentLength = -1
+		return req
+	}
+
+	blocking := NewSanitizingInspector(New([]Detector{EmailDetector{}})).WithUploadPolicy(UploadBlock)
+	blocking.maxMultipartSize = 512
+	if _, err := blocking.InspectRequest(build()); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("InspectRequest() error = %v, want ErrBlocked for an unscanned upload", err)
+	}
+
+	masking := NewSanitizingInspector(New([]Detector{EmailDetector{}}))
+	masking.maxMultipartSize = 512
+	out, err := masking.InspectRequest(build())
+	if err != nil {
+		t.Fatalf("InspectRequest() under mask error = %v", err)
+	}
+	body, _ := io.ReadAll(out.Body)
+	if !strings.Contains(string(body), "john@example.com") {
+		t.Fatalf("mask policy should forward the unscanned body unchanged, got %q", body)
+	}
+}
@@ -0,0 +1,138 @@
+package sanitizer
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultQueryParams are query parameter names whose values are user
+// content, such as search and retrieval terms.
+var DefaultQueryParams = []string{"q", "query", "search", "prompt", "input", "text", "email"}
+
+// DefaultHeaders are request headers that commonly carry end-user identity.
+var DefaultHeaders = []string{"X-User-Email", "X-User-Name", "X-End-User"}
+
+// RequestFields selects the parts of a request outside its body that are
+// sanitized.
+type RequestFields struct {
+	// Headers holds canonical header names.
+	Headers map[string]struct{}
+	// QueryParams holds lower-cased query parameter names.
+	QueryParams map[string]struct{}
+	// Path masks every URL path segment.
+	Path bool
+}
+
+// DefaultRequestFields returns the default header and query parameter
+// selection with path masking off.
+func DefaultRequestFields() RequestFields {
+	return NewRequestFields(DefaultHeaders, DefaultQueryParams, false)
+}
+
+// NewRequestFields builds a RequestFields from header and query parameter
+// names; matching is case-insensitive for both.
+func NewRequestFields(headers, queryParams []string, path bool) RequestFields {
+	rf := RequestFields{
+		Headers:     make(map[string]struct{}, len(headers)),
+		QueryParams: make(map[string]struct{}, len(queryParams)),
+		Path:        path,
+	}
+	for _, h := range headers {
+		if h = strings.TrimSpace(h); h != "" {
+			rf.Headers[http.CanonicalHeaderKey(h)] = struct{}{}
+		}
+	}
+	for _, q := range queryParams {
+		if q = strings.TrimSpace(q); q != "" {
+			rf.QueryParams[strings.ToLower(q)] = struct{}{}
+		}
+	}
+	return rf
+}
+
+// apply masks the selected path segments, query parameter values and
+// headers of r in place, in that order so placeholder numbering is stable.
+// Parameters and segments that mask does not change keep their original
+// encoding.
+func (rf RequestFields) apply(r *http.Request, repl *replacementState, mask func(string) string) {
+	if r.URL != nil {
+		if rf.Path {
+			maskPath(r.URL, repl, mask)
+		}
+		if len(rf.QueryParams) > 0 && r.URL.RawQuery != "" {
+			r.URL.RawQuery = rf.maskQuery(r.URL.RawQuery, repl, mask)
+		}
+	}
+	names := make([]string, 0, len(rf.Headers))
+	for name := range rf.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := r.Header[name]
+		repl.field = "header." + name
+		for idx, v := range values {
+			values[idx] = mask(v)
+		}
+	}
+}
+
+func (rf RequestFields) maskQuery(rawQuery string, repl *replacementState, mask func(string) string) string {
+	pairs := strings.Split(rawQuery, "&")
+	changed := false
+	for idx, pair := range pairs {
+		rawKey, rawValue, ok := strings.Cut(pair, "=")
+		if !ok || rawValue == "" {
+			continue
+		}
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			continue
+		}
+		if _, selected := rf.QueryParams[strings.ToLower(key)]; !selected {
+			continue
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			continue
+		}
+		repl.field = "query." + key
+		if masked := mask(value); masked != value {
+			pairs[idx] = rawKey + "=" + url.QueryEscape(masked)
+			changed = true
+		}
+	}
+	if !changed {
+		return rawQuery
+	}
+	return strings.Join(pairs, "&")
+}
+
+func maskPath(u *url.URL, repl *replacementState, mask func(string) string) {
+	segments := strings.Split(u.EscapedPath(), "/")
+	changed := false
+	for idx, raw := range segments {
+		segment, err := url.PathUnescape(raw)
+		if err != nil || segment == "" {
+			continue
+		}
+		repl.field = "path." + strconv.Itoa(idx)
+		if masked := mask(segment); masked != segment {
+			segments[idx] = url.PathEscape(masked)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	escaped := strings.Join(segments, "/")
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+	u.Path = path
+	u.RawPath = escaped
+}
@@ -0,0 +1,98 @@
+package sanitizer
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSanitizingInspectorMasksQueryHeadersAndPath(t *testing.T) {
+	s := New([]Detector{EmailDetector{}})
+	inspector := NewSanitizingInspector(s).WithRequestFields(NewRequestFields([]string{"x-user-email"}, []string{"Q"}, true))
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/v1/users/jane%40example.com/search?q=mail+john%40example.com&page=2&other=kept%40example.com", nil)
+	req.Header.Set("X-User-Email", "john@example.com")
+	req.Header.Set("Authorization", "Bearer owner@example.com")
+
+	out, err := inspector.InspectRequest(req)
+	if err != nil {
+		t.Fatalf("InspectRequest() error = %v", err)
+	}
+	if got, want := out.URL.EscapedPath(), "/v1/users/%5BEMAIL_1%5D/search"; got != want {
+		t.Fatalf("path = %q, want %q", got, want)
+	}
+	if got, want := out.URL.RawQuery, "q=mail+%5BEMAIL_2%5D&page=2&other=kept%40example.com"; got != want {
+		t.Fatalf("query = %q, want %q", got, want)
+	}
+	// The header value shares the placeholder of the same query value.
+	if got := out.Header.Get("X-User-Email"); got != "[EMAIL_2]" {
+		t.Fatalf("X-User-Email = %q, want [EMAIL_2]", got)
+	}
+	if got := out.Header.Get("Authorization"); got != "Bearer owner@example.com" {
+		t.Fatalf("Authorization = %q, want it untouched", got)
+	}
+	md, ok := AuditMetadataFromRequest(out)
+	if !ok || !md.Sanitized || len(md.Items) != 2 {
+		t.Fatalf("expected audit metadata with two items, got ok=%v md=%+v", ok, md)
+	}
+
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(`{"user":"[EMAIL_1]","results":["[EMAIL_2]"]}`)),
+		ContentLength: int64(len(`{"user":"[EMAIL_1]","results":["[EMAIL_2]"]}`)),
+		Request:       out,
+	}
+	restored, err := inspector.InspectResponse(resp)
+	if err != nil {
+		t.Fatalf("InspectResponse() error = %v", err)
+	}
+	body, _ := io.ReadAll(restored.Body)
+	if got, want := string(body), `{"user":"jane@example.com","results":["john@example.com"]}`; got != want {
+		t.Fatalf("restored body = %q, want %q", got, want)
+	}
+}
+
+func TestSanitizingInspectorNumbersQueryAndBodyTogether(t *testing.T) {
+	s := New([]Detector{EmailDetector{}})
+	inspector := NewSanitizingInspector(s)
+
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com/v1/chat?email=john%40example.com", strings.NewReader(`{"content":"john@example.com and ann@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	out, err := inspector.InspectRequest(req)
+	if err != nil {
+		t.Fatalf("InspectRequest() error = %v", err)
+	}
+	if got, want := out.URL.RawQuery, "email=%5BEMAIL_1%5D"; got != want {
+		t.Fatalf("query = %q, want %q", got, want)
+	}
+	body, _ := io.ReadAll(out.Body)
+	if got, want := string(body), `{"content":"[EMAIL_1] and [EMAIL_2]"}`; got != want {
+		t.Fatalf("body = %q, want %q", got, want)
+	}
+}
+
+func TestRequestFieldsLeavesUnselectedPartsAlone(t *testing.T) {
+	s := New([]Detector{EmailDetector{}})
+	inspector := NewSanitizingInspector(s).WithRequestFields(NewRequestFields(nil, nil, false))
+
+	rawURL := "https://example.com/v1/users/jane%40example.com?q=john%40example.com"
+	req, _ := http.NewRequest(http.MethodGet, rawURL, nil)
+	req.Header.Set("X-User-Email", "john@example.com")
+
+	out, err := inspector.InspectRequest(req)
+	if err != nil {
+		t.Fatalf("InspectRequest() error = %v", err)
+	}
+	if got := out.URL.String(); got != rawURL {
+		t.Fatalf("URL = %q, want %q", got, rawURL)
+	}
+	if got := out.Header.Get("X-User-Email"); got != "john@example.com" {
+		t.Fatalf("X-User-Email = %q, want it untouched", got)
+	}
+	if _, ok := AuditMetadataFromRequest(out); ok {
+		t.Fatalf("expected no audit metadata")
+	}
+}
@@ -52,6 +52,15 @@ func (s *Sanitizer) WithMaxReplacements(v int) *Sanitizer {
 // collectMatches gathers, sorts, and deduplicates matches from all detectors.
 // Returns the chosen non-overlapping matches and the raw match list.
 func (s *Sanitizer) collectMatches(input string) ([]Match, []Match) {
+	if s == nil {
+		return nil, nil
+	}
+	return s.collectMatchesAbove(input, s.confidenceThreshold)
+}
+
+// collectMatchesAbove is collectMatches with matches scoring below
+// threshold dropped instead of those below the confidence threshold.
+func (s *Sanitizer) collectMatchesAbove(input string, threshold float64) ([]Match, []Match) {
 	if s == nil || len(s.detectors) == 0 || input == "" {
 		return nil, nil
 	}
@@ -59,7 +68,7 @@ func (s *Sanitizer) collectMatches(input string) ([]Match, []Match) {
 	all := make([]Match, 0)
 	for _, d := range s.detectors {
 		for _, m := range d.Detect(input) {
-			if m.Confidence < s.confidenceThreshold {
+			if m.Confidence < threshold {
 				continue
 			}
 			if m.Start < 0 || m.End > len(input) || m.Start >= m.End {
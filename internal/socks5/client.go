@@ -0,0 +1,194 @@
+// Package socks5 implements the parts of the SOCKS protocol version 5
+// (RFC 1928) and its username/password authentication (RFC 1929) that Velar
+// needs to chain through corporate proxies and to accept SOCKS clients.
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	version = 0x05
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+
+	userPassVersion = 0x01
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Reply codes a server sends in response to a request (RFC 1928 section 6).
+const (
+	ReplySucceeded           byte = 0x00
+	ReplyGeneralFailure      byte = 0x01
+	ReplyNotAllowed          byte = 0x02
+	ReplyHostUnreachable     byte = 0x04
+	ReplyConnectionRefused   byte = 0x05
+	ReplyCommandNotSupported byte = 0x07
+	ReplyAddressNotSupported byte = 0x08
+)
+
+var replyMessages = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// ErrAuthRejected is returned when the server refuses the offered credentials.
+var ErrAuthRejected = errors.New("socks5: authentication rejected")
+
+// ClientHandshake asks the SOCKS5 server on conn to connect to target
+// (host:port). Username/password authentication is offered when username is
+// not empty. Domain names are sent unresolved so the proxy performs the DNS
+// lookup.
+func ClientHandshake(conn net.Conn, target, username, password string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("socks5: invalid target %q: %w", target, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return fmt.Errorf("socks5: invalid port %q", portStr)
+	}
+
+	greeting := []byte{version, 1, methodNoAuth}
+	if username != "" {
+		greeting = []byte{version, 2, methodNoAuth, methodUserPass}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return err
+	}
+	if choice[0] != version {
+		return fmt.Errorf("socks5: unexpected version %d", choice[0])
+	}
+	switch choice[1] {
+	case methodNoAuth:
+	case methodUserPass:
+		if username == "" {
+			return ErrAuthRejected
+		}
+		if err := writeUserPass(conn, username, password); err != nil {
+			return err
+		}
+	case methodNoAcceptable:
+		return ErrAuthRejected
+	default:
+		return fmt.Errorf("socks5: unsupported auth method %d", choice[1])
+	}
+
+	req := []byte{version, cmdConnect, 0x00}
+	req = appendAddr(req, host)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != ReplySucceeded {
+		msg, ok := replyMessages[reply[1]]
+		if !ok {
+			msg = fmt.Sprintf("reply code %d", reply[1])
+		}
+		return fmt.Errorf("socks5: connect to %s failed: %s", target, msg)
+	}
+	// Discard the bound address; callers only need the stream.
+	_, err = readAddr(conn)
+	return err
+}
+
+func writeUserPass(conn net.Conn, username, password string) error {
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+	msg := []byte{userPassVersion, byte(len(username))}
+	msg = append(msg, username...)
+	msg = append(msg, byte(len(password)))
+	msg = append(msg, password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	var status [2]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return err
+	}
+	if status[1] != 0x00 {
+		return ErrAuthRejected
+	}
+	return nil
+}
+
+func appendAddr(b []byte, host string) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return append(append(b, atypIPv4), ip4...)
+		}
+		return append(append(b, atypIPv6), ip.To16()...)
+	}
+	if len(host) > 255 {
+		host = host[:255]
+	}
+	b = append(b, atypDomain, byte(len(host)))
+	return append(b, host...)
+}
+
+// readAddr reads an ATYP-prefixed address and port and returns it as host:port.
+func readAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4:
+		var ip [4]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(ip[:]).String()
+	case atypIPv6:
+		var ip [16]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(ip[:]).String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("socks5: unsupported address type %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
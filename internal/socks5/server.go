@@ -0,0 +1,127 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Authenticator validates username/password credentials and returns the
+// identity to associate with the connection.
+type Authenticator func(username, password string) (string, bool)
+
+// Request is a CONNECT request accepted by ServerHandshake.
+type Request struct {
+	// Target is the requested destination as host:port. Domain names are
+	// left unresolved.
+	Target string
+	// User is the identity returned by the Authenticator, if any.
+	User string
+}
+
+// ErrCommandNotSupported is returned for BIND and UDP ASSOCIATE requests,
+// which have already been answered with ReplyCommandNotSupported.
+var ErrCommandNotSupported = errors.New("socks5: command not supported")
+
+// ServerHandshake negotiates a method with the client on conn and reads its
+// request. With a nil authenticate the no-authentication method is selected;
+// otherwise the client has to use username/password. On success the caller
+// must answer with WriteReply.
+func ServerHandshake(conn net.Conn, authenticate Authenticator) (Request, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return Request{}, err
+	}
+	if hdr[0] != version {
+		return Request{}, fmt.Errorf("socks5: unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return Request{}, err
+	}
+	want := byte(methodNoAuth)
+	if authenticate != nil {
+		want = methodUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		_, _ = conn.Write([]byte{version, methodNoAcceptable})
+		return Request{}, ErrAuthRejected
+	}
+	if _, err := conn.Write([]byte{version, want}); err != nil {
+		return Request{}, err
+	}
+
+	var req Request
+	if authenticate != nil {
+		user, err := readUserPass(conn, authenticate)
+		if err != nil {
+			return Request{}, err
+		}
+		req.User = user
+	}
+
+	var head [3]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return Request{}, err
+	}
+	if head[0] != version {
+		return Request{}, fmt.Errorf("socks5: unsupported version %d", head[0])
+	}
+	target, err := readAddr(conn)
+	if err != nil {
+		_ = WriteReply(conn, ReplyAddressNotSupported)
+		return Request{}, err
+	}
+	if head[1] != cmdConnect {
+		_ = WriteReply(conn, ReplyCommandNotSupported)
+		return Request{}, fmt.Errorf("%w: %d", ErrCommandNotSupported, head[1])
+	}
+	req.Target = target
+	return req, nil
+}
+
+func readUserPass(conn net.Conn, authenticate Authenticator) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != userPassVersion {
+		return "", fmt.Errorf("socks5: unsupported auth version %d", hdr[0])
+	}
+	username := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return "", err
+	}
+	var n [1]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return "", err
+	}
+	password := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+	user, ok := authenticate(string(username), string(password))
+	if !ok {
+		_, _ = conn.Write([]byte{userPassVersion, 0x01})
+		return "", ErrAuthRejected
+	}
+	if _, err := conn.Write([]byte{userPassVersion, 0x00}); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+// WriteReply answers a request with code. The bound address is reported as
+// 0.0.0.0:0 because proxied streams have no use for it.
+func WriteReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{version, code, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
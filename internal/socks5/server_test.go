@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		username string
+		password string
+		auth     Authenticator
+		wantUser string
+		wantErr  error
+	}{
+		{name: "no auth domain", target: "api.openai.com:443"},
+		{name: "no auth ipv6", target: "[2001:db8::1]:8443"},
+		{
+			name: "user pass", target: "10.0.0.1:443", username: "alice", password: "pw",
+			auth:     func(u, p string) (string, bool) { return u, u == "alice" && p == "pw" },
+			wantUser: "alice",
+		},
+		{
+			name: "rejected credentials", target: "example.com:443", username: "alice", password: "bad",
+			auth:    func(u, p string) (string, bool) { return "", false },
+			wantErr: ErrAuthRejected,
+		},
+		{
+			name: "client without credentials", target: "example.com:443",
+			auth:    func(u, p string) (string, bool) { return u, true },
+			wantErr: ErrAuthRejected,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			type result struct {
+				req Request
+				err error
+			}
+			done := make(chan result, 1)
+			go func() {
+				req, err := ServerHandshake(server, tc.auth)
+				if err == nil {
+					err = WriteReply(server, ReplySucceeded)
+				} else {
+					_ = server.Close()
+				}
+				done <- result{req, err}
+			}()
+
+			clientErr := ClientHandshake(client, tc.target, tc.username, tc.password)
+			got := <-done
+			if tc.wantErr != nil {
+				if !errors.Is(got.err, tc.wantErr) {
+					t.Fatalf("server error = %v, want %v", got.err, tc.wantErr)
+				}
+				if clientErr == nil {
+					t.Fatalf("client handshake succeeded unexpectedly")
+				}
+				return
+			}
+			if got.err != nil || clientErr != nil {
+				t.Fatalf("handshake errors: server=%v client=%v", got.err, clientErr)
+			}
+			if got.req.Target != tc.target || got.req.User != tc.wantUser {
+				t.Fatalf("request = %+v, want target %q user %q", got.req, tc.target, tc.wantUser)
+			}
+		})
+	}
+}
+
+func TestServerRejectsUnsupportedCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ServerHandshake(server, nil)
+		errc <- err
+	}()
+
+	_, _ = client.Write([]byte{version, 1, methodNoAuth})
+	choice := make([]byte, 2)
+	_, _ = client.Read(choice)
+	// UDP ASSOCIATE to 0.0.0.0:0
+	go func() { _, _ = client.Write([]byte{version, 0x03, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0}) }()
+	reply := make([]byte, 10)
+	n, _ := client.Read(reply)
+	if n < 2 || reply[1] != ReplyCommandNotSupported {
+		t.Fatalf("reply = %v", reply[:n])
+	}
+	if err := <-errc; !errors.Is(err, ErrCommandNotSupported) {
+		t.Fatalf("ServerHandshake() error = %v", err)
+	}
+}
@@ -14,9 +14,11 @@ type Stats struct {
 	Port          int              `json:"port"`
 	Requests      RequestStats     `json:"requests"`
 	MaskedItems   MaskedItemsStats `json:"masked_items"`
-	Latency       LatencyStats     `json:"latency"`
-	TopDomains    []DomainStats    `json:"top_domains"`
-	Recent        []RecentRequest  `json:"recent,omitempty"`
+	// ProjectedItems counts what monitor mode would have masked.
+	ProjectedItems MaskedItemsStats `json:"projected_items"`
+	Latency        LatencyStats     `json:"latency"`
+	TopDomains     []DomainStats    `json:"top_domains"`
+	Recent         []RecentRequest  `json:"recent,omitempty"`
 }
 
 type RequestStats struct {
@@ -48,9 +50,12 @@ type RecentRequest struct {
 	StatusCode int            `json:"status_code"`
 	MaskedBy   map[string]int `json:"masked_by"`
 	Masked     int            `json:"masked_count"`
-	SanitizeMs float64        `json:"sanitize_ms"`
-	UpstreamMs float64        `json:"upstream_ms"`
-	TotalMs    float64        `json:"total_ms"`
+	// Monitor marks requests forwarded unchanged; MaskedBy and Masked are
+	// then what would have been masked.
+	Monitor    bool    `json:"monitor,omitempty"`
+	SanitizeMs float64 `json:"sanitize_ms"`
+	UpstreamMs float64 `json:"upstream_ms"`
+	TotalMs    float64 `json:"total_ms"`
 }
 
 type Options struct {
@@ -77,11 +82,12 @@ func CollectFromEntries(entries []audit.Entry, opts Options) Stats {
 	}
 
 	out := Stats{
-		Status:        opts.Status,
-		UptimeSeconds: int64(opts.Uptime.Seconds()),
-		Port:          opts.Port,
-		MaskedItems:   MaskedItemsStats{ByType: map[string]int{}},
-		Requests:      RequestStats{Last5Minute: make([]int, 5)},
+		Status:         opts.Status,
+		UptimeSeconds:  int64(opts.Uptime.Seconds()),
+		Port:           opts.Port,
+		MaskedItems:    MaskedItemsStats{ByType: map[string]int{}},
+		ProjectedItems: MaskedItemsStats{ByType: map[string]int{}},
+		Requests:       RequestStats{Last5Minute: make([]int, 5)},
 	}
 	if out.Status == "" {
 		out.Status = "stopped"
@@ -100,14 +106,20 @@ func CollectFromEntries(entries []audit.Entry, opts Options) Stats {
 		}
 
 		maskedBy := map[string]int{}
+		counted := &out.MaskedItems
+		if e.Monitor {
+			counted = &out.ProjectedItems
+		}
+		masked := 0
 		for _, item := range e.SanitizedItems {
 			t := strings.ToUpper(strings.TrimSpace(item.Type))
-			if t == "" {
+			if t == "" || (item.Action != "" && item.Action != "mask") {
 				continue
 			}
+			masked++
 			maskedBy[t]++
-			out.MaskedItems.ByType[t]++
-			out.MaskedItems.Total++
+			counted.ByType[t]++
+			counted.Total++
 		}
 
 		if !opts.Now.IsZero() && e.Timestamp != "" {
@@ -139,7 +151,8 @@ func CollectFromEntries(entries []audit.Entry, opts Options) Stats {
 			Method:     e.Method,
 			StatusCode: e.StatusCode,
 			MaskedBy:   maskedBy,
-			Masked:     len(e.SanitizedItems),
+			Masked:     masked,
+			Monitor:    e.Monitor,
 			SanitizeMs: e.SanitizeLatencyMs,
 			UpstreamMs: e.UpstreamLatencyMs,
 			TotalMs:    e.TotalLatencyMs,
@@ -39,3 +39,30 @@ func TestCollectFromEntriesLarge(t *testing.T) {
 		t.Fatalf("expected top 5 domains, got %d", len(st.TopDomains))
 	}
 }
+
+func TestCollectFromEntriesSeparatesProjectedItems(t *testing.T) {
+	entries := []audit.Entry{
+		{Host: "api.openai.com", Sanitized: true, SanitizedItems: []audit.SanitizedAudit{{Type: "email"}}},
+		{Host: "api.anthropic.com", Monitor: true, SanitizedItems: []audit.SanitizedAudit{{Type: "email"}, {Type: "phone"}}},
+	}
+	st := CollectFromEntries(entries, Options{Now: time.Now()})
+	if st.MaskedItems.Total != 1 || st.MaskedItems.ByType["EMAIL"] != 1 {
+		t.Fatalf("masked items = %+v, want one email", st.MaskedItems)
+	}
+	if st.ProjectedItems.Total != 2 || st.ProjectedItems.ByType["PHONE"] != 1 {
+		t.Fatalf("projected items = %+v, want email and phone", st.ProjectedItems)
+	}
+	if !st.Recent[0].Monitor || st.Recent[0].Masked != 2 {
+		t.Fatalf("recent = %+v", st.Recent)
+	}
+}
+
+func TestCollectFromEntriesCountsOnlyMaskedActions(t *testing.T) {
+	entries := []audit.Entry{
+		{Host: "api.openai.com", Sanitized: true, SanitizedItems: []audit.SanitizedAudit{{Type: "email", Action: "mask"}, {Type: "person", Action: "warn"}, {Type: "high_entropy", Action: "allow"}}},
+	}
+	st := CollectFromEntries(entries, Options{Now: time.Now()})
+	if st.MaskedItems.Total != 1 || st.MaskedItems.ByType["EMAIL"] != 1 || st.Recent[0].Masked != 1 {
+		t.Fatalf("masked items = %+v, recent = %+v, want only the email", st.MaskedItems, st.Recent)
+	}
+}
@@ -21,7 +21,7 @@ func Enable(host string, port int) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if err := saveBackup(Backup{Service: service, Web: status.Web, Secure: status.Secure}); err != nil {
+	if err := saveBackup(Backup{Service: service, Web: status.Web, Secure: status.Secure, AutoProxy: status.AutoProxy}); err != nil {
 		return "", err
 	}
 
@@ -40,6 +40,38 @@ func Enable(host string, port int) (string, error) {
 	return service, nil
 }
 
+// EnablePAC points the active network service at the proxy auto-config
+// script at pacURL and turns off the static web proxies, so that only the
+// hosts the script selects go through Velar.
+func EnablePAC(pacURL string) (string, error) {
+	service, err := activeService()
+	if err != nil {
+		return "", err
+	}
+
+	status, err := statusForService(service)
+	if err != nil {
+		return "", err
+	}
+	if err := saveBackup(Backup{Service: service, Web: status.Web, Secure: status.Secure, AutoProxy: status.AutoProxy}); err != nil {
+		return "", err
+	}
+
+	if err := runNetworksetup("-setautoproxyurl", service, pacURL); err != nil {
+		return "", err
+	}
+	if err := runNetworksetup("-setautoproxystate", service, "on"); err != nil {
+		return "", err
+	}
+	if err := runNetworksetup("-setwebproxystate", service, "off"); err != nil {
+		return "", err
+	}
+	if err := runNetworksetup("-setsecurewebproxystate", service, "off"); err != nil {
+		return "", err
+	}
+	return service, nil
+}
+
 func Disable() (string, error) {
 	backup, ok, err := loadBackup()
 	if err != nil {
@@ -55,6 +87,9 @@ func Disable() (string, error) {
 		if err := restoreProxy(backup.Service, backup.Secure, true); err != nil {
 			return "", err
 		}
+		if err := restoreAutoProxy(backup.Service, backup.AutoProxy); err != nil {
+			return "", err
+		}
 		if err := deleteBackup(); err != nil {
 			return "", err
 		}
@@ -71,6 +106,9 @@ func Disable() (string, error) {
 	if err := runNetworksetup("-setsecurewebproxystate", service, "off"); err != nil {
 		return "", err
 	}
+	if err := runNetworksetup("-setautoproxystate", service, "off"); err != nil {
+		return "", err
+	}
 	return service, nil
 }
 
@@ -99,7 +137,11 @@ func statusForService(service string) (Status, error) {
 	if err != nil {
 		return Status{}, err
 	}
-	return Status{Service: service, Web: webCfg, Secure: secureCfg}, nil
+	autoOut, err := runNetworksetupOutput("-getautoproxyurl", service)
+	if err != nil {
+		return Status{}, err
+	}
+	return Status{Service: service, Web: webCfg, Secure: secureCfg, AutoProxy: parseAutoProxyConfig(autoOut)}, nil
 }
 
 func activeService() (string, error) {
@@ -133,6 +175,19 @@ func restoreProxy(service string, cfg ProxyConfig, secure bool) error {
 	return runNetworksetup(stateCmd, service, state)
 }
 
+func restoreAutoProxy(service string, cfg AutoProxyConfig) error {
+	if cfg.URL != "" {
+		if err := runNetworksetup("-setautoproxyurl", service, cfg.URL); err != nil {
+			return err
+		}
+	}
+	state := "off"
+	if cfg.Enabled {
+		state = "on"
+	}
+	return runNetworksetup("-setautoproxystate", service, state)
+}
+
 func runNetworksetup(args ...string) error {
 	_, err := runNetworksetupOutput(args...)
 	return err
@@ -17,16 +17,24 @@ type ProxyConfig struct {
 	Port    int    `json:"port"`
 }
 
+// AutoProxyConfig is the proxy auto-config (PAC) URL setting.
+type AutoProxyConfig struct {
+	Enabled bool   `json:"enabled"`
+	URL     string `json:"url"`
+}
+
 type Status struct {
-	Service string
-	Web     ProxyConfig
-	Secure  ProxyConfig
+	Service   string
+	Web       ProxyConfig
+	Secure    ProxyConfig
+	AutoProxy AutoProxyConfig
 }
 
 type Backup struct {
-	Service string      `json:"service"`
-	Web     ProxyConfig `json:"web"`
-	Secure  ProxyConfig `json:"secure"`
+	Service   string          `json:"service"`
+	Web       ProxyConfig     `json:"web"`
+	Secure    ProxyConfig     `json:"secure"`
+	AutoProxy AutoProxyConfig `json:"auto_proxy"`
 }
 
 func parseNetworkServices(out string) []string {
@@ -88,6 +96,26 @@ func parseProxyConfig(out string) (ProxyConfig, error) {
 	return cfg, nil
 }
 
+func parseAutoProxyConfig(out string) AutoProxyConfig {
+	cfg := AutoProxyConfig{}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "URL":
+			if value != "(null)" {
+				cfg.URL = value
+			}
+		case "Enabled":
+			cfg.Enabled = strings.EqualFold(value, "Yes")
+		}
+	}
+	return cfg
+}
+
 func backupFilePath() (string, error) {
 	appDir, err := config.AppDir()
 	if err != nil {
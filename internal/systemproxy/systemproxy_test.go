@@ -39,3 +39,14 @@ Authenticated Proxy Enabled: 0`
 		t.Fatalf("unexpected cfg: %#v", cfg)
 	}
 }
+
+func TestParseAutoProxyConfig(t *testing.T) {
+	cfg := parseAutoProxyConfig("URL: http://localhost:8080/proxy.pac\nEnabled: Yes\n")
+	if !cfg.Enabled || cfg.URL != "http://localhost:8080/proxy.pac" {
+		t.Fatalf("unexpected cfg: %#v", cfg)
+	}
+	cfg = parseAutoProxyConfig("URL: (null)\nEnabled: No\n")
+	if cfg.Enabled || cfg.URL != "" {
+		t.Fatalf("unexpected cfg for unset auto proxy: %#v", cfg)
+	}
+}
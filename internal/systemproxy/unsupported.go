@@ -8,6 +8,10 @@ func Enable(host string, port int) (string, error) {
 	return "", errors.New("system proxy management is supported only on macOS")
 }
 
+func EnablePAC(pacURL string) (string, error) {
+	return "", errors.New("system proxy management is supported only on macOS")
+}
+
 func Disable() (string, error) {
 	return "", errors.New("system proxy management is supported only on macOS")
 }
@@ -0,0 +1,191 @@
+// Package transparent supports accepting connections that were redirected
+// to Velar by the packet filter instead of being sent to it as a proxy. It
+// recovers the destination the client originally dialled and the TLS server
+// name it asked for.
+package transparent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Mode selects how redirected connections reach the listener.
+type Mode string
+
+const (
+	// ModeRedirect handles iptables/nftables REDIRECT (DNAT to the local
+	// listener). The original destination is read with SO_ORIGINAL_DST.
+	ModeRedirect Mode = "redirect"
+	// ModeTProxy handles TPROXY rules. The socket is bound to the original
+	// destination, so it is the connection's local address.
+	ModeTProxy Mode = "tproxy"
+)
+
+// ParseMode validates a configured mode. An empty value selects ModeRedirect.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(strings.ToLower(strings.TrimSpace(s))) {
+	case "", ModeRedirect:
+		return ModeRedirect, nil
+	case ModeTProxy:
+		return ModeTProxy, nil
+	}
+	return "", fmt.Errorf("transparent: unknown mode %q", s)
+}
+
+// Sources is the set of client addresses a transparent listener accepts. A
+// nil *Sources accepts every client.
+type Sources struct {
+	nets []*net.IPNet
+	// local restricts clients to this host's own addresses.
+	local bool
+}
+
+// ParseSources parses patterns, IP addresses or CIDR ranges. Without
+// patterns every client is accepted, unless localOnly is set, which
+// accepts only connections from this host.
+func ParseSources(patterns []string, localOnly bool) (*Sources, error) {
+	s := &Sources{local: localOnly}
+	for _, raw := range patterns {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if ip := net.ParseIP(raw); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			raw = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, n, err := net.ParseCIDR(raw)
+		if err != nil {
+			return nil, fmt.Errorf("transparent: invalid allowed source %q: want an IP address or CIDR range", raw)
+		}
+		s.nets = append(s.nets, n)
+	}
+	if len(s.nets) > 0 {
+		s.local = false
+	}
+	if len(s.nets) == 0 && !s.local {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Allowed reports whether a client at addr may use the listener.
+func (s *Sources) Allowed(addr net.Addr) bool {
+	if s == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if s.local {
+		return isLocal(ip)
+	}
+	for _, n := range s.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocal reports whether ip is a loopback address or one assigned to an
+// interface of this host, as for connections redirected from its own
+// processes.
+func isLocal(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrUnsupported is returned on platforms without transparent proxy support.
+var ErrUnsupported = errors.New("transparent proxy mode is supported only on Linux")
+
+// ErrNotRedirected is returned when a connection reached the listener
+// directly, which would otherwise make Velar connect to itself.
+var ErrNotRedirected = errors.New("transparent: connection was not redirected")
+
+// helloTimeout bounds how long PeekServerName waits for a ClientHello.
+const helloTimeout = 5 * time.Second
+
+var errHelloCaptured = errors.New("client hello captured")
+
+// PeekServerName reads the client's first TLS handshake message and returns
+// the SNI server name along with a connection that replays the bytes
+// consumed. The name is empty when the client does not speak TLS or sent no
+// SNI.
+func PeekServerName(conn net.Conn) (net.Conn, string, error) {
+	br := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, "", err
+	}
+	if first[0] != 0x16 { // not a TLS handshake record
+		return &peekedConn{Conn: conn, r: br}, "", nil
+	}
+
+	rec := &recordingConn{Conn: conn, r: br}
+	var serverName string
+	err = tls.Server(rec, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloCaptured
+		},
+	}).Handshake()
+	if err != nil && !errors.Is(err, errHelloCaptured) {
+		return nil, "", fmt.Errorf("transparent: read client hello: %w", err)
+	}
+	replay := io.MultiReader(bytes.NewReader(rec.buf.Bytes()), br)
+	return &peekedConn{Conn: conn, r: replay}, serverName, nil
+}
+
+// recordingConn feeds the TLS parser and keeps what it read. Writes are
+// dropped so the aborted handshake never reaches the client.
+type recordingConn struct {
+	net.Conn
+	r   io.Reader
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.buf.Write(p[:n])
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// peekedConn serves already consumed bytes before reading from the socket.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -0,0 +1,105 @@
+//go:build linux
+
+package transparent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h; the IPv6
+// variant IP6T_SO_ORIGINAL_DST shares the value.
+const soOriginalDst = 80
+
+// Listen opens a TCP listener for redirected traffic. TPROXY listeners need
+// IP_TRANSPARENT to accept connections addressed to foreign IPs, which
+// requires CAP_NET_ADMIN.
+func Listen(ctx context.Context, addr string, mode Mode) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if mode == ModeTProxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("set IP_TRANSPARENT: %w", sockErr)
+			}
+			return nil
+		}
+	}
+	return lc.Listen(ctx, "tcp", addr)
+}
+
+// OriginalDst returns the address the client originally connected to.
+func OriginalDst(conn net.Conn, mode Mode) (*net.TCPAddr, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("transparent: unexpected local address %v", conn.LocalAddr())
+	}
+	if mode == ModeTProxy {
+		return local, nil
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("transparent: %T is not a TCP connection", conn)
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		dst    *net.TCPAddr
+		optErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			dst, optErr = originalDst4(int(fd))
+		} else {
+			dst, optErr = originalDst6(int(fd))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if optErr != nil {
+		return nil, fmt.Errorf("transparent: SO_ORIGINAL_DST: %w", optErr)
+	}
+	if dst.IP.Equal(local.IP) && dst.Port == local.Port {
+		return nil, ErrNotRedirected
+	}
+	return dst, nil
+}
+
+// originalDst4 reads a struct sockaddr_in. syscall has no getsockopt
+// returning raw bytes, so IPv6Mreq serves as a large enough buffer.
+func originalDst4(fd int) (*net.TCPAddr, error) {
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.SOL_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	b := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+		Port: int(b[2])<<8 | int(b[3]),
+	}, nil
+}
+
+// originalDst6 reads a struct sockaddr_in6 via the IPv6MTUInfo layout,
+// which starts with one.
+func originalDst6(fd int) (*net.TCPAddr, error) {
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.SOL_IPV6, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, info.Addr.Addr[:])
+	return &net.TCPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}, nil
+}
@@ -0,0 +1,39 @@
+//go:build linux
+
+package transparent
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestOriginalDst(t *testing.T) {
+	ln, err := Listen(context.Background(), "127.0.0.1:0", ModeRedirect)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			defer c.Close()
+			_, _ = c.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	defer conn.Close()
+
+	dst, err := OriginalDst(conn, ModeTProxy)
+	if err != nil || dst.String() != ln.Addr().String() {
+		t.Fatalf("OriginalDst(tproxy) = %v, %v; want %s", dst, err, ln.Addr())
+	}
+	// A connection that reached the listener directly has no NAT entry,
+	// or one pointing back at the listener.
+	if dst, err := OriginalDst(conn, ModeRedirect); err == nil {
+		t.Fatalf("OriginalDst(redirect) = %v for a direct connection", dst)
+	}
+}
@@ -0,0 +1,109 @@
+package transparent
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseMode(t *testing.T) {
+	for in, want := range map[string]Mode{"": ModeRedirect, "redirect": ModeRedirect, "TPROXY": ModeTProxy} {
+		got, err := ParseMode(in)
+		if err != nil || got != want {
+			t.Errorf("ParseMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseMode("dnat"); err == nil {
+		t.Errorf("expected error for unknown mode")
+	}
+}
+
+func TestSources(t *testing.T) {
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+
+	if s, err := ParseSources(nil, false); s != nil || err != nil || !s.Allowed(addr("203.0.113.7")) {
+		t.Fatalf("ParseSources(nil, false) = %v, %v; want every client allowed", s, err)
+	}
+
+	local, err := ParseSources(nil, true)
+	if err != nil {
+		t.Fatalf("ParseSources(nil, true) error = %v", err)
+	}
+	if !local.Allowed(addr("127.0.0.1")) || !local.Allowed(addr("::1")) || local.Allowed(addr("203.0.113.7")) {
+		t.Fatal("local-only sources should admit loopback clients and nothing remote")
+	}
+
+	listed, err := ParseSources([]string{"10.0.0.0/8", " 192.0.2.1 ", "2001:db8::/32"}, true)
+	if err != nil {
+		t.Fatalf("ParseSources() error = %v", err)
+	}
+	for ip, want := range map[string]bool{"10.1.2.3": true, "192.0.2.1": true, "192.0.2.2": false, "2001:db8::5": true, "127.0.0.1": false} {
+		if got := listed.Allowed(addr(ip)); got != want {
+			t.Errorf("Allowed(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	if _, err := ParseSources([]string{"proxy.example"}, false); err == nil {
+		t.Fatal("expected an error for a host name")
+	}
+}
+
+func TestPeekServerNameReplaysClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// httptest's built-in certificate is valid for "example.com".
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+	leaf := ts.TLS.Certificates[0]
+
+	clientErr := make(chan error, 1)
+	go func() {
+		tc := tls.Client(client, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+		if err := tc.Handshake(); err != nil {
+			clientErr <- err
+			return
+		}
+		_, err := tc.Write([]byte("ping"))
+		clientErr <- err
+	}()
+
+	conn, name, err := PeekServerName(server)
+	if err != nil {
+		t.Fatalf("PeekServerName() error = %v", err)
+	}
+	if name != "example.com" {
+		t.Fatalf("server name = %q, want example.com", name)
+	}
+
+	// The replayed bytes must let a real TLS server complete the handshake.
+	tlsServer := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{leaf}})
+	_ = tlsServer.SetDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(tlsServer, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read after replay = %q, %v", buf, err)
+	}
+	if err := <-clientErr; err != nil {
+		t.Fatalf("client error = %v", err)
+	}
+}
+
+func TestPeekServerNamePlainText(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() { _, _ = client.Write([]byte("GET / HTTP/1.1\r\n\r\n")) }()
+	conn, name, err := PeekServerName(server)
+	if err != nil || name != "" {
+		t.Fatalf("PeekServerName() = %q, %v", name, err)
+	}
+	buf := make([]byte, 18)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Fatalf("replayed = %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package transparent
+
+import (
+	"context"
+	"net"
+)
+
+func Listen(ctx context.Context, addr string, mode Mode) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+func OriginalDst(conn net.Conn, mode Mode) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
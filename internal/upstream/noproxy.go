@@ -0,0 +1,80 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"velar/internal/hostmatch"
+)
+
+// noProxyRule is one NO_PROXY entry: a host pattern, optionally restricted
+// to a port. A plain domain matches the domain and its subdomains, with or
+// without a leading dot or "*"; "*", IP addresses, CIDR ranges, /regexes/
+// and "!" negations are read as by hostmatch.
+type noProxyRule struct {
+	pattern hostmatch.Pattern
+	port    string
+}
+
+func parseNoProxy(entry string) (noProxyRule, error) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return noProxyRule{}, fmt.Errorf("empty no_proxy entry")
+	}
+	var rule noProxyRule
+	raw := strings.TrimPrefix(entry, "!")
+	if !strings.HasPrefix(raw, "/") {
+		if host, port, err := net.SplitHostPort(raw); err == nil {
+			rule.port = port
+			raw = host
+		}
+		// NO_PROXY reads "*.example.com" like ".example.com".
+		if strings.HasPrefix(raw, "*.") {
+			raw = raw[1:]
+		}
+	}
+	if strings.HasPrefix(entry, "!") {
+		raw = "!" + raw
+	}
+	p, err := hostmatch.Parse(raw, true)
+	if err != nil {
+		return noProxyRule{}, fmt.Errorf("invalid no_proxy entry %q: %w", entry, err)
+	}
+	rule.pattern = p
+	return rule, nil
+}
+
+func (r noProxyRule) matches(host, port string) bool {
+	if r.port != "" && r.port != port {
+		return false
+	}
+	return r.pattern.Match(host)
+}
+
+// bypassProxy reports whether host:port is excluded from the proxy by
+// rules. As in a hostmatch.List, a host is excluded when it matches no
+// negated rule and at least one other, or when there are only negated
+// rules.
+func bypassProxy(rules []noProxyRule, host, port string) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	bypass := true
+	for _, rule := range rules {
+		if !rule.pattern.Negate {
+			bypass = false
+			break
+		}
+	}
+	for _, rule := range rules {
+		if !rule.matches(host, port) {
+			continue
+		}
+		if rule.pattern.Negate {
+			return false
+		}
+		bypass = true
+	}
+	return bypass
+}
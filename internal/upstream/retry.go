@@ -0,0 +1,262 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"velar/internal/config"
+)
+
+const (
+	defaultRetryBackoff = 200 * time.Millisecond
+	maxRetryBackoff     = 5 * time.Second
+	// maxReplayBody is the largest request body kept in memory so it can be
+	// sent again.
+	maxReplayBody = 1 << 20
+)
+
+var defaultRetryStatuses = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// Attempt describes one failed try that is followed by another.
+type Attempt struct {
+	// Target is the host:port the attempt was sent to.
+	Target string
+	// Number counts attempts across all targets, starting at 1.
+	Number int
+	// StatusCode is set when the upstream answered with a retryable status.
+	StatusCode int
+	Err        error
+	// Failover reports that the next attempt goes to another target.
+	Failover bool
+}
+
+// Decision is the audit decision for the failed attempt: "failover" when
+// the next try goes to another target, "retry" otherwise.
+func (a Attempt) Decision() string {
+	if a.Failover {
+		return "failover"
+	}
+	return "retry"
+}
+
+// Reason describes why the attempt failed.
+func (a Attempt) Reason() string {
+	if a.Err != nil {
+		return fmt.Sprintf("upstream attempt %d to %s failed: %v", a.Number, a.Target, a.Err)
+	}
+	return fmt.Sprintf("upstream attempt %d to %s returned %d", a.Number, a.Target, a.StatusCode)
+}
+
+type retryPolicy struct {
+	attempts           int
+	backoff            time.Duration
+	statuses           map[int]struct{}
+	failover           []string
+	retryNonIdempotent bool
+}
+
+// Retrier retries failed upstream requests and fails over to secondary
+// endpoints according to per-host policies.
+type Retrier struct {
+	policies map[string]retryPolicy
+	sleep    func(context.Context, time.Duration) error
+}
+
+// NewRetrier validates policies. It returns nil, nil when none are
+// configured.
+func NewRetrier(policies []config.UpstreamRetry) (*Retrier, error) {
+	if len(policies) == 0 {
+		return nil, nil
+	}
+	r := &Retrier{policies: make(map[string]retryPolicy, len(policies)), sleep: sleepContext}
+	for _, p := range policies {
+		host := strings.ToLower(strings.TrimSpace(p.Host))
+		if host == "" {
+			return nil, errors.New("upstream retry: missing host")
+		}
+		if _, dup := r.policies[host]; dup {
+			return nil, fmt.Errorf("upstream retry: duplicate host %s", host)
+		}
+		if p.Attempts < 0 || p.BackoffMS < 0 {
+			return nil, fmt.Errorf("upstream retry for %s: attempts and backoff_ms must not be negative", host)
+		}
+		policy := retryPolicy{attempts: p.Attempts, backoff: time.Duration(p.BackoffMS) * time.Millisecond, retryNonIdempotent: p.RetryNonIdempotent}
+		if policy.attempts == 0 {
+			policy.attempts = 1
+		}
+		if policy.backoff == 0 {
+			policy.backoff = defaultRetryBackoff
+		}
+		statuses := p.RetryStatuses
+		if len(statuses) == 0 {
+			statuses = defaultRetryStatuses
+		}
+		policy.statuses = make(map[int]struct{}, len(statuses))
+		for _, code := range statuses {
+			if code < 100 || code > 599 {
+				return nil, fmt.Errorf("upstream retry for %s: invalid status %d", host, code)
+			}
+			policy.statuses[code] = struct{}{}
+		}
+		for _, target := range p.Failover {
+			target = strings.ToLower(strings.TrimSpace(target))
+			if target == "" || strings.Contains(target, "/") {
+				return nil, fmt.Errorf("upstream retry for %s: invalid failover target %q (want host or host:port)", host, target)
+			}
+			policy.failover = append(policy.failover, target)
+		}
+		r.policies[host] = policy
+	}
+	return r, nil
+}
+
+// RoundTrip sends req with rt. When req's host has a policy and req can be
+// replayed, failed attempts are retried with exponential backoff on each
+// target in turn, and onAttempt is called for each of them before the next
+// try. Streaming requests and bodies that cannot be buffered get a single
+// attempt. The last response or error is returned.
+func (r *Retrier) RoundTrip(rt http.RoundTripper, req *http.Request, onAttempt func(Attempt)) (*http.Response, error) {
+	if r == nil {
+		return rt.RoundTrip(req)
+	}
+	policy, ok := r.policies[strings.ToLower(req.URL.Hostname())]
+	if !ok {
+		return rt.RoundTrip(req)
+	}
+	body, replayable := replayBody(req)
+	if !replayable || isStreamingRequest(req, body) {
+		return rt.RoundTrip(req)
+	}
+
+	port := req.URL.Port()
+	targets := append([]string{req.URL.Host}, policy.failover...)
+	number := 0
+	for ti, target := range targets {
+		if ti > 0 && !strings.Contains(target, ":") && port != "" {
+			target = net.JoinHostPort(target, port)
+		}
+		backoff := policy.backoff
+		for try := 1; try <= policy.attempts; try++ {
+			number++
+			attempt := req.Clone(req.Context())
+			attempt.URL.Host = target
+			attempt.Host = target
+			if body != nil {
+				attempt.Body = io.NopCloser(bytes.NewReader(body))
+				attempt.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+			}
+			resp, err := rt.RoundTrip(attempt)
+			last := ti == len(targets)-1 && try == policy.attempts
+			if last || !policy.shouldRetry(attempt, resp, err) {
+				return resp, err
+			}
+			failed := Attempt{Target: target, Number: number, Err: err, Failover: try == policy.attempts}
+			if resp != nil {
+				failed.StatusCode = resp.StatusCode
+				_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+				_ = resp.Body.Close()
+			}
+			if onAttempt != nil {
+				onAttempt(failed)
+			}
+			if failed.Failover {
+				break
+			}
+			if err := r.sleep(req.Context(), backoff); err != nil {
+				return nil, err
+			}
+			backoff = min(backoff*2, maxRetryBackoff)
+		}
+	}
+	// Not reached: the last attempt always returns.
+	return nil, errors.New("upstream retry: no attempts made")
+}
+
+// shouldRetry reports whether an attempt failed in a way worth another try.
+// A failed request may already have been processed upstream: a transport
+// error can come after the request was sent, and a 502 or 504 only says a
+// gateway gave up waiting. Such failures are retried only for idempotent
+// requests or when the policy allows it. Requests that never left the
+// dialer are always retried, as are 429 and 503 responses carrying
+// Retry-After, with which the upstream says it turned the request away.
+func (p retryPolicy) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		if req.Context().Err() != nil {
+			return false
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		return p.retryNonIdempotent || isIdempotent(req)
+	}
+	if _, retry := p.statuses[resp.StatusCode]; !retry {
+		return false
+	}
+	if (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) && resp.Header.Get("Retry-After") != "" {
+		return true
+	}
+	return p.retryNonIdempotent || isIdempotent(req)
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+// replayBody buffers req's body so it can be sent more than once. It
+// reports false for bodies of unknown length or over maxReplayBody.
+func replayBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength < 0 || req.ContentLength > maxReplayBody {
+		return nil, false
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		return nil, false
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// isStreamingRequest reports whether the client asked for a streamed
+// response, via Accept or a JSON "stream": true field.
+func isStreamingRequest(req *http.Request, body []byte) bool {
+	if strings.Contains(strings.ToLower(req.Header.Get("Accept")), "text/event-stream") {
+		return true
+	}
+	if len(body) == 0 || !strings.Contains(strings.ToLower(req.Header.Get("Content-Type")), "json") {
+		return false
+	}
+	var payload struct {
+		Stream bool `json:"stream"`
+	}
+	_ = json.Unmarshal(body, &payload)
+	return payload.Stream
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
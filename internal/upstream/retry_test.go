@@ -0,0 +1,238 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"velar/internal/config"
+)
+
+// scriptedTransport answers each request with the next status in statuses,
+// or with err when the status is 0, and records the hosts and bodies sent.
+// 429 and 503 responses carry retryAfter when it is set.
+type scriptedTransport struct {
+	statuses   []int
+	err        error
+	retryAfter string
+	hosts      []string
+	bodies     []string
+}
+
+func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.hosts = append(s.hosts, req.URL.Host)
+	var body string
+	if req.Body != nil {
+		b, _ := io.ReadAll(req.Body)
+		body = string(b)
+	}
+	s.bodies = append(s.bodies, body)
+	status := http.StatusOK
+	if len(s.statuses) > 0 {
+		status, s.statuses = s.statuses[0], s.statuses[1:]
+	}
+	if status == 0 {
+		return nil, s.err
+	}
+	header := http.Header{}
+	if s.retryAfter != "" && (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) {
+		header.Set("Retry-After", s.retryAfter)
+	}
+	return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("")), Header: header, Request: req}, nil
+}
+
+func newTestRetrier(t *testing.T, policies ...config.UpstreamRetry) (*Retrier, *[]time.Duration) {
+	t.Helper()
+	r, err := NewRetrier(policies)
+	if err != nil {
+		t.Fatalf("NewRetrier() error = %v", err)
+	}
+	var waits []time.Duration
+	r.sleep = func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	return r, &waits
+}
+
+func TestRetrierRetriesStatusWithBackoff(t *testing.T) {
+	r, waits := newTestRetrier(t, config.UpstreamRetry{Host: "api.example", Attempts: 3, BackoffMS: 100})
+	rt := &scriptedTransport{statuses: []int{503, 429, 200}, retryAfter: "1"}
+	req, _ := http.NewRequest(http.MethodPost, "https://api.example/v1/chat", strings.NewReader(`{"model":"x"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	var attempts []Attempt
+	resp, err := r.RoundTrip(rt, req, func(a Attempt) { attempts = append(attempts, a) })
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if len(rt.bodies) != 3 || rt.bodies[2] != `{"model":"x"}` {
+		t.Fatalf("bodies = %q, want the body replayed three times", rt.bodies)
+	}
+	if len(attempts) != 2 || attempts[0].StatusCode != 503 || attempts[1].StatusCode != 429 || attempts[1].Number != 2 {
+		t.Fatalf("attempts = %+v", attempts)
+	}
+	if attempts[0].Decision() != "retry" {
+		t.Fatalf("decision = %q, want retry", attempts[0].Decision())
+	}
+	if want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}; len(*waits) != 2 || (*waits)[0] != want[0] || (*waits)[1] != want[1] {
+		t.Fatalf("waits = %v, want %v", *waits, want)
+	}
+}
+
+func TestRetrierFailsOverToNextTarget(t *testing.T) {
+	r, waits := newTestRetrier(t, config.UpstreamRetry{Host: "primary.example", Attempts: 1, Failover: []string{"backup.example"}})
+	rt := &scriptedTransport{statuses: []int{0, 200}, err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	req, _ := http.NewRequest(http.MethodPost, "https://primary.example:8443/v1/chat", strings.NewReader("hello"))
+
+	var attempts []Attempt
+	resp, err := r.RoundTrip(rt, req, func(a Attempt) { attempts = append(attempts, a) })
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if want := []string{"primary.example:8443", "backup.example:8443"}; strings.Join(rt.hosts, ",") != strings.Join(want, ",") {
+		t.Fatalf("hosts = %v, want %v", rt.hosts, want)
+	}
+	if len(attempts) != 1 || !attempts[0].Failover || attempts[0].Decision() != "failover" || attempts[0].Err == nil {
+		t.Fatalf("attempts = %+v", attempts)
+	}
+	if len(*waits) != 0 {
+		t.Fatalf("waits = %v, want no backoff before failover", *waits)
+	}
+}
+
+func TestRetrierReturnsLastFailure(t *testing.T) {
+	r, _ := newTestRetrier(t, config.UpstreamRetry{Host: "api.example", Attempts: 2, Failover: []string{"backup.example"}})
+	rt := &scriptedTransport{statuses: []int{502, 502, 503, 504}}
+	req, _ := http.NewRequest(http.MethodGet, "https://api.example/v1/models", nil)
+
+	resp, err := r.RoundTrip(rt, req, nil)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout || len(rt.hosts) != 4 {
+		t.Fatalf("status = %d after %d attempts, want 504 after 4", resp.StatusCode, len(rt.hosts))
+	}
+}
+
+func TestRetrierRetriesNonIdempotentStatusOnlyWhenTurnedAway(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		wantSent   int
+	}{
+		{name: "bad gateway", status: http.StatusBadGateway, wantSent: 1},
+		{name: "gateway timeout", status: http.StatusGatewayTimeout, wantSent: 1},
+		{name: "unavailable without retry-after", status: http.StatusServiceUnavailable, wantSent: 1},
+		{name: "unavailable with retry-after", status: http.StatusServiceUnavailable, retryAfter: "2", wantSent: 2},
+		{name: "too many requests with retry-after", status: http.StatusTooManyRequests, retryAfter: "2", wantSent: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestRetrier(t, config.UpstreamRetry{Host: "api.example", Attempts: 3})
+			rt := &scriptedTransport{statuses: []int{tt.status, 200}, retryAfter: tt.retryAfter}
+			req, _ := http.NewRequest(http.MethodPost, "https://api.example/v1/chat", strings.NewReader("hello"))
+			if _, err := r.RoundTrip(rt, req, nil); err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			if len(rt.bodies) != tt.wantSent {
+				t.Fatalf("sent %d times, want %d", len(rt.bodies), tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestRetrierDoesNotRetryNonIdempotentAfterSend(t *testing.T) {
+	sendErr := errors.New("connection reset by peer")
+	tests := []struct {
+		name     string
+		policy   config.UpstreamRetry
+		header   string
+		wantSent int
+	}{
+		{name: "post", policy: config.UpstreamRetry{Host: "api.example", Attempts: 3}, wantSent: 1},
+		{name: "idempotency key", policy: config.UpstreamRetry{Host: "api.example", Attempts: 3}, header: "abc", wantSent: 2},
+		{name: "allowed by policy", policy: config.UpstreamRetry{Host: "api.example", Attempts: 3, RetryNonIdempotent: true}, wantSent: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestRetrier(t, tt.policy)
+			rt := &scriptedTransport{statuses: []int{0, 200}, err: sendErr}
+			req, _ := http.NewRequest(http.MethodPost, "https://api.example/v1/chat", strings.NewReader("hello"))
+			if tt.header != "" {
+				req.Header.Set("Idempotency-Key", tt.header)
+			}
+			_, _ = r.RoundTrip(rt, req, nil)
+			if len(rt.hosts) != tt.wantSent {
+				t.Fatalf("sent %d times, want %d", len(rt.hosts), tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestRetrierSendsStreamingRequestsOnce(t *testing.T) {
+	r, _ := newTestRetrier(t, config.UpstreamRetry{Host: "api.example", Attempts: 3})
+	for _, tc := range []struct {
+		name   string
+		body   string
+		accept string
+	}{
+		{name: "stream field", body: `{"model":"x","stream":true}`},
+		{name: "accept header", body: `{"model":"x"}`, accept: "text/event-stream"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := &scriptedTransport{statuses: []int{503, 200}}
+			req, _ := http.NewRequest(http.MethodPost, "https://api.example/v1/chat", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			resp, err := r.RoundTrip(rt, req, nil)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			if resp.StatusCode != http.StatusServiceUnavailable || len(rt.hosts) != 1 {
+				t.Fatalf("status = %d after %d attempts, want 503 after 1", resp.StatusCode, len(rt.hosts))
+			}
+		})
+	}
+}
+
+func TestRetrierIgnoresOtherHosts(t *testing.T) {
+	r, _ := newTestRetrier(t, config.UpstreamRetry{Host: "api.example", Attempts: 3})
+	rt := &scriptedTransport{statuses: []int{503, 200}}
+	req, _ := http.NewRequest(http.MethodGet, "https://other.example/", nil)
+	resp, err := r.RoundTrip(rt, req, nil)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("RoundTrip() = %v, %v, want 503 without retry", resp, err)
+	}
+}
+
+func TestNewRetrierRejectsInvalidPolicies(t *testing.T) {
+	for _, policies := range [][]config.UpstreamRetry{
+		{{Attempts: 2}},
+		{{Host: "a.example"}, {Host: "A.example"}},
+		{{Host: "a.example", Attempts: -1}},
+		{{Host: "a.example", RetryStatuses: []int{42}}},
+		{{Host: "a.example", Failover: []string{"https://b.example/v1"}}},
+	} {
+		if _, err := NewRetrier(policies); err == nil {
+			t.Errorf("NewRetrier(%+v) error = nil, want error", policies)
+		}
+	}
+	if r, err := NewRetrier(nil); r != nil || err != nil {
+		t.Fatalf("NewRetrier(nil) = %v, %v, want nil, nil", r, err)
+	}
+}
@@ -0,0 +1,246 @@
+// Package upstream decides how Velar reaches the network: directly or
+// through a corporate HTTP CONNECT / SOCKS5 proxy, with NO_PROXY-style
+// exclusions and per-host overrides.
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"velar/internal/config"
+	"velar/internal/hostmatch"
+	"velar/internal/socks5"
+)
+
+const dialTimeout = 10 * time.Second
+
+// Direct is the override URL value that bypasses the upstream proxy.
+const Direct = "direct"
+
+type override struct {
+	hosts *hostmatch.List
+	proxy *url.URL
+}
+
+// Router resolves the upstream proxy for a destination host. A nil *Router
+// always connects directly.
+type Router struct {
+	proxy     *url.URL
+	noProxy   []noProxyRule
+	overrides []override
+	dialer    *net.Dialer
+}
+
+// NewRouter validates cfg and builds a Router. It returns nil, nil when no
+// proxy and no overrides are configured.
+func NewRouter(cfg config.UpstreamProxy) (*Router, error) {
+	if strings.TrimSpace(cfg.URL) == "" && len(cfg.Overrides) == 0 {
+		return nil, nil
+	}
+	r := &Router{dialer: &net.Dialer{Timeout: dialTimeout}}
+	if strings.TrimSpace(cfg.URL) != "" {
+		u, err := parseProxyURL(cfg.URL)
+		if err != nil {
+			return nil, err
+		}
+		r.proxy = u
+	}
+	for _, entry := range cfg.NoProxy {
+		rule, err := parseNoProxy(entry)
+		if err != nil {
+			return nil, err
+		}
+		r.noProxy = append(r.noProxy, rule)
+	}
+	for _, o := range cfg.Overrides {
+		if strings.TrimSpace(o.Host) == "" {
+			return nil, fmt.Errorf("upstream proxy override: missing host")
+		}
+		hosts, err := hostmatch.ParseList([]string{o.Host}, false)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy override: %w", err)
+		}
+		var u *url.URL
+		if !strings.EqualFold(strings.TrimSpace(o.URL), Direct) {
+			parsed, err := parseProxyURL(o.URL)
+			if err != nil {
+				return nil, fmt.Errorf("upstream proxy override for %s: %w", o.Host, err)
+			}
+			u = parsed
+		}
+		r.overrides = append(r.overrides, override{hosts: hosts, proxy: u})
+	}
+	return r, nil
+}
+
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy url: %w", err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream proxy url %q: missing host", raw)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Port() == "" {
+		port := "1080"
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// ProxyFor returns the proxy to use for hostport, or nil for a direct
+// connection. Per-host overrides win over NO_PROXY exclusions.
+func (r *Router) ProxyFor(hostport string) *url.URL {
+	if r == nil {
+		return nil
+	}
+	host, port := splitHostPort(hostport)
+	for _, o := range r.overrides {
+		if o.hosts.Match(host) {
+			return o.proxy
+		}
+	}
+	if bypassProxy(r.noProxy, host, port) {
+		return nil
+	}
+	return r.proxy
+}
+
+// ProxyFunc adapts the router for http.Transport.Proxy.
+func (r *Router) ProxyFunc() func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u := r.ProxyFor(canonicalAddr(req.URL))
+		if u != nil && u.Scheme == "socks5h" {
+			// net/http speaks SOCKS5 with remote name resolution already.
+			copied := *u
+			copied.Scheme = "socks5"
+			return &copied, nil
+		}
+		return u, nil
+	}
+}
+
+// DialContext opens a TCP stream to addr, tunneling through the configured
+// proxy when one applies.
+func (r *Router) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if r != nil && r.dialer != nil {
+		dialer = r.dialer
+	}
+	proxyURL := r.ProxyFor(addr)
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial upstream proxy %s: %w", proxyURL.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		username := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if err := socks5.ClientHandshake(conn, addr, username, password); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	default:
+		if proxyURL.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				_ = conn.Close()
+				return nil, fmt.Errorf("tls to upstream proxy %s: %w", proxyURL.Host, err)
+			}
+			conn = tlsConn
+		}
+		tunneled, err := httpConnect(conn, addr, proxyURL)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tunneled, nil
+	}
+}
+
+func httpConnect(conn net.Conn, addr string, proxyURL *url.URL) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("write CONNECT to upstream proxy: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("read CONNECT response from upstream proxy: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream proxy CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn replays bytes the proxy sent right after its CONNECT reply.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" || u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func splitHostPort(hostport string) (string, string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return strings.ToLower(strings.TrimSuffix(host, ".")), port
+}
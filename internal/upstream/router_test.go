@@ -0,0 +1,297 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"velar/internal/config"
+)
+
+func TestRouterProxyFor(t *testing.T) {
+	r, err := NewRouter(config.UpstreamProxy{
+		URL:     "http://corp-proxy:3128",
+		NoProxy: []string{"localhost", ".internal.example", "10.0.0.0/8", "192.168.1.5", "intranet.example:8443"},
+		Overrides: []config.ProxyOverride{
+			{Host: "api.openai.com", URL: "socks5://socks.example:1080"},
+			{Host: "*.internal.example", URL: "http://other:8080"},
+			{Host: "*.azure.com", URL: "direct"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"api.anthropic.com:443", "corp-proxy:3128"},
+		{"api.openai.com:443", "socks.example:1080"},
+		{"svc.internal.example:443", "other:8080"},
+		{"internal.example:443", ""},
+		{"foo.openai.azure.com:443", ""},
+		{"localhost:8080", ""},
+		{"10.1.2.3:443", ""},
+		{"11.1.2.3:443", "corp-proxy:3128"},
+		{"192.168.1.5:443", ""},
+		{"intranet.example:8443", ""},
+		{"intranet.example:443", "corp-proxy:3128"},
+	}
+	for _, tc := range tests {
+		got := ""
+		if u := r.ProxyFor(tc.addr); u != nil {
+			got = u.Host
+		}
+		if got != tc.want {
+			t.Errorf("ProxyFor(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestRouterHostPatterns(t *testing.T) {
+	r, err := NewRouter(config.UpstreamProxy{
+		URL:     "http://corp-proxy:3128",
+		NoProxy: []string{"*.corp.example", "!gateway.corp.example", "fd00::/8"},
+		Overrides: []config.ProxyOverride{
+			{Host: `/api[0-9]+\.example\.com/`, URL: "socks5://socks.example:1080"},
+			{Host: "172.16.0.0/12", URL: "direct"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"api2.example.com:443", "socks.example:1080"},
+		{"api.example.com:443", "corp-proxy:3128"},
+		{"172.20.1.1:443", ""},
+		{"corp.example:443", ""},
+		{"svc.corp.example:443", ""},
+		{"gateway.corp.example:443", "corp-proxy:3128"},
+		{"[fd00::1]:443", ""},
+	}
+	for _, tc := range tests {
+		got := ""
+		if u := r.ProxyFor(tc.addr); u != nil {
+			got = u.Host
+		}
+		if got != tc.want {
+			t.Errorf("ProxyFor(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+
+	for _, cfg := range []config.UpstreamProxy{
+		{URL: "http://corp-proxy:3128", NoProxy: []string{"/[/"}},
+		{Overrides: []config.ProxyOverride{{Host: "api.*.example", URL: "direct"}}},
+	} {
+		if _, err := NewRouter(cfg); err == nil {
+			t.Errorf("NewRouter(%+v) error = nil, want invalid pattern", cfg)
+		}
+	}
+}
+
+func TestNewRouterValidation(t *testing.T) {
+	if r, err := NewRouter(config.UpstreamProxy{}); r != nil || err != nil {
+		t.Fatalf("empty config should yield nil router, got %v %v", r, err)
+	}
+	if _, err := NewRouter(config.UpstreamProxy{URL: "ftp://proxy:21"}); err == nil {
+		t.Fatalf("expected error for unsupported scheme")
+	}
+	if _, err := NewRouter(config.UpstreamProxy{Overrides: []config.ProxyOverride{{URL: "direct"}}}); err == nil {
+		t.Fatalf("expected error for override without host")
+	}
+	var nilRouter *Router
+	if nilRouter.ProxyFor("example.com:443") != nil {
+		t.Fatalf("nil router must connect directly")
+	}
+}
+
+func TestProxyFuncForTransport(t *testing.T) {
+	r, _ := NewRouter(config.UpstreamProxy{URL: "socks5h://user:pw@socks:1080", NoProxy: []string{"example.org"}})
+	fn := r.ProxyFunc()
+	req, _ := http.NewRequest(http.MethodGet, "https://api.openai.com/v1/models", nil)
+	u, err := fn(req)
+	if err != nil || u == nil || u.Scheme != "socks5" || u.User.Username() != "user" {
+		t.Fatalf("ProxyFunc() = %v, %v", u, err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, "http://www.example.org/", nil)
+	if u, _ := fn(req); u != nil {
+		t.Fatalf("expected direct for no_proxy host, got %v", u)
+	}
+}
+
+// echoListener accepts one connection and echoes everything back.
+func echoListener(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+	return ln
+}
+
+func pipe(a, b net.Conn) {
+	go func() { _, _ = io.Copy(a, b); _ = a.Close() }()
+	_, _ = io.Copy(b, a)
+	_ = b.Close()
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
+
+func TestDialThroughHTTPConnectProxyWithBasicAuth(t *testing.T) {
+	target := echoListener(t)
+	defer target.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	authSeen := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		authSeen <- req.Header.Get("Proxy-Authorization")
+		dst, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			_ = conn.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		pipe(conn, dst)
+	}()
+
+	proxyURL := (&url.URL{Scheme: "http", User: url.UserPassword("alice", "s3cret"), Host: ln.Addr().String()}).String()
+	r, err := NewRouter(config.UpstreamProxy{URL: proxyURL})
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+	conn, err := r.DialContext(context.Background(), "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:s3cret"))
+	if got := <-authSeen; got != want {
+		t.Fatalf("Proxy-Authorization = %q, want %q", got, want)
+	}
+}
+
+func TestDialThroughSOCKS5ProxyWithAuth(t *testing.T) {
+	target := echoListener(t)
+	defer target.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 512)
+		// greeting: VER NMETHODS METHODS
+		_, _ = io.ReadFull(conn, buf[:2])
+		_, _ = io.ReadFull(conn, buf[:buf[1]])
+		_, _ = conn.Write([]byte{0x05, 0x02})
+		// RFC 1929 sub-negotiation
+		_, _ = io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		_, _ = io.ReadFull(conn, user)
+		_, _ = io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		_, _ = io.ReadFull(conn, pass)
+		if string(user) != "bob" || string(pass) != "pw" {
+			_, _ = conn.Write([]byte{0x01, 0x01})
+			_ = conn.Close()
+			return
+		}
+		_, _ = conn.Write([]byte{0x01, 0x00})
+		// request: VER CMD RSV ATYP=IPv4 ADDR PORT
+		_, _ = io.ReadFull(conn, buf[:4])
+		_, _ = io.ReadFull(conn, buf[:6])
+		addr := net.JoinHostPort(net.IP(buf[:4]).String(), strconv.Itoa(int(buf[4])<<8|int(buf[5])))
+		dst, err := net.Dial("tcp", addr)
+		if err != nil {
+			_, _ = conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			_ = conn.Close()
+			return
+		}
+		_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		pipe(conn, dst)
+	}()
+
+	r, err := NewRouter(config.UpstreamProxy{URL: "socks5://bob:pw@" + ln.Addr().String()})
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+	conn, err := r.DialContext(context.Background(), "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+}
+
+func TestDialRejectedByHTTPProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = http.ReadRequest(bufio.NewReader(conn))
+		_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"))
+	}()
+
+	r, _ := NewRouter(config.UpstreamProxy{URL: "http://" + ln.Addr().String()})
+	if _, err := r.DialContext(context.Background(), "tcp", "example.com:443"); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("expected 407 error, got %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"velar/internal/config"
+)
+
+// HostTLS holds client TLS settings for upstream hosts that need their own
+// roots, client certificate, minimum version or SPKI pins.
+type HostTLS struct {
+	hosts map[string]hostTLS
+}
+
+type hostTLS struct {
+	roots      *x509.CertPool
+	certs      []tls.Certificate
+	minVersion uint16
+	pins       [][]byte
+}
+
+// LoadHostTLS validates settings and reads the files they reference. It
+// returns nil, nil when no host has settings.
+func LoadHostTLS(settings []config.UpstreamTLS) (*HostTLS, error) {
+	if len(settings) == 0 {
+		return nil, nil
+	}
+	h := &HostTLS{hosts: make(map[string]hostTLS, len(settings))}
+	for _, s := range settings {
+		host := strings.ToLower(strings.TrimSpace(s.Host))
+		if host == "" {
+			return nil, errors.New("upstream tls: missing host")
+		}
+		if _, dup := h.hosts[host]; dup {
+			return nil, fmt.Errorf("upstream tls: duplicate host %s", host)
+		}
+		entry, err := loadHostTLS(s)
+		if err != nil {
+			return nil, fmt.Errorf("upstream tls for %s: %w", host, err)
+		}
+		h.hosts[host] = entry
+	}
+	return h, nil
+}
+
+func loadHostTLS(s config.UpstreamTLS) (hostTLS, error) {
+	var entry hostTLS
+	if s.CAFile != "" {
+		pem, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return hostTLS{}, fmt.Errorf("read ca_file: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return hostTLS{}, fmt.Errorf("ca_file %s contains no certificates", s.CAFile)
+		}
+		entry.roots = roots
+	}
+	if s.CertFile != "" || s.KeyFile != "" {
+		if s.CertFile == "" || s.KeyFile == "" {
+			return hostTLS{}, errors.New("cert_file and key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return hostTLS{}, fmt.Errorf("load client certificate: %w", err)
+		}
+		entry.certs = []tls.Certificate{cert}
+	}
+	if s.MinVersion != "" {
+		v, err := parseTLSVersion(s.MinVersion)
+		if err != nil {
+			return hostTLS{}, err
+		}
+		entry.minVersion = v
+	}
+	for _, pin := range s.Pins {
+		digest, err := parsePin(pin)
+		if err != nil {
+			return hostTLS{}, err
+		}
+		entry.pins = append(entry.pins, digest)
+	}
+	return entry, nil
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	switch strings.TrimSpace(v) {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid min_version %q (want 1.0, 1.1, 1.2 or 1.3)", v)
+}
+
+// parsePin decodes an SPKI pin written as "sha256/<base64>" or as bare
+// base64.
+func parsePin(pin string) ([]byte, error) {
+	encoded := strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+	digest, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q: want sha256/<base64 SHA-256 of the SPKI>", pin)
+	}
+	return digest, nil
+}
+
+// SPKIPin returns the pin for cert in the form pins are configured.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// apply returns a copy of base with the settings of e. Pins are checked
+// after normal chain verification against the certificates of the verified
+// chains only, so a pinned intermediate or root also matches but a pinned
+// certificate the server merely sends alongside an unpinned chain does not.
+func (e hostTLS) apply(base *tls.Config) *tls.Config {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	if e.roots != nil {
+		cfg.RootCAs = e.roots
+	}
+	if len(e.certs) > 0 {
+		cfg.Certificates = e.certs
+	}
+	if e.minVersion != 0 {
+		cfg.MinVersion = e.minVersion
+	}
+	if len(e.pins) > 0 {
+		// Pins are checked against the verified chain, which an
+		// unverified handshake does not have.
+		cfg.InsecureSkipVerify = false
+		pins := e.pins
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					for _, pin := range pins {
+						if bytes.Equal(sum[:], pin) {
+							return nil
+						}
+					}
+				}
+			}
+			return fmt.Errorf("upstream tls: no certificate for %s matches the configured pins", cs.ServerName)
+		}
+	}
+	return cfg
+}
+
+// Transport sends requests for hosts with TLS settings through a clone of
+// the base transport carrying those settings, and all other requests
+// through the base transport itself. Clones are made on first use so they
+// pick up the base's final proxy configuration.
+type Transport struct {
+	base *http.Transport
+
+	mu     sync.Mutex
+	tls    *HostTLS
+	clones map[string]*http.Transport
+}
+
+// NewTransport wraps base. Until SetHostTLS is called every request uses
+// base unchanged.
+func NewTransport(base *http.Transport) *Transport {
+	return &Transport{base: base}
+}
+
+// SetHostTLS replaces the per-host settings. A nil h removes them.
+func (t *Transport) SetHostTLS(h *HostTLS) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, clone := range t.clones {
+		clone.CloseIdleConnections()
+	}
+	t.tls = h
+	t.clones = nil
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transportFor(req.URL.Hostname()).RoundTrip(req)
+}
+
+func (t *Transport) transportFor(host string) *http.Transport {
+	host = strings.ToLower(host)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tls == nil {
+		return t.base
+	}
+	settings, ok := t.tls.hosts[host]
+	if !ok {
+		return t.base
+	}
+	if clone, ok := t.clones[host]; ok {
+		return clone
+	}
+	clone := t.base.Clone()
+	clone.TLSClientConfig = settings.apply(t.base.TLSClientConfig)
+	if t.clones == nil {
+		t.clones = make(map[string]*http.Transport)
+	}
+	t.clones[host] = clone
+	return clone
+}
@@ -0,0 +1,224 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"velar/internal/config"
+)
+
+// writeClientCert creates a self-signed client certificate in dir and
+// returns the certificate and the paths of its PEM files.
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "velar-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return cert, certFile, keyFile
+}
+
+func writeServerCA(t *testing.T, dir string, srv *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+	return path
+}
+
+func newTLSTransport(t *testing.T, settings []config.UpstreamTLS) *Transport {
+	t.Helper()
+	h, err := LoadHostTLS(settings)
+	if err != nil {
+		t.Fatalf("LoadHostTLS() error = %v", err)
+	}
+	tr := NewTransport(&http.Transport{TLSClientConfig: &tls.Config{}})
+	tr.SetHostTLS(h)
+	return tr
+}
+
+func roundTrip(tr http.RoundTripper, url string) error {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestTransportAppliesHostTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, certFile, keyFile := writeClientCert(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs, MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := writeServerCA(t, dir, srv)
+	pin := SPKIPin(srv.Certificate())
+
+	tests := []struct {
+		name     string
+		settings []config.UpstreamTLS
+		wantErr  string
+	}{
+		{name: "no settings", wantErr: "certificate"},
+		{name: "roots only", settings: []config.UpstreamTLS{{Host: "127.0.0.1", CAFile: caFile}}, wantErr: "handshake failure"},
+		{name: "roots and client certificate", settings: []config.UpstreamTLS{{Host: "127.0.0.1", CAFile: caFile, CertFile: certFile, KeyFile: keyFile, Pins: []string{pin}}}},
+		{name: "pin mismatch", settings: []config.UpstreamTLS{{Host: "127.0.0.1", CAFile: caFile, CertFile: certFile, KeyFile: keyFile, Pins: []string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}}}, wantErr: "pins"},
+		{name: "min version above server", settings: []config.UpstreamTLS{{Host: "127.0.0.1", CAFile: caFile, CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"}}, wantErr: "version"},
+		{name: "other host", settings: []config.UpstreamTLS{{Host: "api.example.com", CAFile: caFile, CertFile: certFile, KeyFile: keyFile}}, wantErr: "certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := roundTrip(newTLSTransport(t, tt.settings), srv.URL)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("RoundTrip() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("RoundTrip() error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newCertificate creates a certificate for tmpl signed by parent, or
+// self-signed when parent is nil.
+func newCertificate(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestTransportIgnoresPinnedCertificateOutsideVerifiedChain(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(10),
+		Subject:               pkix.Name{CommonName: "unpinned ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	leaf, leafKey := newCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(11),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	pinned, _ := newCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(12),
+		Subject:      pkix.Name{CommonName: "pinned"},
+	}, nil, nil)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leaf.Raw, pinned.Raw},
+		PrivateKey:  leafKey,
+	}}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+
+	err := roundTrip(newTLSTransport(t, []config.UpstreamTLS{{Host: "127.0.0.1", CAFile: caFile, Pins: []string{SPKIPin(pinned)}}}), srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "pins") {
+		t.Fatalf("RoundTrip() error = %v, want the extra pinned certificate to be ignored", err)
+	}
+	if err := roundTrip(newTLSTransport(t, []config.UpstreamTLS{{Host: "127.0.0.1", CAFile: caFile, Pins: []string{SPKIPin(ca)}}}), srv.URL); err != nil {
+		t.Fatalf("RoundTrip() with the CA pinned error = %v", err)
+	}
+}
+
+func TestLoadHostTLSRejectsInvalidSettings(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, _ := writeClientCert(t, dir)
+	tests := []struct {
+		name     string
+		settings config.UpstreamTLS
+		wantErr  string
+	}{
+		{name: "missing host", settings: config.UpstreamTLS{CAFile: certFile}, wantErr: "missing host"},
+		{name: "missing ca file", settings: config.UpstreamTLS{Host: "a.example", CAFile: filepath.Join(dir, "nope.pem")}, wantErr: "ca_file"},
+		{name: "cert without key", settings: config.UpstreamTLS{Host: "a.example", CertFile: certFile}, wantErr: "together"},
+		{name: "bad version", settings: config.UpstreamTLS{Host: "a.example", MinVersion: "1.4"}, wantErr: "min_version"},
+		{name: "bad pin", settings: config.UpstreamTLS{Host: "a.example", Pins: []string{"sha256/short"}}, wantErr: "invalid pin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadHostTLS([]config.UpstreamTLS{tt.settings})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadHostTLS() error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}